@@ -23,12 +23,19 @@
 package agent
 
 import (
+	"bytes"
+	"encoding/json"
 	"net/http"
 	"os"
+	"time"
 
+	"github.com/abbot/go-http-auth"
+
+	"github.com/redhat-cip/skydive/analyzer"
 	"github.com/redhat-cip/skydive/api"
 	"github.com/redhat-cip/skydive/config"
 	fprobes "github.com/redhat-cip/skydive/flow/probes"
+	_ "github.com/redhat-cip/skydive/flow/probes/packet"
 	shttp "github.com/redhat-cip/skydive/http"
 	"github.com/redhat-cip/skydive/logging"
 	"github.com/redhat-cip/skydive/storage/etcd"
@@ -83,8 +90,8 @@ func (a *Agent) Start() {
 	a.TopologyProbeBundle.Start()
 
 	a.FlowProbeBundle = fprobes.NewFlowProbeBundleFromConfig(a.TopologyProbeBundle, a.Graph)
-	a.FlowProbeBundle.Start()
 
+	var captureHandler *api.BasicApiHandler
 	if addr != "" {
 		a.EtcdClient, err = etcd.NewEtcdClientFromConfig()
 		if err != nil {
@@ -92,11 +99,26 @@ func (a *Agent) Start() {
 			os.Exit(1)
 		}
 
-		captureHandler := &api.BasicApiHandler{
+		captureHandler = &api.BasicApiHandler{
 			ResourceHandler: &api.CaptureHandler{},
 			EtcdKeyAPI:      a.EtcdClient.KeysApi,
 		}
 
+		// restore the captures of the bridges as soon as the probe starts
+		if o, ok := a.FlowProbeBundle.GetProbe("ovssflow").(*fprobes.OvsSFlowProbesHandler); ok {
+			o.CaptureHandler = captureHandler
+		}
+	}
+
+	a.FlowProbeBundle.Start()
+
+	if c := a.FlowProbeBundle.AnalyzerClient; c != nil {
+		if interval := config.GetConfig().GetInt("agent.heartbeat_interval"); interval > 0 {
+			c.StartHeartbeat(string(a.Root.ID), time.Duration(interval)*time.Second)
+		}
+	}
+
+	if addr != "" {
 		l, err := fprobes.NewOnDemandProbeListener(a.FlowProbeBundle, a.Graph, captureHandler)
 		if err != nil {
 			logging.GetLogger().Errorf("Unable to start on-demand flow probe %s", err.Error())
@@ -106,10 +128,107 @@ func (a *Agent) Start() {
 		a.OnDemandProbeListener.Start()
 	}
 
+	a.HTTPServer.RegisterRoutes([]shttp.Route{
+		{
+			"AgentStats",
+			"GET",
+			"/api/stats",
+			a.stats,
+		},
+		{
+			"AgentFlowTableSnapshot",
+			"GET",
+			"/api/flowtable/snapshot",
+			a.flowTableSnapshot,
+		},
+	})
+
 	go a.HTTPServer.ListenAndServe()
 }
 
+type AgentStats struct {
+	FlowQueueDepth   int
+	FlowQueueDropped uint64
+
+	// flows enhanced and passed through unenhanced by the probe pipelines,
+	// see agent.flow_enhancement_sampling
+	FlowsEnhanced   uint64
+	FlowsUnenhanced uint64
+
+	// counters of the flow tables of the probes, by table name, see
+	// agent.flowtable_max_policy
+	FlowTables map[string]FlowTableStats
+}
+
+type FlowTableStats struct {
+	Flows      int
+	Aggregated uint64
+	Dropped    uint64
+	Evicted    uint64
+}
+
+func (a *Agent) stats(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	var stats AgentStats
+	if c := a.FlowProbeBundle.AnalyzerClient; c != nil {
+		stats.FlowQueueDepth = c.QueueDepth()
+		stats.FlowQueueDropped = c.Dropped()
+	}
+
+	pipelineStats := a.FlowProbeBundle.FlowMappingPipelineStats()
+	stats.FlowsEnhanced = pipelineStats.Enhanced
+	stats.FlowsUnenhanced = pipelineStats.Skipped
+
+	stats.FlowTables = make(map[string]FlowTableStats)
+	for name, ft := range a.FlowProbeBundle.FlowTables() {
+		stats.FlowTables[name] = FlowTableStats{
+			Flows:      len(ft.GetFlows()),
+			Aggregated: ft.Aggregated(),
+			Dropped:    ft.Dropped(),
+			Evicted:    ft.Evicted(),
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		logging.GetLogger().Criticalf("Failed to display agent stats: %s", err.Error())
+	}
+}
+
+// flowTableSnapshot dumps the flows of all the flow tables of the probes, by
+// table name, see flow.LoadTable to load a table of the snapshot
+func (a *Agent) flowTableSnapshot(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	snapshot := make(map[string]json.RawMessage)
+	for name, ft := range a.FlowProbeBundle.FlowTables() {
+		var b bytes.Buffer
+		if err := ft.Snapshot(&b); err != nil {
+			logging.GetLogger().Errorf("Failed to snapshot flow table %s: %s", name, err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		snapshot[name] = json.RawMessage(b.Bytes())
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(snapshot); err != nil {
+		logging.GetLogger().Criticalf("Failed to display flow table snapshot: %s", err.Error())
+	}
+}
+
+// ReloadAnalyzers routes the flows to the analyzers of agent.flow_analyzers,
+// or agent.analyzers, the graph is still forwarded to the first analyzer
+func (a *Agent) ReloadAnalyzers() error {
+	if c := a.FlowProbeBundle.AnalyzerClient; c != nil {
+		return c.SetAnalyzers(analyzer.FlowAnalyzersFromConfig())
+	}
+	return nil
+}
+
 func (a *Agent) Stop() {
+	if c := a.FlowProbeBundle.AnalyzerClient; c != nil {
+		c.StopHeartbeat()
+	}
 	a.FlowProbeBundle.UnregisterAllProbes()
 	a.FlowProbeBundle.Stop()
 	a.TopologyProbeBundle.Stop()
@@ -0,0 +1,125 @@
+/*
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package analyzer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+
+	"github.com/redhat-cip/skydive/flow"
+)
+
+// Flows are sent one per datagram in fire-and-forget mode. In ack mode they
+// are grouped in batches identified by an ID that the analyzer acknowledges:
+//
+//	batch: "SKFB" | id uint64 | (length uint32 | flow)*
+//	ack:   "SKFA" | id uint64
+//
+// A protobuf encoded flow can't start with the magic, it would be the start
+// of a group for the unknown field 10, so both formats can be received on
+// the same socket.
+const (
+	// the flows are grouped in batches up to maxBatchSize bytes, a larger
+	// flow being sent alone
+	maxBatchSize = 4096
+	// maximum UDP payload, size of the read buffers so that no datagram is
+	// truncated
+	maxDatagramSize = 65507
+)
+
+var (
+	batchMagic = []byte("SKFB")
+	ackMagic   = []byte("SKFA")
+)
+
+var errInvalidBatch = errors.New("invalid flow batch")
+
+const batchHeaderSize = 12
+
+func isFlowBatch(data []byte) bool {
+	return bytes.HasPrefix(data, batchMagic)
+}
+
+func encodeFlowBatch(id uint64, flows [][]byte) []byte {
+	size := batchHeaderSize
+	for _, f := range flows {
+		size += 4 + len(f)
+	}
+
+	data := make([]byte, batchHeaderSize, size)
+	copy(data, batchMagic)
+	binary.BigEndian.PutUint64(data[4:], id)
+
+	var length [4]byte
+	for _, f := range flows {
+		binary.BigEndian.PutUint32(length[:], uint32(len(f)))
+		data = append(data, length[:]...)
+		data = append(data, f...)
+	}
+
+	return data
+}
+
+func decodeFlowBatch(data []byte) (uint64, []*flow.Flow, error) {
+	if len(data) < batchHeaderSize || !isFlowBatch(data) {
+		return 0, nil, errInvalidBatch
+	}
+	id := binary.BigEndian.Uint64(data[4:])
+
+	var flows []*flow.Flow
+	for data = data[batchHeaderSize:]; len(data) > 0; {
+		if len(data) < 4 {
+			return id, nil, errInvalidBatch
+		}
+
+		length := binary.BigEndian.Uint32(data)
+		if uint32(len(data)-4) < length {
+			return id, nil, errInvalidBatch
+		}
+
+		f, err := flow.FromData(data[4 : 4+length])
+		if err != nil {
+			return id, nil, err
+		}
+		flows = append(flows, f)
+
+		data = data[4+length:]
+	}
+
+	return id, flows, nil
+}
+
+func encodeAck(id uint64) []byte {
+	data := make([]byte, batchHeaderSize)
+	copy(data, ackMagic)
+	binary.BigEndian.PutUint64(data[4:], id)
+	return data
+}
+
+func decodeAck(data []byte) (uint64, error) {
+	if len(data) != batchHeaderSize || !bytes.HasPrefix(data, ackMagic) {
+		return 0, errors.New("invalid flow batch ack")
+	}
+	return binary.BigEndian.Uint64(data[4:]), nil
+}
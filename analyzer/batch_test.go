@@ -0,0 +1,170 @@
+/*
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package analyzer
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/redhat-cip/skydive/flow"
+)
+
+func TestFlowBatch(t *testing.T) {
+	var flows [][]byte
+	for _, uuid := range []string{"flow-1", "flow-2"} {
+		data, err := (&flow.Flow{UUID: uuid}).GetData()
+		if err != nil {
+			t.Fatal(err)
+		}
+		flows = append(flows, data)
+	}
+
+	data := encodeFlowBatch(42, flows)
+	if !isFlowBatch(data) || isFlowBatch(flows[0]) {
+		t.Fatal("Batches and single flows should be distinguished")
+	}
+
+	id, decoded, err := decodeFlowBatch(data)
+	if err != nil || id != 42 || len(decoded) != 2 || decoded[1].UUID != "flow-2" {
+		t.Fatalf("Wrong decoded batch %d: %v, %v", id, decoded, err)
+	}
+
+	if _, _, err := decodeFlowBatch(data[:len(data)-1]); err == nil {
+		t.Error("Truncated batch should be invalid")
+	}
+
+	if id, err := decodeAck(encodeAck(42)); err != nil || id != 42 {
+		t.Errorf("Wrong decoded ack %d: %v", id, err)
+	}
+}
+
+func readBatch(t *testing.T, conn *net.UDPConn) (uint64, *net.UDPAddr) {
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	data := make([]byte, maxDatagramSize)
+	n, addr, err := conn.ReadFromUDP(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, _, err := decodeFlowBatch(data[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id, addr
+}
+
+func TestClientAck(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	client, err := newClient("127.0.0.1", port, 10, DeliveryAck, 100*time.Millisecond, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// not acknowledged, sent again then dropped
+	client.SendFlows([]*flow.Flow{{UUID: "flow-1"}})
+	first, _ := readBatch(t, conn)
+	if again, _ := readBatch(t, conn); again != first {
+		t.Fatalf("Expected batch %d to be sent again, got %d", first, again)
+	}
+
+	for start := time.Now(); client.Unacked() != 1; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 2*time.Second {
+			t.Fatal("Batch should have been dropped after its retries")
+		}
+	}
+
+	// acknowledged, not sent again
+	client.SendFlows([]*flow.Flow{{UUID: "flow-2"}})
+	id, addr := readBatch(t, conn)
+	if _, err := conn.WriteToUDP(encodeAck(id), addr); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	if client.Unacked() != 1 {
+		t.Errorf("Acknowledged batch shouldn't be dropped")
+	}
+
+	client.pendingLock.Lock()
+	defer client.pendingLock.Unlock()
+	if len(client.pending) != 0 {
+		t.Errorf("Expected no pending batch, got %d", len(client.pending))
+	}
+}
+
+func TestRateLimitedBatchAck(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	agent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+
+	var analyzed int
+	s := &Server{
+		FlowRateLimiter: NewFlowRateLimiter(1),
+		flowWorkers: newFlowWorkerPool(1, func(flows []*flow.Flow) {
+			analyzed += len(flows)
+		}),
+		conn: conn,
+	}
+	s.flowWorkers.Start()
+	defer s.flowWorkers.Stop()
+
+	var flows [][]byte
+	for _, uuid := range []string{"flow-1", "flow-2"} {
+		data, _ := (&flow.Flow{UUID: uuid}).GetData()
+		flows = append(flows, data)
+	}
+
+	// only one flow allowed, the batch is acknowledged anyway
+	s.handleFlowBatch(encodeFlowBatch(42, flows), agent.LocalAddr().(*net.UDPAddr))
+	s.flowWorkers.Wait()
+
+	if analyzed != 1 {
+		t.Errorf("Expected a single flow analyzed, got %d", analyzed)
+	}
+
+	agent.SetReadDeadline(time.Now().Add(2 * time.Second))
+	data := make([]byte, maxDatagramSize)
+	n, _, err := agent.ReadFromUDP(data)
+	if err != nil {
+		t.Fatalf("Expected the batch to be acknowledged: %s", err.Error())
+	}
+	if id, err := decodeAck(data[:n]); err != nil || id != 42 {
+		t.Errorf("Wrong ack %d: %v", id, err)
+	}
+}
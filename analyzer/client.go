@@ -23,41 +23,513 @@
 package analyzer
 
 import (
+	"fmt"
 	"net"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/Shopify/sarama"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/redhat-cip/skydive/config"
 	"github.com/redhat-cip/skydive/flow"
 	"github.com/redhat-cip/skydive/logging"
 )
 
+const (
+	minReconnectBackoff = time.Second
+	maxReconnectBackoff = 30 * time.Second
+)
+
+const (
+	// DeliveryFireAndForget sends each flow once without confirmation
+	DeliveryFireAndForget = "fire-and-forget"
+	// DeliveryAck sends the flows in batches acknowledged by the analyzer,
+	// the batches not acknowledged in time are sent again
+	DeliveryAck = "ack"
+	// DeliveryGRPC streams the flows in batches to the gRPC service of the
+	// analyzer, HTTP/2 providing the flow control
+	DeliveryGRPC = "grpc"
+	// DeliveryKafka publishes the flows to a Kafka topic consumed by the
+	// analyzer instead of sending them to the analyzer directly
+	DeliveryKafka = "kafka"
+)
+
 type Client struct {
 	Addr string
 	Port int
 
-	connection net.Conn
+	// replaced on reconnection, see conn
+	connection  net.Conn
+	grpcConn    *grpc.ClientConn
+	connLock    sync.RWMutex
+	grpcPort    int
+	queue       chan *flow.Flow
+	dropped     uint64
+	delivery    string
+	ackTimeout  time.Duration
+	maxRetries  int
+	batchID     uint64
+	pending     map[uint64]*pendingBatch
+	pendingLock sync.Mutex
+	unacked     uint64
+	closed      int32
+
+	kafkaBrokers     []string
+	kafkaTopic       string
+	newKafkaProducer func(brokers []string) (sarama.AsyncProducer, error)
+
+	// a cluster client routes the flows to a client per analyzer
+	cluster     bool
+	queueSize   int
+	members     map[string]*Client
+	ring        *hashRing
+	membersLock sync.RWMutex
+
+	// a pinned client sends the flows to a single analyzer of a cluster
+	// client
+	pinnedTo *Client
+	pinned   string
+
+	// closed to stop the heartbeats, see StartHeartbeat
+	heartbeatQuit chan bool
+}
+
+// pendingBatch is a batch waiting for the acknowledgement of the analyzer
+type pendingBatch struct {
+	data    []byte
+	sent    time.Time
+	retries int
 }
 
 func (c *Client) SendFlow(f *flow.Flow) error {
+	if c.pinnedTo != nil {
+		c.pinnedTo.sendTo(c.pinned, []*flow.Flow{f})
+		return nil
+	}
+
+	if c.cluster {
+		c.membersLock.RLock()
+		defer c.membersLock.RUnlock()
+
+		if m := c.ring.get(flowKey(f)); m != nil {
+			return m.SendFlow(f)
+		}
+		return nil
+	}
+
+	// there is no datagram to write in gRPC and Kafka modes, the flow is
+	// queued to be streamed or published
+	if c.delivery == DeliveryGRPC || c.delivery == DeliveryKafka {
+		c.SendFlows([]*flow.Flow{f})
+		return nil
+	}
+
 	data, err := f.GetData()
 	if err != nil {
 		return err
 	}
 
-	c.connection.Write(data)
+	_, err = c.conn().Write(data)
+	return err
+}
+
+// SendFlows queues the flows to be sent to the analyzer without blocking the
+// caller. When the queue is full the oldest flows are dropped. A copy of the
+// flows is queued, the caller has to own the flows, either updating them or
+// holding the lock of their table, and can keep updating them afterwards.
+func (c *Client) SendFlows(flows []*flow.Flow) {
+	if c.pinnedTo != nil {
+		c.pinnedTo.sendTo(c.pinned, flows)
+		return
+	}
+
+	if c.cluster {
+		c.route(flows)
+		return
+	}
+
+	for _, f := range flows {
+		f = f.Copy()
+		for sent := false; !sent; {
+			select {
+			case c.queue <- f:
+				sent = true
+			default:
+				// queue full, make room by dropping the oldest flow
+				select {
+				case <-c.queue:
+					atomic.AddUint64(&c.dropped, 1)
+				default:
+				}
+			}
+		}
+	}
+}
+
+func (c *Client) QueueDepth() int {
+	if c.cluster {
+		var depth int
+		c.forEachMember(func(m *Client) { depth += m.QueueDepth() })
+		return depth
+	}
+	return len(c.queue)
+}
+
+func (c *Client) Dropped() uint64 {
+	if c.cluster {
+		// along with the flows pinned to removed analyzers
+		dropped := atomic.LoadUint64(&c.dropped)
+		c.forEachMember(func(m *Client) { dropped += m.Dropped() })
+		return dropped
+	}
+	return atomic.LoadUint64(&c.dropped)
+}
+
+// Unacked returns the number of batches dropped because the analyzer didn't
+// acknowledge them after all the retries
+func (c *Client) Unacked() uint64 {
+	if c.cluster {
+		var unacked uint64
+		c.forEachMember(func(m *Client) { unacked += m.Unacked() })
+		return unacked
+	}
+	return atomic.LoadUint64(&c.unacked)
+}
+
+func (c *Client) forEachMember(f func(m *Client)) {
+	c.membersLock.RLock()
+	defer c.membersLock.RUnlock()
+
+	for _, m := range c.members {
+		f(m)
+	}
+}
+
+// close stops sending the queued flows, the client can't be used afterwards
+func (c *Client) close() {
+	atomic.StoreInt32(&c.closed, 1)
+	close(c.queue)
+}
+
+func (c *Client) isClosed() bool {
+	return atomic.LoadInt32(&c.closed) == 1
+}
+
+// addr returns the address of the analyzer, IPv6 addresses being enclosed in
+// square brackets
+func (c *Client) addr() string {
+	return net.JoinHostPort(c.Addr, strconv.Itoa(c.Port))
+}
+
+// grpcAddr returns the address of the gRPC service of the analyzer
+func (c *Client) grpcAddr() string {
+	return net.JoinHostPort(c.Addr, strconv.Itoa(c.grpcPort))
+}
+
+// conn returns the connection to the analyzer
+func (c *Client) conn() net.Conn {
+	c.connLock.RLock()
+	defer c.connLock.RUnlock()
+	return c.connection
+}
+
+// connect opens a connection to the analyzer, the connection it replaces
+// being closed
+func (c *Client) connect() error {
+	if c.delivery == DeliveryGRPC {
+		conn, err := grpc.Dial(c.grpcAddr(), grpc.WithInsecure())
+		if err != nil {
+			return err
+		}
+
+		c.connLock.Lock()
+		prev := c.grpcConn
+		c.grpcConn = conn
+		c.connLock.Unlock()
+
+		if prev != nil {
+			prev.Close()
+		}
+		return nil
+	}
+
+	srv, err := net.ResolveUDPAddr("udp", c.addr())
+	if err != nil {
+		return err
+	}
+
+	connection, err := net.DialUDP("udp", nil, srv)
+	if err != nil {
+		return err
+	}
+
+	c.connLock.Lock()
+	prev := c.connection
+	c.connection = connection
+	c.connLock.Unlock()
 
+	if prev != nil {
+		prev.Close()
+	}
 	return nil
 }
 
-func (c *Client) SendFlows(flows []*flow.Flow) {
-	for _, flow := range flows {
-		err := c.SendFlow(flow)
+// run sends the queued flows. Write errors mean that the analyzer is gone, in
+// that case the connection is retried with an exponential backoff while the
+// flows keep being queued, they are flushed once the analyzer is back.
+func (c *Client) run() {
+	connected := true
+	backoff := minReconnectBackoff
+
+	defer func() {
+		c.conn().Close()
+	}()
+
+	for f := range c.queue {
+		data, err := f.GetData()
 		if err != nil {
 			logging.GetLogger().Errorf("Unable to send flow: %s", err.Error())
+			continue
+		}
+
+		for !c.isClosed() {
+			_, err := c.conn().Write(data)
+			if err == nil {
+				if !connected {
+					logging.GetLogger().Infof("Connected to analyzer %s, flushing %d flows", c.addr(), c.QueueDepth())
+					connected = true
+					backoff = minReconnectBackoff
+				}
+				break
+			}
+
+			if connected {
+				logging.GetLogger().Warningf("Disconnected from analyzer %s: %s", c.addr(), err.Error())
+				connected = false
+			}
+
+			logging.GetLogger().Infof("Reconnecting to analyzer %s in %v", c.addr(), backoff)
+			time.Sleep(backoff)
+
+			if err := c.connect(); err != nil {
+				logging.GetLogger().Errorf("Unable to reconnect to analyzer %s: %s", c.addr(), err.Error())
+			}
+
+			if backoff *= 2; backoff > maxReconnectBackoff {
+				backoff = maxReconnectBackoff
+			}
 		}
 	}
 }
 
+// runGRPC streams the queued flows in batches of the flows available, up to
+// maxGRPCBatchSize flows. A batch is sent again until acknowledged by the
+// analyzer, on errors the stream is opened again with an exponential backoff
+// while the flows keep being queued.
+func (c *Client) runGRPC() {
+	var stream FlowService_SendFlowsClient
+	connected := true
+	backoff := minReconnectBackoff
+
+	defer func() {
+		if stream != nil {
+			stream.CloseSend()
+		}
+		c.grpcConn.Close()
+	}()
+
+	for f := range c.queue {
+		c.batchID++
+		batch := &FlowBatch{ID: c.batchID, Flows: []*flow.Flow{f}}
+	fill:
+		for len(batch.Flows) < maxGRPCBatchSize {
+			select {
+			case f, ok := <-c.queue:
+				if !ok {
+					break fill
+				}
+				batch.Flows = append(batch.Flows, f)
+			default:
+				break fill
+			}
+		}
+
+		for !c.isClosed() {
+			var err error
+			if stream == nil {
+				stream, err = NewFlowServiceClient(c.grpcConn).SendFlows(context.Background())
+			}
+			if err == nil {
+				err = c.sendGRPCBatch(stream, batch)
+			}
+			if err == nil {
+				if !connected {
+					logging.GetLogger().Infof("Connected to analyzer %s, flushing %d flows", c.grpcAddr(), c.QueueDepth())
+					connected = true
+					backoff = minReconnectBackoff
+				}
+				break
+			}
+
+			if connected {
+				logging.GetLogger().Warningf("Disconnected from analyzer %s: %s", c.grpcAddr(), err.Error())
+				connected = false
+			}
+
+			logging.GetLogger().Infof("Reconnecting to analyzer %s in %v", c.grpcAddr(), backoff)
+			time.Sleep(backoff)
+
+			stream = nil
+			if err := c.connect(); err != nil {
+				logging.GetLogger().Errorf("Unable to reconnect to analyzer %s: %s", c.grpcAddr(), err.Error())
+			}
+
+			if backoff *= 2; backoff > maxReconnectBackoff {
+				backoff = maxReconnectBackoff
+			}
+		}
+	}
+}
+
+// sendGRPCBatch sends a batch on the stream and waits for its
+// acknowledgement
+func (c *Client) sendGRPCBatch(stream FlowService_SendFlowsClient, batch *FlowBatch) error {
+	if err := stream.Send(batch); err != nil {
+		return err
+	}
+
+	ack, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	if ack.ID != batch.ID {
+		return fmt.Errorf("batch %d acknowledged instead of %d", ack.ID, batch.ID)
+	}
+	return nil
+}
+
+// runAck sends the queued flows in batches, a batch is sent as soon as the
+// queue is drained or the batch reaches the datagram size. The batches not
+// acknowledged within the ack timeout are sent again up to maxRetries times.
+func (c *Client) runAck() {
+	go c.readAcks()
+
+	ticker := time.NewTicker(c.ackTimeout / 2)
+	defer ticker.Stop()
+
+	var batch [][]byte
+	size := batchHeaderSize
+	for {
+		select {
+		case f, ok := <-c.queue:
+			if !ok {
+				c.conn().Close()
+				return
+			}
+
+			data, err := f.GetData()
+			if err != nil {
+				logging.GetLogger().Errorf("Unable to send flow: %s", err.Error())
+				continue
+			}
+
+			if batchHeaderSize+4+len(data) > maxDatagramSize {
+				logging.GetLogger().Errorf("Unable to send flow %s: %d bytes exceed the datagram size", f.UUID, len(data))
+				continue
+			}
+
+			if len(batch) > 0 && size+4+len(data) > maxBatchSize {
+				c.sendBatch(batch)
+				batch, size = nil, batchHeaderSize
+			}
+			batch = append(batch, data)
+			size += 4 + len(data)
+
+			if len(c.queue) == 0 {
+				c.sendBatch(batch)
+				batch, size = nil, batchHeaderSize
+			}
+		case now := <-ticker.C:
+			c.retransmit(now)
+		}
+	}
+}
+
+func (c *Client) write(data []byte) {
+	if _, err := c.conn().Write(data); err != nil {
+		logging.GetLogger().Debugf("Unable to send flow batch to analyzer %s: %s", c.addr(), err.Error())
+	}
+}
+
+func (c *Client) sendBatch(flows [][]byte) {
+	c.batchID++
+	b := &pendingBatch{
+		data: encodeFlowBatch(c.batchID, flows),
+		sent: time.Now(),
+	}
+
+	c.pendingLock.Lock()
+	c.pending[c.batchID] = b
+	c.pendingLock.Unlock()
+
+	c.write(b.data)
+}
+
+// retransmit sends again the batches not acknowledged within the ack
+// timeout and drops the ones which exhausted their retries
+func (c *Client) retransmit(now time.Time) {
+	c.pendingLock.Lock()
+	defer c.pendingLock.Unlock()
+
+	for id, b := range c.pending {
+		if now.Sub(b.sent) < c.ackTimeout {
+			continue
+		}
+
+		if b.retries >= c.maxRetries {
+			logging.GetLogger().Warningf("Flow batch %d not acknowledged by analyzer %s, dropped", id, c.addr())
+			delete(c.pending, id)
+			atomic.AddUint64(&c.unacked, 1)
+			continue
+		}
+
+		b.retries++
+		b.sent = now
+		c.write(b.data)
+	}
+}
+
+func (c *Client) readAcks() {
+	data := make([]byte, maxDatagramSize)
+	for {
+		n, err := c.conn().Read(data)
+		if err != nil {
+			if c.isClosed() {
+				return
+			}
+
+			// reported when the analyzer is not listening, the batches
+			// will be sent again
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+
+		id, err := decodeAck(data[:n])
+		if err != nil {
+			logging.GetLogger().Errorf("Error while reading flow batch ack: %s", err.Error())
+			continue
+		}
+
+		c.pendingLock.Lock()
+		delete(c.pending, id)
+		c.pendingLock.Unlock()
+	}
+}
+
 func (c *Client) AsyncFlowsUpdate(ft *flow.Table, every time.Duration) {
 	ticker := time.NewTicker(every)
 	defer ticker.Stop()
@@ -69,20 +541,85 @@ func (c *Client) AsyncFlowsUpdate(ft *flow.Table, every time.Duration) {
 	}
 }
 
-func NewClient(addr string, port int) (*Client, error) {
-	client := &Client{Addr: addr, Port: port}
-
-	srv, err := net.ResolveUDPAddr("udp", addr+":"+strconv.FormatInt(int64(port), 10))
-	if err != nil {
-		return nil, err
+func newClient(addr string, port int, queueSize int, delivery string, ackTimeout time.Duration, maxRetries int) (*Client, error) {
+	client := &Client{
+		Addr:       addr,
+		Port:       port,
+		queue:      make(chan *flow.Flow, queueSize),
+		delivery:   delivery,
+		ackTimeout: ackTimeout,
+		maxRetries: maxRetries,
+		pending:    make(map[uint64]*pendingBatch),
+		grpcPort:   config.GetConfig().GetInt("agent.flow_grpc_port"),
 	}
 
-	connection, err := net.DialUDP("udp", nil, srv)
-	if err != nil {
+	if err := client.connect(); err != nil {
 		return nil, err
 	}
 
-	client.connection = connection
+	switch delivery {
+	case DeliveryAck:
+		go client.runAck()
+	case DeliveryGRPC:
+		go client.runGRPC()
+	default:
+		go client.run()
+	}
 
 	return client, nil
 }
+
+// FlowAnalyzersFromConfig returns the analyzers the flows are sent to,
+// agent.flow_analyzers when the analyzers receive the flows on a dedicated
+// address, agent.analyzers otherwise
+func FlowAnalyzersFromConfig() []string {
+	cfg := config.GetConfig()
+	if analyzers := cfg.GetStringSlice("agent.flow_analyzers"); len(analyzers) > 0 {
+		return analyzers
+	}
+	return cfg.GetStringSlice("agent.analyzers")
+}
+
+// NewClientFromConfig returns a client sending the flows to the analyzers of
+// FlowAnalyzersFromConfig, routed by consistent hashing when there are several of them.
+// nil is returned when no analyzer is configured. In kafka delivery mode the
+// flows are published to flow.kafka_topic whatever the analyzers.
+func NewClientFromConfig() (*Client, error) {
+	cfg := config.GetConfig()
+
+	if cfg.GetString("agent.flow_delivery") == DeliveryKafka {
+		return NewKafkaClient(cfg.GetStringSlice("flow.kafka_brokers"),
+			cfg.GetString("flow.kafka_topic"),
+			cfg.GetInt("agent.flow_queue_size"),
+		), nil
+	}
+
+	analyzers := FlowAnalyzersFromConfig()
+	switch len(analyzers) {
+	case 0:
+		return nil, nil
+	case 1:
+		addr, port, err := splitAnalyzerAddr(analyzers[0])
+		if err != nil {
+			return nil, err
+		}
+		return NewClient(addr, port)
+	}
+
+	return newClusterClient(analyzers,
+		cfg.GetInt("agent.flow_queue_size"),
+		cfg.GetString("agent.flow_delivery"),
+		time.Duration(cfg.GetInt("agent.flow_ack_timeout"))*time.Second,
+		cfg.GetInt("agent.flow_ack_retries"),
+	)
+}
+
+func NewClient(addr string, port int) (*Client, error) {
+	cfg := config.GetConfig()
+	return newClient(addr, port,
+		cfg.GetInt("agent.flow_queue_size"),
+		cfg.GetString("agent.flow_delivery"),
+		time.Duration(cfg.GetInt("agent.flow_ack_timeout"))*time.Second,
+		cfg.GetInt("agent.flow_ack_retries"),
+	)
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package analyzer
+
+import (
+	"net"
+	"testing"
+
+	"github.com/redhat-cip/skydive/flow"
+)
+
+func TestSendFlowsCopy(t *testing.T) {
+	client := &Client{queue: make(chan *flow.Flow, 10)}
+
+	f := &flow.Flow{UUID: "flow1", Statistics: &flow.FlowStatistics{Last: 1}}
+	client.SendFlows([]*flow.Flow{f})
+
+	// the flow keeps being updated by its table
+	f.Statistics.Last = 2
+
+	queued := <-client.queue
+	if queued == f || queued.UUID != "flow1" || queued.Statistics.Last != 1 {
+		t.Errorf("Expected a copy of the flow to be queued, got %v", queued)
+	}
+}
+
+func TestReconnectClosesConnection(t *testing.T) {
+	listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	client := &Client{Addr: "127.0.0.1", Port: listener.LocalAddr().(*net.UDPAddr).Port}
+	if err := client.connect(); err != nil {
+		t.Fatal(err)
+	}
+	first := client.conn()
+
+	if err := client.connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.conn().Close()
+
+	if client.conn() == first {
+		t.Fatal("Expected the connection to be replaced")
+	}
+	if _, err := first.Write([]byte("flow")); err == nil {
+		t.Error("Expected the replaced connection to be closed")
+	}
+	if _, err := client.conn().Write([]byte("flow")); err != nil {
+		t.Errorf("Unable to write on the new connection: %s", err.Error())
+	}
+}
@@ -0,0 +1,263 @@
+/*
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package analyzer
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/redhat-cip/skydive/flow"
+	"github.com/redhat-cip/skydive/logging"
+)
+
+// number of points of each analyzer on the hash ring, the more points the
+// more even the distribution of the flows
+const ringReplicas = 64
+
+// hashRing routes the flows on the analyzers by consistent hashing so that
+// only the flows of an added or removed analyzer move on a member change
+type hashRing struct {
+	points []uint32
+	owners map[uint32]*Client
+}
+
+// hashKey spreads the keys on the ring, fnv being too biased for the
+// sequential keys of the analyzer points
+func hashKey(key string) uint32 {
+	h := md5.Sum([]byte(key))
+	return binary.BigEndian.Uint32(h[:4])
+}
+
+func newHashRing(members map[string]*Client) *hashRing {
+	r := &hashRing{owners: make(map[uint32]*Client)}
+	for addr, m := range members {
+		for i := 0; i < ringReplicas; i++ {
+			point := hashKey(addr + "#" + strconv.Itoa(i))
+			r.points = append(r.points, point)
+			r.owners[point] = m
+		}
+	}
+	sort.Sort(uint32Slice(r.points))
+
+	return r
+}
+
+func (r *hashRing) get(key string) *Client {
+	if len(r.points) == 0 {
+		return nil
+	}
+
+	h := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+type uint32Slice []uint32
+
+func (s uint32Slice) Len() int           { return len(s) }
+func (s uint32Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s uint32Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// flowKey identifies a flow across the agents, the tracking ID being computed
+// from the packet content, the same session lands on the same analyzer
+func flowKey(f *flow.Flow) string {
+	if f.TrackingID != "" {
+		return f.TrackingID
+	}
+	return f.UUID
+}
+
+func splitAnalyzerAddr(analyzer string) (string, int, error) {
+	addr, p, err := net.SplitHostPort(analyzer)
+	if err != nil {
+		return "", 0, err
+	}
+
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid analyzer port %s", analyzer)
+	}
+
+	return addr, port, nil
+}
+
+// route sends the flows to the analyzers owning them on the hash ring
+func (c *Client) route(flows []*flow.Flow) {
+	c.membersLock.RLock()
+	defer c.membersLock.RUnlock()
+
+	routed := make(map[*Client][]*flow.Flow)
+	for _, f := range flows {
+		if m := c.ring.get(flowKey(f)); m != nil {
+			routed[m] = append(routed[m], f)
+		}
+	}
+
+	for m, flows := range routed {
+		m.SendFlows(flows)
+	}
+}
+
+// sendTo sends the flows to the given analyzer of a cluster client, dropped
+// when it is not a member anymore
+func (c *Client) sendTo(analyzer string, flows []*flow.Flow) {
+	c.membersLock.RLock()
+	defer c.membersLock.RUnlock()
+
+	if m, ok := c.members[analyzer]; ok {
+		m.SendFlows(flows)
+		return
+	}
+
+	atomic.AddUint64(&c.dropped, uint64(len(flows)))
+	logging.GetLogger().Debugf("Analyzer %s removed, %d flows dropped", analyzer, len(flows))
+}
+
+// Pinned returns a client sending all the flows to the given analyzer, one
+// of the analyzers of the client, instead of routing them by consistent
+// hashing. The analyzer is looked up on each send so that the flows are
+// dropped once it is removed by SetAnalyzers.
+func (c *Client) Pinned(analyzer string) (*Client, error) {
+	if c.delivery == DeliveryKafka {
+		return nil, errors.New("the flows can't be pinned to an analyzer in kafka delivery mode")
+	}
+
+	if !c.cluster {
+		if analyzer == c.addr() {
+			return c, nil
+		}
+		return nil, fmt.Errorf("unknown analyzer %s", analyzer)
+	}
+
+	c.membersLock.RLock()
+	defer c.membersLock.RUnlock()
+
+	if _, ok := c.members[analyzer]; !ok {
+		return nil, fmt.Errorf("unknown analyzer %s", analyzer)
+	}
+
+	return &Client{pinnedTo: c, pinned: analyzer}, nil
+}
+
+// SameDestination returns whether both clients send the flows to the same
+// analyzers, pinned clients being created on each call of Pinned
+func (c *Client) SameDestination(o *Client) bool {
+	if c == o {
+		return true
+	}
+	if c == nil || o == nil {
+		return false
+	}
+	return c.pinnedTo != nil && c.pinnedTo == o.pinnedTo && c.pinned == o.pinned
+}
+
+func (c *Client) newMember(analyzer string) (*Client, error) {
+	addr, port, err := splitAnalyzerAddr(analyzer)
+	if err != nil {
+		return nil, err
+	}
+
+	return newClient(addr, port, c.queueSize, c.delivery, c.ackTimeout, c.maxRetries)
+}
+
+// SetAnalyzers changes the analyzers of a cluster client, the flows are then
+// routed on the new member set. A single analyzer client can't be changed.
+func (c *Client) SetAnalyzers(analyzers []string) error {
+	if !c.cluster {
+		if len(analyzers) == 1 && analyzers[0] == c.addr() {
+			return nil
+		}
+		return errors.New("the analyzers of a single analyzer client can't be changed, restart required")
+	}
+
+	if len(analyzers) == 0 {
+		return errors.New("at least one analyzer is required")
+	}
+
+	c.membersLock.Lock()
+	defer c.membersLock.Unlock()
+
+	members := make(map[string]*Client)
+	var added, removed []string
+	for _, analyzer := range analyzers {
+		if m, ok := c.members[analyzer]; ok {
+			members[analyzer] = m
+			continue
+		}
+
+		m, err := c.newMember(analyzer)
+		if err != nil {
+			// the current member set is kept
+			for _, analyzer := range added {
+				members[analyzer].close()
+			}
+			return err
+		}
+		members[analyzer] = m
+		added = append(added, analyzer)
+	}
+
+	for analyzer, m := range c.members {
+		if _, ok := members[analyzer]; !ok {
+			removed = append(removed, analyzer)
+			m.close()
+		}
+	}
+
+	c.members = members
+	c.ring = newHashRing(members)
+
+	if len(added) > 0 || len(removed) > 0 {
+		logging.GetLogger().Infof("Analyzers rebalanced %s", logging.Fields("added", strings.Join(added, ","), "removed", strings.Join(removed, ","), "analyzers", len(members)))
+	}
+
+	return nil
+}
+
+func newClusterClient(analyzers []string, queueSize int, delivery string, ackTimeout time.Duration, maxRetries int) (*Client, error) {
+	client := &Client{
+		cluster:    true,
+		queueSize:  queueSize,
+		delivery:   delivery,
+		ackTimeout: ackTimeout,
+		maxRetries: maxRetries,
+		members:    make(map[string]*Client),
+	}
+
+	if err := client.SetAnalyzers(analyzers); err != nil {
+		return nil, err
+	}
+
+	return client, nil
+}
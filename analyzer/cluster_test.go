@@ -0,0 +1,219 @@
+/*
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package analyzer
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/flow"
+)
+
+func TestHashRing(t *testing.T) {
+	members := map[string]*Client{
+		"10.0.0.1:8082": {Addr: "10.0.0.1"},
+		"10.0.0.2:8082": {Addr: "10.0.0.2"},
+		"10.0.0.3:8082": {Addr: "10.0.0.3"},
+	}
+	ring := newHashRing(members)
+
+	owners := make(map[string]*Client)
+	count := make(map[*Client]int)
+	for i := 0; i < 3000; i++ {
+		key := strconv.Itoa(i)
+		owners[key] = ring.get(key)
+		count[owners[key]]++
+	}
+
+	for addr, m := range members {
+		if count[m] < 500 {
+			t.Errorf("Uneven distribution, %s owns %d keys out of 3000", addr, count[m])
+		}
+	}
+
+	// only the keys of the removed analyzer move
+	removed := members["10.0.0.3:8082"]
+	delete(members, "10.0.0.3:8082")
+	ring = newHashRing(members)
+	for key, owner := range owners {
+		if m := ring.get(key); m == removed || (owner != removed && m != owner) {
+			t.Fatalf("Key %s moved from %s to %s", key, owner.Addr, m.Addr)
+		}
+	}
+}
+
+func listenAnalyzer(t *testing.T) (*net.UDPConn, string) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, conn.LocalAddr().String()
+}
+
+func readFlows(t *testing.T, conn *net.UDPConn, count int) map[string]bool {
+	flows := make(map[string]bool)
+	data := make([]byte, maxDatagramSize)
+	for i := 0; i < count; i++ {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, err := conn.Read(data)
+		if err != nil {
+			t.Fatalf("Expected %d flows, got %d: %s", count, i, err.Error())
+		}
+
+		f, err := flow.FromData(data[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		flows[f.TrackingID] = true
+	}
+	return flows
+}
+
+func TestClusterClient(t *testing.T) {
+	conn1, addr1 := listenAnalyzer(t)
+	defer conn1.Close()
+	conn2, addr2 := listenAnalyzer(t)
+	defer conn2.Close()
+
+	client, err := newClusterClient([]string{addr1, addr2}, 100, DeliveryFireAndForget, time.Second, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var flows []*flow.Flow
+	expected := make(map[string]string)
+	for i := 0; i < 20; i++ {
+		f := &flow.Flow{UUID: "flow-" + strconv.Itoa(i), TrackingID: "tracking-" + strconv.Itoa(i)}
+		flows = append(flows, f)
+
+		m := client.ring.get(f.TrackingID)
+		expected[f.TrackingID] = m.Addr + ":" + strconv.Itoa(m.Port)
+	}
+
+	count := make(map[string]int)
+	for _, addr := range expected {
+		count[addr]++
+	}
+	if count[addr1] == 0 || count[addr2] == 0 {
+		t.Fatalf("Flows not spread on the analyzers: %v", count)
+	}
+
+	client.SendFlows(flows)
+	for conn, addr := range map[*net.UDPConn]string{conn1: addr1, conn2: addr2} {
+		for id := range readFlows(t, conn, count[addr]) {
+			if expected[id] != addr {
+				t.Errorf("Flow %s sent to %s instead of %s", id, addr, expected[id])
+			}
+		}
+	}
+
+	// the flows of the removed analyzer move to the remaining one
+	removed := client.members[addr2]
+	if err := client.SetAnalyzers([]string{addr1}); err != nil {
+		t.Fatal(err)
+	}
+	if !removed.isClosed() || len(client.members) != 1 {
+		t.Fatal("Removed analyzer client should be closed")
+	}
+
+	client.SendFlows(flows)
+	if received := readFlows(t, conn1, len(flows)); len(received) != len(flows) {
+		t.Errorf("Expected all the flows on the remaining analyzer, got %d", len(received))
+	}
+
+	if err := client.SetAnalyzers([]string{"missing-port"}); err == nil || len(client.members) != 1 {
+		t.Error("Invalid analyzer should be refused and the members kept")
+	}
+}
+
+func TestPinnedClient(t *testing.T) {
+	conn1, addr1 := listenAnalyzer(t)
+	defer conn1.Close()
+	conn2, addr2 := listenAnalyzer(t)
+	defer conn2.Close()
+
+	client, err := newClusterClient([]string{addr1, addr2}, 100, DeliveryFireAndForget, time.Second, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.Pinned("127.0.0.1:1"); err == nil {
+		t.Error("Unknown analyzer should be refused")
+	}
+
+	pinned, err := client.Pinned(addr2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var flows []*flow.Flow
+	for i := 0; i < 20; i++ {
+		flows = append(flows, &flow.Flow{UUID: "flow-" + strconv.Itoa(i), TrackingID: "tracking-" + strconv.Itoa(i)})
+	}
+
+	pinned.SendFlows(flows)
+	if received := readFlows(t, conn2, len(flows)); len(received) != len(flows) {
+		t.Errorf("Expected all the flows on the pinned analyzer, got %d", len(received))
+	}
+
+	// dropped once the analyzer is removed
+	if err := client.SetAnalyzers([]string{addr1}); err != nil {
+		t.Fatal(err)
+	}
+	pinned.SendFlows(flows)
+	if dropped := client.Dropped(); dropped != uint64(len(flows)) {
+		t.Errorf("Expected %d flows dropped, got %d", len(flows), dropped)
+	}
+}
+
+func TestPinnedIPv6(t *testing.T) {
+	client := &Client{Addr: "::1", Port: 8082}
+
+	if pinned, err := client.Pinned("[::1]:8082"); err != nil || pinned != client {
+		t.Errorf("Expected the IPv6 analyzer to be the client itself, got %v", err)
+	}
+
+	if err := client.SetAnalyzers([]string{"[::1]:8082"}); err != nil {
+		t.Errorf("Expected the same IPv6 analyzer to be accepted, got %s", err.Error())
+	}
+}
+
+func TestFlowAnalyzersFromConfig(t *testing.T) {
+	cfg := config.GetConfig()
+	cfg.Set("agent.analyzers", []string{"10.0.0.1:8082"})
+	defer cfg.Set("agent.analyzers", []string{"127.0.0.1:8082"})
+
+	if analyzers := FlowAnalyzersFromConfig(); len(analyzers) != 1 || analyzers[0] != "10.0.0.1:8082" {
+		t.Errorf("Expected the API addresses of the analyzers, got %v", analyzers)
+	}
+
+	cfg.Set("agent.flow_analyzers", []string{"10.0.1.1:8082"})
+	defer cfg.Set("agent.flow_analyzers", []string{})
+
+	if analyzers := FlowAnalyzersFromConfig(); len(analyzers) != 1 || analyzers[0] != "10.0.1.1:8082" {
+		t.Errorf("Expected the flow addresses of the analyzers, got %v", analyzers)
+	}
+}
@@ -0,0 +1,185 @@
+// Code generated by protoc-gen-go.
+// source: analyzer/flow_service.proto
+// DO NOT EDIT!
+
+/*
+Package analyzer is a generated protocol buffer package.
+
+It is generated from these files:
+
+	analyzer/flow_service.proto
+
+It has these top-level messages:
+
+	FlowBatch
+	FlowBatchAck
+*/
+package analyzer
+
+import proto "github.com/golang/protobuf/proto"
+import fmt "fmt"
+import math "math"
+import flow "github.com/redhat-cip/skydive/flow"
+
+import (
+	context "golang.org/x/net/context"
+	grpc "google.golang.org/grpc"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+const _ = proto.ProtoPackageIsVersion1
+
+type FlowBatch struct {
+	Flows []*flow.Flow `protobuf:"bytes,1,rep,name=Flows" json:"Flows,omitempty"`
+	// identifier of the batch on the stream, acknowledged by FlowBatchAck
+	ID uint64 `protobuf:"varint,2,opt,name=ID" json:"ID,omitempty"`
+}
+
+func (m *FlowBatch) Reset()                    { *m = FlowBatch{} }
+func (m *FlowBatch) String() string            { return proto.CompactTextString(m) }
+func (*FlowBatch) ProtoMessage()               {}
+func (*FlowBatch) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{0} }
+
+func (m *FlowBatch) GetFlows() []*flow.Flow {
+	if m != nil {
+		return m.Flows
+	}
+	return nil
+}
+
+type FlowBatchAck struct {
+	// number of flows of the batch received
+	Count uint64 `protobuf:"varint,1,opt,name=Count" json:"Count,omitempty"`
+	ID    uint64 `protobuf:"varint,2,opt,name=ID" json:"ID,omitempty"`
+}
+
+func (m *FlowBatchAck) Reset()                    { *m = FlowBatchAck{} }
+func (m *FlowBatchAck) String() string            { return proto.CompactTextString(m) }
+func (*FlowBatchAck) ProtoMessage()               {}
+func (*FlowBatchAck) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{1} }
+
+func init() {
+	proto.RegisterType((*FlowBatch)(nil), "analyzer.FlowBatch")
+	proto.RegisterType((*FlowBatchAck)(nil), "analyzer.FlowBatchAck")
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// Client API for FlowService service
+
+type FlowServiceClient interface {
+	SendFlows(ctx context.Context, opts ...grpc.CallOption) (FlowService_SendFlowsClient, error)
+}
+
+type flowServiceClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewFlowServiceClient(cc *grpc.ClientConn) FlowServiceClient {
+	return &flowServiceClient{cc}
+}
+
+func (c *flowServiceClient) SendFlows(ctx context.Context, opts ...grpc.CallOption) (FlowService_SendFlowsClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_FlowService_serviceDesc.Streams[0], c.cc, "/analyzer.FlowService/SendFlows", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &flowServiceSendFlowsClient{stream}
+	return x, nil
+}
+
+type FlowService_SendFlowsClient interface {
+	Send(*FlowBatch) error
+	Recv() (*FlowBatchAck, error)
+	grpc.ClientStream
+}
+
+type flowServiceSendFlowsClient struct {
+	grpc.ClientStream
+}
+
+func (x *flowServiceSendFlowsClient) Send(m *FlowBatch) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *flowServiceSendFlowsClient) Recv() (*FlowBatchAck, error) {
+	m := new(FlowBatchAck)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Server API for FlowService service
+
+type FlowServiceServer interface {
+	SendFlows(FlowService_SendFlowsServer) error
+}
+
+func RegisterFlowServiceServer(s *grpc.Server, srv FlowServiceServer) {
+	s.RegisterService(&_FlowService_serviceDesc, srv)
+}
+
+func _FlowService_SendFlows_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(FlowServiceServer).SendFlows(&flowServiceSendFlowsServer{stream})
+}
+
+type FlowService_SendFlowsServer interface {
+	Send(*FlowBatchAck) error
+	Recv() (*FlowBatch, error)
+	grpc.ServerStream
+}
+
+type flowServiceSendFlowsServer struct {
+	grpc.ServerStream
+}
+
+func (x *flowServiceSendFlowsServer) Send(m *FlowBatchAck) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *flowServiceSendFlowsServer) Recv() (*FlowBatch, error) {
+	m := new(FlowBatch)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+var _FlowService_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "analyzer.FlowService",
+	HandlerType: (*FlowServiceServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "SendFlows",
+			Handler:       _FlowService_SendFlows_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+}
+
+var fileDescriptor0 = []byte{
+	// 182 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0x92, 0x4e, 0xcc, 0x4b, 0xcc,
+	0xa9, 0xac, 0x4a, 0x2d, 0xd2, 0x4f, 0xcb, 0xc9, 0x2f, 0x8f, 0x2f, 0x4e, 0x2d, 0x2a, 0xcb, 0x4c,
+	0x4e, 0xd5, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0xe2, 0x80, 0x49, 0x4a, 0xf1, 0x83, 0x64, 0xc1,
+	0x4a, 0x20, 0x52, 0x4a, 0xb6, 0x5c, 0x9c, 0x6e, 0x39, 0xf9, 0xe5, 0x4e, 0x89, 0x25, 0xc9, 0x19,
+	0x42, 0x0a, 0x5c, 0xac, 0x20, 0x4e, 0xb1, 0x04, 0xa3, 0x02, 0xb3, 0x06, 0xb7, 0x11, 0x97, 0x1e,
+	0x58, 0x21, 0x48, 0x28, 0x08, 0x22, 0x21, 0xc4, 0xc7, 0xc5, 0xe4, 0xe9, 0x22, 0xc1, 0xa4, 0xc0,
+	0xa8, 0xc1, 0x12, 0xc4, 0xe4, 0xe9, 0xa2, 0x64, 0xc2, 0xc5, 0x03, 0xd7, 0xee, 0x98, 0x9c, 0x2d,
+	0x24, 0xc2, 0xc5, 0xea, 0x9c, 0x5f, 0x9a, 0x57, 0x22, 0xc1, 0x08, 0x56, 0x02, 0xe1, 0xa0, 0xeb,
+	0x32, 0xf2, 0xe6, 0xe2, 0x06, 0xe9, 0x0a, 0x86, 0x38, 0x52, 0xc8, 0x86, 0x8b, 0x33, 0x38, 0x35,
+	0x2f, 0x05, 0x62, 0x83, 0xb0, 0x1e, 0xcc, 0xb1, 0x7a, 0x70, 0x93, 0xa5, 0xc4, 0xb0, 0x08, 0x3a,
+	0x26, 0x67, 0x6b, 0x30, 0x1a, 0x30, 0x26, 0xb1, 0x81, 0x3d, 0x62, 0x0c, 0x18, 0x00, 0x44, 0x40,
+	0x81, 0x1f, 0x02, 0x01, 0x00, 0x00,
+}
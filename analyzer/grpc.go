@@ -0,0 +1,67 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package analyzer
+
+import (
+	"io"
+
+	"github.com/redhat-cip/skydive/flow"
+)
+
+// Flows are streamed to the analyzer gRPC service in batches of at most
+// maxGRPCBatchSize flows, see flow_service.proto
+const maxGRPCBatchSize = 500
+
+// flowServer analyzes the flows streamed by the agents, the flows refused by
+// the rate limiter are dropped like the ones received over UDP. Each batch is
+// acknowledged once dispatched.
+type flowServer struct {
+	server *Server
+}
+
+func (fs *flowServer) SendFlows(stream FlowService_SendFlowsServer) error {
+	for {
+		batch, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		allowed := make([]*flow.Flow, 0, len(batch.Flows))
+		for _, f := range batch.Flows {
+			if fs.server.FlowRateLimiter.Allow() {
+				allowed = append(allowed, f)
+			}
+		}
+
+		if len(allowed) > 0 {
+			fs.server.flowWorkers.Dispatch(allowed)
+		}
+
+		if err := stream.Send(&FlowBatchAck{ID: batch.ID, Count: uint64(len(batch.Flows))}); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,146 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package analyzer
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+
+	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/flow"
+)
+
+type fakeFlowServer struct {
+	sync.Mutex
+	flows []*flow.Flow
+	// acknowledgements to drop, so that the batches are sent again
+	drop int
+}
+
+func (s *fakeFlowServer) SendFlows(stream FlowService_SendFlowsServer) error {
+	for {
+		batch, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		s.Lock()
+		s.flows = append(s.flows, batch.Flows...)
+		drop := s.drop > 0
+		if drop {
+			s.drop--
+		}
+		s.Unlock()
+
+		// fail the stream without acknowledging the batch
+		if drop {
+			return errors.New("batch lost")
+		}
+
+		if err := stream.Send(&FlowBatchAck{ID: batch.ID, Count: uint64(len(batch.Flows))}); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *fakeFlowServer) received() []*flow.Flow {
+	s.Lock()
+	defer s.Unlock()
+	return append([]*flow.Flow(nil), s.flows...)
+}
+
+func newFakeFlowServer(t *testing.T, drop int) (*fakeFlowServer, *grpc.Server) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := grpc.NewServer()
+	fs := &fakeFlowServer{drop: drop}
+	RegisterFlowServiceServer(server, fs)
+	go server.Serve(listener)
+
+	config.GetConfig().Set("agent.flow_grpc_port", listener.Addr().(*net.TCPAddr).Port)
+	return fs, server
+}
+
+// waitFlows waits for the server to receive the given number of flows
+func waitFlows(t *testing.T, fs *fakeFlowServer, count int) []*flow.Flow {
+	for start := time.Now(); len(fs.received()) < count; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("Expected %d flows to be streamed, got %d", count, len(fs.received()))
+		}
+	}
+	return fs.received()
+}
+
+func TestClientGRPC(t *testing.T) {
+	fs, server := newFakeFlowServer(t, 0)
+	defer server.Stop()
+
+	client, err := newClient("127.0.0.1", 0, 10, DeliveryGRPC, time.Second, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.close()
+
+	client.SendFlows([]*flow.Flow{{UUID: "flow-1"}, {UUID: "flow-2"}})
+	client.SendFlow(&flow.Flow{UUID: "flow-3"})
+
+	flows := waitFlows(t, fs, 3)
+	if len(flows) != 3 || flows[0].UUID != "flow-1" || flows[2].UUID != "flow-3" {
+		t.Errorf("Flows corrupted, duplicated or out of order: %v", flows)
+	}
+}
+
+func TestClientGRPCUnacked(t *testing.T) {
+	fs, server := newFakeFlowServer(t, 1)
+	defer server.Stop()
+
+	client, err := newClient("127.0.0.1", 0, 10, DeliveryGRPC, time.Second, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.close()
+
+	// the batch not acknowledged is sent again on a new stream
+	client.SendFlow(&flow.Flow{UUID: "flow-1"})
+	flows := waitFlows(t, fs, 2)
+	if flows[0].UUID != "flow-1" || flows[1].UUID != "flow-1" {
+		t.Fatalf("Expected the unacknowledged batch to be sent again, got %v", flows)
+	}
+
+	client.SendFlow(&flow.Flow{UUID: "flow-2"})
+	if flows := waitFlows(t, fs, 3); flows[2].UUID != "flow-2" {
+		t.Errorf("Expected the next batch to be streamed, got %v", flows)
+	}
+}
@@ -0,0 +1,271 @@
+/*
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package analyzer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/abbot/go-http-auth"
+
+	"github.com/redhat-cip/skydive/logging"
+)
+
+// The agents send a heartbeat to the flow address of the analyzers so that
+// an idle agent can be told apart from a dead one:
+//
+//	heartbeat: "SKHB" | JSON encoded Heartbeat
+//
+// Like the flow batches it can't be mistaken for a protobuf encoded flow.
+var heartbeatMagic = []byte("SKHB")
+
+var errInvalidHeartbeat = errors.New("invalid heartbeat")
+
+// Heartbeat is sent periodically by the agents along with their flow
+// delivery statistics
+type Heartbeat struct {
+	AgentID          string
+	FlowQueueDepth   int
+	FlowQueueDropped uint64
+	Unacked          uint64
+}
+
+// AgentStatus is the liveness of an agent as seen by the analyzer, an agent
+// is down when no heartbeat was received within the stale timeout
+type AgentStatus struct {
+	Heartbeat
+	Address  string
+	LastSeen time.Time
+	Alive    bool
+}
+
+func isHeartbeat(data []byte) bool {
+	return bytes.HasPrefix(data, heartbeatMagic)
+}
+
+func encodeHeartbeat(hb *Heartbeat) ([]byte, error) {
+	data, err := json.Marshal(hb)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte{}, heartbeatMagic...), data...), nil
+}
+
+func decodeHeartbeat(data []byte) (*Heartbeat, error) {
+	if !isHeartbeat(data) {
+		return nil, errInvalidHeartbeat
+	}
+
+	var hb Heartbeat
+	if err := json.Unmarshal(data[len(heartbeatMagic):], &hb); err != nil {
+		return nil, err
+	}
+	if hb.AgentID == "" {
+		return nil, errInvalidHeartbeat
+	}
+	return &hb, nil
+}
+
+// heartbeatTargets returns the flow addresses of the analyzers the client
+// sends its flows to, none in kafka delivery mode
+func (c *Client) heartbeatTargets() []string {
+	if c.cluster {
+		var targets []string
+		c.forEachMember(func(m *Client) { targets = append(targets, m.heartbeatTargets()...) })
+		return targets
+	}
+
+	if c.delivery == DeliveryKafka {
+		return nil
+	}
+	return []string{net.JoinHostPort(c.Addr, strconv.FormatInt(int64(c.Port), 10))}
+}
+
+func (c *Client) sendHeartbeat(agentID string) {
+	data, err := encodeHeartbeat(&Heartbeat{
+		AgentID:          agentID,
+		FlowQueueDepth:   c.QueueDepth(),
+		FlowQueueDropped: c.Dropped(),
+		Unacked:          c.Unacked(),
+	})
+	if err != nil {
+		logging.GetLogger().Errorf("Unable to encode heartbeat: %s", err.Error())
+		return
+	}
+
+	for _, target := range c.heartbeatTargets() {
+		conn, err := net.Dial("udp", target)
+		if err != nil {
+			logging.GetLogger().Debugf("Unable to send heartbeat to analyzer %s: %s", target, err.Error())
+			continue
+		}
+
+		if _, err := conn.Write(data); err != nil {
+			logging.GetLogger().Debugf("Unable to send heartbeat to analyzer %s: %s", target, err.Error())
+		}
+		conn.Close()
+	}
+}
+
+// StartHeartbeat sends a heartbeat identifying the agent to the analyzers
+// every interval, until StopHeartbeat is called
+func (c *Client) StartHeartbeat(agentID string, interval time.Duration) {
+	c.heartbeatQuit = make(chan bool)
+
+	go func(quit chan bool) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		c.sendHeartbeat(agentID)
+		for {
+			select {
+			case <-ticker.C:
+				c.sendHeartbeat(agentID)
+			case <-quit:
+				return
+			}
+		}
+	}(c.heartbeatQuit)
+}
+
+func (c *Client) StopHeartbeat() {
+	if c.heartbeatQuit != nil {
+		close(c.heartbeatQuit)
+		c.heartbeatQuit = nil
+	}
+}
+
+type agentStatusSlice []AgentStatus
+
+func (s agentStatusSlice) Len() int           { return len(s) }
+func (s agentStatusSlice) Less(i, j int) bool { return s[i].AgentID < s[j].AgentID }
+func (s agentStatusSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// agentTracker keeps the last heartbeat of the agents. The heartbeats not
+// being authenticated, the agents down for forgetTimeout are forgotten and
+// at most maxAgents agents are tracked.
+type agentTracker struct {
+	sync.RWMutex
+	staleTimeout  time.Duration
+	forgetTimeout time.Duration
+	maxAgents     int
+	agents        map[string]*AgentStatus
+}
+
+// makeRoom forgets the agent down for the longest time to track a new one,
+// it returns false if all the agents are alive
+func (t *agentTracker) makeRoom() bool {
+	var oldest *AgentStatus
+	for _, status := range t.agents {
+		if !status.Alive && (oldest == nil || status.LastSeen.Before(oldest.LastSeen)) {
+			oldest = status
+		}
+	}
+
+	if oldest == nil {
+		return false
+	}
+	delete(t.agents, oldest.AgentID)
+	return true
+}
+
+func (t *agentTracker) seen(hb *Heartbeat, addr string, now time.Time) {
+	t.Lock()
+	defer t.Unlock()
+
+	status, ok := t.agents[hb.AgentID]
+	if !ok {
+		if t.maxAgents > 0 && len(t.agents) >= t.maxAgents && !t.makeRoom() {
+			logging.GetLogger().Warningf("Heartbeat of agent %s from %s ignored, %d agents already tracked", hb.AgentID, addr, len(t.agents))
+			return
+		}
+
+		logging.GetLogger().Infof("Agent %s seen from %s", hb.AgentID, addr)
+		status = &AgentStatus{}
+		t.agents[hb.AgentID] = status
+	} else if !status.Alive {
+		logging.GetLogger().Infof("Agent %s is up again, seen from %s", hb.AgentID, addr)
+	}
+
+	status.Heartbeat = *hb
+	status.Address = addr
+	status.LastSeen = now
+	status.Alive = true
+}
+
+// expire marks down the agents without heartbeat within the stale timeout
+// and forgets the ones without heartbeat within the forget timeout
+func (t *agentTracker) expire(now time.Time) {
+	t.Lock()
+	defer t.Unlock()
+
+	for id, status := range t.agents {
+		if status.Alive && now.Sub(status.LastSeen) > t.staleTimeout {
+			logging.GetLogger().Warningf("Agent %s is down, no heartbeat since %s", id, status.LastSeen)
+			status.Alive = false
+		}
+
+		if !status.Alive && now.Sub(status.LastSeen) > t.forgetTimeout {
+			logging.GetLogger().Infof("Agent %s forgotten, no heartbeat since %s", id, status.LastSeen)
+			delete(t.agents, id)
+		}
+	}
+}
+
+// statuses returns the status of the agents, sorted by ID
+func (t *agentTracker) statuses() []AgentStatus {
+	t.RLock()
+	defer t.RUnlock()
+
+	statuses := make([]AgentStatus, 0, len(t.agents))
+	for _, status := range t.agents {
+		statuses = append(statuses, *status)
+	}
+	sort.Sort(agentStatusSlice(statuses))
+
+	return statuses
+}
+
+func (t *agentTracker) serveAgents(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(t.statuses()); err != nil {
+		logging.GetLogger().Criticalf("Failed to display agent statuses: %s", err.Error())
+	}
+}
+
+func newAgentTracker(staleTimeout time.Duration, forgetTimeout time.Duration, maxAgents int) *agentTracker {
+	return &agentTracker{
+		staleTimeout:  staleTimeout,
+		forgetTimeout: forgetTimeout,
+		maxAgents:     maxAgents,
+		agents:        make(map[string]*AgentStatus),
+	}
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package analyzer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHeartbeat(t *testing.T) {
+	conn, addr := listenAnalyzer(t)
+	defer conn.Close()
+
+	client, err := newClusterClient([]string{addr}, 10, DeliveryFireAndForget, time.Second, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.StartHeartbeat("agent-1", time.Hour)
+	defer client.StopHeartbeat()
+
+	// the first heartbeat is sent right away
+	data := make([]byte, maxDatagramSize)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, from, err := conn.ReadFromUDP(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hb, err := decodeHeartbeat(data[:n])
+	if err != nil || hb.AgentID != "agent-1" {
+		t.Fatalf("Wrong heartbeat received: %v, %v", hb, err)
+	}
+
+	tracker := newAgentTracker(30*time.Second, time.Hour, 10)
+	now := time.Now()
+	tracker.seen(hb, from.IP.String(), now)
+
+	tracker.expire(now.Add(10 * time.Second))
+	if statuses := tracker.statuses(); len(statuses) != 1 || !statuses[0].Alive || statuses[0].Address != "127.0.0.1" {
+		t.Errorf("Expected the agent to be alive: %+v", statuses)
+	}
+
+	tracker.expire(now.Add(time.Minute))
+	if statuses := tracker.statuses(); len(statuses) != 1 || statuses[0].Alive {
+		t.Errorf("Expected the agent to be down: %+v", statuses)
+	}
+
+	tracker.seen(hb, "127.0.0.1", now.Add(time.Minute))
+	if statuses := tracker.statuses(); !statuses[0].Alive {
+		t.Errorf("Expected the agent to be up again: %+v", statuses)
+	}
+
+	if _, err := decodeHeartbeat(append(heartbeatMagic, []byte(`{}`)...)); err == nil {
+		t.Error("Expected a heartbeat without agent ID to be refused")
+	}
+}
+
+func TestAgentTrackerLimits(t *testing.T) {
+	tracker := newAgentTracker(30*time.Second, time.Hour, 2)
+	now := time.Now()
+
+	tracker.seen(&Heartbeat{AgentID: "agent-1"}, "127.0.0.1", now)
+	tracker.seen(&Heartbeat{AgentID: "agent-2"}, "127.0.0.1", now.Add(time.Second))
+
+	// the agents alive are never replaced
+	tracker.seen(&Heartbeat{AgentID: "agent-3"}, "127.0.0.1", now)
+	if statuses := tracker.statuses(); len(statuses) != 2 || statuses[1].AgentID != "agent-2" {
+		t.Fatalf("Expected the new agent to be ignored: %+v", statuses)
+	}
+
+	// the agent down for the longest time is replaced
+	tracker.expire(now.Add(time.Minute))
+	tracker.seen(&Heartbeat{AgentID: "agent-3"}, "127.0.0.1", now.Add(time.Minute))
+	if statuses := tracker.statuses(); len(statuses) != 2 || statuses[0].AgentID != "agent-2" || statuses[1].AgentID != "agent-3" {
+		t.Fatalf("Expected the oldest agent down to be replaced: %+v", statuses)
+	}
+
+	tracker.expire(now.Add(2 * time.Hour))
+	if statuses := tracker.statuses(); len(statuses) != 0 {
+		t.Errorf("Expected the agents down to be forgotten: %+v", statuses)
+	}
+}
@@ -0,0 +1,234 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+package analyzer
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+
+	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/flow"
+	"github.com/redhat-cip/skydive/logging"
+)
+
+// Flows are exchanged over Kafka as their protobuf encoding, one flow per
+// message keyed by the flow UUID so that the updates of a flow land in the
+// same partition and are consumed in order.
+
+// delay between two connections to unreachable brokers
+const kafkaRetryPeriod = 5 * time.Second
+
+func newKafkaProducer(brokers []string) (sarama.AsyncProducer, error) {
+	cfg := sarama.NewConfig()
+	cfg.ClientID = "skydive-agent"
+	cfg.Producer.Return.Errors = true
+	return sarama.NewAsyncProducer(brokers, cfg)
+}
+
+func newKafkaConsumer(brokers []string) (sarama.Consumer, error) {
+	cfg := sarama.NewConfig()
+	cfg.ClientID = "skydive-analyzer"
+	return sarama.NewConsumer(brokers, cfg)
+}
+
+// runKafka publishes the queued flows to the flow topic. The brokers are
+// connected to in the background, the flows keep being queued meanwhile.
+func (c *Client) runKafka() {
+	var producer sarama.AsyncProducer
+	for !c.isClosed() {
+		var err error
+		if producer, err = c.newKafkaProducer(c.kafkaBrokers); err == nil {
+			break
+		}
+		logging.GetLogger().Errorf("Unable to connect to Kafka brokers %v, retrying in %v: %s", c.kafkaBrokers, kafkaRetryPeriod, err.Error())
+		time.Sleep(kafkaRetryPeriod)
+	}
+	if producer == nil {
+		return
+	}
+	defer producer.AsyncClose()
+
+	go func() {
+		for err := range producer.Errors() {
+			logging.GetLogger().Errorf("Unable to publish flow to Kafka topic %s: %s", c.kafkaTopic, err.Error())
+		}
+	}()
+
+	for f := range c.queue {
+		data, err := f.GetData()
+		if err != nil {
+			logging.GetLogger().Errorf("Unable to send flow: %s", err.Error())
+			continue
+		}
+
+		producer.Input() <- &sarama.ProducerMessage{
+			Topic: c.kafkaTopic,
+			Key:   sarama.StringEncoder(f.UUID),
+			Value: sarama.ByteEncoder(data),
+		}
+	}
+}
+
+func newKafkaClient(brokers []string, topic string, queueSize int, newProducer func(brokers []string) (sarama.AsyncProducer, error)) *Client {
+	client := &Client{
+		queue:            make(chan *flow.Flow, queueSize),
+		delivery:         DeliveryKafka,
+		kafkaBrokers:     brokers,
+		kafkaTopic:       topic,
+		newKafkaProducer: newProducer,
+	}
+
+	go client.runKafka()
+
+	return client
+}
+
+// NewKafkaClient returns a client publishing the flows to a Kafka topic
+// instead of sending them to an analyzer
+func NewKafkaClient(brokers []string, topic string, queueSize int) *Client {
+	return newKafkaClient(brokers, topic, queueSize, newKafkaProducer)
+}
+
+// kafkaFlowSource consumes the flows published by the agents on all the
+// partitions of the flow topic, starting from the newest offsets. The
+// partitions are listed once connected, the ones added later are ignored
+// until the analyzer restarts.
+type kafkaFlowSource struct {
+	brokers     []string
+	topic       string
+	handle      func(f *flow.Flow)
+	quit        chan struct{}
+	wg          sync.WaitGroup
+	newConsumer func(brokers []string) (sarama.Consumer, error)
+}
+
+func (k *kafkaFlowSource) connect() (sarama.Consumer, []sarama.PartitionConsumer) {
+	for {
+		consumer, err := k.newConsumer(k.brokers)
+		if err == nil {
+			var partitions []int32
+			if partitions, err = consumer.Partitions(k.topic); err == nil {
+				var pcs []sarama.PartitionConsumer
+				for _, p := range partitions {
+					var pc sarama.PartitionConsumer
+					if pc, err = consumer.ConsumePartition(k.topic, p, sarama.OffsetNewest); err != nil {
+						break
+					}
+					pcs = append(pcs, pc)
+				}
+				if err == nil {
+					return consumer, pcs
+				}
+
+				for _, pc := range pcs {
+					pc.Close()
+				}
+			}
+			consumer.Close()
+		}
+
+		logging.GetLogger().Errorf("Unable to consume Kafka topic %s from %v, retrying in %v: %s", k.topic, k.brokers, kafkaRetryPeriod, err.Error())
+
+		select {
+		case <-k.quit:
+			return nil, nil
+		case <-time.After(kafkaRetryPeriod):
+		}
+	}
+}
+
+func (k *kafkaFlowSource) consume(pc sarama.PartitionConsumer) {
+	defer k.wg.Done()
+	defer pc.Close()
+
+	for {
+		select {
+		case msg, ok := <-pc.Messages():
+			if !ok {
+				return
+			}
+
+			f, err := flow.FromData(msg.Value)
+			if err != nil {
+				logging.GetLogger().Errorf("Unable to decode flow from Kafka topic %s: %s", k.topic, err.Error())
+				continue
+			}
+			k.handle(f)
+		case <-k.quit:
+			return
+		}
+	}
+}
+
+func (k *kafkaFlowSource) run() {
+	defer k.wg.Done()
+
+	consumer, pcs := k.connect()
+	if consumer == nil {
+		return
+	}
+
+	logging.GetLogger().Infof("Consuming flows from Kafka topic %s, %d partitions", k.topic, len(pcs))
+
+	k.wg.Add(len(pcs))
+	for _, pc := range pcs {
+		go k.consume(pc)
+	}
+
+	<-k.quit
+	consumer.Close()
+}
+
+func (k *kafkaFlowSource) start() {
+	k.wg.Add(1)
+	go k.run()
+}
+
+func (k *kafkaFlowSource) stop() {
+	close(k.quit)
+	k.wg.Wait()
+}
+
+func newKafkaFlowSource(brokers []string, topic string, handle func(f *flow.Flow)) *kafkaFlowSource {
+	return &kafkaFlowSource{
+		brokers:     brokers,
+		topic:       topic,
+		handle:      handle,
+		quit:        make(chan struct{}),
+		newConsumer: newKafkaConsumer,
+	}
+}
+
+// newKafkaFlowSourceFromConfig returns the source of the flows published to
+// flow.kafka_topic, nil when no flow.kafka_brokers is configured
+func newKafkaFlowSourceFromConfig(handle func(f *flow.Flow)) *kafkaFlowSource {
+	cfg := config.GetConfig()
+
+	brokers := cfg.GetStringSlice("flow.kafka_brokers")
+	if len(brokers) == 0 {
+		return nil
+	}
+
+	return newKafkaFlowSource(brokers, cfg.GetString("flow.kafka_topic"), handle)
+}
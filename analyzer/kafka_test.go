@@ -0,0 +1,186 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+package analyzer
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+
+	"github.com/redhat-cip/skydive/flow"
+)
+
+type fakeProducer struct {
+	sarama.AsyncProducer
+	input  chan *sarama.ProducerMessage
+	errors chan *sarama.ProducerError
+}
+
+func (p *fakeProducer) Input() chan<- *sarama.ProducerMessage {
+	return p.input
+}
+
+func (p *fakeProducer) Errors() <-chan *sarama.ProducerError {
+	return p.errors
+}
+
+func (p *fakeProducer) AsyncClose() {
+	close(p.errors)
+}
+
+type fakeConsumer struct {
+	sarama.Consumer
+	partitions map[int32]*fakePartitionConsumer
+	closed     chan bool
+}
+
+func (c *fakeConsumer) Partitions(topic string) ([]int32, error) {
+	var partitions []int32
+	for p := range c.partitions {
+		partitions = append(partitions, p)
+	}
+	return partitions, nil
+}
+
+func (c *fakeConsumer) ConsumePartition(topic string, partition int32, offset int64) (sarama.PartitionConsumer, error) {
+	return c.partitions[partition], nil
+}
+
+func (c *fakeConsumer) Close() error {
+	close(c.closed)
+	return nil
+}
+
+type fakePartitionConsumer struct {
+	sarama.PartitionConsumer
+	messages chan *sarama.ConsumerMessage
+}
+
+func (pc *fakePartitionConsumer) Messages() <-chan *sarama.ConsumerMessage {
+	return pc.messages
+}
+
+func (pc *fakePartitionConsumer) Close() error {
+	return nil
+}
+
+func TestKafkaFlows(t *testing.T) {
+	producer := &fakeProducer{
+		input:  make(chan *sarama.ProducerMessage),
+		errors: make(chan *sarama.ProducerError),
+	}
+
+	client := newKafkaClient([]string{"127.0.0.1:9092"}, "flows", 10, func(brokers []string) (sarama.AsyncProducer, error) {
+		return producer, nil
+	})
+	defer client.close()
+
+	consumer := &fakeConsumer{
+		partitions: map[int32]*fakePartitionConsumer{
+			0: {messages: make(chan *sarama.ConsumerMessage)},
+			1: {messages: make(chan *sarama.ConsumerMessage)},
+		},
+		closed: make(chan bool),
+	}
+
+	received := make(chan *flow.Flow, 10)
+	source := newKafkaFlowSource([]string{"127.0.0.1:9092"}, "flows", func(f *flow.Flow) {
+		received <- f
+	})
+	source.newConsumer = func(brokers []string) (sarama.Consumer, error) {
+		return consumer, nil
+	}
+	source.start()
+
+	if err := client.SendFlow(&flow.Flow{UUID: "flow-1", LayersPath: "Ethernet/IPv4/UDP"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var m *sarama.ProducerMessage
+	select {
+	case m = <-producer.input:
+	case <-time.After(5 * time.Second):
+		t.Fatal("flow not published")
+	}
+
+	if m.Topic != "flows" {
+		t.Errorf("flow published to %s instead of flows", m.Topic)
+	}
+	if key, _ := m.Key.Encode(); string(key) != "flow-1" {
+		t.Errorf("expected the flow UUID as key, got %s", string(key))
+	}
+
+	// a message not being a flow is skipped
+	consumer.partitions[1].messages <- &sarama.ConsumerMessage{Value: []byte("garbage")}
+
+	value, _ := m.Value.Encode()
+	consumer.partitions[1].messages <- &sarama.ConsumerMessage{Value: value}
+
+	select {
+	case f := <-received:
+		if f.UUID != "flow-1" || f.LayersPath != "Ethernet/IPv4/UDP" {
+			t.Errorf("unexpected flow consumed: %v", f)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("flow not consumed")
+	}
+
+	source.stop()
+
+	select {
+	case <-consumer.closed:
+	default:
+		t.Error("consumer not closed once stopped")
+	}
+}
+
+func TestKafkaFlowSourceRetry(t *testing.T) {
+	source := newKafkaFlowSource([]string{"127.0.0.1:9092"}, "flows", func(f *flow.Flow) {})
+
+	attempts := make(chan bool, 1)
+	source.newConsumer = func(brokers []string) (sarama.Consumer, error) {
+		attempts <- true
+		return nil, errors.New("unreachable")
+	}
+	source.start()
+
+	select {
+	case <-attempts:
+	case <-time.After(5 * time.Second):
+		t.Fatal("brokers not connected to")
+	}
+
+	// stopping doesn't wait for the next connection attempt
+	stopped := make(chan bool)
+	go func() {
+		source.stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("source not stopped while retrying")
+	}
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package analyzer
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FlowRateLimiter is a token bucket limiting the number of flows accepted per
+// second. A rate of 0 means unlimited.
+type FlowRateLimiter struct {
+	sync.Mutex
+	rate    int
+	tokens  float64
+	last    time.Time
+	dropped uint64
+}
+
+func (l *FlowRateLimiter) SetRate(rate int) {
+	l.Lock()
+	defer l.Unlock()
+
+	if rate == l.rate {
+		return
+	}
+
+	l.rate = rate
+	if l.tokens > float64(rate) {
+		l.tokens = float64(rate)
+	}
+}
+
+func (l *FlowRateLimiter) Rate() int {
+	l.Lock()
+	defer l.Unlock()
+
+	return l.rate
+}
+
+// Allow returns whether a flow can be accepted, otherwise the flow is counted
+// as dropped
+func (l *FlowRateLimiter) Allow() bool {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.rate <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	if l.tokens > float64(l.rate) {
+		l.tokens = float64(l.rate)
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		atomic.AddUint64(&l.dropped, 1)
+		return false
+	}
+	l.tokens--
+
+	return true
+}
+
+func (l *FlowRateLimiter) Dropped() uint64 {
+	return atomic.LoadUint64(&l.dropped)
+}
+
+func NewFlowRateLimiter(rate int) *FlowRateLimiter {
+	return &FlowRateLimiter{
+		rate:   rate,
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
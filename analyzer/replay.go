@@ -0,0 +1,101 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package analyzer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/redhat-cip/skydive/flow"
+	"github.com/redhat-cip/skydive/flow/mappings"
+	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/storage"
+)
+
+const replayBatchSize = 100
+
+// number of seconds a storage being started is waited for
+const replayStoreRetries = 30
+
+func storeReplayed(s storage.Storage, flows []*flow.Flow) error {
+	for i := 0; ; i++ {
+		err := s.StoreFlows(flows)
+		if err == nil || i == replayStoreRetries {
+			return err
+		}
+		logging.GetLogger().Debugf("Unable to store replayed flows, retrying: %s", err.Error())
+		time.Sleep(time.Second)
+	}
+}
+
+// ReplayFlows stores the flows read from r, one JSON flow per line like in
+// the deadletter file, enhancing them first if a pipeline is given. The
+// number of flows stored is returned.
+func ReplayFlows(r io.Reader, s storage.Storage, pipeline *mappings.FlowMappingPipeline) (int, error) {
+	var flows []*flow.Flow
+	count := 0
+
+	flush := func() error {
+		if len(flows) == 0 {
+			return nil
+		}
+		if pipeline != nil {
+			pipeline.Enhance(flows)
+		}
+		if err := storeReplayed(s, flows); err != nil {
+			return err
+		}
+		count += len(flows)
+		flows = nil
+		return nil
+	}
+
+	reader := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return count, err
+		}
+
+		if data = bytes.TrimSpace(data); len(data) > 0 {
+			f := new(flow.Flow)
+			if err := json.Unmarshal(data, f); err != nil {
+				return count, fmt.Errorf("invalid flow at line %d: %s", line, err.Error())
+			}
+
+			if flows = append(flows, f); len(flows) == replayBatchSize {
+				if err := flush(); err != nil {
+					return count, err
+				}
+			}
+		}
+
+		if err == io.EOF {
+			return count, flush()
+		}
+	}
+}
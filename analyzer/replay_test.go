@@ -0,0 +1,88 @@
+/*
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package analyzer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/flow"
+	"github.com/redhat-cip/skydive/storage"
+)
+
+type fakeStorage struct {
+	storage.Storage
+	batches [][]*flow.Flow
+}
+
+func (s *fakeStorage) StoreFlows(flows []*flow.Flow) error {
+	s.batches = append(s.batches, flows)
+	return nil
+}
+
+func TestReplayFlows(t *testing.T) {
+	var buf bytes.Buffer
+	for i := 0; i != replayBatchSize+1; i++ {
+		data, err := json.Marshal(&flow.Flow{UUID: fmt.Sprintf("flow-%d", i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf.Write(data)
+		buf.WriteString("\n\n")
+	}
+
+	s := &fakeStorage{}
+	count, err := ReplayFlows(&buf, s, nil)
+	if err != nil || count != replayBatchSize+1 {
+		t.Fatalf("Wrong replayed flows %d: %v", count, err)
+	}
+
+	if len(s.batches) != 2 || len(s.batches[1]) != 1 || s.batches[1][0].UUID != fmt.Sprintf("flow-%d", replayBatchSize) {
+		t.Errorf("Wrong stored batches: %v", s.batches)
+	}
+
+	s = &fakeStorage{}
+	count, err = ReplayFlows(strings.NewReader("{\"UUID\":\"flow-1\"}\nnot a flow\n"), s, nil)
+	if err == nil || !strings.Contains(err.Error(), "line 2") || count != 0 || len(s.batches) != 0 {
+		t.Errorf("Invalid line should stop the replay: %d, %v", count, err)
+	}
+}
+
+func TestNoStorage(t *testing.T) {
+	cfg := config.GetConfig()
+	cfg.Set("analyzer.storage", "elasticsearch")
+	cfg.Set("analyzer.no_storage", true)
+	defer func() {
+		cfg.Set("analyzer.storage", "")
+		cfg.Set("analyzer.no_storage", false)
+	}()
+
+	// no connection attempted to elasticsearch
+	if s, err := NewStorageFromConfig(); s != nil || err != nil {
+		t.Errorf("Expected no storage, got %v: %v", s, err)
+	}
+}
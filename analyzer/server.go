@@ -23,6 +23,7 @@
 package analyzer
 
 import (
+	"fmt"
 	"net"
 	"net/http"
 	"os"
@@ -31,6 +32,8 @@ import (
 	"sync/atomic"
 	"time"
 
+	"google.golang.org/grpc"
+
 	"github.com/redhat-cip/skydive/api"
 	"github.com/redhat-cip/skydive/config"
 	"github.com/redhat-cip/skydive/flow"
@@ -52,11 +55,23 @@ type Server struct {
 	FlowMappingPipeline *mappings.FlowMappingPipeline
 	Storage             storage.Storage
 	FlowTable           *flow.Table
+	FlowRateLimiter     *FlowRateLimiter
+	flowWorkers         *flowWorkerPool
 	conn                *net.UDPConn
+	grpcListener        net.Listener
+	grpcServer          *grpc.Server
+	kafkaSource         *kafkaFlowSource
 	EmbeddedEtcd        *etcd.EmbeddedEtcd
 	EtcdClient          *etcd.EtcdClient
 	running             atomic.Value
 	wgServers           sync.WaitGroup
+
+	// address of the flow ingestion, UDP and gRPC
+	flowAddr string
+	flowPort int
+
+	// liveness of the agents sending heartbeats
+	agents *agentTracker
 }
 
 func (s *Server) flowExpireUpdate(flows []*flow.Flow) {
@@ -66,6 +81,13 @@ func (s *Server) flowExpireUpdate(flows []*flow.Flow) {
 	}
 }
 
+func (s *Server) flowMetrics(metrics []*flow.FlowMetric) {
+	if s.Storage != nil {
+		s.Storage.StoreMetrics(metrics)
+		logging.GetLogger().Debugf("%d flow metrics stored", len(metrics))
+	}
+}
+
 func (s *Server) AnalyzeFlows(flows []*flow.Flow) {
 	s.FlowTable.Update(flows)
 	s.FlowMappingPipeline.Enhance(flows)
@@ -75,10 +97,10 @@ func (s *Server) AnalyzeFlows(flows []*flow.Flow) {
 
 func (s *Server) handleUDPFlowPacket() {
 	s.conn.SetDeadline(time.Now().Add(200 * time.Millisecond))
-	data := make([]byte, 4096)
+	data := make([]byte, maxDatagramSize)
 
 	for s.running.Load() == true {
-		n, _, err := s.conn.ReadFromUDP(data)
+		n, addr, err := s.conn.ReadFromUDP(data)
 		if err != nil {
 			if err.(net.Error).Timeout() == true {
 				s.conn.SetDeadline(time.Now().Add(200 * time.Millisecond))
@@ -91,23 +113,123 @@ func (s *Server) handleUDPFlowPacket() {
 			return
 		}
 
+		if isFlowBatch(data[0:n]) {
+			s.handleFlowBatch(data[0:n], addr)
+			continue
+		}
+
+		if isHeartbeat(data[0:n]) {
+			s.handleHeartbeat(data[0:n], addr)
+			continue
+		}
+
+		if !s.FlowRateLimiter.Allow() {
+			continue
+		}
+
 		f, err := flow.FromData(data[0:n])
 		if err != nil {
 			logging.GetLogger().Errorf("Error while parsing flow: %s", err.Error())
+			continue
 		}
 
-		s.AnalyzeFlows([]*flow.Flow{f})
+		s.flowWorkers.Dispatch([]*flow.Flow{f})
+	}
+}
+
+// handleFlowBatch analyzes the flows of a batch sent in ack mode and
+// acknowledges it. The flows refused by the rate limiter are dropped as in
+// fire-and-forget mode, the batch is acknowledged anyway so that the agent
+// doesn't send again the flows already analyzed.
+func (s *Server) handleFlowBatch(data []byte, addr *net.UDPAddr) {
+	id, flows, err := decodeFlowBatch(data)
+	if err != nil {
+		logging.GetLogger().Errorf("Error while parsing flow batch: %s", err.Error())
+		return
+	}
+
+	allowed := make([]*flow.Flow, 0, len(flows))
+	for _, f := range flows {
+		if s.FlowRateLimiter.Allow() {
+			allowed = append(allowed, f)
+		}
+	}
+
+	if len(allowed) > 0 {
+		s.flowWorkers.Dispatch(allowed)
+	}
+
+	if _, err := s.conn.WriteToUDP(encodeAck(id), addr); err != nil {
+		logging.GetLogger().Errorf("Unable to acknowledge flow batch %d: %s", id, err.Error())
+	}
+}
+
+// handleHeartbeat records the heartbeat of an agent, not subject to the rate
+// limiter so that busy agents are not marked down
+func (s *Server) handleHeartbeat(data []byte, addr *net.UDPAddr) {
+	hb, err := decodeHeartbeat(data)
+	if err != nil {
+		logging.GetLogger().Errorf("Error while parsing heartbeat: %s", err.Error())
+		return
+	}
+
+	s.agents.seen(hb, addr.IP.String(), time.Now())
+}
+
+// handleKafkaFlow analyzes a flow consumed from Kafka, dropped like the ones
+// received over UDP when refused by the rate limiter
+func (s *Server) handleKafkaFlow(f *flow.Flow) {
+	if s.FlowRateLimiter.Allow() {
+		s.flowWorkers.Dispatch([]*flow.Flow{f})
+	}
+}
+
+// applyRateLimitConfig updates the flow rate limit from the configuration so
+// that the limit can be changed by reloading the configuration
+func (s *Server) applyRateLimitConfig() {
+	rate := config.GetConfig().GetInt("analyzer.max_flows_per_second")
+	if rate != s.FlowRateLimiter.Rate() {
+		logging.GetLogger().Infof("Flow rate limit set to %d flows per second", rate)
+		s.FlowRateLimiter.SetRate(rate)
+	}
+}
+
+// applyFlowTableConfig updates the flow table expire and update periods
+// from the configuration, the flows already in the table are kept
+func (s *Server) applyFlowTableConfig() {
+	expire := time.Duration(config.GetConfig().GetInt("analyzer.flowtable_expire")) * time.Second
+	if expire > 0 && expire != s.FlowTable.AggregationWindow() {
+		logging.GetLogger().Infof("Flow table expire set to %v", expire)
+		s.FlowTable.SetExpireDuration(expire)
+	}
+
+	update := time.Duration(config.GetConfig().GetInt("analyzer.flowtable_update")) * time.Second
+	if update > 0 && update != s.FlowTable.UpdatedDuration() {
+		logging.GetLogger().Infof("Flow table update set to %v", update)
+		s.FlowTable.SetUpdatedDuration(update)
 	}
 }
 
 func (s *Server) asyncFlowTableExpireUpdated() {
+	ticker := time.NewTicker(time.Second * 1)
+	defer ticker.Stop()
+
+	var dropped uint64
 	for s.running.Load() == true {
 		select {
 		case now := <-s.FlowTable.GetExpireTicker():
 			s.FlowTable.Expire(now)
 		case now := <-s.FlowTable.GetUpdatedTicker():
 			s.FlowTable.Updated(now)
-		case <-time.After(time.Second * 1):
+		case now := <-ticker.C:
+			s.applyRateLimitConfig()
+			s.applyFlowTableConfig()
+			s.agents.expire(now)
+
+			if d := s.FlowRateLimiter.Dropped(); d != dropped {
+				logging.GetLogger().Warningf("%d flows dropped by the rate limiter", d-dropped)
+				dropped = d
+			}
 		}
 	}
 }
@@ -120,6 +242,7 @@ func (s *Server) ListenAndServe() {
 	}
 
 	s.AlertServer.AlertManager.Start()
+	s.flowWorkers.Start()
 
 	s.wgServers.Add(4)
 	go func() {
@@ -135,7 +258,7 @@ func (s *Server) ListenAndServe() {
 	go func() {
 		defer s.wgServers.Done()
 
-		host := s.HTTPServer.Addr + ":" + strconv.FormatInt(int64(s.HTTPServer.Port), 10)
+		host := net.JoinHostPort(s.flowAddr, strconv.FormatInt(int64(s.flowPort), 10))
 		addr, err := net.ResolveUDPAddr("udp", host)
 		s.conn, err = net.ListenUDP("udp", addr)
 		if err != nil {
@@ -150,6 +273,22 @@ func (s *Server) ListenAndServe() {
 		defer s.wgServers.Done()
 		s.asyncFlowTableExpireUpdated()
 	}()
+
+	if s.grpcListener != nil {
+		s.grpcServer = grpc.NewServer()
+		RegisterFlowServiceServer(s.grpcServer, &flowServer{server: s})
+
+		s.wgServers.Add(1)
+		go func() {
+			defer s.wgServers.Done()
+			s.grpcServer.Serve(s.grpcListener)
+		}()
+	}
+
+	s.kafkaSource = newKafkaFlowSourceFromConfig(s.handleKafkaFlow)
+	if s.kafkaSource != nil {
+		s.kafkaSource.start()
+	}
 }
 
 func (s *Server) Stop() {
@@ -157,6 +296,11 @@ func (s *Server) Stop() {
 	s.FlowTable.UnregisterAll()
 	s.WSServer.Stop()
 	s.HTTPServer.Stop()
+	if s.grpcServer != nil {
+		s.grpcServer.Stop()
+	} else if s.grpcListener != nil {
+		s.grpcListener.Close()
+	}
 	if s.EmbeddedEtcd != nil {
 		s.EmbeddedEtcd.Stop()
 	}
@@ -165,7 +309,11 @@ func (s *Server) Stop() {
 	}
 	s.AlertServer.AlertManager.Stop()
 	s.EtcdClient.Stop()
+	if s.kafkaSource != nil {
+		s.kafkaSource.stop()
+	}
 	s.wgServers.Wait()
+	s.flowWorkers.Stop()
 	if tr, ok := http.DefaultTransport.(interface {
 		CloseIdleConnections()
 	}); ok {
@@ -175,27 +323,50 @@ func (s *Server) Stop() {
 
 func (s *Server) Flush() {
 	logging.GetLogger().Critical("Flush() MUST be called for testing purpose only, not in production")
+	s.flowWorkers.Wait()
 	s.FlowTable.ExpireNow()
 }
 
 func (s *Server) SetStorage(storage storage.Storage) {
 	s.Storage = storage
+	if s.AlertServer != nil {
+		s.AlertServer.AlertManager.Storage = storage
+	}
 }
 
-func (s *Server) SetStorageFromConfig() {
-	if t := config.GetConfig().GetString("analyzer.storage"); t != "" {
-		switch t {
-		case "elasticsearch":
-			storage, err := elasticseach.New()
-			if err != nil {
-				logging.GetLogger().Fatalf("Can't connect to ElasticSearch server: %v", err)
-			}
-			s.SetStorage(storage)
-		default:
-			logging.GetLogger().Fatalf("Storage type unknown: %s", t)
-			os.Exit(1)
+// NewStorageFromConfig returns the storage of analyzer.storage, nil if no
+// storage is configured or if analyzer.no_storage disables it
+func NewStorageFromConfig() (storage.Storage, error) {
+	if config.GetConfig().GetBool("analyzer.no_storage") {
+		return nil, nil
+	}
+
+	switch t := config.GetConfig().GetString("analyzer.storage"); t {
+	case "":
+		return nil, nil
+	case "elasticsearch":
+		storage, err := elasticseach.New()
+		if err != nil {
+			return nil, fmt.Errorf("Can't connect to ElasticSearch server: %v", err)
 		}
-		logging.GetLogger().Infof("Using %s as storage", t)
+		return storage, nil
+	default:
+		return nil, fmt.Errorf("Storage type unknown: %s", t)
+	}
+}
+
+func (s *Server) SetStorageFromConfig() {
+	storage, err := NewStorageFromConfig()
+	if err != nil {
+		logging.GetLogger().Fatalf("%s", err.Error())
+		os.Exit(1)
+	}
+
+	if storage != nil {
+		s.SetStorage(storage)
+		logging.GetLogger().Infof("Using %s as storage", config.GetConfig().GetString("analyzer.storage"))
+	} else if config.GetConfig().GetBool("analyzer.no_storage") {
+		logging.GetLogger().Warning("Storage disabled, the flows are not persisted")
 	}
 }
 
@@ -242,6 +413,7 @@ func NewServerFromConfig() (*Server, error) {
 		ResourceHandler: &api.CaptureHandler{},
 		EtcdKeyAPI:      etcdClient.KeysApi,
 	}
+	api.RegisterCaptureApi(captureHandler, g, httpServer)
 	err = apiServer.RegisterApiHandler(captureHandler)
 	if err != nil {
 		return nil, err
@@ -251,14 +423,26 @@ func NewServerFromConfig() (*Server, error) {
 		ResourceHandler: &api.AlertHandler{},
 		EtcdKeyAPI:      etcdClient.KeysApi,
 	}
-	err = apiServer.RegisterApiHandler(alertHandler)
+
+	alertManager, err := alert.NewAlertManager(g, alertHandler)
 	if err != nil {
 		return nil, err
 	}
 
-	alertManager := alert.NewAlertManager(g, alertHandler)
+	// the alerts created through the API are limited, like the ones of the
+	// alerts file and of the reconciliations
+	limitedAlertHandler := alert.NewLimitedAlertHandler(alertManager, config.GetConfig().GetInt("alert.max_count"))
 
+	// registered before the alert handler whose GET /api/alert/ prefix route
+	// would shadow /api/alert/export
 	aserver := alert.NewServer(alertManager, wsServer)
+	aserver.RegisterEvaluateApi(httpServer)
+
+	err = apiServer.RegisterApiHandler(limitedAlertHandler)
+	if err != nil {
+		return nil, err
+	}
+	api.RegisterAlertApi(limitedAlertHandler, httpServer)
 	gserver := graph.NewServer(g, wsServer)
 
 	gfe := mappings.NewGraphFlowEnhancer(g)
@@ -268,6 +452,15 @@ func NewServerFromConfig() (*Server, error) {
 
 	flowtable := flow.NewTable()
 
+	// the flows are received on the API address unless a dedicated one is
+	// configured
+	flowAddr, flowPort := httpServer.Addr, httpServer.Port
+	if config.GetConfig().GetString("analyzer.flow_listen") != "" {
+		if flowAddr, flowPort, err = config.GetHostPortAttributes("analyzer", "flow_listen"); err != nil {
+			return nil, fmt.Errorf("Configuration error: %s", err.Error())
+		}
+	}
+
 	server := &Server{
 		HTTPServer:          httpServer,
 		WSServer:            wsServer,
@@ -275,17 +468,45 @@ func NewServerFromConfig() (*Server, error) {
 		AlertServer:         aserver,
 		FlowMappingPipeline: pipeline,
 		FlowTable:           flowtable,
+		FlowRateLimiter:     NewFlowRateLimiter(config.GetConfig().GetInt("analyzer.max_flows_per_second")),
 		EmbeddedEtcd:        etcdServer,
 		EtcdClient:          etcdClient,
+		flowAddr:            flowAddr,
+		flowPort:            flowPort,
+		agents: newAgentTracker(
+			time.Duration(config.GetConfig().GetInt("analyzer.agent_stale_timeout"))*time.Second,
+			time.Duration(config.GetConfig().GetInt("analyzer.agent_forget_timeout"))*time.Second,
+			config.GetConfig().GetInt("analyzer.agent_max_count"),
+		),
 	}
+	server.flowWorkers = newFlowWorkerPool(config.GetConfig().GetInt("analyzer.workers"), server.AnalyzeFlows)
 	server.SetStorageFromConfig()
 
 	api.RegisterFlowApi("analyzer", flowtable, server.Storage, httpServer)
 
+	httpServer.RegisterRoutes([]shttp.Route{
+		{
+			"AgentStatus",
+			"GET",
+			"/api/agents",
+			server.agents.serveAgents,
+		},
+	})
+
 	cfgFlowtable_expire := config.GetConfig().GetInt("analyzer.flowtable_expire")
 	flowtable.RegisterExpire(server.flowExpireUpdate, time.Duration(cfgFlowtable_expire)*time.Second)
 	cfgFlowtable_update := config.GetConfig().GetInt("analyzer.flowtable_update")
 	flowtable.RegisterUpdated(server.flowExpireUpdate, time.Duration(cfgFlowtable_update)*time.Second)
+	flowtable.RegisterMetrics(server.flowMetrics)
+
+	// the gRPC service is opt-in, its port is bound here so that a port
+	// already in use is reported as a configuration error
+	if port := config.GetConfig().GetInt("analyzer.flow_grpc_port"); port > 0 {
+		host := net.JoinHostPort(flowAddr, strconv.Itoa(port))
+		if server.grpcListener, err = net.Listen("tcp", host); err != nil {
+			return nil, fmt.Errorf("Unable to listen for the gRPC flows on %s: %s", host, err.Error())
+		}
+	}
 
 	return server, nil
 }
@@ -0,0 +1,122 @@
+/*
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package analyzer
+
+import (
+	"hash/fnv"
+	"sync"
+
+	"github.com/redhat-cip/skydive/flow"
+)
+
+// number of flow batches waiting for a worker before the receivers block
+const flowWorkerQueueSize = 100
+
+// flowWorkerPool analyzes the received flows concurrently. The flows are
+// dispatched to the workers according to their UUID so that the updates of
+// a flow are always analyzed, in order, by the same worker.
+type flowWorkerPool struct {
+	queues  []chan []*flow.Flow
+	analyze func(flows []*flow.Flow)
+	quit    chan struct{}
+	pending sync.WaitGroup
+	workers sync.WaitGroup
+}
+
+func (p *flowWorkerPool) run(queue chan []*flow.Flow) {
+	defer p.workers.Done()
+
+	for {
+		select {
+		case flows := <-queue:
+			p.analyze(flows)
+			p.pending.Done()
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+func (p *flowWorkerPool) worker(f *flow.Flow) int {
+	h := fnv.New32a()
+	h.Write([]byte(f.UUID))
+	return int(h.Sum32() % uint32(len(p.queues)))
+}
+
+// Dispatch queues the flows to their workers, waiting for a worker if its
+// queue is full
+func (p *flowWorkerPool) Dispatch(flows []*flow.Flow) {
+	batches := make([][]*flow.Flow, len(p.queues))
+	for _, f := range flows {
+		i := p.worker(f)
+		batches[i] = append(batches[i], f)
+	}
+
+	for i, batch := range batches {
+		if len(batch) == 0 {
+			continue
+		}
+
+		p.pending.Add(1)
+		select {
+		case p.queues[i] <- batch:
+		case <-p.quit:
+			p.pending.Done()
+			return
+		}
+	}
+}
+
+// Wait waits for all the flows dispatched to be analyzed
+func (p *flowWorkerPool) Wait() {
+	p.pending.Wait()
+}
+
+func (p *flowWorkerPool) Start() {
+	for _, queue := range p.queues {
+		p.workers.Add(1)
+		go p.run(queue)
+	}
+}
+
+// Stop stops the workers, the flows still queued are dropped
+func (p *flowWorkerPool) Stop() {
+	close(p.quit)
+	p.workers.Wait()
+}
+
+func newFlowWorkerPool(workers int, analyze func(flows []*flow.Flow)) *flowWorkerPool {
+	if workers < 1 {
+		workers = 1
+	}
+
+	p := &flowWorkerPool{
+		queues:  make([]chan []*flow.Flow, workers),
+		analyze: analyze,
+		quit:    make(chan struct{}),
+	}
+	for i := range p.queues {
+		p.queues[i] = make(chan []*flow.Flow, flowWorkerQueueSize)
+	}
+	return p
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package analyzer
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/redhat-cip/skydive/flow"
+)
+
+func TestFlowWorkerPool(t *testing.T) {
+	var lock sync.Mutex
+	updates := make(map[string][]int64)
+
+	pool := newFlowWorkerPool(4, func(flows []*flow.Flow) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		for _, f := range flows {
+			updates[f.UUID] = append(updates[f.UUID], f.Statistics.Last)
+		}
+	})
+	pool.Start()
+	defer pool.Stop()
+
+	for i := int64(0); i != 50; i++ {
+		var flows []*flow.Flow
+		for j := 0; j != 20; j++ {
+			flows = append(flows, &flow.Flow{
+				UUID:       fmt.Sprintf("flow-%d", j),
+				Statistics: &flow.FlowStatistics{Last: i},
+			})
+		}
+		pool.Dispatch(flows)
+	}
+	pool.Wait()
+
+	if len(updates) != 20 {
+		t.Fatalf("Wrong number of flows analyzed: %d", len(updates))
+	}
+
+	for uuid, lasts := range updates {
+		if len(lasts) != 50 {
+			t.Fatalf("Wrong number of updates of %s: %d", uuid, len(lasts))
+		}
+		for i, last := range lasts {
+			if last != int64(i) {
+				t.Fatalf("Updates of %s analyzed out of order: %v", uuid, lasts)
+			}
+		}
+	}
+}
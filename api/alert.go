@@ -23,43 +23,102 @@
 package api
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"go/parser"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
-	"github.com/nu7hatch/gouuid"
+	"github.com/abbot/go-http-auth"
+
+	shttp "github.com/redhat-cip/skydive/http"
+	"github.com/redhat-cip/skydive/logging"
 )
 
 const (
 	FIXED = 1 + iota
 	THRESHOLD
+	AGGREGATE
+	FLOW
+)
+
+const (
+	INFO     = "info"
+	WARNING  = "warning"
+	CRITICAL = "critical"
 )
 
+// Alert Test is a go expression evaluated against the values of the selected
+// nodes, where the helpers contains, hasPrefix, hasSuffix and
+// cidrContains(cidr, ip) are available, ex: hasPrefix(Name, "eth"). The
+// numeric LinkedField metadata of a node linked to the selected node by an
+// edge of the LinkedEdge relation type, any if empty, is available as
+// linked_<LinkedField>, ex: Rate > 0.8 * linked_Speed. The messages of a
+// Synchronous alert are delivered before the evaluation goes on, by the
+// listeners supporting it, the graph being blocked meanwhile up to
+// analyzer.alert_sync_timeout seconds per message. A FireOnce alert fires
+// for the first matching node only and is then disabled, the change being
+// persisted, until enabled again.
 type Alert struct {
-	UUID        string
-	Name        string
-	Description string
-	Select      string
-	Test        string
-	Action      string
-	Type        int
-	Count       int
-	CreateTime  time.Time
+	UUID                UUID
+	Name                string
+	Description         string
+	Select              string
+	Test                string
+	Action              string
+	Message             string
+	Type                int
+	Aggregate           string
+	Delta               string
+	DeltaWindow         int
+	FlowWindow          int
+	Host                string
+	NeighborEdge        string
+	NeighborAlias       string
+	LinkedEdge          string
+	LinkedField         string
+	GroupWindow         int
+	MaxActionsPerMinute int
+	Snapshot            bool
+	Synchronous         bool
+	FireOnce            bool
+	Severity            string
+	Enabled             bool
+	Count               int
+	CreateTime          time.Time
+	Hash                string
+	// set by the analyzer evaluating the alert, the error of the last
+	// evaluation is empty if it succeeded
+	LastError    string
+	LastEvalTime time.Time
 }
 
 type AlertHandler struct {
 }
 
 func NewAlert() *Alert {
-	id, _ := uuid.NewV4()
-
 	return &Alert{
-		UUID:       id.String(),
+		UUID:       NewUUID(),
 		CreateTime: time.Now(),
 		Type:       FIXED,
+		Severity:   WARNING,
+		Enabled:    true,
 	}
 }
 
 func (a *AlertHandler) New() ApiResource {
-	return &Alert{}
+	// alerts created without type or severity default to fixed warning
+	// alerts and are enabled unless explicitly disabled
+	return &Alert{
+		Type:     FIXED,
+		Severity: WARNING,
+		Enabled:  true,
+	}
 }
 
 func (a *AlertHandler) Name() string {
@@ -67,5 +126,263 @@ func (a *AlertHandler) Name() string {
 }
 
 func (a *Alert) ID() string {
-	return a.UUID
+	return a.UUID.String()
+}
+
+// ContentHash identifies the alerts having the same Select, Test and Action
+// whatever their UUID
+func (a *Alert) ContentHash() string {
+	h := sha1.New()
+	for _, s := range []string{a.Select, a.Test, a.Action} {
+		io.WriteString(h, s)
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// MarshalJSON always exposes the up to date content hash
+func (a Alert) MarshalJSON() ([]byte, error) {
+	type alert Alert
+	al := alert(a)
+	al.Hash = a.ContentHash()
+	return json.Marshal(al)
+}
+
+// Validate checks that the alert can fire, the test is only parsed as the
+// metadata it references are only known at evaluation time
+func (a *Alert) Validate() error {
+	if a.Name == "" {
+		return &ValidationError{Field: "Name", Message: "can't be empty"}
+	}
+
+	if a.Select == "" {
+		return &ValidationError{Field: "Select", Message: "can't be empty"}
+	}
+
+	if a.Test == "" {
+		return &ValidationError{Field: "Test", Message: "can't be empty"}
+	}
+
+	if _, err := parser.ParseExpr(a.Test); err != nil {
+		return &ValidationError{Field: "Test", Message: err.Error()}
+	}
+
+	if a.Type < FIXED || a.Type > FLOW {
+		return &ValidationError{Field: "Type", Message: fmt.Sprintf("unknown type %d", a.Type)}
+	}
+
+	switch a.Severity {
+	case INFO, WARNING, CRITICAL:
+	default:
+		return &ValidationError{Field: "Severity", Message: fmt.Sprintf("unknown severity %q", a.Severity)}
+	}
+
+	if a.GroupWindow < 0 {
+		return &ValidationError{Field: "GroupWindow", Message: "can't be negative"}
+	}
+
+	if a.Delta != "" && a.Type != THRESHOLD {
+		return &ValidationError{Field: "Delta", Message: "only available for threshold alerts"}
+	}
+
+	if a.DeltaWindow < 0 {
+		return &ValidationError{Field: "DeltaWindow", Message: "can't be negative"}
+	}
+
+	// flow alerts select the stored flows with URL encoded term filters
+	if a.Type == FLOW {
+		if _, err := url.ParseQuery(a.Select); err != nil {
+			return &ValidationError{Field: "Select", Message: err.Error()}
+		}
+	}
+
+	// metadata:<key> actions flag the nodes firing the alert
+	if strings.HasPrefix(a.Action, "metadata:") {
+		if a.Type == FLOW {
+			return &ValidationError{Field: "Action", Message: "metadata actions not available for flow alerts"}
+		}
+		if strings.TrimSpace(strings.TrimPrefix(a.Action, "metadata:")) == "" {
+			return &ValidationError{Field: "Action", Message: "metadata key can't be empty"}
+		}
+	}
+
+	if a.FlowWindow < 0 {
+		return &ValidationError{Field: "FlowWindow", Message: "can't be negative"}
+	}
+
+	if a.LinkedEdge != "" && a.LinkedField == "" {
+		return &ValidationError{Field: "LinkedField", Message: "required by LinkedEdge"}
+	}
+
+	if a.LinkedField != "" && (a.Type == AGGREGATE || a.Type == FLOW) {
+		return &ValidationError{Field: "LinkedField", Message: "only available for the alerts evaluated per node"}
+	}
+
+	return nil
+}
+
+// AlertEncoder streams alerts as a JSON object indexed by UUID, one alert
+// at a time, so that the whole document is never held in memory
+type AlertEncoder struct {
+	w     io.Writer
+	count int
+}
+
+func NewAlertEncoder(w io.Writer) *AlertEncoder {
+	return &AlertEncoder{w: w}
+}
+
+// Encode writes the alert as the next member of the object
+func (e *AlertEncoder) Encode(id string, alert ApiResource) error {
+	key, err := json.Marshal(id)
+	if err != nil {
+		return err
+	}
+
+	value, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	sep := "{"
+	if e.count > 0 {
+		sep = ","
+	}
+	e.count++
+
+	if _, err := io.WriteString(e.w, sep); err != nil {
+		return err
+	}
+	if _, err := e.w.Write(key); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(e.w, ":"); err != nil {
+		return err
+	}
+	_, err = e.w.Write(value)
+	return err
+}
+
+// Close terminates the object, an empty object is written if no alert
+// was encoded
+func (e *AlertEncoder) Close() error {
+	end := "}\n"
+	if e.count == 0 {
+		end = "{}\n"
+	}
+
+	_, err := io.WriteString(e.w, end)
+	return err
+}
+
+// ExportAlerts writes all the alerts as a JSON object indexed by UUID, the
+// output can be loaded back using ImportAlerts.
+func ExportAlerts(h ApiHandler, w io.Writer) error {
+	enc := NewAlertEncoder(w)
+	for id, alert := range h.Index() {
+		if err := enc.Encode(id, alert); err != nil {
+			return err
+		}
+	}
+
+	return enc.Close()
+}
+
+// ImportAlerts reads a JSON object of alerts indexed by UUID and stores each of
+// them. If preserveUUID is false a new UUID is assigned to every alert. The
+// dedup mode is applied to the alerts already stored, see CreateDedup.
+func ImportAlerts(h ApiHandler, r io.Reader, preserveUUID bool, dedup string) error {
+	var alerts map[string]json.RawMessage
+	if err := json.NewDecoder(r).Decode(&alerts); err != nil {
+		return err
+	}
+
+	for id, data := range alerts {
+		alert := h.New().(*Alert)
+		if err := json.Unmarshal(data, alert); err != nil {
+			return err
+		}
+
+		if !preserveUUID {
+			alert.UUID = NewUUID()
+		} else if alert.UUID.IsZero() {
+			u, err := ParseUUID(id)
+			if err != nil {
+				return err
+			}
+			alert.UUID = u
+		}
+
+		if _, err := CreateDedup(h, alert, dedup); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// alertPredicate returns a predicate matching the alerts whose Name starts
+// with name_prefix and whose Action is action, nil if none of them is given
+// so that all the alerts can't be deleted by mistake
+func alertPredicate(query url.Values) func(ApiResource) bool {
+	prefix, action := query.Get("name_prefix"), query.Get("action")
+	if prefix == "" && action == "" {
+		return nil
+	}
+
+	return func(r ApiResource) bool {
+		a := r.(*Alert)
+		return strings.HasPrefix(a.Name, prefix) && (action == "" || a.Action == action)
+	}
+}
+
+func RegisterAlertApi(h ApiHandler, r *shttp.Server) {
+	routes := []shttp.Route{
+		{
+			"AlertImport",
+			"POST",
+			"/api/alert/import",
+			func(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+				preserveUUID := r.URL.Query().Get("preserve_uuid") == "true"
+				if err := ImportAlerts(h, r.Body, preserveUUID, r.URL.Query().Get("dedup")); err != nil {
+					logging.GetLogger().Errorf("Failed to import alerts: %s", err.Error())
+					writeError(w, err)
+					return
+				}
+
+				w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+				w.WriteHeader(http.StatusOK)
+				if err := ExportAlerts(h, w); err != nil {
+					logging.GetLogger().Criticalf("Failed to display alerts: %s", err.Error())
+				}
+			},
+		},
+		{
+			"AlertDeleteWhere",
+			"DELETE",
+			"/api/alert",
+			func(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+				predicate := alertPredicate(r.URL.Query())
+				if predicate == nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+
+				deleted, err := DeleteWhere(h, predicate)
+				if err != nil {
+					logging.GetLogger().Errorf("Failed to delete alerts: %s", err.Error())
+					writeError(w, err)
+					return
+				}
+
+				w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+				w.WriteHeader(http.StatusOK)
+				if err := json.NewEncoder(w).Encode(map[string]int{"Deleted": deleted}); err != nil {
+					logging.GetLogger().Criticalf("Failed to display deleted alerts: %s", err.Error())
+				}
+			},
+		},
+	}
+
+	r.RegisterRoutes(routes)
 }
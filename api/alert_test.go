@@ -0,0 +1,181 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestAlert_ImportExport(t *testing.T) {
+	src := NewMemoryApiHandler(&AlertHandler{})
+
+	alert := NewAlert()
+	alert.Name = "test"
+	alert.Severity = CRITICAL
+	src.Create(alert)
+
+	// api defines its own bytes constant, use a recorder as buffer
+	w := httptest.NewRecorder()
+	if err := ExportAlerts(src, w); err != nil {
+		t.Fatal(err)
+	}
+	data := w.Body.String()
+
+	dst := NewMemoryApiHandler(&AlertHandler{})
+	if err := ImportAlerts(dst, strings.NewReader(data), true, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	imported, ok := dst.Get(alert.ID())
+	if !ok {
+		t.Fatalf("Alert %s not imported: %v", alert.ID(), dst.Index())
+	}
+	if imported.(*Alert).Name != "test" || imported.(*Alert).Severity != CRITICAL {
+		t.Errorf("Alert corrupted: %+v", imported)
+	}
+
+	dst = NewMemoryApiHandler(&AlertHandler{})
+	if err := ImportAlerts(dst, strings.NewReader(data), false, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(dst.Index()) != 1 {
+		t.Fatalf("Wrong number of alerts: got %d, expected 1", len(dst.Index()))
+	}
+	if _, ok := dst.Get(alert.ID()); ok {
+		t.Error("A new UUID should have been assigned")
+	}
+}
+
+func TestAlertValidate(t *testing.T) {
+	alert := NewAlert()
+	alert.Name = "mtu"
+	alert.Select = "MTU"
+	alert.Test = "MTU > 1500"
+	if err := alert.Validate(); err != nil {
+		t.Errorf("Alert should be valid: %s", err.Error())
+	}
+
+	for field, invalid := range map[string]func(*Alert){
+		"Type":        func(a *Alert) { a.Type = 0 },
+		"Severity":    func(a *Alert) { a.Severity = "fatal" },
+		"GroupWindow": func(a *Alert) { a.GroupWindow = -1 },
+	} {
+		a := *alert
+		invalid(&a)
+		if err, ok := a.Validate().(*ValidationError); !ok || err.Field != field {
+			t.Errorf("Expected a %s validation error, got %v", field, err)
+		}
+	}
+
+	alert.Test = "MTU >"
+	if err, ok := alert.Validate().(*ValidationError); !ok || err.Field != "Test" {
+		t.Errorf("Expected a Test validation error, got %v", err)
+	}
+
+	alert.Select = ""
+	if err, ok := alert.Validate().(*ValidationError); !ok || err.Field != "Select" {
+		t.Errorf("Expected a Select validation error, got %v", err)
+	}
+}
+
+func TestAlertDedup(t *testing.T) {
+	h := NewMemoryApiHandler(&AlertHandler{})
+
+	alert := NewAlert()
+	alert.Name = "mtu"
+	alert.Select = "MTU"
+	alert.Test = "MTU > 1500"
+	h.Create(alert)
+
+	dup := NewAlert()
+	dup.Name = "mtu again"
+	dup.Select = alert.Select
+	dup.Test = alert.Test
+
+	if dup.ContentHash() != alert.ContentHash() {
+		t.Fatal("Alerts with the same content should have the same hash")
+	}
+
+	if _, err := CreateDedup(h, dup, DedupReject); err == nil {
+		t.Error("Duplicate alert should have been rejected")
+	} else if e, ok := err.(*DuplicateError); !ok || e.ID != alert.ID() {
+		t.Errorf("Expected a duplicate of %s, got %v", alert.ID(), err)
+	}
+
+	r, err := CreateDedup(h, dup, DedupMerge)
+	if err != nil || r.ID() != alert.ID() {
+		t.Errorf("Duplicate alert should have been merged into %s, got %v (%v)", alert.ID(), r, err)
+	}
+
+	if len(h.Index()) != 1 {
+		t.Errorf("Wrong number of alerts: got %d, expected 1", len(h.Index()))
+	}
+
+	if _, err := CreateDedup(h, dup, ""); err != nil || len(h.Index()) != 2 {
+		t.Errorf("Duplicate alert should have been created without dedup: %v", err)
+	}
+
+	data, _ := json.Marshal(alert)
+	var decoded Alert
+	if err := json.Unmarshal(data, &decoded); err != nil || decoded.Hash != alert.ContentHash() {
+		t.Errorf("Content hash not exposed: %s", string(data))
+	}
+}
+
+func TestDeleteWhere(t *testing.T) {
+	h := NewMemoryApiHandler(&AlertHandler{})
+	for _, name := range []string{"old-1", "old-2", "new-1"} {
+		alert := NewAlert()
+		alert.Name = name
+		alert.Action = "http://hook1"
+		h.Create(alert)
+	}
+	alert := NewAlert()
+	alert.Name = "old-3"
+	alert.Action = "http://hook2"
+	h.Create(alert)
+
+	if alertPredicate(url.Values{}) != nil {
+		t.Fatal("An empty filter shouldn't match all the alerts")
+	}
+
+	deleted, err := DeleteWhere(h, alertPredicate(url.Values{"name_prefix": {"old-"}, "action": {"http://hook1"}}))
+	if err != nil || deleted != 2 || len(h.Index()) != 2 {
+		t.Fatalf("Expected 2 alerts deleted, got %d (%v), remaining %v", deleted, err, h.Index())
+	}
+
+	if deleted, _ = DeleteWhere(h, alertPredicate(url.Values{"action": {"http://hook2"}})); deleted != 1 {
+		t.Fatalf("Expected the alert of the second hook deleted, got %d", deleted)
+	}
+
+	for _, r := range h.Index() {
+		if r.(*Alert).Name != "new-1" {
+			t.Errorf("Unexpected remaining alert: %+v", r)
+		}
+	}
+}
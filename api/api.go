@@ -66,6 +66,27 @@ func (a *ApiServer) AsyncWatch(n string, f ApiWatcherCallback) StoppableWatcher
 	return a.handlers[n].AsyncWatch(f)
 }
 
+// writeError writes the HTTP status code matching a resource handler error,
+// validation errors are sent back to the client
+func writeError(w http.ResponseWriter, err error) {
+	switch err.(type) {
+	case *ValidationError:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case *DuplicateError:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case *LimitError:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case *NotFoundError:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		if err == context.DeadlineExceeded {
+			w.WriteHeader(http.StatusGatewayTimeout)
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}
+}
+
 func (a *ApiServer) RegisterApiHandler(handler ApiHandler) error {
 	name := handler.Name()
 	title := strings.Title(name)
@@ -120,12 +141,13 @@ func (a *ApiServer) RegisterApiHandler(handler ApiHandler) error {
 					return
 				}
 
-				if err := handler.Create(resource); err != nil {
-					w.WriteHeader(http.StatusBadRequest)
+				resource, err := CreateDedup(handler, resource, r.URL.Query().Get("dedup"))
+				if err != nil {
+					writeError(w, err)
 					return
 				}
 
-				data, err := json.Marshal(&resource)
+				data, err = json.Marshal(&resource)
 				if err != nil {
 					w.WriteHeader(http.StatusBadRequest)
 					return
@@ -138,6 +160,41 @@ func (a *ApiServer) RegisterApiHandler(handler ApiHandler) error {
 				}
 			},
 		},
+		{
+			title + "Update",
+			"PUT",
+			shttp.PathPrefix(fmt.Sprintf("/api/%s/", name)),
+			func(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+				id := r.URL.Path[len(fmt.Sprintf("/api/%s/", name)):]
+				if id == "" {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+
+				if _, ok := handler.Get(id); !ok {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+
+				resource := handler.New()
+				data, _ := ioutil.ReadAll(r.Body)
+				if err := json.Unmarshal(data, &resource); err != nil || resource.ID() != id {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+
+				if err := handler.Create(resource); err != nil {
+					writeError(w, err)
+					return
+				}
+
+				w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+				w.WriteHeader(http.StatusOK)
+				if err := json.NewEncoder(w).Encode(resource); err != nil {
+					logging.GetLogger().Criticalf("Failed to update %s: %s", name, err.Error())
+				}
+			},
+		},
 		{
 			title + "Delete",
 			"DELETE",
@@ -150,7 +207,7 @@ func (a *ApiServer) RegisterApiHandler(handler ApiHandler) error {
 				}
 
 				if err := handler.Delete(id); err != nil {
-					w.WriteHeader(http.StatusBadRequest)
+					writeError(w, err)
 					return
 				}
 
@@ -162,8 +219,11 @@ func (a *ApiServer) RegisterApiHandler(handler ApiHandler) error {
 
 	a.HTTPServer.RegisterRoutes(routes)
 
-	if _, err := a.EtcdKeyAPI.Set(context.Background(), "/"+name, "", &etcd.SetOptions{Dir: true}); err != nil {
-		if _, err = a.EtcdKeyAPI.Get(context.Background(), "/"+name, nil); err != nil {
+	ctx, cancel := etcdContext()
+	defer cancel()
+
+	if _, err := a.EtcdKeyAPI.Set(ctx, "/"+name, "", &etcd.SetOptions{Dir: true}); err != nil {
+		if _, err = a.EtcdKeyAPI.Get(ctx, "/"+name, nil); err != nil {
 			return err
 		}
 	}
@@ -0,0 +1,100 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+// Package apitest provides the API helpers of the tests of the resource
+// consumers
+package apitest
+
+import (
+	"sync"
+
+	"github.com/redhat-cip/skydive/api"
+)
+
+// MemoryApiHandler is an ApiHandler keeping the resources in memory, with
+// no validation nor watch support
+type MemoryApiHandler struct {
+	api.ResourceHandler
+	lock      sync.RWMutex
+	resources map[string]api.ApiResource
+}
+
+func (h *MemoryApiHandler) Index() map[string]api.ApiResource {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	resources := make(map[string]api.ApiResource, len(h.resources))
+	for id, r := range h.resources {
+		resources[id] = r
+	}
+	return resources
+}
+
+func (h *MemoryApiHandler) Get(id string) (api.ApiResource, bool) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	r, ok := h.resources[id]
+	return r, ok
+}
+
+func (h *MemoryApiHandler) Create(r api.ApiResource) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.resources[r.ID()] = r
+	return nil
+}
+
+// Update changes the stored resource under the handler lock, the version
+// is always 0 as the resources are not versioned
+func (h *MemoryApiHandler) Update(id string, update func(resource api.ApiResource, version uint64) error) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	r, ok := h.resources[id]
+	if !ok {
+		return &api.NotFoundError{ID: id}
+	}
+	return update(r, 0)
+}
+
+func (h *MemoryApiHandler) Delete(id string) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	delete(h.resources, id)
+	return nil
+}
+
+func (h *MemoryApiHandler) AsyncWatch(f api.ApiWatcherCallback) api.StoppableWatcher {
+	return nil
+}
+
+// NewMemoryApiHandler returns an empty handler of the resources of rh, any
+// kind of resource can be stored though
+func NewMemoryApiHandler(rh api.ResourceHandler) *MemoryApiHandler {
+	return &MemoryApiHandler{
+		ResourceHandler: rh,
+		resources:       make(map[string]api.ApiResource),
+	}
+}
@@ -22,9 +22,36 @@
 
 package api
 
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/abbot/go-http-auth"
+
+	shttp "github.com/redhat-cip/skydive/http"
+	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/topology"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
 type Capture struct {
 	ProbePath string `json:"ProbePath,omitempty"`
 	BPFFilter string `json:"BPFFilter,omitempty"`
+	// type of the probe handling the capture: pcap, afpacket or ovssflow,
+	// chosen from the type of the node when empty
+	Type string `json:"Type,omitempty"`
+	// flow table expire/update durations in second overriding the agent
+	// configuration, 0 to keep the configuration values
+	FlowTableExpire int `json:"FlowTableExpire,omitempty"`
+	FlowTableUpdate int `json:"FlowTableUpdate,omitempty"`
+	// address:port of the analyzer, one of the agent.analyzers of the agents,
+	// the flows of the capture are sent to instead of being routed on all
+	// the analyzers. Only supported by the ovssflow probes.
+	Analyzer string `json:"Analyzer,omitempty"`
 }
 
 type CaptureHandler struct {
@@ -48,3 +75,181 @@ func (c *CaptureHandler) Name() string {
 func (c *Capture) ID() string {
 	return c.ProbePath
 }
+
+// Validate checks the analyzer address, whether the agents know the analyzer
+// is checked by the agents
+func (c *Capture) Validate() error {
+	if c.Analyzer == "" {
+		return nil
+	}
+
+	_, port, err := net.SplitHostPort(c.Analyzer)
+	if err != nil {
+		return &ValidationError{Field: "Analyzer", Message: err.Error()}
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+		return &ValidationError{Field: "Analyzer", Message: fmt.Sprintf("invalid port %s", port)}
+	}
+
+	return nil
+}
+
+// ActiveCapture is a capture along with the paths of the nodes on which the
+// agents run its probe
+type ActiveCapture struct {
+	Capture *Capture
+	Nodes   []string
+}
+
+// ActiveCaptures returns the captures whose probe runs on at least one node
+// of the graph, indexed by capture ID. The agents flag these nodes with
+// State.FlowCapture, a wildcard capture is then reported once with all its
+// nodes.
+func ActiveCaptures(h ApiHandler, g *graph.Graph) map[string]*ActiveCapture {
+	captures := h.Index()
+	active := make(map[string]*ActiveCapture)
+
+	g.RLock()
+	defer g.RUnlock()
+
+	for _, n := range g.LookupNodes(graph.Metadata{"State.FlowCapture": "ON"}) {
+		nodes := g.LookupShortestPath(n, graph.Metadata{"Type": "host"}, topology.IsOwnershipEdge)
+		if len(nodes) == 0 {
+			continue
+		}
+
+		path := topology.NodePath{Nodes: nodes}.Marshal()
+		id := path
+		if _, ok := captures[id]; !ok {
+			id = "*/" + topology.NodePath{Nodes: nodes[:len(nodes)-1]}.Marshal()
+			if _, ok := captures[id]; !ok {
+				continue
+			}
+		}
+
+		ac, ok := active[id]
+		if !ok {
+			ac = &ActiveCapture{Capture: captures[id].(*Capture)}
+			active[id] = ac
+		}
+		ac.Nodes = append(ac.Nodes, path)
+	}
+
+	return active
+}
+
+// CaptureGraph is the part of the topology observed by a capture
+type CaptureGraph struct {
+	Nodes []*graph.Node
+	Edges []*graph.Edge
+}
+
+// captureNodes returns the nodes matching the probe path of a capture, one
+// per host for a wildcard path
+func captureNodes(g *graph.Graph, probePath string) []*graph.Node {
+	if !strings.HasPrefix(probePath, "*/") {
+		if n := topology.LookupNodeFromNodePathString(g, probePath); n != nil {
+			return []*graph.Node{n}
+		}
+		return nil
+	}
+
+	var nodes []*graph.Node
+	for _, h := range g.LookupNodes(graph.Metadata{"Type": "host"}) {
+		path := topology.NodePath{Nodes: []*graph.Node{h}}.Marshal() + probePath[1:]
+		if n := topology.LookupNodeFromNodePathString(g, path); n != nil {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
+
+// CaptureSubgraph returns the nodes of the path of the probe of a capture
+// along with the nodes attached to the probed node, the interfaces of a
+// bridge for instance, and the edges linking them together.
+func CaptureSubgraph(g *graph.Graph, probePath string) *CaptureGraph {
+	g.RLock()
+	defer g.RUnlock()
+
+	sg := &CaptureGraph{Nodes: []*graph.Node{}, Edges: []*graph.Edge{}}
+	seen := make(map[graph.Identifier]bool)
+	add := func(n *graph.Node) {
+		if !seen[n.ID] {
+			seen[n.ID] = true
+			sg.Nodes = append(sg.Nodes, n)
+		}
+	}
+
+	for _, n := range captureNodes(g, probePath) {
+		for _, p := range g.LookupShortestPath(n, graph.Metadata{"Type": "host"}, topology.IsOwnershipEdge) {
+			add(p)
+		}
+		for _, e := range g.GetNodeEdges(n) {
+			parent, child := g.GetEdgeNodes(e)
+			if parent != nil && child != nil {
+				add(parent)
+				add(child)
+			}
+		}
+	}
+
+	edges := make(map[graph.Identifier]bool)
+	for _, n := range sg.Nodes {
+		for _, e := range g.GetNodeEdges(n) {
+			parent, child := g.GetEdgeNodes(e)
+			if parent == nil || child == nil || !seen[parent.ID] || !seen[child.ID] || edges[e.ID] {
+				continue
+			}
+			edges[e.ID] = true
+			sg.Edges = append(sg.Edges, e)
+		}
+	}
+
+	return sg
+}
+
+// RegisterCaptureApi registers the capture endpoints relying on the graph,
+// to be called before registering the capture handler whose GET
+// /api/capture/ prefix route would shadow them
+func RegisterCaptureApi(h ApiHandler, g *graph.Graph, r *shttp.Server) {
+	routes := []shttp.Route{
+		{
+			"CaptureActive",
+			"GET",
+			"/api/capture/active",
+			func(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+				w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+				w.WriteHeader(http.StatusOK)
+				if err := json.NewEncoder(w).Encode(ActiveCaptures(h, g)); err != nil {
+					logging.GetLogger().Criticalf("Failed to display active captures: %s", err.Error())
+				}
+			},
+		},
+		{
+			"CaptureSubgraph",
+			"GET",
+			"/api/capture/subgraph",
+			func(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+				resource, ok := h.Get(r.URL.Query().Get("id"))
+				if !ok {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+
+				sg := CaptureSubgraph(g, resource.(*Capture).ProbePath)
+				if len(sg.Nodes) == 0 {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+
+				w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+				w.WriteHeader(http.StatusOK)
+				if err := json.NewEncoder(w).Encode(sg); err != nil {
+					logging.GetLogger().Criticalf("Failed to display capture subgraph: %s", err.Error())
+				}
+			},
+		},
+	}
+
+	r.RegisterRoutes(routes)
+}
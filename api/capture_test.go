@@ -0,0 +1,102 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+package api
+
+import (
+	"testing"
+
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+func newGraph(t *testing.T) *graph.Graph {
+	b, err := graph.NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := graph.NewGraph(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return g
+}
+
+func TestActiveCaptures(t *testing.T) {
+	g := newGraph(t)
+
+	ownership := graph.Metadata{"RelationType": "ownership"}
+	for _, host := range []string{"host1", "host2"} {
+		h := g.NewNode(graph.GenID(), graph.Metadata{"Name": host, "Type": "host"})
+		br := g.NewNode(graph.GenID(), graph.Metadata{"Name": "br-int", "Type": "ovsbridge", "State.FlowCapture": "ON"})
+		g.Link(h, br, ownership)
+		eth := g.NewNode(graph.GenID(), graph.Metadata{"Name": "eth0", "Type": "device", "State.FlowCapture": "OFF"})
+		g.Link(h, eth, ownership)
+	}
+
+	h := NewMemoryApiHandler(&CaptureHandler{})
+	h.Create(NewCapture("*/br-int[Type=ovsbridge]", ""))
+	h.Create(NewCapture("host1[Type=host]/eth0[Type=device]", ""))
+
+	active := ActiveCaptures(h, g)
+	if len(active) != 1 {
+		t.Fatalf("Expected only the bridge capture to be active, got %v", active)
+	}
+
+	ac, ok := active["*/br-int[Type=ovsbridge]"]
+	if !ok || len(ac.Nodes) != 2 || ac.Capture.ProbePath != "*/br-int[Type=ovsbridge]" {
+		t.Fatalf("Expected the bridge capture active on both hosts, got %+v", ac)
+	}
+}
+
+func TestCaptureSubgraph(t *testing.T) {
+	g := newGraph(t)
+
+	ownership := graph.Metadata{"RelationType": "ownership"}
+	h := g.NewNode(graph.GenID(), graph.Metadata{"Name": "host1", "Type": "host"})
+	br := g.NewNode(graph.GenID(), graph.Metadata{"Name": "br-int", "Type": "ovsbridge"})
+	g.Link(h, br, ownership)
+	port := g.NewNode(graph.GenID(), graph.Metadata{"Name": "patch", "Type": "ovsport"})
+	g.Link(br, port, ownership)
+	intf := g.NewNode(graph.GenID(), graph.Metadata{"Name": "patch", "Type": "patch"})
+	g.Link(port, intf, ownership)
+	eth := g.NewNode(graph.GenID(), graph.Metadata{"Name": "eth0", "Type": "device"})
+	g.Link(h, eth, ownership)
+
+	sg := CaptureSubgraph(g, "host1[Type=host]/br-int[Type=ovsbridge]")
+	if len(sg.Nodes) != 3 || len(sg.Edges) != 2 {
+		t.Fatalf("Expected the host, the bridge and its port, got %+v", sg)
+	}
+	for _, n := range sg.Nodes {
+		if n.ID == eth.ID || n.ID == intf.ID {
+			t.Errorf("Node %s not expected in the subgraph", n.Metadata()["Name"])
+		}
+	}
+
+	if sg = CaptureSubgraph(g, "*/br-int[Type=ovsbridge]"); len(sg.Nodes) != 3 {
+		t.Errorf("Expected the wildcard path to match the bridge, got %+v", sg)
+	}
+
+	if sg = CaptureSubgraph(g, "host1[Type=host]/br-ex[Type=ovsbridge]"); len(sg.Nodes) != 0 {
+		t.Errorf("Expected an empty subgraph, got %+v", sg)
+	}
+}
@@ -26,7 +26,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/abbot/go-http-auth"
 	"github.com/gorilla/mux"
@@ -68,6 +70,150 @@ func (f *FlowApi) flowSearch(w http.ResponseWriter, r *auth.AuthenticatedRequest
 	}
 }
 
+func (f *FlowApi) flowProbePath(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	query := r.URL.Query()
+
+	path := query.Get("path")
+	if path == "" {
+		http.Error(w, "path parameter required", http.StatusBadRequest)
+		return
+	}
+
+	prefix, _ := strconv.ParseBool(query.Get("prefix"))
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if f.Storage == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	flows, err := f.Storage.SearchFlowsByProbePath(path, prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(flows); err != nil {
+		panic(err)
+	}
+}
+
+func (f *FlowApi) flowGet(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	uuid := r.URL.Path[len("/api/flow/"):]
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if f.Storage == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	fl, err := f.Storage.GetFlow(uuid)
+	if err != nil {
+		logging.GetLogger().Errorf("Unable to retrieve flow %s: %s", uuid, err.Error())
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	if fl == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(fl); err != nil {
+		panic(err)
+	}
+}
+
+// flowMetrics returns the packets and bytes of a flow per update window,
+// optionally between the from and to epoch seconds
+func (f *FlowApi) flowMetrics(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	uuid := strings.TrimSuffix(r.URL.Path[len("/api/flow/"):], "/metrics")
+
+	from, to := int64(0), time.Now().Unix()
+	for k, v := range map[string]*int64{"from": &from, "to": &to} {
+		if s := r.URL.Query().Get(k); s != "" {
+			i, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			*v = i
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if f.Storage == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	metrics, err := f.Storage.SearchMetrics(uuid, from, to)
+	if err != nil {
+		logging.GetLogger().Errorf("Unable to retrieve the metrics of flow %s: %s", uuid, err.Error())
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(metrics); err != nil {
+		panic(err)
+	}
+}
+
+// flowAggregate returns the packets and bytes of the flows matching the term
+// filters given as parameters summed per bucket of interval seconds, one
+// hour of one minute buckets by default
+func (f *FlowApi) flowAggregate(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	filters := make(storage.Filters)
+	to := time.Now().Unix()
+	from, interval := to-3600, int64(60)
+
+	bounds := map[string]*int64{"from": &from, "to": &to, "interval": &interval}
+	for k, v := range r.URL.Query() {
+		b, found := bounds[k]
+		if !found {
+			filters[k] = v[0]
+			continue
+		}
+
+		i, err := strconv.ParseInt(v[0], 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid %s parameter: %s", k, v[0]), http.StatusBadRequest)
+			return
+		}
+		*b = i
+	}
+
+	if interval <= 0 || from > to {
+		http.Error(w, "interval has to be strictly positive and from before to", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if f.Storage == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	metrics, err := f.Storage.AggregateMetrics(filters, from, to, interval)
+	if err != nil {
+		logging.GetLogger().Errorf("Unable to aggregate the flow metrics: %s", err.Error())
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(metrics); err != nil {
+		panic(err)
+	}
+}
+
 func (f *FlowApi) serveDataIndex(w http.ResponseWriter, r *auth.AuthenticatedRequest, message string) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(http.StatusOK)
@@ -122,6 +268,8 @@ func (f *FlowApi) conversationLayer(w http.ResponseWriter, r *auth.Authenticated
 		ltype = flow.FlowEndpointType_ETHERNET
 	case "ipv4":
 		ltype = flow.FlowEndpointType_IPV4
+	case "ipv6":
+		ltype = flow.FlowEndpointType_IPV6
 	case "tcp":
 		ltype = flow.FlowEndpointType_TCPPORT
 	case "udp":
@@ -247,6 +395,18 @@ func (f *FlowApi) registerEndpoints(r *shttp.Server) {
 			"/api/flow/search",
 			f.flowSearch,
 		},
+		{
+			"FlowProbePath",
+			"GET",
+			"/api/flow/probepath",
+			f.flowProbePath,
+		},
+		{
+			"FlowAggregate",
+			"GET",
+			"/api/flow/aggregate",
+			f.flowAggregate,
+		},
 		{
 			"ConversationLayer",
 			"GET",
@@ -259,6 +419,18 @@ func (f *FlowApi) registerEndpoints(r *shttp.Server) {
 			"/api/flow/discovery/{type}",
 			f.discoveryType,
 		},
+		{
+			"FlowGet",
+			"GET",
+			"/api/flow/{id}",
+			f.flowGet,
+		},
+		{
+			"FlowMetrics",
+			"GET",
+			"/api/flow/{id}/metrics",
+			f.flowMetrics,
+		},
 	}
 
 	r.RegisterRoutes(routes)
@@ -24,11 +24,15 @@ package api
 
 import (
 	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
+	"github.com/abbot/go-http-auth"
 	v "github.com/gima/govalid/v1"
 
 	"github.com/redhat-cip/skydive/flow"
+	"github.com/redhat-cip/skydive/storage"
 )
 
 func TestFlowTable_jsonFlowConversationEthernetPath(t *testing.T) {
@@ -108,3 +112,184 @@ func TestFlowTable_jsonFlowDiscovery(t *testing.T) {
 	test_jsonFlowDiscovery(t, packets)
 	t.Log("jsonFlowDiscovery PACKETS : ok")
 }
+
+type probePathStorage struct {
+	path     string
+	prefix   bool
+	from, to int64
+	filters  storage.Filters
+	interval int64
+}
+
+func (s *probePathStorage) Start() {
+}
+
+func (s *probePathStorage) Stop() {
+}
+
+func (s *probePathStorage) StoreFlows(flows []*flow.Flow) error {
+	return nil
+}
+
+func (s *probePathStorage) SearchFlows(filters storage.Filters) ([]*flow.Flow, error) {
+	return nil, nil
+}
+
+func (s *probePathStorage) SearchFlowsByProbePath(path string, prefix bool) ([]*flow.Flow, error) {
+	s.path, s.prefix = path, prefix
+	return []*flow.Flow{{ProbeGraphPath: path}}, nil
+}
+
+func (s *probePathStorage) SearchFlowsSince(filters storage.Filters, since int64) ([]*flow.Flow, error) {
+	return nil, nil
+}
+
+func (s *probePathStorage) GetFlow(uuid string) (*flow.Flow, error) {
+	if uuid != "flow1" {
+		return nil, nil
+	}
+	return &flow.Flow{UUID: uuid, ProbeGraphPath: "host1[Type=host]"}, nil
+}
+
+func (s *probePathStorage) StoreMetrics(metrics []*flow.FlowMetric) error {
+	return nil
+}
+
+func (s *probePathStorage) SearchMetrics(uuid string, from int64, to int64) ([]*flow.FlowMetric, error) {
+	s.from, s.to = from, to
+	return []*flow.FlowMetric{{UUID: uuid, Start: 10, Last: 20, ABPackets: 1}}, nil
+}
+
+func (s *probePathStorage) AggregateMetrics(filters storage.Filters, from int64, to int64, interval int64) ([]*flow.FlowMetric, error) {
+	s.filters, s.from, s.to, s.interval = filters, from, to, interval
+	return []*flow.FlowMetric{{Start: from, Last: from + interval, ABBytes: 100, BABytes: 50}}, nil
+}
+
+func TestFlowProbePath(t *testing.T) {
+	st := &probePathStorage{}
+	fa := &FlowApi{Storage: st}
+
+	req, _ := http.NewRequest("GET", "/api/flow/probepath?path=host1[Type=host]&prefix=true", nil)
+	w := httptest.NewRecorder()
+	fa.flowProbePath(w, &auth.AuthenticatedRequest{Request: *req})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+
+	if st.path != "host1[Type=host]" || !st.prefix {
+		t.Errorf("Wrong storage query: %s (prefix %t)", st.path, st.prefix)
+	}
+
+	var flows []*flow.Flow
+	if err := json.NewDecoder(w.Body).Decode(&flows); err != nil || len(flows) != 1 {
+		t.Errorf("Expected one flow, got %v (%v)", flows, err)
+	}
+
+	req, _ = http.NewRequest("GET", "/api/flow/probepath", nil)
+	w = httptest.NewRecorder()
+	fa.flowProbePath(w, &auth.AuthenticatedRequest{Request: *req})
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 without path, got %d", w.Code)
+	}
+}
+
+func TestFlowGet(t *testing.T) {
+	fa := &FlowApi{Storage: &probePathStorage{}}
+
+	req, _ := http.NewRequest("GET", "/api/flow/flow1", nil)
+	w := httptest.NewRecorder()
+	fa.flowGet(w, &auth.AuthenticatedRequest{Request: *req})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+
+	var f flow.Flow
+	if err := json.NewDecoder(w.Body).Decode(&f); err != nil || f.UUID != "flow1" || f.ProbeGraphPath != "host1[Type=host]" {
+		t.Errorf("Wrong flow returned: %v (%v)", f, err)
+	}
+
+	req, _ = http.NewRequest("GET", "/api/flow/unknown", nil)
+	w = httptest.NewRecorder()
+	fa.flowGet(w, &auth.AuthenticatedRequest{Request: *req})
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for an unknown flow, got %d", w.Code)
+	}
+}
+
+func TestFlowMetrics(t *testing.T) {
+	st := &probePathStorage{}
+	fa := &FlowApi{Storage: st}
+
+	req, _ := http.NewRequest("GET", "/api/flow/flow1/metrics?from=10&to=100", nil)
+	w := httptest.NewRecorder()
+	fa.flowMetrics(w, &auth.AuthenticatedRequest{Request: *req})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+
+	if st.from != 10 || st.to != 100 {
+		t.Errorf("Wrong storage query range: %d-%d", st.from, st.to)
+	}
+
+	var metrics []*flow.FlowMetric
+	if err := json.NewDecoder(w.Body).Decode(&metrics); err != nil || len(metrics) != 1 || metrics[0].UUID != "flow1" {
+		t.Errorf("Expected the metrics of flow1, got %v (%v)", metrics, err)
+	}
+
+	req, _ = http.NewRequest("GET", "/api/flow/flow1/metrics?from=yesterday", nil)
+	w = httptest.NewRecorder()
+	fa.flowMetrics(w, &auth.AuthenticatedRequest{Request: *req})
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an invalid range, got %d", w.Code)
+	}
+}
+
+func TestFlowAggregate(t *testing.T) {
+	st := &probePathStorage{}
+	fa := &FlowApi{Storage: st}
+
+	req, _ := http.NewRequest("GET", "/api/flow/aggregate?from=0&to=3600&interval=60&Statistics.Endpoints.AB.Value=192.168.0.1", nil)
+	w := httptest.NewRecorder()
+	fa.flowAggregate(w, &auth.AuthenticatedRequest{Request: *req})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+
+	if st.from != 0 || st.to != 3600 || st.interval != 60 {
+		t.Errorf("Wrong storage query range: %d-%d per %d", st.from, st.to, st.interval)
+	}
+
+	if len(st.filters) != 1 || st.filters["Statistics.Endpoints.AB.Value"] != "192.168.0.1" {
+		t.Errorf("Wrong storage query filters: %v", st.filters)
+	}
+
+	var metrics []*flow.FlowMetric
+	if err := json.NewDecoder(w.Body).Decode(&metrics); err != nil || len(metrics) != 1 || metrics[0].ABBytes != 100 {
+		t.Errorf("Expected one bucket, got %v (%v)", metrics, err)
+	}
+
+	req, _ = http.NewRequest("GET", "/api/flow/aggregate", nil)
+	w = httptest.NewRecorder()
+	fa.flowAggregate(w, &auth.AuthenticatedRequest{Request: *req})
+
+	if w.Code != http.StatusOK || st.to-st.from != 3600 || st.interval != 60 || len(st.filters) != 0 {
+		t.Errorf("Expected one hour of one minute buckets by default, got %d-%d per %d", st.from, st.to, st.interval)
+	}
+
+	for _, query := range []string{"interval=0", "interval=minute", "from=100&to=10"} {
+		req, _ = http.NewRequest("GET", "/api/flow/aggregate?"+query, nil)
+		w = httptest.NewRecorder()
+		fa.flowAggregate(w, &auth.AuthenticatedRequest{Request: *req})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for %s, got %d", query, w.Code)
+		}
+	}
+}
@@ -33,6 +33,7 @@ import (
 	etcd "github.com/coreos/etcd/client"
 	"golang.org/x/net/context"
 
+	"github.com/redhat-cip/skydive/config"
 	"github.com/redhat-cip/skydive/logging"
 )
 
@@ -68,24 +69,114 @@ type StoppableWatcher interface {
 	Stop()
 }
 
+// IndexedWatcher is implemented by the watchers reporting the etcd index of
+// the last handled event
+type IndexedWatcher interface {
+	StoppableWatcher
+	LastIndex() uint64
+}
+
 type BasicStoppableWatcher struct {
-	watcher etcd.Watcher
-	running atomic.Value
-	ctx     context.Context
-	cancel  context.CancelFunc
-	wg      sync.WaitGroup
+	running   atomic.Value
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	lastIndex uint64
+}
+
+// ApiResourceValidator is implemented by the resources checking their fields
+// before being stored
+type ApiResourceValidator interface {
+	Validate() error
+}
+
+type ValidationError struct {
+	Field   string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", e.Field, e.Message)
+}
+
+// ApiResourceHasher is implemented by the resources that can be compared by
+// content, regardless of their ID
+type ApiResourceHasher interface {
+	ContentHash() string
+}
+
+// deduplication modes used when creating a resource whose content is already
+// stored under another ID
+const (
+	DedupReject = "reject"
+	DedupMerge  = "merge"
+)
+
+type DuplicateError struct {
+	ID string
+}
+
+func (e *DuplicateError) Error() string {
+	return fmt.Sprintf("duplicate of %s", e.ID)
+}
+
+// LimitError is returned when creating a resource while the maximum number
+// of resources is reached
+type LimitError struct {
+	Resource string
+	Max      int
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("maximum number of %s reached (%d)", e.Resource, e.Max)
+}
+
+// NotFoundError is returned when updating a resource which doesn't exist
+type NotFoundError struct {
+	ID string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("%s not found", e.ID)
+}
+
+// ApiUpdater is implemented by the handlers able to update a resource
+// without overwriting a concurrent change. The update function is called with
+// the stored resource and its version, and called again with the new one if
+// the resource changed before being written. An error returned by the update
+// function aborts the update.
+type ApiUpdater interface {
+	Update(id string, update func(resource ApiResource, version uint64) error) error
+}
+
+// ApiSelfTester is implemented by the handlers able to check that their
+// backend is usable
+type ApiSelfTester interface {
+	SelfTest() error
 }
 
 type ApiResourceWatcher interface {
 	AsyncWatch(f ApiWatcherCallback) StoppableWatcher
 }
 
+// etcdContext returns a context bounded by etcd.request_timeout so that an
+// unresponsive etcd doesn't block the caller forever
+func etcdContext() (context.Context, context.CancelFunc) {
+	timeout := time.Duration(config.GetConfig().GetInt("etcd.request_timeout")) * time.Second
+	return context.WithTimeout(context.Background(), timeout)
+}
+
 func (s *BasicStoppableWatcher) Stop() {
 	s.cancel()
 	s.running.Store(false)
 	s.wg.Wait()
 }
 
+// LastIndex returns the etcd index of the last event handled by the watcher
+func (s *BasicStoppableWatcher) LastIndex() uint64 {
+	return atomic.LoadUint64(&s.lastIndex)
+}
+
 func (h *BasicApiHandler) Name() string {
 	return h.ResourceHandler.Name()
 }
@@ -110,7 +201,10 @@ func (h *BasicApiHandler) collectNodes(flatten map[string]ApiResource, nodes etc
 func (h *BasicApiHandler) Index() map[string]ApiResource {
 	etcdPath := fmt.Sprintf("/%s/", h.ResourceHandler.Name())
 
-	resp, err := h.EtcdKeyAPI.Get(context.Background(), etcdPath, &etcd.GetOptions{Recursive: true})
+	ctx, cancel := etcdContext()
+	defer cancel()
+
+	resp, err := h.EtcdKeyAPI.Get(ctx, etcdPath, &etcd.GetOptions{Recursive: true})
 	resources := make(map[string]ApiResource)
 
 	if err == nil {
@@ -123,7 +217,10 @@ func (h *BasicApiHandler) Index() map[string]ApiResource {
 func (h *BasicApiHandler) Get(id string) (ApiResource, bool) {
 	etcdPath := fmt.Sprintf("/%s/%s", h.ResourceHandler.Name(), id)
 
-	resp, err := h.EtcdKeyAPI.Get(context.Background(), etcdPath, nil)
+	ctx, cancel := etcdContext()
+	defer cancel()
+
+	resp, err := h.EtcdKeyAPI.Get(ctx, etcdPath, nil)
 	if err != nil {
 		return nil, false
 	}
@@ -134,68 +231,331 @@ func (h *BasicApiHandler) Get(id string) (ApiResource, bool) {
 }
 
 func (h *BasicApiHandler) Create(resource ApiResource) error {
+	if v, ok := resource.(ApiResourceValidator); ok {
+		if err := v.Validate(); err != nil {
+			return err
+		}
+	}
+
 	data, err := json.Marshal(&resource)
 	if err != nil {
 		return err
 	}
 
+	ctx, cancel := etcdContext()
+	defer cancel()
+
 	etcdPath := fmt.Sprintf("/%s/%s", h.ResourceHandler.Name(), resource.ID())
-	_, err = h.EtcdKeyAPI.Set(context.Background(), etcdPath, string(data), nil)
+	_, err = h.EtcdKeyAPI.Set(ctx, etcdPath, string(data), nil)
 	return err
 }
 
+// Update changes the stored resource with a compare-and-swap on its etcd
+// modified index, retrying with the stored resource when it was modified in
+// the meantime. The version is the etcd modified index of the resource.
+func (h *BasicApiHandler) Update(id string, update func(resource ApiResource, version uint64) error) error {
+	etcdPath := fmt.Sprintf("/%s/%s", h.ResourceHandler.Name(), id)
+
+	for {
+		ctx, cancel := etcdContext()
+		err := h.compareAndSwap(ctx, etcdPath, id, update)
+		cancel()
+
+		if etcdErr, ok := err.(etcd.Error); ok && etcdErr.Code == etcd.ErrorCodeTestFailed {
+			logging.GetLogger().Debugf("%s modified concurrently, retrying the update", etcdPath)
+			continue
+		}
+		return err
+	}
+}
+
+func (h *BasicApiHandler) compareAndSwap(ctx context.Context, etcdPath string, id string, update func(resource ApiResource, version uint64) error) error {
+	resp, err := h.EtcdKeyAPI.Get(ctx, etcdPath, nil)
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return &NotFoundError{ID: id}
+		}
+		return err
+	}
+
+	resource := h.unmarshal(resp.Node)
+	if err := update(resource, resp.Node.ModifiedIndex); err != nil {
+		return err
+	}
+
+	if v, ok := resource.(ApiResourceValidator); ok {
+		if err := v.Validate(); err != nil {
+			return err
+		}
+	}
+
+	data, err := json.Marshal(&resource)
+	if err != nil {
+		return err
+	}
+
+	_, err = h.EtcdKeyAPI.Set(ctx, etcdPath, string(data), &etcd.SetOptions{PrevIndex: resp.Node.ModifiedIndex})
+	return err
+}
+
+// CreateDedup creates the resource unless a resource with the same content
+// hash already exists. In that case the DedupReject mode returns a
+// DuplicateError while the DedupMerge mode returns the existing resource. An
+// empty mode always creates the resource.
+func CreateDedup(h ApiHandler, resource ApiResource, mode string) (ApiResource, error) {
+	switch mode {
+	case "":
+		return resource, h.Create(resource)
+	case DedupReject, DedupMerge:
+	default:
+		return nil, &ValidationError{Field: "dedup", Message: fmt.Sprintf("unknown mode %s", mode)}
+	}
+
+	hasher, ok := resource.(ApiResourceHasher)
+	if !ok {
+		return resource, h.Create(resource)
+	}
+
+	hash := hasher.ContentHash()
+	for id, r := range h.Index() {
+		if id == resource.ID() {
+			continue
+		}
+
+		if other, ok := r.(ApiResourceHasher); ok && other.ContentHash() == hash {
+			if mode == DedupReject {
+				return nil, &DuplicateError{ID: id}
+			}
+			return r, nil
+		}
+	}
+
+	return resource, h.Create(resource)
+}
+
+// DeleteWhere deletes the resources matching the predicate and returns how
+// many were deleted. The watchers are notified of each deletion as usual.
+func DeleteWhere(h ApiHandler, predicate func(ApiResource) bool) (int, error) {
+	deleted := 0
+	for id, r := range h.Index() {
+		if !predicate(r) {
+			continue
+		}
+
+		if err := h.Delete(id); err != nil {
+			// already deleted by someone else
+			if etcd.IsKeyNotFound(err) {
+				continue
+			}
+			return deleted, err
+		}
+		deleted++
+	}
+
+	return deleted, nil
+}
+
 func (h *BasicApiHandler) Delete(id string) error {
 	etcdPath := fmt.Sprintf("/%s/%s", h.ResourceHandler.Name(), id)
 
-	if _, err := h.EtcdKeyAPI.Delete(context.Background(), etcdPath, nil); err != nil {
+	ctx, cancel := etcdContext()
+	defer cancel()
+
+	if _, err := h.EtcdKeyAPI.Delete(ctx, etcdPath, nil); err != nil {
 		return err
 	}
 
 	return nil
 }
 
+// SelfTest writes, reads back and deletes a throwaway key while watching it,
+// so that an etcd unable to store the resources or to notify their changes is
+// detected before the handler is used
+func (h *BasicApiHandler) SelfTest() error {
+	etcdPath := fmt.Sprintf("/selftest/%s/%s", h.ResourceHandler.Name(), NewUUID().String())
+
+	ctx, cancel := etcdContext()
+	defer cancel()
+
+	resp, err := h.EtcdKeyAPI.Set(ctx, etcdPath, "selftest", &etcd.SetOptions{TTL: time.Minute})
+	if err != nil {
+		return fmt.Errorf("write failed: %s", err.Error())
+	}
+	index := resp.Node.ModifiedIndex
+
+	resp, err = h.EtcdKeyAPI.Get(ctx, etcdPath, nil)
+	if err != nil {
+		return fmt.Errorf("read failed: %s", err.Error())
+	}
+	if resp.Node.Value != "selftest" {
+		return fmt.Errorf("read failed: unexpected value %s", resp.Node.Value)
+	}
+
+	watcher := h.EtcdKeyAPI.Watcher(etcdPath, &etcd.WatcherOptions{AfterIndex: index})
+	if _, err = h.EtcdKeyAPI.Delete(ctx, etcdPath, nil); err != nil {
+		return fmt.Errorf("delete failed: %s", err.Error())
+	}
+
+	if resp, err = watcher.Next(ctx); err != nil {
+		return fmt.Errorf("watch failed: %s", err.Error())
+	}
+	if resp.Action != "delete" {
+		return fmt.Errorf("watch failed: unexpected %s event", resp.Action)
+	}
+
+	return nil
+}
+
+// etcdNodes returns the resources nodes stored under etcdPath indexed by
+// their key relative to etcdPath and the etcd index of the read
+func (h *BasicApiHandler) etcdNodes(etcdPath string) (map[string]*etcd.Node, uint64, error) {
+	ctx, cancel := etcdContext()
+	defer cancel()
+
+	resp, err := h.EtcdKeyAPI.Get(ctx, etcdPath, &etcd.GetOptions{Recursive: true})
+	if err != nil {
+		if etcdErr, ok := err.(etcd.Error); ok && etcdErr.Code == etcd.ErrorCodeKeyNotFound {
+			return nil, etcdErr.Index, nil
+		}
+		return nil, 0, err
+	}
+
+	nodes := make(map[string]*etcd.Node)
+	var collect func(etcd.Nodes)
+	collect = func(children etcd.Nodes) {
+		for _, node := range children {
+			if node.Dir {
+				collect(node.Nodes)
+			} else {
+				nodes[strings.TrimPrefix(node.Key, etcdPath)] = node
+			}
+		}
+	}
+	collect(resp.Node.Nodes)
+
+	return nodes, resp.Index, nil
+}
+
+func (h *BasicApiHandler) unmarshal(node *etcd.Node) ApiResource {
+	resource := h.ResourceHandler.New()
+	json.Unmarshal([]byte(node.Value), resource)
+	return resource
+}
+
+// resync calls the callback for the resources created, updated or deleted
+// since the events already handled, known holds the modified index of the
+// resources handled so far. It returns the etcd index to watch after.
+func (h *BasicApiHandler) resync(etcdPath string, known map[string]uint64, f ApiWatcherCallback) (uint64, error) {
+	nodes, index, err := h.etcdNodes(etcdPath)
+	if err != nil {
+		return 0, err
+	}
+
+	for id, node := range nodes {
+		modified, ok := known[id]
+		switch {
+		case !ok:
+			f("create", id, h.unmarshal(node))
+		case modified != node.ModifiedIndex:
+			f("update", id, h.unmarshal(node))
+		default:
+			continue
+		}
+		known[id] = node.ModifiedIndex
+	}
+
+	for id := range known {
+		if _, ok := nodes[id]; !ok {
+			f("delete", id, h.ResourceHandler.New())
+			delete(known, id)
+		}
+	}
+
+	return index, nil
+}
+
+// watchActions maps the etcd actions of the compare-and-swap writes to the
+// actions of the plain writes so that the callbacks don't have to know them
+var watchActions = map[string]string{
+	"compareAndSwap":   "update",
+	"compareAndDelete": "delete",
+}
+
+// AsyncWatch calls the callback for the stored resources then for each of
+// their changes. When the watch fails, ex: when the etcd event history doesn't
+// go back to the last handled event anymore, the resources are read again,
+// the differences are sent to the callback and the watch resumes after the
+// index of this read.
 func (h *BasicApiHandler) AsyncWatch(f ApiWatcherCallback) StoppableWatcher {
 	etcdPath := fmt.Sprintf("/%s/", h.ResourceHandler.Name())
 
-	watcher := h.EtcdKeyAPI.Watcher(etcdPath, &etcd.WatcherOptions{Recursive: true})
-
 	ctx, cancel := context.WithCancel(context.Background())
 	sw := &BasicStoppableWatcher{
-		watcher: watcher,
-		ctx:     ctx,
-		cancel:  cancel,
+		ctx:    ctx,
+		cancel: cancel,
 	}
 
 	// init phase retrieve all the previous value and use init as action for the
 	// callback
-	for id, node := range h.Index() {
-		f("init", id, node)
+	known := make(map[string]uint64)
+	nodes, index, err := h.etcdNodes(etcdPath)
+	if err != nil {
+		logging.GetLogger().Errorf("Error while reading etcd: %s", err.Error())
+	}
+	for id, node := range nodes {
+		f("init", id, h.unmarshal(node))
+		known[id] = node.ModifiedIndex
 	}
+	sw.lastIndex = index
 
 	sw.wg.Add(1)
 	sw.running.Store(true)
 	go func() {
 		defer sw.wg.Done()
 
+		watcher := h.EtcdKeyAPI.Watcher(etcdPath, &etcd.WatcherOptions{Recursive: true, AfterIndex: sw.LastIndex()})
 		for sw.running.Load() == true {
 			resp, err := watcher.Next(sw.ctx)
 			if err != nil {
+				if sw.ctx.Err() != nil {
+					return
+				}
 				logging.GetLogger().Errorf("Error while watching etcd: %s", err.Error())
 
 				time.Sleep(1 * time.Second)
+
+				index, err := h.resync(etcdPath, known, f)
+				if err != nil {
+					logging.GetLogger().Errorf("Error while resyncing etcd: %s", err.Error())
+					continue
+				}
+				logging.GetLogger().Infof("Resynced %s from etcd index %d", etcdPath, index)
+
+				atomic.StoreUint64(&sw.lastIndex, index)
+				watcher = h.EtcdKeyAPI.Watcher(etcdPath, &etcd.WatcherOptions{Recursive: true, AfterIndex: index})
 				continue
 			}
 
+			atomic.StoreUint64(&sw.lastIndex, resp.Node.ModifiedIndex)
+
 			if resp.Node.Dir {
 				continue
 			}
 
-			id := strings.TrimPrefix(resp.Node.Key, etcdPath)
+			action := resp.Action
+			if a, ok := watchActions[action]; ok {
+				action = a
+			}
 
-			resource := h.ResourceHandler.New()
-			json.Unmarshal([]byte(resp.Node.Value), resource)
+			id := strings.TrimPrefix(resp.Node.Key, etcdPath)
+			switch action {
+			case "expire", "delete":
+				delete(known, id)
+			default:
+				known[id] = resp.Node.ModifiedIndex
+			}
 
-			f(resp.Action, id, resource)
+			f(action, id, h.unmarshal(resp.Node))
 		}
 	}()
 
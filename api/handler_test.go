@@ -0,0 +1,305 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// fakeKeysAPI stores the keys in memory, the events sent to the watchers
+// are pushed by the tests
+type fakeKeysAPI struct {
+	etcd.KeysAPI
+	sync.Mutex
+	index    uint64
+	nodes    map[string]*etcd.Node
+	events   chan *etcd.Response
+	watchers []uint64
+	err      error
+}
+
+type fakeWatcher struct {
+	api *fakeKeysAPI
+}
+
+func (w *fakeWatcher) Next(ctx context.Context) (*etcd.Response, error) {
+	select {
+	case resp := <-w.api.events:
+		if resp == nil {
+			return nil, errors.New("event index cleared")
+		}
+		return resp, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (k *fakeKeysAPI) set(key string, value string) *etcd.Node {
+	k.Lock()
+	defer k.Unlock()
+
+	k.index++
+	node := &etcd.Node{Key: key, Value: value, ModifiedIndex: k.index}
+	k.nodes[key] = node
+	return node
+}
+
+func (k *fakeKeysAPI) delete(key string) {
+	k.Lock()
+	defer k.Unlock()
+
+	k.index++
+	delete(k.nodes, key)
+}
+
+// Set sends the event of the compare-and-swap writes to the watchers
+func (k *fakeKeysAPI) Set(ctx context.Context, key string, value string, opts *etcd.SetOptions) (*etcd.Response, error) {
+	if k.err != nil {
+		return nil, k.err
+	}
+
+	if opts == nil || opts.PrevIndex == 0 {
+		return &etcd.Response{Action: "set", Node: k.set(key, value)}, nil
+	}
+
+	k.Lock()
+	prev, ok := k.nodes[key]
+	k.Unlock()
+	if !ok || prev.ModifiedIndex != opts.PrevIndex {
+		return nil, etcd.Error{Code: etcd.ErrorCodeTestFailed, Message: "Compare failed"}
+	}
+
+	resp := &etcd.Response{Action: "compareAndSwap", Node: k.set(key, value)}
+	go func() {
+		k.events <- resp
+	}()
+	return resp, nil
+}
+
+// Delete sends the delete event to the watchers
+func (k *fakeKeysAPI) Delete(ctx context.Context, key string, opts *etcd.DeleteOptions) (*etcd.Response, error) {
+	k.delete(key)
+
+	resp := &etcd.Response{Action: "delete", Node: &etcd.Node{Key: key}}
+	go func() {
+		k.events <- resp
+	}()
+	return resp, nil
+}
+
+func (k *fakeKeysAPI) Get(ctx context.Context, key string, opts *etcd.GetOptions) (*etcd.Response, error) {
+	k.Lock()
+	defer k.Unlock()
+
+	if node, ok := k.nodes[key]; ok {
+		return &etcd.Response{Action: "get", Node: node, Index: k.index}, nil
+	}
+	if !strings.HasSuffix(key, "/") {
+		return nil, etcd.Error{Code: etcd.ErrorCodeKeyNotFound, Message: "Key not found", Index: k.index}
+	}
+
+	dir := &etcd.Node{Key: key, Dir: true}
+	for _, node := range k.nodes {
+		dir.Nodes = append(dir.Nodes, node)
+	}
+	return &etcd.Response{Action: "get", Node: dir, Index: k.index}, nil
+}
+
+func (k *fakeKeysAPI) Watcher(key string, opts *etcd.WatcherOptions) etcd.Watcher {
+	k.Lock()
+	defer k.Unlock()
+
+	k.watchers = append(k.watchers, opts.AfterIndex)
+	return &fakeWatcher{api: k}
+}
+
+func storeAlert(t *testing.T, k *fakeKeysAPI, name string) (string, *etcd.Node) {
+	alert := NewAlert()
+	alert.Name = name
+	alert.Select = "MTU"
+	alert.Test = "MTU > 1500"
+
+	data, err := json.Marshal(alert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return alert.ID(), k.set("/alert/"+alert.ID(), string(data))
+}
+
+func waitEvents(t *testing.T, events chan string, count int) []string {
+	var received []string
+	for len(received) < count {
+		select {
+		case e := <-events:
+			received = append(received, e)
+		case <-time.After(3 * time.Second):
+			t.Fatalf("Expected %d events, got %v", count, received)
+		}
+	}
+	sort.Strings(received)
+	return received
+}
+
+func TestAsyncWatchResync(t *testing.T) {
+	k := &fakeKeysAPI{
+		nodes:  make(map[string]*etcd.Node),
+		events: make(chan *etcd.Response),
+	}
+	h := &BasicApiHandler{ResourceHandler: &AlertHandler{}, EtcdKeyAPI: k}
+
+	updated, _ := storeAlert(t, k, "updated")
+	deleted, _ := storeAlert(t, k, "deleted")
+	unchanged, _ := storeAlert(t, k, "unchanged")
+
+	events := make(chan string, 10)
+	w := h.AsyncWatch(func(action string, id string, resource ApiResource) {
+		events <- action + " " + resource.(*Alert).Name + " " + id
+	}).(IndexedWatcher)
+	defer w.Stop()
+
+	if received := waitEvents(t, events, 3); len(received) != 3 || w.LastIndex() != 3 {
+		t.Fatalf("Wrong init events %v at index %d", received, w.LastIndex())
+	}
+
+	// changes missed by the watcher
+	data, _ := json.Marshal(&Alert{UUID: mustParseUUID(t, updated), Name: "updated"})
+	k.set("/alert/"+updated, string(data))
+	k.delete("/alert/" + deleted)
+	created, _ := storeAlert(t, k, "created")
+	k.events <- nil
+
+	expected := []string{
+		"create created " + created,
+		"delete  " + deleted,
+		"update updated " + updated,
+	}
+	if received := waitEvents(t, events, 3); strings.Join(received, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Expected resync events %v, got %v", expected, received)
+	}
+
+	// the watch resumes after the resync index
+	_, node := storeAlert(t, k, "watched")
+	k.events <- &etcd.Response{Action: "set", Node: node}
+	if received := waitEvents(t, events, 1); !strings.HasPrefix(received[0], "set watched") {
+		t.Fatalf("Expected a set event, got %v", received)
+	}
+
+	k.Lock()
+	defer k.Unlock()
+	if len(k.watchers) != 2 || k.watchers[0] != 3 || k.watchers[1] != 6 {
+		t.Errorf("Wrong watchers indexes %v", k.watchers)
+	}
+	if w.LastIndex() != node.ModifiedIndex {
+		t.Errorf("Expected last index %d, got %d", node.ModifiedIndex, w.LastIndex())
+	}
+
+	select {
+	case e := <-events:
+		t.Errorf("Unexpected event %s, %s wasn't modified", e, unchanged)
+	default:
+	}
+}
+
+func mustParseUUID(t *testing.T, s string) UUID {
+	u, err := ParseUUID(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestSelfTest(t *testing.T) {
+	k := &fakeKeysAPI{
+		nodes:  make(map[string]*etcd.Node),
+		events: make(chan *etcd.Response),
+	}
+	h := &BasicApiHandler{ResourceHandler: &AlertHandler{}, EtcdKeyAPI: k}
+
+	if err := h.SelfTest(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(k.nodes) != 0 || len(k.watchers) != 1 || k.watchers[0] != 1 {
+		t.Errorf("Self test key should be watched then deleted: %v, %v", k.nodes, k.watchers)
+	}
+
+	k.err = errors.New("etcd down")
+	if err := h.SelfTest(); err == nil || !strings.Contains(err.Error(), "etcd down") {
+		t.Errorf("Expected a write error, got %v", err)
+	}
+}
+
+func TestUpdateWatched(t *testing.T) {
+	k := &fakeKeysAPI{
+		nodes:  make(map[string]*etcd.Node),
+		events: make(chan *etcd.Response),
+	}
+	h := &BasicApiHandler{ResourceHandler: &AlertHandler{}, EtcdKeyAPI: k}
+
+	id, _ := storeAlert(t, k, "updated")
+	alert := &Alert{}
+
+	events := make(chan string, 10)
+	w := h.AsyncWatch(func(action string, id string, resource ApiResource) {
+		*alert = *resource.(*Alert)
+		events <- action + " " + resource.(*Alert).Name
+	})
+	defer w.Stop()
+	waitEvents(t, events, 1)
+
+	// modified concurrently during the first attempt
+	var versions []uint64
+	err := h.Update(id, func(resource ApiResource, version uint64) error {
+		versions = append(versions, version)
+		if len(versions) == 1 {
+			k.Lock()
+			value := k.nodes["/alert/"+id].Value
+			k.Unlock()
+			k.set("/alert/"+id, value)
+		}
+		resource.(*Alert).Enabled = false
+		return nil
+	})
+	if err != nil || len(versions) != 2 || versions[0] == versions[1] {
+		t.Fatalf("Expected the update to be retried, got %v after %v", err, versions)
+	}
+
+	if received := waitEvents(t, events, 1); received[0] != "update updated" || alert.Enabled {
+		t.Errorf("Expected the disabled alert to be watched, got %v: %+v", received, alert)
+	}
+
+	if err := h.Update("unknown", nil); err == nil {
+		t.Error("Expected unknown resources not to be updated")
+	} else if _, ok := err.(*NotFoundError); !ok {
+		t.Errorf("Expected a not found error, got %v", err)
+	}
+}
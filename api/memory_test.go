@@ -0,0 +1,84 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package api
+
+import (
+	"sync"
+)
+
+// MemoryApiHandler is an ApiHandler keeping the resources in memory, with
+// no validation nor watch support, see apitest for the tests of the other
+// packages
+type MemoryApiHandler struct {
+	ResourceHandler
+	lock      sync.RWMutex
+	resources map[string]ApiResource
+}
+
+func (h *MemoryApiHandler) Index() map[string]ApiResource {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	resources := make(map[string]ApiResource, len(h.resources))
+	for id, r := range h.resources {
+		resources[id] = r
+	}
+	return resources
+}
+
+func (h *MemoryApiHandler) Get(id string) (ApiResource, bool) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	r, ok := h.resources[id]
+	return r, ok
+}
+
+func (h *MemoryApiHandler) Create(r ApiResource) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.resources[r.ID()] = r
+	return nil
+}
+
+func (h *MemoryApiHandler) Delete(id string) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	delete(h.resources, id)
+	return nil
+}
+
+func (h *MemoryApiHandler) AsyncWatch(f ApiWatcherCallback) StoppableWatcher {
+	return nil
+}
+
+// NewMemoryApiHandler returns an empty handler of the resources of rh, any
+// kind of resource can be stored though
+func NewMemoryApiHandler(rh ResourceHandler) *MemoryApiHandler {
+	return &MemoryApiHandler{
+		ResourceHandler: rh,
+		resources:       make(map[string]ApiResource),
+	}
+}
@@ -28,6 +28,7 @@ import (
 
 	"github.com/abbot/go-http-auth"
 	shttp "github.com/redhat-cip/skydive/http"
+	"github.com/redhat-cip/skydive/topology"
 	"github.com/redhat-cip/skydive/topology/graph"
 )
 
@@ -45,6 +46,86 @@ func (t *TopologyApi) topologyIndex(w http.ResponseWriter, r *auth.Authenticated
 	}
 }
 
+type ShortestPath struct {
+	NodePath string
+	Nodes    []*graph.Node
+}
+
+// topologyShortestPath returns the shortest path between the source and the
+// destination nodes, optionally following only the edges of the given
+// relation type.
+func (t *TopologyApi) topologyShortestPath(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	query := r.URL.Query()
+
+	var ev []graph.EdgeValidator
+	if relation := query.Get("edge"); relation != "" {
+		ev = append(ev, func(e *graph.Edge) bool {
+			return e.Metadata()["RelationType"] == relation
+		})
+	}
+
+	t.Graph.RLock()
+	defer t.Graph.RUnlock()
+
+	src := t.Graph.GetNode(graph.Identifier(query.Get("source")))
+	dst := t.Graph.GetNode(graph.Identifier(query.Get("destination")))
+	if src == nil || dst == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// NodePath marshals the nodes in the reverse order
+	nodes := t.Graph.LookupShortestPathToNode(dst, src, ev...)
+	if len(nodes) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	path := &ShortestPath{
+		NodePath: topology.NodePath{Nodes: nodes}.Marshal(),
+	}
+	for i := len(nodes) - 1; i >= 0; i-- {
+		path.Nodes = append(path.Nodes, nodes[i])
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(path); err != nil {
+		panic(err)
+	}
+}
+
+// TopologyCount is the number of nodes and edges matching a filter
+type TopologyCount struct {
+	Nodes int
+	Edges int
+}
+
+// topologyCount counts the nodes and the edges whose metadata match the
+// filter parameter, a JSON object, all of them without filter.
+func (t *TopologyApi) topologyCount(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	filter := graph.Metadata{}
+	if f := r.URL.Query().Get("filter"); f != "" {
+		if err := json.Unmarshal([]byte(f), &filter); err != nil {
+			http.Error(w, "invalid filter: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	t.Graph.RLock()
+	count := &TopologyCount{
+		Nodes: t.Graph.CountNodes(filter),
+		Edges: t.Graph.CountEdges(filter),
+	}
+	t.Graph.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(count); err != nil {
+		panic(err)
+	}
+}
+
 func (t *TopologyApi) registerEndpoints(r *shttp.Server) {
 	routes := []shttp.Route{
 		{
@@ -53,6 +134,18 @@ func (t *TopologyApi) registerEndpoints(r *shttp.Server) {
 			"/api/topology",
 			t.topologyIndex,
 		},
+		{
+			"TopologyShortestPath",
+			"GET",
+			"/api/topology/shortestpath",
+			t.topologyShortestPath,
+		},
+		{
+			"TopologyCount",
+			"GET",
+			"/api/topology/count",
+			t.topologyCount,
+		},
 	}
 
 	r.RegisterRoutes(routes)
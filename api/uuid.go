@@ -0,0 +1,88 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+
+	"github.com/nu7hatch/gouuid"
+)
+
+// UUID wraps gouuid so that resources identifiers can be compared without
+// being stringified. The zero value is serialized as an empty string.
+type UUID uuid.UUID
+
+func NewUUID() UUID {
+	u, _ := uuid.NewV4()
+	return UUID(*u)
+}
+
+func ParseUUID(s string) (UUID, error) {
+	if s == "" {
+		return UUID{}, nil
+	}
+
+	u, err := uuid.ParseHex(s)
+	if err != nil {
+		return UUID{}, err
+	}
+	return UUID(*u), nil
+}
+
+func (id UUID) IsZero() bool {
+	return id == UUID{}
+}
+
+// Equal compares the underlying bytes in constant time
+func (id UUID) Equal(other UUID) bool {
+	return subtle.ConstantTimeCompare(id[:], other[:]) == 1
+}
+
+func (id UUID) String() string {
+	if id.IsZero() {
+		return ""
+	}
+
+	u := uuid.UUID(id)
+	return u.String()
+}
+
+func (id UUID) MarshalJSON() ([]byte, error) {
+	return json.Marshal(id.String())
+}
+
+func (id *UUID) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	u, err := ParseUUID(s)
+	if err != nil {
+		return err
+	}
+	*id = u
+
+	return nil
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestUUID_ParseEqual(t *testing.T) {
+	id := NewUUID()
+
+	parsed, err := ParseUUID(id.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !id.Equal(parsed) {
+		t.Errorf("UUIDs should be equal: %s != %s", id.String(), parsed.String())
+	}
+
+	if id.Equal(NewUUID()) {
+		t.Error("Two generated UUIDs should not be equal")
+	}
+
+	if _, err := ParseUUID("not-an-uuid"); err == nil {
+		t.Error("Parsing an invalid UUID should fail")
+	}
+}
+
+func TestUUID_JSON(t *testing.T) {
+	alert := NewAlert()
+
+	data, err := json.Marshal(alert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded Alert
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	if !decoded.UUID.Equal(alert.UUID) {
+		t.Errorf("UUID corrupted: %s != %s", decoded.UUID.String(), alert.UUID.String())
+	}
+
+	var empty UUID
+	if data, _ := json.Marshal(empty); string(data) != `""` {
+		t.Errorf("Zero UUID should be serialized as an empty string, got %s", string(data))
+	}
+}
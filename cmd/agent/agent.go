@@ -45,6 +45,23 @@ var Agent = &cobra.Command{
 		agent.Start()
 
 		logging.GetLogger().Notice("Skydive Agent started")
+
+		go func() {
+			hup := make(chan os.Signal, 1)
+			signal.Notify(hup, syscall.SIGHUP)
+			for range hup {
+				if err := config.ReloadConfig(); err != nil {
+					logging.GetLogger().Errorf("Unable to reload configuration: %s", err.Error())
+					continue
+				}
+				if err := agent.ReloadAnalyzers(); err != nil {
+					logging.GetLogger().Errorf("Unable to reload the analyzers: %s", err.Error())
+					continue
+				}
+				logging.GetLogger().Notice("Skydive Agent configuration reloaded")
+			}
+		}()
+
 		ch := make(chan os.Signal)
 		signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
 		<-ch
@@ -57,17 +74,17 @@ var Agent = &cobra.Command{
 
 func init() {
 	Agent.Flags().String("listen", "127.0.0.1:8081", "address and port for the agent API")
-	config.GetConfig().BindPFlag("agent.listen", Agent.Flags().Lookup("listen"))
+	config.BindPFlag("agent.listen", Agent.Flags().Lookup("listen"))
 
 	Agent.Flags().String("ovsdb", "127.0.0.1:6400", "ovsdb connection")
-	config.GetConfig().BindPFlag("ovs.ovsdb", Agent.Flags().Lookup("ovsdb"))
+	config.BindPFlag("ovs.ovsdb", Agent.Flags().Lookup("ovsdb"))
 
 	Agent.Flags().String("sflow-listen", "127.0.0.1:6345", "listen parameter for the sflow agent")
-	config.GetConfig().BindPFlag("sflow.listen", Agent.Flags().Lookup("sflow-listen"))
+	config.BindPFlag("sflow.listen", Agent.Flags().Lookup("sflow-listen"))
 
 	Agent.Flags().Int("flowtable-expire", 300, "expiration time for flowtable entries")
-	config.GetConfig().BindPFlag("agent.flowtable_expire", Agent.Flags().Lookup("flowtable-expire"))
+	config.BindPFlag("agent.flowtable_expire", Agent.Flags().Lookup("flowtable-expire"))
 
 	Agent.Flags().Int("flowtable-update", 30, "send updated flows to analyzer every time (second)")
-	config.GetConfig().BindPFlag("agent.flowtable_update", Agent.Flags().Lookup("flowtable-update"))
+	config.BindPFlag("agent.flowtable_update", Agent.Flags().Lookup("flowtable-update"))
 }
@@ -29,7 +29,10 @@ import (
 
 	"github.com/redhat-cip/skydive/analyzer"
 	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/flow/mappings"
 	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/topology/alert"
+	"github.com/redhat-cip/skydive/topology/graph"
 
 	"github.com/spf13/cobra"
 )
@@ -47,9 +50,31 @@ var Analyzer = &cobra.Command{
 			logging.GetLogger().Fatalf("Can't start Analyzer : %v", err)
 		}
 
+		if brokers := config.GetConfig().GetStringSlice("analyzer.alert_kafka_brokers"); len(brokers) > 0 {
+			sink := alert.NewKafkaAlertSink(brokers, config.GetConfig().GetString("analyzer.alert_kafka_topic"))
+			server.AlertServer.AlertManager.AddEventListener(sink)
+			sink.Start()
+			defer sink.Stop()
+		}
+
 		server.ListenAndServe()
 
 		logging.GetLogger().Notice("Skydive Analyzer started !")
+
+		go func() {
+			hup := make(chan os.Signal, 1)
+			signal.Notify(hup, syscall.SIGHUP)
+			for range hup {
+				if err := config.ReloadConfig(); err != nil {
+					logging.GetLogger().Errorf("Unable to reload configuration: %s", err.Error())
+					continue
+				}
+				// analyzer.flowtable_expire, analyzer.flowtable_update and
+				// analyzer.max_flows_per_second are applied by the server
+				logging.GetLogger().Notice("Skydive Analyzer configuration reloaded")
+			}
+		}()
+
 		ch := make(chan os.Signal)
 		signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
 		<-ch
@@ -60,34 +85,100 @@ var Analyzer = &cobra.Command{
 	},
 }
 
+var replayEnhance bool
+
+var Replay = &cobra.Command{
+	Use:          "replay [file]",
+	Short:        "Store the flows of a file",
+	Long:         "Store the flows of a file, one JSON flow per line like in the elasticsearch deadletter file, using the analyzer storage",
+	SilenceUsage: true,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			cmd.Usage()
+			os.Exit(1)
+		}
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		file, err := os.Open(args[0])
+		if err != nil {
+			logging.GetLogger().Fatalf("Can't open flow file: %v", err)
+		}
+		defer file.Close()
+
+		storage, err := analyzer.NewStorageFromConfig()
+		if err != nil {
+			logging.GetLogger().Fatalf("Can't replay flows: %v", err)
+		}
+		if storage == nil {
+			logging.GetLogger().Fatal("Can't replay flows: no storage configured, see analyzer.storage")
+		}
+
+		// the flows are enhanced with the topology of the graph backend, only
+		// relevant with a backend shared with the analyzers
+		var pipeline *mappings.FlowMappingPipeline
+		if replayEnhance {
+			backend, err := graph.BackendFromConfig()
+			if err != nil {
+				logging.GetLogger().Fatalf("Can't replay flows: %v", err)
+			}
+			g, err := graph.NewGraph(backend)
+			if err != nil {
+				logging.GetLogger().Fatalf("Can't replay flows: %v", err)
+			}
+			pipeline = mappings.NewFlowMappingPipeline(mappings.NewGraphFlowEnhancer(g), mappings.NewOvsFlowEnhancer(g))
+		}
+
+		storage.Start()
+		count, err := analyzer.ReplayFlows(file, storage, pipeline)
+		storage.Stop()
+		if err != nil {
+			logging.GetLogger().Fatalf("Replay stopped after %d flows: %v", count, err)
+		}
+
+		logging.GetLogger().Noticef("%d flows replayed", count)
+	},
+}
+
 func init() {
 	Analyzer.Flags().String("listen", "127.0.0.1:8082", "address and port for the analyzer API")
-	config.GetConfig().BindPFlag("analyzer.listen", Analyzer.Flags().Lookup("listen"))
+	config.BindPFlag("analyzer.listen", Analyzer.Flags().Lookup("listen"))
+
+	Analyzer.Flags().String("flow-listen", "", "address and port receiving the flows, the API address if empty")
+	config.BindPFlag("analyzer.flow_listen", Analyzer.Flags().Lookup("flow-listen"))
+
+	Analyzer.Flags().Bool("no-storage", false, "run without storage, the flows are analyzed but not persisted")
+	config.BindPFlag("analyzer.no_storage", Analyzer.Flags().Lookup("no-storage"))
 
 	Analyzer.Flags().Int("flowtable-expire", 600, "expiration time for flowtable entries")
-	config.GetConfig().BindPFlag("analyzer.flowtable_expire", Analyzer.Flags().Lookup("flowtable-expire"))
+	config.BindPFlag("analyzer.flowtable_expire", Analyzer.Flags().Lookup("flowtable-expire"))
 
 	Analyzer.Flags().Int("flowtable-update", 60, "send updated flows to storage every time (second)")
-	config.GetConfig().BindPFlag("analyzer.flowtable_update", Analyzer.Flags().Lookup("flowtable-update"))
+	config.BindPFlag("analyzer.flowtable_update", Analyzer.Flags().Lookup("flowtable-update"))
+
+	Analyzer.Flags().Int("max-flows-per-second", 0, "maximum number of flows received per second, 0 means unlimited")
+	config.BindPFlag("analyzer.max_flows_per_second", Analyzer.Flags().Lookup("max-flows-per-second"))
 
 	Analyzer.Flags().String("elasticsearch", "127.0.0.1:9200", "elasticsearch server")
-	config.GetConfig().BindPFlag("storage.elasticsearch", Analyzer.Flags().Lookup("elasticsearch"))
+	config.BindPFlag("storage.elasticsearch", Analyzer.Flags().Lookup("elasticsearch"))
 
 	Analyzer.Flags().String("etcd", "http://127.0.0.1:2379", "etcd servers")
-	config.GetConfig().BindPFlag("etcd.servers", Analyzer.Flags().Lookup("etcd"))
+	config.BindPFlag("etcd.servers", Analyzer.Flags().Lookup("etcd"))
 
 	Analyzer.Flags().Bool("embed-etcd", true, "embed etcd")
-	config.GetConfig().BindPFlag("etcd.embedded", Analyzer.Flags().Lookup("embed-etcd"))
+	config.BindPFlag("etcd.embedded", Analyzer.Flags().Lookup("embed-etcd"))
 
 	Analyzer.Flags().Int("etcd-port", 2379, "embedded etcd port")
-	config.GetConfig().BindPFlag("etcd.port", Analyzer.Flags().Lookup("etcd-port"))
+	config.BindPFlag("etcd.port", Analyzer.Flags().Lookup("etcd-port"))
 
 	Analyzer.Flags().String("etcd-datadir", "/tmp/skydive-etcd", "embedded etcd data folder")
-	config.GetConfig().BindPFlag("etcd.data_dir", Analyzer.Flags().Lookup("etcd-datadir"))
+	config.BindPFlag("etcd.data_dir", Analyzer.Flags().Lookup("etcd-datadir"))
 
 	Analyzer.Flags().String("graph-backend", "memory", "graph backend")
-	config.GetConfig().BindPFlag("graph.backend", Analyzer.Flags().Lookup("graph-backend"))
+	config.BindPFlag("graph.backend", Analyzer.Flags().Lookup("graph-backend"))
 
 	Analyzer.Flags().String("gremlin", "ws://127.0.0.1:8182", "gremlin server")
-	config.GetConfig().BindPFlag("graph.gremlin", Analyzer.Flags().Lookup("gremlin"))
+	config.BindPFlag("graph.gremlin", Analyzer.Flags().Lookup("gremlin"))
+
+	Replay.Flags().BoolVarP(&replayEnhance, "enhance", "", false, "enhance the flows with the topology of the graph backend before storing them")
+	Analyzer.AddCommand(Replay)
 }
@@ -23,6 +23,7 @@
 package client
 
 import (
+	"net/url"
 	"os"
 
 	"github.com/redhat-cip/skydive/api"
@@ -37,6 +38,24 @@ var (
 	alertSelect      string
 	alertTest        string
 	alertAction      string
+	alertMessage     string
+	alertSeverity    string
+	alertAggregate   string
+	alertDelta       string
+	alertDeltaWindow int
+	alertFlow        bool
+	alertFlowWindow  int
+	alertHost        string
+	alertGroupWindow int
+	alertMaxActions  int
+	alertSnapshot    bool
+	alertSync        bool
+	alertFireOnce    bool
+	neighborEdge     string
+	neighborAlias    string
+	linkedEdge       string
+	linkedField      string
+	alertDedup       string
 )
 
 var AlertCmd = &cobra.Command{
@@ -61,7 +80,36 @@ var AlertCreate = &cobra.Command{
 		setFromFlag(cmd, "select", &alert.Select)
 		setFromFlag(cmd, "action", &alert.Action)
 		setFromFlag(cmd, "test", &alert.Test)
-		if err := client.Create("alert", &alert); err != nil {
+		setFromFlag(cmd, "message", &alert.Message)
+		setFromFlag(cmd, "severity", &alert.Severity)
+		setFromFlag(cmd, "aggregate", &alert.Aggregate)
+		setFromFlag(cmd, "delta", &alert.Delta)
+		setFromFlag(cmd, "host", &alert.Host)
+		setFromFlag(cmd, "neighbor-edge", &alert.NeighborEdge)
+		setFromFlag(cmd, "neighbor-alias", &alert.NeighborAlias)
+		setFromFlag(cmd, "linked-edge", &alert.LinkedEdge)
+		setFromFlag(cmd, "linked-field", &alert.LinkedField)
+		alert.GroupWindow = alertGroupWindow
+		alert.MaxActionsPerMinute = alertMaxActions
+		alert.Snapshot = alertSnapshot
+		alert.Synchronous = alertSync
+		alert.FireOnce = alertFireOnce
+		alert.DeltaWindow = alertDeltaWindow
+		alert.FlowWindow = alertFlowWindow
+		if cmd.LocalFlags().Lookup("aggregate").Changed {
+			alert.Type = api.AGGREGATE
+		}
+		if cmd.LocalFlags().Lookup("delta").Changed {
+			alert.Type = api.THRESHOLD
+		}
+		if alertFlow {
+			alert.Type = api.FLOW
+		}
+		params := url.Values{}
+		if alertDedup != "" {
+			params.Set("dedup", alertDedup)
+		}
+		if err := client.CreateWithParams("alert", params, &alert); err != nil {
 			logging.GetLogger().Errorf(err.Error())
 			os.Exit(1)
 		}
@@ -130,12 +178,77 @@ var AlertDelete = &cobra.Command{
 	},
 }
 
+func setAlertEnabled(id string, enabled bool) {
+	var alert api.Alert
+	client := api.NewCrudClientFromConfig(&authenticationOpts)
+	if client == nil {
+		os.Exit(1)
+	}
+	if err := client.Get("alert", id, &alert); err != nil {
+		logging.GetLogger().Errorf(err.Error())
+		os.Exit(1)
+	}
+	alert.Enabled = enabled
+	if err := client.Update("alert", id, &alert); err != nil {
+		logging.GetLogger().Errorf(err.Error())
+		os.Exit(1)
+	}
+	printJSON(&alert)
+}
+
+var AlertEnable = &cobra.Command{
+	Use:   "enable [alert]",
+	Short: "Enable alert",
+	Long:  "Enable alert",
+	PreRun: func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			cmd.Usage()
+			os.Exit(1)
+		}
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		setAlertEnabled(args[0], true)
+	},
+}
+
+var AlertDisable = &cobra.Command{
+	Use:   "disable [alert]",
+	Short: "Disable alert without deleting it",
+	Long:  "Disable alert without deleting it",
+	PreRun: func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			cmd.Usage()
+			os.Exit(1)
+		}
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		setAlertEnabled(args[0], false)
+	},
+}
+
 func addAlertFlags(cmd *cobra.Command) {
 	cmd.Flags().StringVarP(&alertName, "name", "", "", "alert name")
 	cmd.Flags().StringVarP(&alertDescription, "description", "", "", "alert description")
 	cmd.Flags().StringVarP(&alertSelect, "select", "", "", "alert select criteria")
 	cmd.Flags().StringVarP(&alertTest, "test", "", "", "alert test")
-	cmd.Flags().StringVarP(&alertAction, "action", "", "", "alert action")
+	cmd.Flags().StringVarP(&alertAction, "action", "", "", "alert action, metadata:<key> sets the key to true on the matching nodes while the alert fires")
+	cmd.Flags().StringVarP(&alertMessage, "message", "", "", "alert message, node metadata can be used as template placeholders, ex: {{.Name}}")
+	cmd.Flags().StringVarP(&alertAggregate, "aggregate", "", "", "evaluate the test once on all the selected nodes, using matchCount and matchSum/matchAvg of the given metadata")
+	cmd.Flags().StringVarP(&alertDelta, "delta", "", "", "comma separated numeric metadata whose variation over the delta window is available in the test, ex: ifInErrors gives ifInErrors_delta and ifInErrors_rate")
+	cmd.Flags().IntVarP(&alertDeltaWindow, "delta-window", "", 60, "number of seconds over which the deltas are computed")
+	cmd.Flags().BoolVarP(&alertFlow, "flow", "", false, "test the flows stored by the analyzer, select being URL encoded flow filters, ex: LayersPath=Ethernet/IPv4/TCP, the test can use flowCount, flowBytes and flowPackets")
+	cmd.Flags().IntVarP(&alertFlowWindow, "flow-window", "", 300, "number of seconds during which the flows tested have to be updated")
+	cmd.Flags().StringVarP(&alertHost, "host", "", "", "only evaluate nodes owned by the matching host, wildcards accepted")
+	cmd.Flags().IntVarP(&alertGroupWindow, "group-window", "", 0, "coalesce the fires of the alert for the same node during the given number of seconds")
+	cmd.Flags().IntVarP(&alertMaxActions, "max-actions", "", 0, "maximum number of actions per minute, 0 for unlimited")
+	cmd.Flags().BoolVarP(&alertSnapshot, "snapshot", "", false, "store a snapshot of the matching nodes and their neighbors when the alert fires")
+	cmd.Flags().BoolVarP(&alertSync, "synchronous", "", false, "deliver the messages of the alert before evaluating the other alerts, blocking the analyzer graph while they are published")
+	cmd.Flags().BoolVarP(&alertFireOnce, "fire-once", "", false, "disable the alert once it fired, it has to be enabled again to fire again")
+	cmd.Flags().StringVarP(&neighborEdge, "neighbor-edge", "", "", "relation type of the edge to the parent node used by the test, any if empty")
+	cmd.Flags().StringVarP(&neighborAlias, "neighbor-alias", "", "", "prefix of the parent node metadata in the test, ex: parent gives parent_State")
+	cmd.Flags().StringVarP(&linkedEdge, "linked-edge", "", "", "relation type of the edge to the node holding the linked field, any if empty")
+	cmd.Flags().StringVarP(&linkedField, "linked-field", "", "", "numeric metadata of a linked node used by the test, ex: Speed gives linked_Speed")
+	cmd.Flags().StringVarP(&alertSeverity, "severity", "", "warning", "alert severity: info, warning or critical")
 }
 
 func init() {
@@ -143,6 +256,9 @@ func init() {
 	AlertCmd.AddCommand(AlertGet)
 	AlertCmd.AddCommand(AlertCreate)
 	AlertCmd.AddCommand(AlertDelete)
+	AlertCmd.AddCommand(AlertEnable)
+	AlertCmd.AddCommand(AlertDisable)
 
 	addAlertFlags(AlertCreate)
+	AlertCreate.Flags().StringVarP(&alertDedup, "dedup", "", "", "behavior when an alert with the same select, test and action exists: reject or merge")
 }
@@ -24,6 +24,7 @@ package client
 
 import (
 	"fmt"
+	"net/url"
 	"os"
 
 	"github.com/redhat-cip/skydive/api"
@@ -33,8 +34,12 @@ import (
 )
 
 var (
-	probePath string
-	bpfFilter string
+	probePath       string
+	bpfFilter       string
+	flowTableExpire int
+	flowTableUpdate int
+	captureType     string
+	captureAnalyzer string
 )
 
 var CaptureCmd = &cobra.Command{
@@ -55,11 +60,21 @@ var CaptureCreate = &cobra.Command{
 			os.Exit(1)
 		}
 
+		if flowTableExpire < 0 || flowTableUpdate < 0 {
+			fmt.Println("Flow table expire and update durations must be positive")
+			cmd.Usage()
+			os.Exit(1)
+		}
+
 		client := api.NewCrudClientFromConfig(&authenticationOpts)
 		if client == nil {
 			os.Exit(1)
 		}
 		capture := api.NewCapture(probePath, bpfFilter)
+		capture.FlowTableExpire = flowTableExpire
+		capture.FlowTableUpdate = flowTableUpdate
+		capture.Type = captureType
+		capture.Analyzer = captureAnalyzer
 		if err := client.Create("capture", &capture); err != nil {
 			logging.GetLogger().Errorf(err.Error())
 			os.Exit(1)
@@ -86,6 +101,48 @@ var CaptureList = &cobra.Command{
 	},
 }
 
+var CaptureActive = &cobra.Command{
+	Use:   "active",
+	Short: "List the captures running on the agents",
+	Long:  "List the captures running on the agents with the nodes on which their probe runs",
+	Run: func(cmd *cobra.Command, args []string) {
+		var captures map[string]api.ActiveCapture
+		client := api.NewCrudClientFromConfig(&authenticationOpts)
+		if client == nil {
+			os.Exit(1)
+		}
+		if err := client.List("capture/active", &captures); err != nil {
+			logging.GetLogger().Errorf(err.Error())
+			os.Exit(1)
+		}
+		printJSON(captures)
+	},
+}
+
+var CaptureSubgraph = &cobra.Command{
+	Use:   "subgraph [capture]",
+	Short: "Display the topology covered by a capture",
+	Long:  "Display the nodes of the probe path of a capture and the nodes attached to the probed node",
+	PreRun: func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			cmd.Usage()
+			os.Exit(1)
+		}
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		var sg api.CaptureGraph
+		client := api.NewCrudClientFromConfig(&authenticationOpts)
+		if client == nil {
+			os.Exit(1)
+		}
+		if err := client.List("capture/subgraph?id="+url.QueryEscape(args[0]), &sg); err != nil {
+			logging.GetLogger().Errorf(err.Error())
+			os.Exit(1)
+		}
+		printJSON(&sg)
+	},
+}
+
 var CaptureGet = &cobra.Command{
 	Use:   "get [capture]",
 	Short: "Display capture",
@@ -110,7 +167,7 @@ var CaptureGet = &cobra.Command{
 var CaptureDelete = &cobra.Command{
 	Use:   "delete [capture]",
 	Short: "Delete capture",
-	Long:  "Delete capture",
+	Long:  "Delete capture, the agents then stop its probes",
 	PreRun: func(cmd *cobra.Command, args []string) {
 		if len(args) == 0 {
 			cmd.Usage()
@@ -132,12 +189,18 @@ var CaptureDelete = &cobra.Command{
 func addCaptureFlags(cmd *cobra.Command) {
 	cmd.Flags().StringVarP(&probePath, "probepath", "", "", "probe path")
 	cmd.Flags().StringVarP(&bpfFilter, "bpf", "", "", "BPF filter")
+	cmd.Flags().StringVarP(&captureType, "type", "", "", "capture type: pcap, afpacket or ovssflow, chosen from the node type if empty")
+	cmd.Flags().IntVarP(&flowTableExpire, "flowtable-expire", "", 0, "flow table expire in second, default to the agent configuration")
+	cmd.Flags().IntVarP(&flowTableUpdate, "flowtable-update", "", 0, "flow table update in second, default to the agent configuration")
+	cmd.Flags().StringVarP(&captureAnalyzer, "analyzer", "", "", "address:port of the analyzer the flows are sent to, ovssflow captures only")
 }
 
 func init() {
 	CaptureCmd.AddCommand(CaptureList)
+	CaptureCmd.AddCommand(CaptureActive)
 	CaptureCmd.AddCommand(CaptureCreate)
 	CaptureCmd.AddCommand(CaptureGet)
+	CaptureCmd.AddCommand(CaptureSubgraph)
 	CaptureCmd.AddCommand(CaptureDelete)
 
 	addCaptureFlags(CaptureCreate)
@@ -67,7 +67,7 @@ func init() {
 	rootCmd.PersistentFlags().StringVarP(&cfgPath, "conf", "c", "", "location of Skydive agent config file")
 	rootCmd.PersistentFlags().StringVarP(&cfgBackend, "config-backend", "b", "file", "configuration backend (defaults to file)")
 	rootCmd.Flags().Int("ws-pong-timeout", 50, "WebSocket Ping/Pong timeout in second")
-	config.GetConfig().BindPFlag("ws_pong_timeout", rootCmd.Flags().Lookup("ws-pong-timeout"))
+	config.BindPFlag("ws_pong_timeout", rootCmd.Flags().Lookup("ws-pong-timeout"))
 }
 
 func main() {
@@ -59,7 +59,7 @@ func integerEqual(a interface{}, b interface{}) bool {
 	return n1 == n2
 }
 
-func toFloat64(f interface{}) (float64, error) {
+func ToFloat64(f interface{}) (float64, error) {
 	switch f.(type) {
 	case int, uint, int32, uint32, int64, uint64:
 		i, err := toInt64(f)
@@ -76,12 +76,12 @@ func toFloat64(f interface{}) (float64, error) {
 }
 
 func floatEqual(a interface{}, b interface{}) bool {
-	f1, err := toFloat64(a)
+	f1, err := ToFloat64(a)
 	if err != nil {
 		return false
 	}
 
-	f2, err := toFloat64(b)
+	f2, err := ToFloat64(b)
 	if err != nil {
 		return false
 	}
@@ -23,47 +23,126 @@
 package config
 
 import (
-	"errors"
 	"fmt"
+	"net"
 	"net/url"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 	_ "github.com/spf13/viper/remote"
 )
 
-var cfg *viper.Viper
+var (
+	// the configuration is replaced as a whole on reload, viper not
+	// supporting concurrent reads and writes
+	current    atomic.Value
+	cfgBackend string
+	cfgPath    string
+
+	// the defaults and flags registered at runtime, applied again to the
+	// reloaded configurations
+	registered   sync.Mutex
+	userDefaults = make(map[string]interface{})
+	flags        = make(map[string]*pflag.Flag)
+)
 
 func init() {
-	cfg = viper.New()
+	current.Store(newConfig())
+}
+
+// newConfig returns a configuration holding the defaults and the flags
+func newConfig() *viper.Viper {
+	cfg := viper.New()
+	setDefaults(cfg)
+
+	registered.Lock()
+	defer registered.Unlock()
+
+	for key, value := range userDefaults {
+		cfg.SetDefault(key, value)
+	}
+	for key, flag := range flags {
+		cfg.BindPFlag(key, flag)
+	}
+
+	return cfg
+}
+
+func setDefaults(cfg *viper.Viper) {
 	cfg.SetDefault("agent.analyzers", "127.0.0.1:8082")
 	cfg.SetDefault("agent.listen", "127.0.0.1:8081")
 	cfg.SetDefault("agent.flowtable_expire", 300)
 	cfg.SetDefault("agent.flowtable_update", 30)
+	cfg.SetDefault("agent.flowtable_max", 0)
+	cfg.SetDefault("agent.flowtable_max_policy", "drop-new")
+	cfg.SetDefault("agent.flow_queue_size", 10000)
+	cfg.SetDefault("agent.flow_delivery", "fire-and-forget")
+	cfg.SetDefault("agent.flow_ack_timeout", 2)
+	cfg.SetDefault("agent.flow_ack_retries", 3)
+	cfg.SetDefault("agent.flow_grpc_port", 8083)
+	cfg.SetDefault("agent.flow_enhancement_sampling", 1)
+	cfg.SetDefault("agent.heartbeat_interval", 10)
+	cfg.SetDefault("flow.key_fields", []string{"network", "transport"})
+	cfg.SetDefault("flow.kafka_topic", "skydive-flows")
 	cfg.SetDefault("ovs.ovsdb", "127.0.0.1:6400")
 	cfg.SetDefault("graph.backend", "memory")
 	cfg.SetDefault("graph.gremlin", "ws://127.0.0.1:8182")
 	cfg.SetDefault("sflow.bind_address", "127.0.0.1:6345")
 	cfg.SetDefault("sflow.port_min", 6345)
 	cfg.SetDefault("sflow.port_max", 6355)
+	cfg.SetDefault("sflow.agent_uuid", "host-bridge")
+	cfg.SetDefault("sflow.transport", "udp")
+	cfg.SetDefault("sflow.header_size", 256)
+	cfg.SetDefault("sflow.socket_dir", "/var/run/skydive")
+	cfg.SetDefault("sflow.idle_timeout", 0)
+	cfg.SetDefault("sflow.read_buffer", 0)
+	cfg.SetDefault("sflow.sampling_scale", true)
+	cfg.SetDefault("sflow.parsers", 1)
 	cfg.SetDefault("analyzer.listen", "127.0.0.1:8082")
 	cfg.SetDefault("analyzer.flowtable_expire", 600)
 	cfg.SetDefault("analyzer.flowtable_update", 60)
+	cfg.SetDefault("analyzer.max_flows_per_second", 0)
+	cfg.SetDefault("analyzer.flow_grpc_port", 0)
+	cfg.SetDefault("analyzer.workers", runtime.NumCPU())
+	cfg.SetDefault("analyzer.no_storage", false)
+	cfg.SetDefault("analyzer.agent_stale_timeout", 30)
+	cfg.SetDefault("analyzer.agent_forget_timeout", 86400)
+	cfg.SetDefault("analyzer.agent_max_count", 10000)
+	cfg.SetDefault("analyzer.alert_snapshot_dir", "/tmp/skydive-alerts")
+	cfg.SetDefault("analyzer.alert_snapshot_max_files", 1000)
+	cfg.SetDefault("analyzer.alert_eval_budget", 0)
+	cfg.SetDefault("analyzer.alert_flow_interval", 30)
+	cfg.SetDefault("analyzer.alert_correlation_window", 60)
+	cfg.SetDefault("analyzer.alert_kafka_topic", "skydive-alerts")
+	cfg.SetDefault("analyzer.alert_timestamp_format", "rfc3339")
+	cfg.SetDefault("analyzer.alert_sync_timeout", 5)
+	cfg.SetDefault("analyzer.alert_test_cache_size", 1000)
+	cfg.SetDefault("analyzer.alert_env_prefix", "SKYDIVE_ALERT_")
+	cfg.SetDefault("alert.max_count", 10000)
 	cfg.SetDefault("storage.elasticsearch", "127.0.0.1:9200")
+	cfg.SetDefault("storage.elasticsearch_compress", false)
+	cfg.SetDefault("storage.elasticsearch_deadletter", "")
+	cfg.SetDefault("storage.elasticsearch_deadletter_max_size", 100)
+	cfg.SetDefault("storage.elasticsearch_retention", 0)
 	cfg.SetDefault("ws_pong_timeout", 5)
 	cfg.SetDefault("docker.url", "unix:///var/run/docker.sock")
 	cfg.SetDefault("etcd.data_dir", "/tmp/skydive-etcd")
 	cfg.SetDefault("etcd.embedded", true)
 	cfg.SetDefault("etcd.port", 2379)
 	cfg.SetDefault("etcd.servers", []string{"http://127.0.0.1:2379"})
+	cfg.SetDefault("etcd.request_timeout", 5)
 	cfg.SetDefault("auth.type", "noauth")
 	cfg.SetDefault("auth.keystone.tenant", "admin")
 }
 
-func checkStrictPositive(key string) error {
+func checkStrictPositive(cfg *viper.Viper, key string) error {
 	if value := cfg.GetInt(key); value < 1 {
 		return fmt.Errorf("invalid value for %s (%d)", key, value)
 	}
@@ -71,23 +150,154 @@ func checkStrictPositive(key string) error {
 	return nil
 }
 
-func checkConfig() error {
-	if err := checkStrictPositive("agent.flowtable_expire"); err != nil {
+func checkConfig(cfg *viper.Viper) error {
+	if err := checkStrictPositive(cfg, "agent.flowtable_expire"); err != nil {
+		return err
+	}
+
+	if err := checkStrictPositive(cfg, "agent.flowtable_update"); err != nil {
+		return err
+	}
+
+	if err := checkStrictPositive(cfg, "analyzer.flowtable_expire"); err != nil {
+		return err
+	}
+
+	if err := checkStrictPositive(cfg, "analyzer.flowtable_update"); err != nil {
+		return err
+	}
+
+	if err := checkStrictPositive(cfg, "analyzer.workers"); err != nil {
 		return err
 	}
 
-	if err := checkStrictPositive("agent.flowtable_update"); err != nil {
+	if err := checkStrictPositive(cfg, "analyzer.alert_flow_interval"); err != nil {
 		return err
 	}
 
-	if err := checkStrictPositive("analyzer.flowtable_expire"); err != nil {
+	if err := checkStrictPositive(cfg, "analyzer.alert_sync_timeout"); err != nil {
 		return err
 	}
 
-	if err := checkStrictPositive("analyzer.flowtable_update"); err != nil {
+	if err := checkStrictPositive(cfg, "analyzer.alert_test_cache_size"); err != nil {
 		return err
 	}
 
+	if err := checkStrictPositive(cfg, "agent.flow_queue_size"); err != nil {
+		return err
+	}
+
+	if err := checkStrictPositive(cfg, "agent.flow_enhancement_sampling"); err != nil {
+		return err
+	}
+
+	if err := checkStrictPositive(cfg, "sflow.parsers"); err != nil {
+		return err
+	}
+
+	if err := checkStrictPositive(cfg, "storage.elasticsearch_deadletter_max_size"); err != nil {
+		return err
+	}
+
+	if interval := cfg.GetInt("agent.heartbeat_interval"); interval < 0 {
+		return fmt.Errorf("invalid value for agent.heartbeat_interval (%d)", interval)
+	}
+
+	if err := checkStrictPositive(cfg, "analyzer.agent_stale_timeout"); err != nil {
+		return err
+	}
+
+	if forget := cfg.GetInt("analyzer.agent_forget_timeout"); forget < cfg.GetInt("analyzer.agent_stale_timeout") {
+		return fmt.Errorf("analyzer.agent_forget_timeout (%d) has to be greater than analyzer.agent_stale_timeout", forget)
+	}
+
+	if err := checkStrictPositive(cfg, "analyzer.agent_max_count"); err != nil {
+		return err
+	}
+
+	if retention := cfg.GetInt("storage.elasticsearch_retention"); retention < 0 {
+		return fmt.Errorf("invalid value for storage.elasticsearch_retention (%d)", retention)
+	}
+
+	switch format := cfg.GetString("analyzer.alert_timestamp_format"); format {
+	case "rfc3339", "epoch-millis":
+	default:
+		return fmt.Errorf("invalid value for analyzer.alert_timestamp_format (%s)", format)
+	}
+
+	if max := cfg.GetInt("alert.max_count"); max < 0 {
+		return fmt.Errorf("invalid value for alert.max_count (%d)", max)
+	}
+
+	if max := cfg.GetInt("agent.flowtable_max"); max < 0 {
+		return fmt.Errorf("invalid value for agent.flowtable_max (%d)", max)
+	}
+
+	switch policy := cfg.GetString("agent.flowtable_max_policy"); policy {
+	case "drop-new", "evict-oldest", "force-expire":
+	default:
+		return fmt.Errorf("invalid value for agent.flowtable_max_policy (%s)", policy)
+	}
+
+	fields := cfg.GetStringSlice("flow.key_fields")
+	if len(fields) == 0 {
+		return fmt.Errorf("flow.key_fields can't be empty")
+	}
+	for _, field := range fields {
+		switch field {
+		case "network", "protocol", "transport", "vlan", "mpls":
+		default:
+			return fmt.Errorf("invalid value for flow.key_fields (%s)", field)
+		}
+	}
+
+	if port := cfg.GetInt("analyzer.flow_grpc_port"); port < 0 || port > 65535 {
+		return fmt.Errorf("invalid value for analyzer.flow_grpc_port (%d)", port)
+	}
+
+	switch delivery := cfg.GetString("agent.flow_delivery"); delivery {
+	case "fire-and-forget":
+	case "grpc":
+		if port := cfg.GetInt("agent.flow_grpc_port"); port < 1 || port > 65535 {
+			return fmt.Errorf("invalid value for agent.flow_grpc_port (%d)", port)
+		}
+	case "ack":
+		if err := checkStrictPositive(cfg, "agent.flow_ack_timeout"); err != nil {
+			return err
+		}
+	case "kafka":
+		if len(cfg.GetStringSlice("flow.kafka_brokers")) == 0 {
+			return fmt.Errorf("flow.kafka_brokers is required by the kafka flow delivery")
+		}
+	default:
+		return fmt.Errorf("invalid value for agent.flow_delivery (%s)", delivery)
+	}
+
+	if err := checkStrictPositive(cfg, "etcd.request_timeout"); err != nil {
+		return err
+	}
+
+	switch transport := cfg.GetString("sflow.transport"); transport {
+	case "udp":
+	case "unix":
+		if cfg.GetString("sflow.socket_dir") == "" {
+			return fmt.Errorf("sflow.socket_dir is required by the unix sflow transport")
+		}
+
+		// ovsdb only accepts ip:port sflow targets
+		for _, probe := range cfg.GetStringSlice("agent.flow.probes") {
+			if probe == "ovssflow" {
+				return fmt.Errorf("the unix sflow transport is not supported by the ovssflow probe, Open vSwitch only sends sFlow over udp")
+			}
+		}
+	default:
+		return fmt.Errorf("invalid value for sflow.transport (%s)", transport)
+	}
+
+	if min, max := cfg.GetInt("sflow.port_min"), cfg.GetInt("sflow.port_max"); min < 1 || max > 65535 || min > max {
+		return fmt.Errorf("invalid sflow port range (%d-%d)", min, max)
+	}
+
 	return nil
 }
 
@@ -100,11 +310,7 @@ func checkViperSupportedExts(ext string) bool {
 	return false
 }
 
-func InitConfig(backend string, path string) error {
-	if path == "" {
-		return fmt.Errorf("Empty configuration path")
-	}
-
+func readConfig(cfg *viper.Viper, backend string, path string) error {
 	ext := strings.TrimPrefix(filepath.Ext(path), ".")
 	if ext == "" || !checkViperSupportedExts(ext) {
 		ext = "yaml"
@@ -117,6 +323,8 @@ func InitConfig(backend string, path string) error {
 		if err != nil {
 			return err
 		}
+		defer configFile.Close()
+
 		if err := cfg.ReadConfig(configFile); err != nil {
 			return err
 		}
@@ -135,41 +343,89 @@ func InitConfig(backend string, path string) error {
 		return fmt.Errorf("Invalid backend: %s", backend)
 	}
 
-	return checkConfig()
+	return checkConfig(cfg)
+}
+
+func InitConfig(backend string, path string) error {
+	if path == "" {
+		return fmt.Errorf("Empty configuration path")
+	}
+
+	cfg := newConfig()
+	if err := readConfig(cfg, backend, path); err != nil {
+		return err
+	}
+
+	current.Store(cfg)
+	cfgBackend, cfgPath = backend, path
+
+	return nil
+}
+
+// ReloadConfig reads again the configuration used by InitConfig so that the
+// values read periodically by the components can be changed without restart.
+// The configuration is read into a new instance replacing the current one
+// once valid, the components reading the configuration meanwhile keep
+// reading the previous one.
+func ReloadConfig() error {
+	if cfgPath == "" {
+		return fmt.Errorf("No configuration to reload")
+	}
+
+	cfg := newConfig()
+	if err := readConfig(cfg, cfgBackend, cfgPath); err != nil {
+		return err
+	}
+
+	current.Store(cfg)
+	return nil
 }
 
+// GetConfig returns the current configuration, the instance returned must not
+// be kept as it is replaced on reload
 func GetConfig() *viper.Viper {
-	return cfg
+	return current.Load().(*viper.Viper)
 }
 
 func SetDefault(key string, value interface{}) {
-	cfg.SetDefault(key, value)
+	registered.Lock()
+	userDefaults[key] = value
+	registered.Unlock()
+
+	GetConfig().SetDefault(key, value)
 }
 
+// BindPFlag binds the key to the command line flag, in the current and the
+// reloaded configurations
+func BindPFlag(key string, flag *pflag.Flag) error {
+	registered.Lock()
+	flags[key] = flag
+	registered.Unlock()
+
+	return GetConfig().BindPFlag(key, flag)
+}
+
+// GetHostPortAttributes parses a "port", "host:port" or "[ipv6]:port" value,
+// the host defaults to 127.0.0.1 and is returned without brackets
 func GetHostPortAttributes(s string, p string) (string, int, error) {
 	key := s + "." + p
-	listen := strings.Split(GetConfig().GetString(key), ":")
-
-	addr := "127.0.0.1"
+	listen := GetConfig().GetString(key)
 
-	switch len(listen) {
-	case 1:
-		port, err := strconv.Atoi(listen[0])
-		if err != nil {
-			return "", 0, err
-		}
+	if port, err := strconv.Atoi(listen); err == nil {
+		return "127.0.0.1", port, nil
+	}
 
-		return addr, port, nil
-	case 2:
-		port, err := strconv.Atoi(listen[1])
-		if err != nil {
-			return "", 0, err
-		}
+	addr, portStr, err := net.SplitHostPort(listen)
+	if err != nil {
+		return "", 0, fmt.Errorf("Malformed listen parameter %s: %s", key, err.Error())
+	}
 
-		return listen[0], port, nil
-	default:
-		return "", 0, errors.New(fmt.Sprintf("Malformed listen parameter %s in section %s", s, p))
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return "", 0, fmt.Errorf("Malformed listen parameter %s: %s", key, err.Error())
 	}
+
+	return addr, port, nil
 }
 
 func GetAnalyzerClientAddr() (string, int, error) {
@@ -0,0 +1,133 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestGetHostPortAttributes(t *testing.T) {
+	tests := []struct {
+		listen string
+		addr   string
+		port   int
+	}{
+		{"6345", "127.0.0.1", 6345},
+		{"192.168.0.1:6345", "192.168.0.1", 6345},
+		{"[::1]:6345", "::1", 6345},
+		{"[fe80::1%eth0]:6345", "fe80::1%eth0", 6345},
+		{"localhost:6345", "localhost", 6345},
+	}
+
+	for _, test := range tests {
+		GetConfig().Set("sflow.listen", test.listen)
+
+		addr, port, err := GetHostPortAttributes("sflow", "listen")
+		if err != nil {
+			t.Errorf("Unable to parse %s: %s", test.listen, err.Error())
+			continue
+		}
+
+		if addr != test.addr || port != test.port {
+			t.Errorf("Wrong address for %s: %s %d", test.listen, addr, port)
+		}
+	}
+
+	for _, listen := range []string{"::1:6345", "localhost:port", "localhost"} {
+		GetConfig().Set("sflow.listen", listen)
+
+		if _, _, err := GetHostPortAttributes("sflow", "listen"); err == nil {
+			t.Errorf("Parsing %s should fail", listen)
+		}
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	f, err := ioutil.TempFile("", "skydive-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	write := func(content string) {
+		if err := ioutil.WriteFile(f.Name(), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("etcd:\n  request_timeout: 10\n")
+	if err := InitConfig("file", f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	SetDefault("test.reload", "kept")
+
+	previous := GetConfig()
+	write("etcd:\n  request_timeout: 20\n")
+	if err := ReloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	if timeout := GetConfig().GetInt("etcd.request_timeout"); timeout != 20 {
+		t.Errorf("Expected the reloaded value, got %d", timeout)
+	}
+	if GetConfig().GetString("test.reload") != "kept" {
+		t.Error("Expected the defaults set at runtime to be kept")
+	}
+
+	// the previous configuration is replaced, not modified
+	if timeout := previous.GetInt("etcd.request_timeout"); timeout != 10 {
+		t.Errorf("Expected the previous configuration to be untouched, got %d", timeout)
+	}
+
+	write("etcd:\n  request_timeout: 0\n")
+	if err := ReloadConfig(); err == nil || GetConfig().GetInt("etcd.request_timeout") != 20 {
+		t.Error("Expected an invalid configuration not to be applied")
+	}
+}
+
+func TestCheckSFlowTransport(t *testing.T) {
+	for transport, valid := range map[string]bool{"udp": true, "unix": true, "tcp": false} {
+		cfg := newConfig()
+		cfg.Set("sflow.transport", transport)
+
+		if err := checkConfig(cfg); (err == nil) != valid {
+			t.Errorf("Unexpected validation result for transport %s: %v", transport, err)
+		}
+	}
+
+	cfg := newConfig()
+	cfg.Set("sflow.transport", "unix")
+	cfg.Set("sflow.socket_dir", "")
+	if err := checkConfig(cfg); err == nil {
+		t.Error("Expected the unix transport to require a socket directory")
+	}
+
+	cfg = newConfig()
+	cfg.Set("sflow.transport", "unix")
+	cfg.Set("agent.flow.probes", []string{"pcap", "ovssflow"})
+	if err := checkConfig(cfg); err == nil {
+		t.Error("Expected the unix transport to be refused with the ovssflow probe")
+	}
+}
@@ -0,0 +1,122 @@
+/*
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package flow
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// encapsulationTags returns the VLAN IDs and the MPLS labels of the packet,
+// outermost first
+func encapsulationTags(packet gopacket.Packet) (vlans []uint32, labels []uint32) {
+	for _, layer := range packet.Layers() {
+		switch l := layer.(type) {
+		case *layers.Dot1Q:
+			vlans = append(vlans, uint32(l.VLANIdentifier))
+		case *layers.MPLS:
+			labels = append(labels, l.Label)
+		}
+	}
+	return
+}
+
+// decapsulate returns the packet carried by an MPLS pseudowire when gopacket
+// couldn't guess the MPLS payload, the packet itself otherwise. The payload
+// is decoded as Ethernet, then after a control word as its first nibble is
+// 0 like the one of many MAC addresses.
+func decapsulate(packet gopacket.Packet) gopacket.Packet {
+	if packet.NetworkLayer() != nil || packet.Layer(layers.LayerTypeMPLS) == nil {
+		return packet
+	}
+
+	failure := packet.ErrorLayer()
+	if failure == nil {
+		return packet
+	}
+
+	payload := failure.LayerContents()
+	if inner := gopacket.NewPacket(payload, layers.LayerTypeEthernet, gopacket.Default); inner.NetworkLayer() != nil {
+		return inner
+	}
+
+	if len(payload) > 4 && payload[0]>>4 == 0 {
+		if inner := gopacket.NewPacket(payload[4:], layers.LayerTypeEthernet, gopacket.Default); inner.NetworkLayer() != nil {
+			return inner
+		}
+	}
+
+	return packet
+}
+
+// isUndecodable returns whether the flow of the packet can't be identified,
+// either the Ethernet header or the header following it couldn't be decoded
+func isUndecodable(packet gopacket.Packet) bool {
+	if packet.Layer(layers.LayerTypeEthernet) == nil {
+		return true
+	}
+	return packet.NetworkLayer() == nil && packet.ErrorLayer() != nil
+}
+
+// undecodableFlow returns the flow counting the sampled packets of the sFlow
+// agent whose header couldn't be decoded
+func undecodableFlow(ft *Table, datagram *layers.SFlowDatagram, setter FlowProbePathSetter) *Flow {
+	key := fmt.Sprintf("%s/%d-undecodable", sflowAgentAddress(datagram), datagram.SubAgentID)
+
+	flow, created := ft.GetOrCreateFlow(key)
+	if flow == nil {
+		return nil
+	}
+	now := time.Now().Unix()
+	if created {
+		if setter != nil {
+			setter.SetProbePath(flow)
+		}
+		flow.SFlowAgentAddress = sflowAgentAddress(datagram)
+		flow.SFlowSubAgentID = datagram.SubAgentID
+		flow.LayersPath = "Undecodable"
+		flow.Statistics = &FlowStatistics{Start: now, Endpoints: []*FlowEndpointsStatistics{}}
+
+		hasher := sha1.New()
+		hasher.Write([]byte(flow.LayersPath))
+		flow.TrackingID = hex.EncodeToString(hasher.Sum(nil))
+
+		bfStart := make([]byte, 8)
+		binary.BigEndian.PutUint64(bfStart, uint64(now))
+		hasher.Write(bfStart)
+		hasher.Write([]byte(flow.ProbeGraphPath))
+		hasher.Write([]byte(key))
+		flow.UUID = hex.EncodeToString(hasher.Sum(nil))
+	}
+
+	flow.Statistics.Last = now
+	flow.Undecodable++
+
+	return flow
+}
@@ -0,0 +1,133 @@
+/*
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package flow
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func serializePacket(t *testing.T, l ...gopacket.SerializableLayer) gopacket.Packet {
+	buffer := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true}, l...); err != nil {
+		t.Fatal(err)
+	}
+	return gopacket.NewPacket(buffer.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+}
+
+func newEncapTestLayers() (*layers.IPv4, *layers.UDP) {
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		SrcIP:    net.IP{10, 0, 0, 1},
+		DstIP:    net.IP{10, 0, 0, 2},
+		Protocol: layers.IPProtocolUDP,
+	}
+	return ip, &layers.UDP{SrcPort: 5000, DstPort: 53}
+}
+
+func sflowFlows(t *testing.T, ft *Table, packet gopacket.Packet) []*Flow {
+	datagram := &layers.SFlowDatagram{AgentAddress: net.ParseIP("192.168.0.1")}
+	sample := &layers.SFlowFlowSample{
+		Records: []layers.SFlowRecord{layers.SFlowRawPacketFlowRecord{Header: packet}},
+	}
+	return FlowsFromSFlowSample(ft, datagram, sample, nil, nil)
+}
+
+func TestSFlowEncapsulation(t *testing.T) {
+	ip, udp := newEncapTestLayers()
+	packet := serializePacket(t,
+		&layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0x00, 0x0F, 0xAA, 0xFA, 0xAA, 0x01},
+			DstMAC:       net.HardwareAddr{0x00, 0x0D, 0xBD, 0xBD, 0x01, 0xBD},
+			EthernetType: layers.EthernetTypeQinQ,
+		},
+		&layers.Dot1Q{VLANIdentifier: 100, Type: layers.EthernetTypeDot1Q},
+		&layers.Dot1Q{VLANIdentifier: 200, Type: layers.EthernetTypeMPLSUnicast},
+		&layers.MPLS{Label: 1000, TTL: 64},
+		&layers.MPLS{Label: 2000, StackBottom: true, TTL: 64},
+		ip, udp, gopacket.Payload([]byte{1, 2, 3}))
+
+	flows := sflowFlows(t, NewTable(), packet)
+	if len(flows) != 1 {
+		t.Fatalf("Expected one flow, got %d", len(flows))
+	}
+
+	f := flows[0]
+	if len(f.VLANs) != 2 || f.VLANs[0] != 100 || f.VLANs[1] != 200 {
+		t.Errorf("Wrong VLANs: %v", f.VLANs)
+	}
+	if len(f.MPLSLabels) != 2 || f.MPLSLabels[0] != 1000 || f.MPLSLabels[1] != 2000 {
+		t.Errorf("Wrong MPLS labels: %v", f.MPLSLabels)
+	}
+	if f.Statistics.GetEndpointsType(FlowEndpointType_UDPPORT) == nil {
+		t.Errorf("Inner transport layer should be decoded: %s", f.LayersPath)
+	}
+}
+
+func TestSFlowPseudowire(t *testing.T) {
+	ip, udp := newEncapTestLayers()
+	inner := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0x00, 0x0F, 0xAA, 0xFA, 0xAA, 0x02},
+		DstMAC:       net.HardwareAddr{0x00, 0x0D, 0xBD, 0xBD, 0x01, 0xBE},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	packet := serializePacket(t,
+		&layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0x00, 0x0F, 0xAA, 0xFA, 0xAA, 0x01},
+			DstMAC:       net.HardwareAddr{0x00, 0x0D, 0xBD, 0xBD, 0x01, 0xBD},
+			EthernetType: layers.EthernetTypeMPLSUnicast,
+		},
+		&layers.MPLS{Label: 3000, StackBottom: true, TTL: 64},
+		inner, ip, udp, gopacket.Payload([]byte{1, 2, 3}))
+
+	flows := sflowFlows(t, NewTable(), packet)
+	if len(flows) != 1 || flows[0].Statistics.GetEndpointsType(FlowEndpointType_UDPPORT) == nil {
+		t.Fatalf("Expected the pseudowire payload to be decoded, got %v", flows)
+	}
+
+	if len(flows[0].MPLSLabels) != 1 || flows[0].MPLSLabels[0] != 3000 {
+		t.Errorf("Wrong MPLS labels: %v", flows[0].MPLSLabels)
+	}
+}
+
+func TestSFlowUndecodable(t *testing.T) {
+	ft := NewTable()
+	packet := gopacket.NewPacket([]byte{0x01, 0x02, 0x03}, layers.LayerTypeEthernet, gopacket.Default)
+
+	var flows []*Flow
+	for i := 0; i < 2; i++ {
+		flows = sflowFlows(t, ft, packet)
+	}
+
+	if len(flows) != 1 || flows[0].LayersPath != "Undecodable" || flows[0].Undecodable != 2 {
+		t.Fatalf("Expected an undecodable flow counting 2 packets, got %v", flows)
+	}
+
+	if flows[0].UUID == "" || flows[0].SFlowAgentAddress != "192.168.0.1" {
+		t.Errorf("Wrong undecodable flow: %v", flows[0])
+	}
+}
@@ -0,0 +1,282 @@
+/*
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package flow
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// PacketFilter evaluates the subset of the BPF filter syntax applying to the
+// protocols, the addresses and the ports of a packet, ex:
+// "tcp port 443 and not src net 10.0.0.0/8". It is used by the probes that
+// can't install a kernel filter, like the sFlow agents.
+type PacketFilter struct {
+	expr string
+	root filterNode
+}
+
+type filterNode func(p *packetFields) bool
+
+type packetFields struct {
+	protocols map[string]bool
+	src, dst  net.IP
+	sport     int
+	dport     int
+	ports     bool
+}
+
+type filterParser struct {
+	tokens []string
+	pos    int
+}
+
+var filterProtocols = map[string]bool{
+	"ether": true, "arp": true, "ip": true, "ip6": true,
+	"tcp": true, "udp": true, "sctp": true, "icmp": true, "icmp6": true,
+}
+
+func tokenizeFilter(expr string) []string {
+	expr = strings.NewReplacer("(", " ( ", ")", " ) ", "!", " ! ").Replace(expr)
+	return strings.Fields(expr)
+}
+
+func (fp *filterParser) peek() string {
+	if fp.pos < len(fp.tokens) {
+		return fp.tokens[fp.pos]
+	}
+	return ""
+}
+
+func (fp *filterParser) next() string {
+	t := fp.peek()
+	if t != "" {
+		fp.pos++
+	}
+	return t
+}
+
+func (fp *filterParser) parseOr() (filterNode, error) {
+	left, err := fp.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for fp.peek() == "or" || fp.peek() == "||" {
+		fp.next()
+		right, err := fp.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(p *packetFields) bool { return l(p) || right(p) }
+	}
+	return left, nil
+}
+
+func (fp *filterParser) parseAnd() (filterNode, error) {
+	left, err := fp.parseNot()
+	if err != nil {
+		return nil, err
+	}
+
+	for fp.peek() == "and" || fp.peek() == "&&" {
+		fp.next()
+		right, err := fp.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(p *packetFields) bool { return l(p) && right(p) }
+	}
+	return left, nil
+}
+
+func (fp *filterParser) parseNot() (filterNode, error) {
+	if fp.peek() == "not" || fp.peek() == "!" {
+		fp.next()
+		n, err := fp.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return func(p *packetFields) bool { return !n(p) }, nil
+	}
+
+	if fp.peek() == "(" {
+		fp.next()
+		n, err := fp.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if fp.next() != ")" {
+			return nil, fmt.Errorf("missing closing parenthesis")
+		}
+		return n, nil
+	}
+
+	return fp.parsePrimitive()
+}
+
+// parsePrimitive parses [proto] [src|dst] (host|net|port) value or a single
+// protocol name
+func (fp *filterParser) parsePrimitive() (filterNode, error) {
+	var proto, dir string
+
+	if filterProtocols[fp.peek()] {
+		proto = fp.next()
+	}
+
+	if fp.peek() == "src" || fp.peek() == "dst" {
+		dir = fp.next()
+	}
+
+	var match filterNode
+	switch kind := fp.peek(); kind {
+	case "host", "net", "port":
+		fp.next()
+		value := fp.next()
+		if value == "" {
+			return nil, fmt.Errorf("missing value after %s", kind)
+		}
+
+		var err error
+		if match, err = addressFilter(kind, dir, value); err != nil {
+			return nil, err
+		}
+	default:
+		if proto == "" {
+			if kind == "" {
+				return nil, fmt.Errorf("unexpected end of filter")
+			}
+			return nil, fmt.Errorf("unexpected token %s", kind)
+		}
+		if dir != "" {
+			return nil, fmt.Errorf("missing host, net or port after %s", dir)
+		}
+	}
+
+	if proto == "" {
+		return match, nil
+	}
+
+	if match == nil {
+		return func(p *packetFields) bool { return p.protocols[proto] }, nil
+	}
+	return func(p *packetFields) bool { return p.protocols[proto] && match(p) }, nil
+}
+
+func addressFilter(kind string, dir string, value string) (filterNode, error) {
+	src, dst := dir != "dst", dir != "src"
+
+	switch kind {
+	case "port":
+		port, err := strconv.Atoi(value)
+		if err != nil || port < 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid port %s", value)
+		}
+		return func(p *packetFields) bool {
+			return p.ports && ((src && p.sport == port) || (dst && p.dport == port))
+		}, nil
+	case "host":
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid host %s", value)
+		}
+		return func(p *packetFields) bool {
+			return (src && ip.Equal(p.src)) || (dst && ip.Equal(p.dst))
+		}, nil
+	default:
+		_, ipnet, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid net %s", value)
+		}
+		return func(p *packetFields) bool {
+			return (src && p.src != nil && ipnet.Contains(p.src)) || (dst && p.dst != nil && ipnet.Contains(p.dst))
+		}, nil
+	}
+}
+
+// NewPacketFilter parses a filter expression, an error describing the
+// faulty part of the expression is returned if it can't be parsed
+func NewPacketFilter(expr string) (*PacketFilter, error) {
+	fp := &filterParser{tokens: tokenizeFilter(expr)}
+
+	root, err := fp.parseOr()
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter \"%s\": %s", expr, err.Error())
+	}
+
+	if t := fp.peek(); t != "" {
+		return nil, fmt.Errorf("invalid filter \"%s\": unexpected token %s", expr, t)
+	}
+
+	return &PacketFilter{expr: expr, root: root}, nil
+}
+
+func (f *PacketFilter) String() string {
+	return f.expr
+}
+
+func newPacketFields(packet gopacket.Packet) *packetFields {
+	p := &packetFields{protocols: make(map[string]bool)}
+
+	for _, layer := range packet.Layers() {
+		switch l := layer.(type) {
+		case *layers.Ethernet:
+			p.protocols["ether"] = true
+		case *layers.ARP:
+			p.protocols["arp"] = true
+		case *layers.IPv4:
+			p.protocols["ip"] = true
+			p.src, p.dst = l.SrcIP, l.DstIP
+		case *layers.IPv6:
+			p.protocols["ip6"] = true
+			p.src, p.dst = l.SrcIP, l.DstIP
+		case *layers.ICMPv4:
+			p.protocols["icmp"] = true
+		case *layers.ICMPv6:
+			p.protocols["icmp6"] = true
+		case *layers.TCP:
+			p.protocols["tcp"] = true
+			p.sport, p.dport, p.ports = int(l.SrcPort), int(l.DstPort), true
+		case *layers.UDP:
+			p.protocols["udp"] = true
+			p.sport, p.dport, p.ports = int(l.SrcPort), int(l.DstPort), true
+		case *layers.SCTP:
+			p.protocols["sctp"] = true
+			p.sport, p.dport, p.ports = int(l.SrcPort), int(l.DstPort), true
+		}
+	}
+
+	return p
+}
+
+// Match returns whether the packet is selected by the filter
+func (f *PacketFilter) Match(packet gopacket.Packet) bool {
+	return f.root(newPacketFields(packet))
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package flow
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func newFilterTestPacket(t *testing.T) gopacket.Packet {
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		SrcIP:    net.IP{10, 0, 0, 1},
+		DstIP:    net.IP{192, 168, 1, 2},
+		Protocol: layers.IPProtocolTCP,
+	}
+	tcp := &layers.TCP{SrcPort: 34567, DstPort: 443}
+
+	buffer := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true},
+		&layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0x00, 0x0F, 0xAA, 0xFA, 0xAA, 0x01},
+			DstMAC:       net.HardwareAddr{0x00, 0x0D, 0xBD, 0xBD, 0x01, 0xBD},
+			EthernetType: layers.EthernetTypeIPv4,
+		}, ip, tcp, gopacket.Payload([]byte{1, 2, 3}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return gopacket.NewPacket(buffer.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+}
+
+func TestPacketFilter(t *testing.T) {
+	packet := newFilterTestPacket(t)
+
+	tests := map[string]bool{
+		"tcp":                             true,
+		"udp":                             false,
+		"tcp port 443":                    true,
+		"tcp dst port 443":                true,
+		"tcp src port 443":                false,
+		"udp port 443":                    false,
+		"host 10.0.0.1":                   true,
+		"dst host 10.0.0.1":               false,
+		"src net 10.0.0.0/8":              true,
+		"net 172.16.0.0/12":               false,
+		"tcp and not port 80":             true,
+		"port 80 or port 443":             true,
+		"!(port 443)":                     false,
+		"(udp or tcp) && dst port 443":    true,
+		"not (src host 10.0.0.1 or icmp)": false,
+	}
+
+	for expr, expected := range tests {
+		f, err := NewPacketFilter(expr)
+		if err != nil {
+			t.Errorf("Unable to parse %s: %s", expr, err.Error())
+			continue
+		}
+
+		if f.Match(packet) != expected {
+			t.Errorf("Filter %s should return %t", expr, expected)
+		}
+	}
+
+	for _, expr := range []string{"", "port", "port abc", "tcp and", "(tcp", "tcp)", "host 10.0.0", "src tcp", "foo"} {
+		if _, err := NewPacketFilter(expr); err == nil {
+			t.Errorf("Filter %s should be invalid", expr)
+		}
+	}
+}
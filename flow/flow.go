@@ -23,6 +23,7 @@
 package flow
 
 import (
+	"bytes"
 	"crypto/sha1"
 	"encoding/binary"
 	"encoding/hex"
@@ -30,6 +31,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"strings"
 	"time"
 
 	"github.com/golang/protobuf/proto"
@@ -85,7 +87,6 @@ func Var8bin(v []byte) []byte {
 }
 
 func (eps *FlowEndpointsStatistics) hash(ab interface{}, ba interface{}) {
-	var vab, vba uint64
 	var binab, binba []byte
 
 	hasher := sha1.New()
@@ -93,36 +94,28 @@ func (eps *FlowEndpointsStatistics) hash(ab interface{}, ba interface{}) {
 	case net.HardwareAddr:
 		binab = ab.(net.HardwareAddr)
 		binba = ba.(net.HardwareAddr)
-		vab = binary.BigEndian.Uint64(Var8bin(binab))
-		vba = binary.BigEndian.Uint64(Var8bin(binba))
 	case net.IP:
 		binab = ab.(net.IP)
 		binba = ba.(net.IP)
-		vab = binary.BigEndian.Uint64(Var8bin(binab))
-		vba = binary.BigEndian.Uint64(Var8bin(binba))
 	case layers.TCPPort:
 		binab = make([]byte, 2)
 		binba = make([]byte, 2)
 		binary.BigEndian.PutUint16(binab, uint16(ab.(layers.TCPPort)))
 		binary.BigEndian.PutUint16(binba, uint16(ba.(layers.TCPPort)))
-		vab = uint64(ab.(layers.TCPPort))
-		vba = uint64(ba.(layers.TCPPort))
 	case layers.UDPPort:
 		binab = make([]byte, 2)
 		binba = make([]byte, 2)
 		binary.BigEndian.PutUint16(binab, uint16(ab.(layers.UDPPort)))
 		binary.BigEndian.PutUint16(binba, uint16(ba.(layers.UDPPort)))
-		vab = uint64(ab.(layers.UDPPort))
-		vba = uint64(ba.(layers.UDPPort))
 	case layers.SCTPPort:
 		binab = make([]byte, 2)
 		binba = make([]byte, 2)
 		binary.BigEndian.PutUint16(binab, uint16(ab.(layers.SCTPPort)))
 		binary.BigEndian.PutUint16(binba, uint16(ba.(layers.SCTPPort)))
-		vab = uint64(ab.(layers.SCTPPort))
-		vba = uint64(ba.(layers.SCTPPort))
 	}
-	if vab < vba {
+	// the addresses and ports of a type have the same length, the byte
+	// order is the order of their value
+	if bytes.Compare(binab, binba) < 0 {
 		hasher.Write(binab)
 		hasher.Write(binba)
 	} else {
@@ -159,7 +152,53 @@ func (key FlowKey) String() string {
 	return fmt.Sprintf("%x-%x", key.net, key.transport)
 }
 
-func (flow *Flow) fillFromGoPacket(packet *gopacket.Packet) error {
+// fields of the packets a flow table can key the flows by, see
+// Table.SetKeyFields
+const (
+	KeyNetwork   = "network"
+	KeyProtocol  = "protocol"
+	KeyTransport = "transport"
+	KeyVLAN      = "vlan"
+	KeyMPLS      = "mpls"
+)
+
+// DefaultKeyFields are the fields keying the flows by addresses and ports
+var DefaultKeyFields = []string{KeyNetwork, KeyTransport}
+
+func isKeyField(field string) bool {
+	switch field {
+	case KeyNetwork, KeyProtocol, KeyTransport, KeyVLAN, KeyMPLS:
+		return true
+	}
+	return false
+}
+
+// keyFromFields returns the key of the packet made of the given fields, the
+// VLAN and MPLS tags being read from outer which may encapsulate the packet
+func keyFromFields(p gopacket.Packet, outer gopacket.Packet, fields []string) string {
+	parts := make([]string, len(fields))
+	for i, field := range fields {
+		switch field {
+		case KeyNetwork:
+			parts[i] = fmt.Sprintf("%x", LayerFlow(p.NetworkLayer()).FastHash())
+		case KeyProtocol:
+			if l := p.TransportLayer(); l != nil {
+				parts[i] = l.LayerType().String()
+			}
+		case KeyTransport:
+			parts[i] = fmt.Sprintf("%x", LayerFlow(p.TransportLayer()).FastHash())
+		case KeyVLAN:
+			vlans, _ := encapsulationTags(outer)
+			parts[i] = fmt.Sprint(vlans)
+		case KeyMPLS:
+			_, labels := encapsulationTags(outer)
+			parts[i] = fmt.Sprint(labels)
+		}
+	}
+	return strings.Join(parts, "-")
+}
+
+func (flow *Flow) fillFromGoPacket(packet *gopacket.Packet, weight uint64) error {
 	/* Continue if no ethernet layer */
 	ethernetLayer := (*packet).Layer(layers.LayerTypeEthernet)
 	_, ok := ethernetLayer.(*layers.Ethernet)
@@ -177,7 +216,7 @@ func (flow *Flow) fillFromGoPacket(packet *gopacket.Packet) error {
 		flow.Statistics = fs
 	}
 	fs.Last = now
-	fs.Update(packet)
+	fs.UpdateWeighted(packet, weight)
 
 	if newFlow {
 		hasher := sha1.New()
@@ -201,6 +240,12 @@ func (flow *Flow) fillFromGoPacket(packet *gopacket.Packet) error {
 		binary.BigEndian.PutUint64(bfStart, uint64(fs.Start))
 		hasher.Write(bfStart)
 		hasher.Write([]byte(flow.ProbeGraphPath))
+		if flow.SFlowAgentAddress != "" || flow.SFlowSubAgentID != 0 {
+			bfSubAgent := make([]byte, 4)
+			binary.BigEndian.PutUint32(bfSubAgent, flow.SFlowSubAgentID)
+			hasher.Write([]byte(flow.SFlowAgentAddress))
+			hasher.Write(bfSubAgent)
+		}
 		flow.UUID = hex.EncodeToString(hasher.Sum(nil))
 	}
 	return nil
@@ -226,14 +271,46 @@ func (flow *Flow) GetData() ([]byte, error) {
 	return data, nil
 }
 
+// Copy returns a deep copy of the flow, to be handed over to other goroutines
+// while the flow table keeps updating the flow
+func (flow *Flow) Copy() *Flow {
+	return proto.Clone(flow).(*Flow)
+}
+
 func FlowFromGoPacket(ft *Table, packet *gopacket.Packet, setter FlowProbePathSetter) *Flow {
-	key := NewFlowKeyFromGoPacket(packet)
-	flow, _ := ft.GetOrCreateFlow(key.String())
+	return flowFromGoPacket(ft, packet, *packet, setter, nil, 1)
+}
+
+// sflowAgentAddress returns the address of the agent which sent the datagram
+func sflowAgentAddress(datagram *layers.SFlowDatagram) string {
+	if datagram == nil || len(datagram.AgentAddress) == 0 {
+		return ""
+	}
+	return datagram.AgentAddress.String()
+}
+
+// flowFromGoPacket keeps the flows of the sFlow agents and sub-agents in
+// distinct entries of the table when datagram is not nil, outer is the packet
+// encapsulating packet, if any, carrying the VLAN and MPLS tags
+func flowFromGoPacket(ft *Table, packet *gopacket.Packet, outer gopacket.Packet, setter FlowProbePathSetter, datagram *layers.SFlowDatagram, weight uint64) *Flow {
+	key := ft.key(*packet, outer)
+	if datagram != nil {
+		key = fmt.Sprintf("%s/%d-%s", sflowAgentAddress(datagram), datagram.SubAgentID, key)
+	}
+
+	flow, _ := ft.GetOrCreateFlow(key)
+	if flow == nil {
+		return nil
+	}
 	if setter != nil {
 		setter.SetProbePath(flow)
 	}
+	if datagram != nil {
+		flow.SFlowAgentAddress = sflowAgentAddress(datagram)
+		flow.SFlowSubAgentID = datagram.SubAgentID
+	}
 
-	err := flow.fillFromGoPacket(packet)
+	err := flow.fillFromGoPacket(packet, weight)
 	if err != nil {
 		logging.GetLogger().Error(err.Error())
 		return nil
@@ -242,8 +319,35 @@ func FlowFromGoPacket(ft *Table, packet *gopacket.Packet, setter FlowProbePathSe
 	return flow
 }
 
-func FlowsFromSFlowSample(ft *Table, sample *layers.SFlowFlowSample, setter FlowProbePathSetter) []*Flow {
+// sflowIfIndex returns the ifIndex of a sFlow sample input/output interface
+// or 0 when the interface is unknown, local, or the packet was discarded or
+// sent to multiple interfaces (format bits other than 0).
+func sflowIfIndex(v uint32) uint32 {
+	if v>>30 != 0 || v == 0x3FFFFFFF {
+		return 0
+	}
+	return v
+}
+
+/* Records of a same conversation are folded into one flow, returned once */
+/* The records whose packet doesn't match the filter, if any, are skipped */
+/* The counters are scaled by the sampling rate if enabled on the table */
+func FlowsFromSFlowSample(ft *Table, datagram *layers.SFlowDatagram, sample *layers.SFlowFlowSample, setter FlowProbePathSetter, filter *PacketFilter) []*Flow {
 	flows := []*Flow{}
+	seen := make(map[*Flow]bool)
+
+	weight := uint64(1)
+	if ft.SamplingScale() && sample.SamplingRate > 1 {
+		weight = uint64(sample.SamplingRate)
+	}
+
+	/* The extended URL record describes the sampled packet of the sample */
+	var url *layers.SFlowExtendedURLRecord
+	for _, rec := range sample.Records {
+		if record, ok := rec.(layers.SFlowExtendedURLRecord); ok {
+			url = &record
+		}
+	}
 
 	for _, rec := range sample.Records {
 
@@ -254,15 +358,48 @@ func FlowsFromSFlowSample(ft *Table, sample *layers.SFlowFlowSample, setter Flow
 		case layers.SFlowExtendedSwitchFlowRecord:
 			logging.GetLogger().Debug("1st layer is not SFlowRawPacketFlowRecord type")
 			continue
+		case layers.SFlowExtendedURLRecord:
+			continue
 		default:
 			logging.GetLogger().Critical("1st layer is not a SFlow supported type")
 			continue
 		}
 
 		record := rec.(layers.SFlowRawPacketFlowRecord)
+		if filter != nil && !filter.Match(record.Header) {
+			continue
+		}
+
+		/* The flow is identified by the packet within the VLAN/MPLS tags, */
+		/* the tags are kept on the flow */
+		packet := decapsulate(record.Header)
+		if isUndecodable(packet) {
+			flow := undecodableFlow(ft, datagram, setter)
+			if flow != nil && !seen[flow] {
+				seen[flow] = true
+				flows = append(flows, flow)
+			}
+			continue
+		}
+
+		flow := flowFromGoPacket(ft, &packet, record.Header, setter, datagram, weight)
+		if flow == nil {
+			continue
+		}
+		flow.VLANs, flow.MPLSLabels = encapsulationTags(record.Header)
+
+		if index := sflowIfIndex(sample.InputInterface); index != 0 {
+			flow.IfInIndex = index
+		}
+		if index := sflowIfIndex(sample.OutputInterface); index != 0 {
+			flow.IfOutIndex = index
+		}
+		if url != nil {
+			flow.HTTPURL, flow.HTTPHost = url.URL, url.Host
+		}
 
-		flow := FlowFromGoPacket(ft, &record.Header, setter)
-		if flow != nil {
+		if !seen[flow] {
+			seen[flow] = true
 			flows = append(flows, flow)
 		}
 	}
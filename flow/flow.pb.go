@@ -61,6 +61,7 @@ const (
 	FlowEndpointType_TCPPORT  FlowEndpointType = 2
 	FlowEndpointType_UDPPORT  FlowEndpointType = 3
 	FlowEndpointType_SCTPPORT FlowEndpointType = 4
+	FlowEndpointType_IPV6     FlowEndpointType = 5
 )
 
 var FlowEndpointType_name = map[int32]string{
@@ -69,6 +70,7 @@ var FlowEndpointType_name = map[int32]string{
 	2: "TCPPORT",
 	3: "UDPPORT",
 	4: "SCTPPORT",
+	5: "IPV6",
 }
 var FlowEndpointType_value = map[string]int32{
 	"ETHERNET": 0,
@@ -76,6 +78,7 @@ var FlowEndpointType_value = map[string]int32{
 	"TCPPORT":  2,
 	"UDPPORT":  3,
 	"SCTPPORT": 4,
+	"IPV6":     5,
 }
 
 func (x FlowEndpointType) String() string {
@@ -159,6 +162,24 @@ type Flow struct {
 	ProbeGraphPath string `protobuf:"bytes,11,opt,name=ProbeGraphPath" json:"ProbeGraphPath,omitempty"`
 	IfSrcGraphPath string `protobuf:"bytes,14,opt,name=IfSrcGraphPath" json:"IfSrcGraphPath,omitempty"`
 	IfDstGraphPath string `protobuf:"bytes,19,opt,name=IfDstGraphPath" json:"IfDstGraphPath,omitempty"`
+	// sFlow ingress/egress interface indexes, 0 when unknown
+	IfInIndex  uint32 `protobuf:"varint,20,opt,name=IfInIndex" json:"IfInIndex,omitempty"`
+	IfOutIndex uint32 `protobuf:"varint,21,opt,name=IfOutIndex" json:"IfOutIndex,omitempty"`
+	// sFlow agent address and sub-agent ID, distinguishing the linecards of a switch
+	SFlowAgentAddress string `protobuf:"bytes,22,opt,name=SFlowAgentAddress" json:"SFlowAgentAddress,omitempty"`
+	SFlowSubAgentID   uint32 `protobuf:"varint,23,opt,name=SFlowSubAgentID" json:"SFlowSubAgentID,omitempty"`
+	// sFlow VLAN IDs and MPLS labels encapsulating the sampled packet, outermost first
+	VLANs      []uint32 `protobuf:"varint,24,rep,packed,name=VLANs" json:"VLANs,omitempty"`
+	MPLSLabels []uint32 `protobuf:"varint,25,rep,packed,name=MPLSLabels" json:"MPLSLabels,omitempty"`
+	// number of sFlow sampled packets whose header couldn't be decoded
+	Undecodable uint64 `protobuf:"varint,26,opt,name=Undecodable" json:"Undecodable,omitempty"`
+	// set when the agent skipped the flow enhancement, see agent.flow_enhancement_sampling
+	Unenhanced bool `protobuf:"varint,27,opt,name=Unenhanced" json:"Unenhanced,omitempty"`
+	// hostname of the agent having captured the flow
+	Host string `protobuf:"bytes,28,opt,name=Host" json:"Host,omitempty"`
+	// URL and host of the sFlow extended URL record of the sample, if any
+	HTTPURL  string `protobuf:"bytes,29,opt,name=HTTPURL" json:"HTTPURL,omitempty"`
+	HTTPHost string `protobuf:"bytes,30,opt,name=HTTPHost" json:"HTTPHost,omitempty"`
 }
 
 func (m *Flow) Reset()                    { *m = Flow{} }
@@ -183,34 +204,45 @@ func init() {
 }
 
 var fileDescriptor0 = []byte{
-	// 462 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x8c, 0x53, 0xc1, 0x6e, 0xd3, 0x40,
-	0x10, 0x25, 0xf6, 0xba, 0xa9, 0x27, 0xc5, 0x84, 0xa5, 0x2a, 0x3e, 0x00, 0x42, 0x39, 0x20, 0x14,
-	0xa1, 0x22, 0x95, 0x5e, 0x10, 0xa7, 0xa4, 0x31, 0xd4, 0x6a, 0x95, 0x5a, 0xeb, 0x4d, 0xb9, 0x21,
-	0xad, 0x83, 0x8b, 0x2d, 0xac, 0xd8, 0xf2, 0x6e, 0xa9, 0xf2, 0x07, 0xfc, 0x10, 0xff, 0xc7, 0xec,
-	0xba, 0x8d, 0x1d, 0x72, 0xe1, 0xe2, 0xcc, 0x7b, 0x7e, 0x6f, 0xde, 0xec, 0x6c, 0x0c, 0x4f, 0x6e,
-	0x8a, 0xf2, 0xee, 0xbd, 0x7e, 0x1c, 0x57, 0x75, 0xa9, 0x4a, 0x4a, 0x74, 0x3d, 0xfa, 0x06, 0x47,
-	0x9f, 0xf1, 0x37, 0x58, 0x7d, 0xaf, 0xca, 0x7c, 0xa5, 0x62, 0x25, 0x54, 0x2e, 0x55, 0xbe, 0x94,
-	0xf4, 0x10, 0x9c, 0x6b, 0x51, 0xdc, 0xa6, 0xbe, 0xf5, 0xba, 0xf7, 0xd6, 0x65, 0xce, 0x2f, 0x0d,
-	0xa8, 0x0f, 0xfd, 0x48, 0x2c, 0x7f, 0xa6, 0x4a, 0xfa, 0x0e, 0xf2, 0x84, 0xf5, 0xab, 0x06, 0x6a,
-	0xfd, 0x74, 0xad, 0x52, 0xe9, 0xef, 0x19, 0xde, 0x49, 0x34, 0x18, 0xfd, 0xe9, 0xc1, 0xf3, 0x6e,
-	0x80, 0xec, 0x24, 0x8c, 0x81, 0xf0, 0x75, 0x95, 0xfa, 0x3d, 0x34, 0x78, 0x27, 0x47, 0xc7, 0x66,
-	0xb8, 0xae, 0x58, 0xbf, 0x65, 0x44, 0xe1, 0x93, 0x52, 0x20, 0xe7, 0x42, 0x66, 0x66, 0x98, 0x03,
-	0x46, 0x32, 0xac, 0xe9, 0x3b, 0xb0, 0x26, 0x53, 0xdf, 0x46, 0x66, 0x70, 0xf2, 0x62, 0xd7, 0xdd,
-	0x26, 0x31, 0x4b, 0x4c, 0xb5, 0x7a, 0x3a, 0xf1, 0xc9, 0xff, 0xa8, 0x93, 0xc9, 0xe8, 0x0e, 0x3c,
-	0xfd, 0x76, 0x7b, 0x1f, 0x88, 0x6a, 0x65, 0xc6, 0xb5, 0x99, 0x23, 0x35, 0xd0, 0x73, 0x5d, 0x0a,
-	0xa9, 0xcc, 0x5c, 0x36, 0x23, 0x05, 0xd6, 0xf4, 0x13, 0xb8, 0x9b, 0xe3, 0xe2, 0x78, 0x36, 0x06,
-	0xbe, 0xdc, 0x0d, 0xec, 0x6c, 0x82, 0xb9, 0xe9, 0x03, 0x39, 0xfa, 0x6d, 0x01, 0xd1, 0x32, 0xdd,
-	0x79, 0xb1, 0x08, 0x67, 0x26, 0xce, 0x65, 0xe4, 0x16, 0x6b, 0xfa, 0x0a, 0xe0, 0x52, 0xac, 0xd3,
-	0x5a, 0x46, 0x42, 0x65, 0xf7, 0x17, 0x03, 0xc5, 0x86, 0xa1, 0xa7, 0x00, 0x6d, 0xd7, 0xfb, 0xcd,
-	0x1c, 0xb6, 0xd1, 0x9d, 0x44, 0x90, 0xed, 0xc9, 0xb0, 0x2b, 0xaf, 0xf1, 0x16, 0xf3, 0xd5, 0x0f,
-	0xcc, 0x73, 0x9a, 0xae, 0x6a, 0xc3, 0xd0, 0x37, 0xe0, 0x45, 0x75, 0x99, 0xa4, 0x5f, 0x6a, 0x51,
-	0x65, 0x26, 0x79, 0x60, 0x34, 0x5e, 0xb5, 0xc5, 0x6a, 0x5d, 0x78, 0x13, 0xd7, 0xcb, 0x56, 0xe7,
-	0x35, 0xba, 0x7c, 0x8b, 0x6d, 0x74, 0x33, 0xa9, 0x5a, 0xdd, 0xb3, 0x07, 0x5d, 0x97, 0x1d, 0x7f,
-	0x84, 0xa7, 0xdd, 0x85, 0x99, 0x93, 0xd3, 0x7d, 0x5c, 0x78, 0x38, 0xbf, 0x18, 0x3e, 0xa2, 0x03,
-	0xe8, 0xcf, 0x03, 0xfe, 0xf5, 0x8a, 0x5d, 0x0c, 0x7b, 0xf4, 0x31, 0xb8, 0x9c, 0x4d, 0xe6, 0x71,
-	0x74, 0xc5, 0xf8, 0xd0, 0x1a, 0x33, 0x18, 0xfe, 0xfb, 0x47, 0xa2, 0x07, 0xb0, 0x1f, 0xf0, 0xf3,
-	0x80, 0xa1, 0x09, 0xdd, 0xd8, 0x27, 0x8c, 0xae, 0x4f, 0xd1, 0x8a, 0x7d, 0xf8, 0x59, 0xd4, 0x18,
-	0x35, 0x58, 0xcc, 0x1a, 0x60, 0x6b, 0x47, 0x7c, 0xc6, 0x1b, 0x44, 0x92, 0x3d, 0xf3, 0xdd, 0x7c,
-	0xf8, 0x1b, 0x00, 0x00, 0xff, 0xff, 0x52, 0x0b, 0xe1, 0x20, 0x4a, 0x03, 0x00, 0x00,
+	// 640 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8d, 0x54, 0x4d, 0x4f, 0xdb, 0x40,
+	0x10, 0x6d, 0x12, 0x9b, 0xc4, 0x13, 0x48, 0xc2, 0x96, 0xc2, 0x96, 0x02, 0x42, 0x39, 0x54, 0x08,
+	0x55, 0x54, 0xa2, 0xa8, 0x52, 0xd5, 0x93, 0x03, 0x69, 0xb1, 0x48, 0x83, 0xb5, 0x71, 0xe8, 0xa5,
+	0xaa, 0x64, 0x27, 0x1b, 0x6c, 0x35, 0xb5, 0x23, 0xef, 0xa6, 0x94, 0x1f, 0xd6, 0xff, 0xd3, 0x9f,
+	0xd2, 0xd9, 0x75, 0x88, 0x1d, 0xb8, 0xf4, 0xe2, 0xec, 0x7b, 0xf3, 0x66, 0xde, 0xec, 0xc7, 0x04,
+	0x9a, 0x93, 0x69, 0x72, 0xf7, 0x56, 0x7d, 0x4e, 0x66, 0x69, 0x22, 0x13, 0x62, 0xa8, 0x75, 0xfb,
+	0x3b, 0x6c, 0x7f, 0xc2, 0xdf, 0x6e, 0x3c, 0x9e, 0x25, 0x51, 0x2c, 0x07, 0xd2, 0x97, 0x91, 0x90,
+	0xd1, 0x48, 0x90, 0x2d, 0x30, 0x6f, 0xfc, 0xe9, 0x9c, 0xd3, 0xf2, 0x61, 0xe9, 0xc8, 0x62, 0xe6,
+	0x2f, 0x05, 0x08, 0x85, 0xaa, 0xeb, 0x8f, 0x7e, 0x70, 0x29, 0xa8, 0x89, 0xbc, 0xc1, 0xaa, 0xb3,
+	0x0c, 0x2a, 0x7d, 0xe7, 0x5e, 0x72, 0x41, 0xd7, 0x34, 0x6f, 0x06, 0x0a, 0xb4, 0xff, 0x94, 0x60,
+	0xa7, 0x68, 0x20, 0x0a, 0x0e, 0xc7, 0x60, 0x78, 0xf7, 0x33, 0x4e, 0x4b, 0x98, 0xd0, 0x38, 0xdd,
+	0x3e, 0xd1, 0xcd, 0x15, 0xc5, 0x2a, 0xca, 0x0c, 0x89, 0x5f, 0x42, 0xc0, 0xb8, 0xf4, 0x45, 0xa8,
+	0x9b, 0x59, 0x67, 0x46, 0x88, 0x6b, 0xf2, 0x06, 0xca, 0x76, 0x87, 0x56, 0x90, 0xa9, 0x9f, 0xee,
+	0x3d, 0xcd, 0xce, 0x9d, 0x58, 0xd9, 0xef, 0x28, 0x75, 0xc7, 0xa6, 0xc6, 0xff, 0xa8, 0x03, 0xbb,
+	0x7d, 0x07, 0x0d, 0x15, 0x5d, 0x3d, 0x0f, 0x44, 0xa9, 0xd4, 0xed, 0x56, 0x98, 0x29, 0x14, 0x50,
+	0x7d, 0xf5, 0x7c, 0x21, 0x75, 0x5f, 0x15, 0x66, 0x4c, 0x71, 0x4d, 0x3e, 0x82, 0xb5, 0xdc, 0x2e,
+	0xb6, 0x57, 0x41, 0xc3, 0xfd, 0xa7, 0x86, 0x85, 0x93, 0x60, 0x16, 0x7f, 0x20, 0xdb, 0x7f, 0x0d,
+	0x30, 0x94, 0x4c, 0x55, 0x1e, 0x0e, 0x9d, 0x0b, 0x6d, 0x67, 0x31, 0x63, 0x8e, 0x6b, 0x72, 0x00,
+	0xd0, 0xf3, 0xef, 0x79, 0x2a, 0x5c, 0x5f, 0x86, 0x8b, 0x8b, 0x81, 0xe9, 0x92, 0x21, 0x67, 0x00,
+	0x79, 0xd5, 0xc5, 0xc9, 0x6c, 0xe5, 0xd6, 0x05, 0x47, 0x10, 0xf9, 0xce, 0xb0, 0xaa, 0x97, 0xe2,
+	0x2d, 0x46, 0xf1, 0x2d, 0xfa, 0x99, 0x59, 0x55, 0xb9, 0x64, 0xc8, 0x6b, 0x68, 0xb8, 0x69, 0x12,
+	0xf0, 0xcf, 0xa9, 0x3f, 0x0b, 0xb5, 0x73, 0x5d, 0x6b, 0x1a, 0xb3, 0x15, 0x56, 0xe9, 0x9c, 0xc9,
+	0x20, 0x1d, 0xe5, 0xba, 0x46, 0xa6, 0x8b, 0x56, 0xd8, 0x4c, 0x77, 0x21, 0x64, 0xae, 0x7b, 0xfe,
+	0xa0, 0x2b, 0xb2, 0x64, 0x0f, 0x2c, 0x67, 0xe2, 0xc4, 0x4e, 0x3c, 0xe6, 0xbf, 0xe9, 0x16, 0x4a,
+	0x36, 0x98, 0x15, 0x3d, 0x10, 0xaa, 0x6b, 0x67, 0x72, 0x3d, 0x97, 0x59, 0xf8, 0x85, 0x0e, 0x43,
+	0xb4, 0x64, 0xf0, 0xbe, 0x37, 0x07, 0x6a, 0xd3, 0xf6, 0x2d, 0x8f, 0xa5, 0x3d, 0x1e, 0xa7, 0x5c,
+	0x08, 0xba, 0xad, 0x8d, 0x36, 0xc5, 0xe3, 0x00, 0x39, 0x82, 0xa6, 0x56, 0x0f, 0xe6, 0x81, 0xe6,
+	0xf1, 0x20, 0x76, 0x74, 0xc9, 0xa6, 0x58, 0xa5, 0xf5, 0x5c, 0xf4, 0xec, 0xbe, 0xa0, 0x14, 0x6f,
+	0x76, 0x03, 0xe7, 0x42, 0x01, 0xd5, 0xcd, 0x17, 0xb7, 0x37, 0xe8, 0xf9, 0x01, 0x9f, 0x0a, 0xfa,
+	0x52, 0x87, 0xe0, 0xe7, 0x92, 0x21, 0x87, 0x50, 0x1f, 0x62, 0x5b, 0xa3, 0x64, 0xec, 0x07, 0x53,
+	0x4e, 0x77, 0xf5, 0x8c, 0xd4, 0xe7, 0x39, 0xa5, 0x2a, 0x0c, 0x63, 0x1e, 0x87, 0x7e, 0x3c, 0xe2,
+	0x63, 0xfa, 0x0a, 0x05, 0x35, 0x06, 0xf3, 0x25, 0xa3, 0x27, 0x20, 0xc1, 0x97, 0xb6, 0x97, 0xbd,
+	0x87, 0x10, 0xd7, 0x6a, 0x1a, 0x2f, 0x3d, 0xcf, 0x1d, 0xb2, 0x1e, 0xdd, 0xd7, 0x74, 0x35, 0xcc,
+	0x20, 0xd9, 0x85, 0x9a, 0x8a, 0xe8, 0x8c, 0x03, 0x1d, 0xaa, 0x85, 0x0b, 0x7c, 0xfc, 0x01, 0x36,
+	0x8b, 0x0f, 0x51, 0xbf, 0x28, 0x52, 0xc3, 0x87, 0xec, 0xf4, 0xaf, 0x5a, 0xcf, 0x48, 0x1d, 0xaa,
+	0xfd, 0xae, 0xf7, 0xf5, 0x9a, 0x5d, 0xb5, 0x4a, 0x64, 0x03, 0x2c, 0x8f, 0xd9, 0xfd, 0x81, 0x7b,
+	0xcd, 0xbc, 0x56, 0xf9, 0xf8, 0x1b, 0xb4, 0x1e, 0x0f, 0x28, 0x59, 0x87, 0x5a, 0xd7, 0xbb, 0xec,
+	0x32, 0x4c, 0xc2, 0x6c, 0xac, 0xe3, 0xb8, 0x37, 0x67, 0x98, 0x8a, 0x75, 0xbc, 0x73, 0x37, 0x4b,
+	0x54, 0x60, 0x78, 0x91, 0x81, 0x8a, 0xca, 0x18, 0x9c, 0x7b, 0x19, 0x32, 0x16, 0x19, 0xef, 0x5b,
+	0x66, 0xb0, 0xa6, 0xff, 0x99, 0xde, 0xfd, 0x03, 0xa0, 0x50, 0x01, 0x70, 0xac, 0x04, 0x00, 0x00,
 }
@@ -24,10 +24,13 @@ package flow
 
 import (
 	"encoding/json"
+	"net"
 	"reflect"
 	"testing"
 
 	v "github.com/gima/govalid/v1"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 )
 
 func TestFlowJSON(t *testing.T) {
@@ -106,3 +109,188 @@ func TestFlowJSON(t *testing.T) {
 		t.Fatal("Unmarshalled flow not equal to the original")
 	}
 }
+
+func TestSFlowIfIndex(t *testing.T) {
+	tests := map[uint32]uint32{
+		0:          0,
+		3:          3,
+		0x3FFFFFFF: 0,
+		0x40000002: 0,
+		0x80000003: 0,
+	}
+
+	for value, expected := range tests {
+		if index := sflowIfIndex(value); index != expected {
+			t.Errorf("Expected ifIndex %d for %x, got %d", expected, value, index)
+		}
+	}
+}
+
+func TestSFlowSubAgents(t *testing.T) {
+	ft := NewTable()
+	packet := forgeTestPacket(t, 64, false, ETH, IPv4, UDP)
+
+	sample := &layers.SFlowFlowSample{
+		Records: []layers.SFlowRecord{layers.SFlowRawPacketFlowRecord{Header: *packet}},
+	}
+
+	var uuids []string
+	for _, subAgent := range []uint32{1, 2} {
+		datagram := &layers.SFlowDatagram{
+			AgentAddress: net.ParseIP("192.168.0.1"),
+			SubAgentID:   subAgent,
+		}
+
+		flows := FlowsFromSFlowSample(ft, datagram, sample, &probePathSetter{"probe"}, nil)
+		if len(flows) != 1 {
+			t.Fatalf("Expected one flow, got %d", len(flows))
+		}
+
+		if flows[0].SFlowAgentAddress != "192.168.0.1" || flows[0].SFlowSubAgentID != subAgent {
+			t.Errorf("Wrong sFlow source: %s/%d", flows[0].SFlowAgentAddress, flows[0].SFlowSubAgentID)
+		}
+		uuids = append(uuids, flows[0].UUID)
+	}
+
+	if len(ft.GetFlows()) != 2 || uuids[0] == uuids[1] {
+		t.Errorf("Flows of the sub-agents should be distinct: %v", uuids)
+	}
+}
+
+func TestSFlowExtendedURL(t *testing.T) {
+	ft := NewTable()
+	packet := forgeTestPacket(t, 64, false, ETH, IPv4, TCP)
+
+	sample := &layers.SFlowFlowSample{
+		Records: []layers.SFlowRecord{
+			layers.SFlowRawPacketFlowRecord{Header: *packet},
+			layers.SFlowExtendedURLRecord{Direction: layers.SFlowURLdst, URL: "/index.html", Host: "www.example.com"},
+		},
+	}
+
+	flows := FlowsFromSFlowSample(ft, nil, sample, &probePathSetter{"probe"}, nil)
+	if len(flows) != 1 {
+		t.Fatalf("Expected one flow, got %d", len(flows))
+	}
+	if flows[0].HTTPURL != "/index.html" || flows[0].HTTPHost != "www.example.com" {
+		t.Errorf("Wrong HTTP URL: %s %s", flows[0].HTTPHost, flows[0].HTTPURL)
+	}
+
+	// a sample without the record leaves the flow untouched
+	sample.Records = sample.Records[:1]
+	flows = FlowsFromSFlowSample(ft, nil, sample, &probePathSetter{"probe"}, nil)
+	if len(flows) != 1 || flows[0].HTTPURL != "/index.html" {
+		t.Errorf("Expected the URL to be kept: %v", flows)
+	}
+
+	packet = forgeTestPacket(t, 64, false, ETH, IPv4, UDP)
+	sample.Records = []layers.SFlowRecord{layers.SFlowRawPacketFlowRecord{Header: *packet}}
+	flows = FlowsFromSFlowSample(ft, nil, sample, &probePathSetter{"probe"}, nil)
+	if len(flows) != 1 || flows[0].HTTPURL != "" || flows[0].HTTPHost != "" {
+		t.Errorf("Expected a flow without URL: %v", flows)
+	}
+}
+
+func TestSFlowIPv6(t *testing.T) {
+	ft := NewTable()
+
+	var flows []*Flow
+	for _, swap := range []bool{false, true} {
+		packet := forgeTestPacket(t, 64, swap, ETH, IPv6, TCP)
+		sample := &layers.SFlowFlowSample{
+			Records: []layers.SFlowRecord{layers.SFlowRawPacketFlowRecord{Header: *packet}},
+		}
+		flows = append(flows, FlowsFromSFlowSample(ft, nil, sample, &probePathSetter{"probe"}, nil)...)
+	}
+
+	if len(flows) != 2 || flows[0] != flows[1] {
+		t.Fatalf("Both directions should be folded into one flow: %v", flows)
+	}
+
+	f := flows[0]
+	if f.LayersPath != "Ethernet/IPv6/TCP/Payload" {
+		t.Errorf("Wrong layers path: %s", f.LayersPath)
+	}
+
+	ip := f.GetStatistics().GetEndpointsType(FlowEndpointType_IPV6)
+	if ip == nil {
+		t.Fatalf("IPv6 endpoints expected: %s", f.GetStatistics().DumpInfo())
+	}
+	if net.ParseIP(ip.AB.Value).To16() == nil || net.ParseIP(ip.AB.Value).To4() != nil {
+		t.Errorf("Wrong IPv6 address: %s", ip.AB.Value)
+	}
+
+	// 40 bytes of header, 20 of TCP and 3 of payload in each direction
+	if ip.AB.Packets != 1 || ip.BA.Packets != 1 || ip.AB.Bytes != 63 || ip.BA.Bytes != 63 {
+		t.Errorf("Wrong IPv6 statistics: %s", f.GetStatistics().DumpInfo())
+	}
+
+	if f.GetStatistics().GetEndpointsType(FlowEndpointType_TCPPORT) == nil {
+		t.Errorf("TCP endpoints expected: %s", f.GetStatistics().DumpInfo())
+	}
+}
+
+func TestSFlowIPv6Truncated(t *testing.T) {
+	// header of a 552 bytes IPv6 DNS query truncated by the sFlow agent
+	header := []byte{
+		0x52, 0x54, 0x00, 0x12, 0x34, 0x56, 0x52, 0x54, 0x00, 0xab, 0xcd, 0xef, 0x86, 0xdd,
+		0x60, 0x00, 0x00, 0x00, 0x02, 0x00, 0x11, 0x40,
+		0xfd, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01,
+		0xfd, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02,
+		0xd4, 0x31, 0x00, 0x35, 0x02, 0x00, 0x00, 0x00,
+		0x12, 0x34, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00,
+	}
+	packet := gopacket.NewPacket(header, layers.LayerTypeEthernet, gopacket.Default)
+
+	sample := &layers.SFlowFlowSample{
+		Records: []layers.SFlowRecord{layers.SFlowRawPacketFlowRecord{Header: packet}},
+	}
+
+	flows := FlowsFromSFlowSample(NewTable(), nil, sample, &probePathSetter{"probe"}, nil)
+	if len(flows) != 1 {
+		t.Fatalf("Expected one flow, got %d", len(flows))
+	}
+
+	fs := flows[0].GetStatistics()
+	ip := fs.GetEndpointsType(FlowEndpointType_IPV6)
+	if ip == nil || ip.AB.Value != "fd00::1" || ip.BA.Value != "fd00::2" || ip.AB.Bytes != 552 {
+		t.Fatalf("Wrong IPv6 endpoints: %s", fs.DumpInfo())
+	}
+
+	udp := fs.GetEndpointsType(FlowEndpointType_UDPPORT)
+	if udp == nil || udp.AB.Value != "54321" || udp.BA.Value != "53" {
+		t.Errorf("Wrong UDP endpoints: %s", fs.DumpInfo())
+	}
+}
+
+func TestSFlowSamplingScale(t *testing.T) {
+	packet := *udpPacket(t, 1234, 0)
+	sample := &layers.SFlowFlowSample{
+		SamplingRate: 10,
+		Records:      []layers.SFlowRecord{layers.SFlowRawPacketFlowRecord{Header: packet}},
+	}
+
+	raw := FlowsFromSFlowSample(NewTable(), nil, sample, nil, nil)
+
+	ft := NewTable()
+	ft.SetSamplingScale(true)
+	FlowsFromSFlowSample(ft, nil, sample, nil, nil)
+	scaled := FlowsFromSFlowSample(ft, nil, sample, nil, nil)
+
+	if len(raw) != 1 || len(scaled) != 1 {
+		t.Fatalf("Expected one flow, got %d and %d", len(raw), len(scaled))
+	}
+
+	for _, eptype := range []FlowEndpointType{FlowEndpointType_ETHERNET, FlowEndpointType_IPV4, FlowEndpointType_UDPPORT} {
+		r := raw[0].GetStatistics().GetEndpointsType(eptype)
+		s := scaled[0].GetStatistics().GetEndpointsType(eptype)
+		if r == nil || s == nil {
+			t.Fatalf("Missing %s endpoints", eptype)
+		}
+		rPackets, rBytes := r.AB.Packets+r.BA.Packets, r.AB.Bytes+r.BA.Bytes
+		sPackets, sBytes := s.AB.Packets+s.BA.Packets, s.AB.Bytes+s.BA.Bytes
+		if rPackets != 1 || sPackets != 20 || sBytes != 20*rBytes {
+			t.Errorf("Wrong %s counters: raw %d/%d, scaled %d/%d", eptype, rPackets, rBytes, sPackets, sBytes)
+		}
+	}
+}
@@ -57,3 +57,12 @@ func (ftma *tableManagerAsync) Unregister() {
 	ftma.ticker.Stop()
 	ftma.running = false
 }
+
+// Reset changes the period of a registered function. The ticker is replaced,
+// the loops selecting on it have to get it again after the reset.
+func (ftma *tableManagerAsync) Reset(every time.Duration, duration time.Duration) {
+	ftma.ticker.Stop()
+	ftma.every = every
+	ftma.duration = duration
+	ftma.ticker = time.NewTicker(every)
+}
@@ -23,7 +23,13 @@
 package mappings
 
 import (
+	"hash/fnv"
+	"os"
+	"sync/atomic"
+
+	"github.com/redhat-cip/skydive/config"
 	"github.com/redhat-cip/skydive/flow"
+	"github.com/redhat-cip/skydive/logging"
 )
 
 type FlowEnhancer interface {
@@ -32,6 +38,39 @@ type FlowEnhancer interface {
 
 type FlowMappingPipeline struct {
 	Enhancers []FlowEnhancer
+	// Sampling restricts the enhancement to one flow out of Sampling, 0 or 1
+	// enhances all of them
+	Sampling uint32
+	// Host, when set, tags all the flows, sampled or not, with the hostname
+	// of the agent
+	Host     string
+	enhanced uint64
+	skipped  uint64
+}
+
+type FlowMappingPipelineStats struct {
+	Enhanced uint64
+	Skipped  uint64
+}
+
+// Add sums the stats of several pipelines
+func (s FlowMappingPipelineStats) Add(o FlowMappingPipelineStats) FlowMappingPipelineStats {
+	return FlowMappingPipelineStats{
+		Enhanced: s.Enhanced + o.Enhanced,
+		Skipped:  s.Skipped + o.Skipped,
+	}
+}
+
+// sampled returns whether the flow has to be enhanced. The sampling is based
+// on the flow UUID so that a flow is enhanced at each update or never.
+func (fe *FlowMappingPipeline) sampled(flow *flow.Flow) bool {
+	if fe.Sampling <= 1 {
+		return true
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(flow.UUID))
+	return h.Sum32()%fe.Sampling == 0
 }
 
 func (fe *FlowMappingPipeline) EnhanceFlow(flow *flow.Flow) {
@@ -40,9 +79,30 @@ func (fe *FlowMappingPipeline) EnhanceFlow(flow *flow.Flow) {
 	}
 }
 
+// Enhance enhances the sampled flows, the other ones are passed through
+// marked as unenhanced
 func (fe *FlowMappingPipeline) Enhance(flows []*flow.Flow) {
 	for _, flow := range flows {
+		if fe.Host != "" {
+			flow.Host = fe.Host
+		}
+
+		if !fe.sampled(flow) {
+			flow.Unenhanced = true
+			atomic.AddUint64(&fe.skipped, 1)
+			continue
+		}
+
 		fe.EnhanceFlow(flow)
+		atomic.AddUint64(&fe.enhanced, 1)
+	}
+}
+
+// Stats returns the number of flows enhanced and passed through unenhanced
+func (fe *FlowMappingPipeline) Stats() FlowMappingPipelineStats {
+	return FlowMappingPipelineStats{
+		Enhanced: atomic.LoadUint64(&fe.enhanced),
+		Skipped:  atomic.LoadUint64(&fe.skipped),
 	}
 }
 
@@ -51,3 +111,17 @@ func NewFlowMappingPipeline(enhancers ...FlowEnhancer) *FlowMappingPipeline {
 		Enhancers: enhancers,
 	}
 }
+
+// NewFlowMappingPipelineFromConfig returns an agent pipeline enhancing the
+// flows sampled according to agent.flow_enhancement_sampling and tagging them
+// with the hostname of the agent
+func NewFlowMappingPipelineFromConfig(enhancers ...FlowEnhancer) *FlowMappingPipeline {
+	pipeline := NewFlowMappingPipeline(enhancers...)
+	pipeline.Sampling = uint32(config.GetConfig().GetInt("agent.flow_enhancement_sampling"))
+	if h, err := os.Hostname(); err == nil {
+		pipeline.Host = h
+	} else {
+		logging.GetLogger().Errorf("Unable to retrieve hostname, flows won't be tagged: %s", err.Error())
+	}
+	return pipeline
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package mappings
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/redhat-cip/skydive/flow"
+)
+
+type countEnhancer struct {
+	count int
+}
+
+func (c *countEnhancer) Enhance(f *flow.Flow) {
+	c.count++
+}
+
+func TestSampling(t *testing.T) {
+	enhancer := &countEnhancer{}
+	pipeline := NewFlowMappingPipeline(enhancer)
+	pipeline.Sampling = 4
+
+	flows := make([]*flow.Flow, 1000)
+	for i := range flows {
+		flows[i] = &flow.Flow{UUID: strconv.Itoa(i)}
+	}
+
+	pipeline.Enhance(flows)
+	stats := pipeline.Stats()
+	if stats.Enhanced+stats.Skipped != 1000 || int(stats.Enhanced) != enhancer.count {
+		t.Fatalf("Wrong pipeline stats: %+v, %d flows enhanced", stats, enhancer.count)
+	}
+
+	if stats.Enhanced < 150 || stats.Enhanced > 350 {
+		t.Errorf("Expected about one flow out of 4 enhanced, got %d", stats.Enhanced)
+	}
+
+	for _, f := range flows {
+		if f.Unenhanced != !pipeline.sampled(f) {
+			t.Fatalf("Wrong unenhanced flag for flow %s", f.UUID)
+		}
+	}
+
+	// a flow is sampled the same way at each update
+	pipeline.Enhance(flows)
+	if again := pipeline.Stats(); again.Enhanced != 2*stats.Enhanced {
+		t.Errorf("Flows not sampled consistently: %+v then %+v", stats, again)
+	}
+}
+
+func TestHostTag(t *testing.T) {
+	pipeline := NewFlowMappingPipeline(&countEnhancer{})
+	pipeline.Sampling = 1000000
+	pipeline.Host = "host1"
+
+	flows := []*flow.Flow{{UUID: "1"}, {UUID: "2"}}
+	pipeline.Enhance(flows)
+	for _, f := range flows {
+		if f.Host != "host1" {
+			t.Errorf("Expected flow %s tagged with the host, sampled or not, got %+v", f.UUID, f)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package flow
+
+// FlowMetric holds the packets and bytes of a flow counted at its link layer
+// between Start and Last, epoch seconds
+type FlowMetric struct {
+	UUID      string
+	Start     int64
+	Last      int64
+	ABPackets uint64
+	ABBytes   uint64
+	BAPackets uint64
+	BABytes   uint64
+}
+
+type MetricFunc func(m []*FlowMetric)
+
+// totalMetric returns the counters of the flow since its start
+func totalMetric(f *Flow, now int64) *FlowMetric {
+	fs := f.GetStatistics()
+	if fs == nil {
+		return &FlowMetric{UUID: f.UUID, Last: now}
+	}
+
+	m := &FlowMetric{UUID: f.UUID, Start: fs.Start, Last: now}
+	if ep := fs.GetEndpointsType(FlowEndpointType_ETHERNET); ep != nil {
+		m.ABPackets, m.ABBytes = ep.AB.Packets, ep.AB.Bytes
+		m.BAPackets, m.BABytes = ep.BA.Packets, ep.BA.Bytes
+	}
+	return m
+}
+
+// sub returns the counters of m since prev, the counters are restarted
+// when the flow statistics were reset
+func (m *FlowMetric) sub(prev *FlowMetric) *FlowMetric {
+	if m.ABPackets < prev.ABPackets || m.BAPackets < prev.BAPackets || m.ABBytes < prev.ABBytes || m.BABytes < prev.BABytes {
+		return m
+	}
+
+	return &FlowMetric{
+		UUID:      m.UUID,
+		Start:     prev.Last,
+		Last:      m.Last,
+		ABPackets: m.ABPackets - prev.ABPackets,
+		ABBytes:   m.ABBytes - prev.ABBytes,
+		BAPackets: m.BAPackets - prev.BAPackets,
+		BABytes:   m.BABytes - prev.BABytes,
+	}
+}
+
+func (m *FlowMetric) isZero() bool {
+	return m.ABPackets == 0 && m.BAPackets == 0
+}
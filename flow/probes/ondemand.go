@@ -28,6 +28,7 @@ import (
 
 	"github.com/redhat-cip/skydive/api"
 	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/probe"
 	"github.com/redhat-cip/skydive/topology"
 	"github.com/redhat-cip/skydive/topology/graph"
 )
@@ -39,48 +40,72 @@ type OnDemandProbeListener struct {
 	CaptureHandler api.ApiHandler
 	watcher        api.StoppableWatcher
 	host           string
+	registered     map[graph.Identifier]string
 }
 
 type FlowProbe interface {
+	probe.Probe
 	RegisterProbe(n *graph.Node, capture *api.Capture) error
 	UnregisterProbe(n *graph.Node) error
 	Flush()
 }
 
-func (o *OnDemandProbeListener) probeFromType(n *graph.Node) FlowProbe {
-	var probeName string
+// probeType returns the type of the capture or, when not specified, the type
+// of probe handling the node
+func probeType(n *graph.Node, capture *api.Capture) string {
+	if capture.Type != "" {
+		return capture.Type
+	}
 
 	switch n.Metadata()["Type"] {
 	case "ovsbridge":
-		probeName = "ovssflow"
+		return "ovssflow"
 	default:
-		probeName = "pcap"
+		return "pcap"
 	}
+}
 
-	probe := o.Probes.GetProbe(probeName)
-	if probe == nil {
+func (o *OnDemandProbeListener) getProbe(t string) FlowProbe {
+	p := o.Probes.GetProbe(t)
+	if p == nil {
 		return nil
 	}
 
-	return probe.(FlowProbe)
+	return p.(FlowProbe)
 }
 
 func (o *OnDemandProbeListener) registerProbe(n *graph.Node, capture *api.Capture) {
-	fprobe := o.probeFromType(n)
+	t := probeType(n, capture)
+
+	fprobe := o.getProbe(t)
 	if fprobe == nil {
-		logging.GetLogger().Errorf("Failed to register flow probe, unknown type %v", n)
+		logging.GetLogger().Errorf("Failed to register flow probe, unknown type %s for %v", t, n)
 		return
 	}
 
 	if err := fprobe.RegisterProbe(n, capture); err != nil {
-		logging.GetLogger().Debugf("Failed to register flow probe: %s", err.Error())
+		// nodes are registered again on every update, only report the
+		// failures of the first registration
+		if _, ok := o.registered[n.ID]; ok {
+			logging.GetLogger().Debugf("Failed to register flow probe: %s", err.Error())
+		} else {
+			logging.GetLogger().Errorf("Failed to register flow probe on %s: %s", capture.ProbePath, err.Error())
+			return
+		}
 	}
+	o.registered[n.ID] = t
 
 	o.Graph.AddMetadata(n, "State.FlowCapture", "ON")
 }
 
 func (o *OnDemandProbeListener) unregisterProbe(n *graph.Node) {
-	fprobe := o.probeFromType(n)
+	t, ok := o.registered[n.ID]
+	if !ok {
+		return
+	}
+	delete(o.registered, n.ID)
+
+	fprobe := o.getProbe(t)
 	if fprobe == nil {
 		return
 	}
@@ -194,5 +219,6 @@ func NewOnDemandProbeListener(fb *FlowProbeBundle, g *graph.Graph, ch api.ApiHan
 		Probes:         fb,
 		CaptureHandler: ch,
 		host:           h,
+		registered:     make(map[graph.Identifier]string),
 	}, nil
 }
@@ -26,12 +26,16 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"os"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/socketplane/libovsdb"
 
 	"github.com/redhat-cip/skydive/analyzer"
 	"github.com/redhat-cip/skydive/api"
+	"github.com/redhat-cip/skydive/config"
 	"github.com/redhat-cip/skydive/flow"
 	"github.com/redhat-cip/skydive/flow/mappings"
 	"github.com/redhat-cip/skydive/logging"
@@ -42,6 +46,13 @@ import (
 	"github.com/redhat-cip/skydive/topology/probes"
 )
 
+const (
+	// enough for the ethernet, IP and transport headers
+	minHeaderSize = 64
+	// maximum header size supported by OVS
+	maxHeaderSize = 256
+)
+
 type OvsSFlowProbe struct {
 	ID             string
 	Interface      string
@@ -50,25 +61,99 @@ type OvsSFlowProbe struct {
 	Sampling       uint32
 	Polling        uint32
 	ProbeGraphPath string
+
+	// protects ProbeGraphPath, refreshed while the agent labels flows
+	lock sync.RWMutex
 }
 
 type OvsSFlowProbesHandler struct {
+	graph.DefaultGraphListener
 	Graph          *graph.Graph
 	AnalyzerClient *analyzer.Client
+	// captures restored by Start, none if not set
+	CaptureHandler api.ApiHandler
 	ovsClient      *ovsdb.OvsClient
 	allocator      *sflow.SFlowAgentAllocator
+	host           string
+
+	// registered probes by bridge UUID, their path is refreshed when the
+	// bridges are moved
+	probes     map[string]*OvsSFlowProbe
+	probesLock sync.Mutex
+}
+
+// the rows of the flow export tables whose probe-id starts with this prefix
+// are owned by skydive
+const probeIDPrefix = "Skydive"
+
+// flowExportTables are the ovsdb flow export tables along with the Bridge
+// column referencing their rows
+var flowExportTables = []struct {
+	table  string
+	column string
+}{
+	{"sFlow", "sflow"},
+	{"IPFIX", "ipfix"},
+	{"NetFlow", "netflow"},
 }
 
 func probeID(i string) string {
-	return "SkydiveSFlowProbe_" + strings.Replace(i, "-", "_", -1)
+	return probeIDPrefix + "SFlowProbe_" + strings.Replace(i, "-", "_", -1)
+}
+
+// agentUUID returns the identifier of the sFlow agent used for a bridge
+// according to the sflow.agent_uuid scheme, either "bridge" to use the ovsdb
+// bridge UUID or "host-bridge" to use the hostname and the bridge name.
+func (o *OvsSFlowProbesHandler) agentUUID(n *graph.Node) string {
+	name, _ := n.Metadata()["Name"].(string)
+	return o.bridgeAgentUUID(n.Metadata()["UUID"].(string), name)
+}
+
+func (o *OvsSFlowProbesHandler) bridgeAgentUUID(bridgeUUID string, name string) string {
+	switch scheme := config.GetConfig().GetString("sflow.agent_uuid"); scheme {
+	case "bridge":
+	case "host-bridge":
+		if name != "" {
+			return sflow.AgentUUID(o.host, name)
+		}
+	default:
+		logging.GetLogger().Errorf("Unknown sflow agent UUID scheme %s, using bridge UUID", scheme)
+	}
+
+	return bridgeUUID
 }
 
 func (p *OvsSFlowProbe) SetProbePath(flow *flow.Flow) bool {
+	p.lock.RLock()
 	flow.ProbeGraphPath = p.ProbeGraphPath
+	p.lock.RUnlock()
+	return true
+}
+
+// setProbeGraphPath changes the path the flows are labeled with, returns
+// whether it changed
+func (p *OvsSFlowProbe) setProbeGraphPath(path string) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.ProbeGraphPath == path {
+		return false
+	}
+	p.ProbeGraphPath = path
 	return true
 }
 
-func newInsertSFlowProbeOP(probe OvsSFlowProbe) (*libovsdb.Operation, error) {
+// newInsertSFlowProbeOP returns the operation inserting the probe, the header
+// size of the probe is clamped to the range accepted by OVS and the sflow agent
+func newInsertSFlowProbeOP(probe *OvsSFlowProbe) (*libovsdb.Operation, error) {
+	if probe.HeaderSize < minHeaderSize {
+		logging.GetLogger().Warningf("sFlow header size %d too small, using %d", probe.HeaderSize, minHeaderSize)
+		probe.HeaderSize = minHeaderSize
+	} else if probe.HeaderSize > maxHeaderSize {
+		logging.GetLogger().Warningf("sFlow header size %d too large, using %d", probe.HeaderSize, maxHeaderSize)
+		probe.HeaderSize = maxHeaderSize
+	}
+
 	sFlowRow := make(map[string]interface{})
 	sFlowRow["agent"] = probe.Interface
 	sFlowRow["targets"] = probe.Target
@@ -95,13 +180,20 @@ func newInsertSFlowProbeOP(probe OvsSFlowProbe) (*libovsdb.Operation, error) {
 }
 
 func compareProbeID(row *map[string]interface{}, id string) (bool, error) {
+	value, err := rowProbeID(row)
+	return value == id && value != "", err
+}
+
+// rowProbeID returns the probe-id of the external_ids of a row, empty if not
+// set
+func rowProbeID(row *map[string]interface{}) (string, error) {
 	extIds := (*row)["external_ids"]
 	switch extIds.(type) {
 	case []interface{}:
 		sl := extIds.([]interface{})
 		bSliced, err := json.Marshal(sl)
 		if err != nil {
-			return false, err
+			return "", err
 		}
 
 		switch sl[0] {
@@ -109,18 +201,151 @@ func compareProbeID(row *map[string]interface{}, id string) (bool, error) {
 			var oMap libovsdb.OvsMap
 			err = json.Unmarshal(bSliced, &oMap)
 			if err != nil {
-				return false, err
+				return "", err
 			}
 
-			if value, ok := oMap.GoMap["probe-id"]; ok {
-				if value.(string) == id {
-					return true, nil
+			if value, ok := oMap.GoMap["probe-id"].(string); ok {
+				return value, nil
+			}
+		}
+	}
+
+	return "", nil
+}
+
+// ownedRows returns the UUIDs of the rows of the table owned by skydive
+func (o *OvsSFlowProbesHandler) ownedRows(table string) ([]string, error) {
+	/* FIX(safchain) don't find a way to send a null condition */
+	condition := libovsdb.NewCondition("_uuid", "!=", libovsdb.UUID{GoUuid: "abc"})
+	selectOp := libovsdb.Operation{
+		Op:      "select",
+		Table:   table,
+		Where:   []interface{}{condition},
+		Columns: []string{"_uuid", "external_ids"},
+	}
+
+	result, err := o.ovsClient.Exec(selectOp)
+	if err != nil {
+		return nil, err
+	}
+
+	var uuids []string
+	for _, r := range result {
+		for _, row := range r.Rows {
+			u, ok := row["_uuid"].([]interface{})
+			if !ok || len(u) != 2 {
+				continue
+			}
+
+			if id, _ := rowProbeID(&row); strings.HasPrefix(id, probeIDPrefix) {
+				uuids = append(uuids, u[1].(string))
+			}
+		}
+	}
+
+	return uuids, nil
+}
+
+// refUUIDs returns the UUIDs referenced by a column, either a single UUID or
+// a set of UUIDs
+func refUUIDs(value interface{}) []string {
+	v, ok := value.([]interface{})
+	if !ok || len(v) != 2 {
+		return nil
+	}
+
+	switch v[0] {
+	case "uuid":
+		if u, ok := v[1].(string); ok {
+			return []string{u}
+		}
+	case "set":
+		var uuids []string
+		if set, ok := v[1].([]interface{}); ok {
+			for _, e := range set {
+				uuids = append(uuids, refUUIDs(e)...)
+			}
+		}
+		return uuids
+	}
+
+	return nil
+}
+
+// cleanupProbeRows unlinks the rows owned by skydive of the flow export
+// tables from their bridges, ovsdb then garbage collects them as they are
+// no longer referenced
+func (o *OvsSFlowProbesHandler) cleanupProbeRows() error {
+	owned := make(map[string]string)
+	columns := []string{"_uuid"}
+	for _, t := range flowExportTables {
+		uuids, err := o.ownedRows(t.table)
+		if err != nil {
+			return err
+		}
+		for _, uuid := range uuids {
+			owned[uuid] = t.table
+		}
+		columns = append(columns, t.column)
+	}
+
+	if len(owned) == 0 {
+		return nil
+	}
+
+	/* FIX(safchain) don't find a way to send a null condition */
+	condition := libovsdb.NewCondition("_uuid", "!=", libovsdb.UUID{GoUuid: "abc"})
+	selectOp := libovsdb.Operation{
+		Op:      "select",
+		Table:   "Bridge",
+		Where:   []interface{}{condition},
+		Columns: columns,
+	}
+
+	result, err := o.ovsClient.Exec(selectOp)
+	if err != nil {
+		return err
+	}
+
+	operations := []libovsdb.Operation{}
+	for _, r := range result {
+		for _, row := range r.Rows {
+			u, ok := row["_uuid"].([]interface{})
+			if !ok || len(u) != 2 {
+				continue
+			}
+			bridgeUUID := u[1].(string)
+
+			bridgeRow := make(map[string]interface{})
+			for _, t := range flowExportTables {
+				for _, uuid := range refUUIDs(row[t.column]) {
+					if table, ok := owned[uuid]; ok {
+						logging.GetLogger().Infof("Removing OVS %s probe %s from bridge %s", table, uuid, bridgeUUID)
+						bridgeRow[t.column] = libovsdb.OvsSet{GoSet: make([]interface{}, 0)}
+					}
 				}
 			}
+
+			if len(bridgeRow) == 0 {
+				continue
+			}
+
+			condition := libovsdb.NewCondition("_uuid", "==", libovsdb.UUID{GoUuid: bridgeUUID})
+			operations = append(operations, libovsdb.Operation{
+				Op:    "update",
+				Table: "Bridge",
+				Row:   bridgeRow,
+				Where: []interface{}{condition},
+			})
 		}
 	}
 
-	return false, nil
+	if len(operations) == 0 {
+		return nil
+	}
+
+	_, err = o.ovsClient.Exec(operations...)
+	return err
 }
 
 func (o *OvsSFlowProbesHandler) retrieveSFlowProbeUUID(id string) (string, error) {
@@ -152,8 +377,8 @@ func (o *OvsSFlowProbesHandler) retrieveSFlowProbeUUID(id string) (string, error
 	return "", nil
 }
 
-func (o *OvsSFlowProbesHandler) registerSFlowProbeOnBridge(probe OvsSFlowProbe, bridgeUUID string) error {
-	probeUUID, err := o.retrieveSFlowProbeUUID(probeID(bridgeUUID))
+func (o *OvsSFlowProbesHandler) registerSFlowProbeOnBridge(probe *OvsSFlowProbe, bridgeUUID string) error {
+	probeUUID, err := o.retrieveSFlowProbeUUID(probe.ID)
 	if err != nil {
 		return err
 	}
@@ -165,13 +390,26 @@ func (o *OvsSFlowProbesHandler) registerSFlowProbeOnBridge(probe OvsSFlowProbe,
 		uuid = libovsdb.UUID{GoUuid: probeUUID}
 
 		logging.GetLogger().Infof("Using already registered OVS SFlow probe \"%s(%s)\"", probe.ID, uuid)
+
+		// the probe may have been registered by a previous agent whose
+		// sflow agent listened on another target
+		sFlowRow := make(map[string]interface{})
+		sFlowRow["targets"] = probe.Target
+
+		condition := libovsdb.NewCondition("_uuid", "==", uuid)
+		operations = append(operations, libovsdb.Operation{
+			Op:    "update",
+			Table: "sFlow",
+			Row:   sFlowRow,
+			Where: []interface{}{condition},
+		})
 	} else {
 		insertOp, err := newInsertSFlowProbeOP(probe)
 		if err != nil {
 			return err
 		}
 		uuid = libovsdb.UUID{GoUuid: insertOp.UUIDName}
-		logging.GetLogger().Infof("Registering new OVS SFlow probe \"%s(%s)\"", probe.ID, uuid)
+		logging.GetLogger().Infof("Registering new OVS SFlow probe \"%s(%s)\" with a header size of %d", probe.ID, uuid, probe.HeaderSize)
 
 		operations = append(operations, *insertOp)
 	}
@@ -195,8 +433,8 @@ func (o *OvsSFlowProbesHandler) registerSFlowProbeOnBridge(probe OvsSFlowProbe,
 	return nil
 }
 
-func (o *OvsSFlowProbesHandler) UnregisterSFlowProbeFromBridge(bridgeUUID string) error {
-	probeUUID, err := o.retrieveSFlowProbeUUID(probeID(bridgeUUID))
+func (o *OvsSFlowProbesHandler) UnregisterSFlowProbeFromBridge(bridgeUUID string, agentUUID string) error {
+	probeUUID, err := o.retrieveSFlowProbeUUID(probeID(agentUUID))
 	if err != nil {
 		return err
 	}
@@ -225,21 +463,55 @@ func (o *OvsSFlowProbesHandler) UnregisterSFlowProbeFromBridge(bridgeUUID string
 	return nil
 }
 
-func (o *OvsSFlowProbesHandler) RegisterProbeOnBridge(bridgeUUID string, path string) error {
-	probe := OvsSFlowProbe{
-		ID:             probeID(bridgeUUID),
+func (o *OvsSFlowProbesHandler) RegisterProbeOnBridge(bridgeUUID string, agentUUID string, path string, capture *api.Capture) error {
+	probe := &OvsSFlowProbe{
+		ID:             probeID(agentUUID),
 		Interface:      "lo",
-		HeaderSize:     256,
+		HeaderSize:     uint32(config.GetConfig().GetInt("sflow.header_size")),
 		Sampling:       1,
 		Polling:        0,
 		ProbeGraphPath: path,
 	}
 
-	agent, err := o.allocator.Alloc(bridgeUUID, &probe)
+	opts := sflow.AgentOptions{
+		FlowTableExpire: time.Duration(capture.FlowTableExpire) * time.Second,
+		FlowTableUpdate: time.Duration(capture.FlowTableUpdate) * time.Second,
+	}
+
+	if capture.BPFFilter != "" {
+		var err error
+		if opts.Filter, err = flow.NewPacketFilter(capture.BPFFilter); err != nil {
+			return err
+		}
+	}
+
+	// the flows of a capture targeting an analyzer are all sent to it
+	if capture.Analyzer != "" {
+		if o.AnalyzerClient == nil {
+			return fmt.Errorf("no analyzer client to send the flows to analyzer %s", capture.Analyzer)
+		}
+
+		var err error
+		if opts.AnalyzerClient, err = o.AnalyzerClient.Pinned(capture.Analyzer); err != nil {
+			return err
+		}
+	}
+
+	agent, err := o.allocator.Alloc(agentUUID, probe, opts)
 	if err != nil && err != sflow.AgentAlreadyAllocated {
 		return err
 	}
 
+	// an already allocated agent keeps labeling the flows with the probe it
+	// was allocated with, only the path of this one is updated
+	o.probesLock.Lock()
+	if registered, found := o.probes[bridgeUUID]; found && err == sflow.AgentAlreadyAllocated {
+		registered.setProbeGraphPath(path)
+	} else {
+		o.probes[bridgeUUID] = probe
+	}
+	o.probesLock.Unlock()
+
 	probe.Target = agent.GetTarget()
 
 	err = o.registerSFlowProbeOnBridge(probe, bridgeUUID)
@@ -262,7 +534,7 @@ func (o *OvsSFlowProbesHandler) RegisterProbe(n *graph.Node, capture *api.Captur
 
 		probePath := topology.NodePath{Nodes: nodes}.Marshal()
 
-		err := o.RegisterProbeOnBridge(n.Metadata()["UUID"].(string), probePath)
+		err := o.RegisterProbeOnBridge(n.Metadata()["UUID"].(string), o.agentUUID(n), probePath, capture)
 		if err != nil {
 			return err
 		}
@@ -270,17 +542,28 @@ func (o *OvsSFlowProbesHandler) RegisterProbe(n *graph.Node, capture *api.Captur
 	return nil
 }
 
-func (o *OvsSFlowProbesHandler) unregisterProbe(bridgeUUID string) error {
-	err := o.UnregisterSFlowProbeFromBridge(bridgeUUID)
+func (o *OvsSFlowProbesHandler) unregisterProbe(bridgeUUID string, agentUUID string) error {
+	err := o.UnregisterSFlowProbeFromBridge(bridgeUUID, agentUUID)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// UnregisterProbe removes the probe from the bridge and releases its sFlow
+// agent. Called by the OnDemandProbeListener when a captured bridge is
+// deleted from the graph, the agent is released even if the bridge is
+// already gone from ovsdb.
 func (o *OvsSFlowProbesHandler) UnregisterProbe(n *graph.Node) error {
 	if isOvsBridge(n) {
-		err := o.unregisterProbe(n.Metadata()["UUID"].(string))
+		bridgeUUID, agentUUID := n.Metadata()["UUID"].(string), o.agentUUID(n)
+		defer o.allocator.Release(agentUUID)
+
+		o.probesLock.Lock()
+		delete(o.probes, bridgeUUID)
+		o.probesLock.Unlock()
+
+		err := o.unregisterProbe(bridgeUUID, agentUUID)
 		if err != nil {
 			return err
 		}
@@ -288,11 +571,162 @@ func (o *OvsSFlowProbesHandler) UnregisterProbe(n *graph.Node) error {
 	return nil
 }
 
+// onAgentEvicted removes the probe of an agent stopped by itself from its
+// bridge, otherwise OVS would keep sending the datagrams of the bridge to the
+// freed port, which may be allocated to the agent of another bridge
+func (o *OvsSFlowProbesHandler) onAgentEvicted(agentUUID string) {
+	id := probeID(agentUUID)
+
+	o.probesLock.Lock()
+	var bridgeUUID string
+	for uuid, probe := range o.probes {
+		if probe.ID == id {
+			bridgeUUID = uuid
+			delete(o.probes, uuid)
+			break
+		}
+	}
+	o.probesLock.Unlock()
+
+	if bridgeUUID == "" {
+		return
+	}
+
+	if err := o.unregisterProbe(bridgeUUID, agentUUID); err != nil {
+		logging.GetLogger().Errorf("Unable to remove the probe of evicted sflow agent %s from bridge %s: %s", agentUUID, bridgeUUID, err.Error())
+	}
+}
+
+// refreshProbePaths updates the path of the registered probes whose bridge
+// has now another ownership path to its host, so that the flows of a moved
+// bridge are not labeled with a stale path. The ovsdb rows of the probes are
+// identified by the sFlow agent and not by the path, they are kept as is.
+// Called by the graph with its lock held.
+func (o *OvsSFlowProbesHandler) refreshProbePaths() {
+	o.probesLock.Lock()
+	defer o.probesLock.Unlock()
+
+	for bridgeUUID, probe := range o.probes {
+		n := o.Graph.LookupFirstNode(graph.Metadata{"UUID": bridgeUUID, "Type": "ovsbridge"})
+		if n == nil {
+			continue
+		}
+
+		// keep the previous path while the bridge is being moved
+		nodes := o.Graph.LookupShortestPath(n, graph.Metadata{"Type": "host"}, topology.IsOwnershipEdge)
+		if len(nodes) == 0 {
+			continue
+		}
+
+		path := topology.NodePath{Nodes: nodes}.Marshal()
+		if probe.setProbeGraphPath(path) {
+			logging.GetLogger().Infof("Flows of bridge %s now captured at %s", bridgeUUID, path)
+		}
+	}
+}
+
+func (o *OvsSFlowProbesHandler) OnEdgeAdded(e *graph.Edge) {
+	if topology.IsOwnershipEdge(e) {
+		o.refreshProbePaths()
+	}
+}
+
+func (o *OvsSFlowProbesHandler) OnEdgeDeleted(e *graph.Edge) {
+	if topology.IsOwnershipEdge(e) {
+		o.refreshProbePaths()
+	}
+}
+
+// bridges returns the name of the OVS bridges indexed by UUID
+func (o *OvsSFlowProbesHandler) bridges() (map[string]string, error) {
+	/* FIX(safchain) don't find a way to send a null condition */
+	condition := libovsdb.NewCondition("_uuid", "!=", libovsdb.UUID{GoUuid: "abc"})
+	selectOp := libovsdb.Operation{
+		Op:      "select",
+		Table:   "Bridge",
+		Where:   []interface{}{condition},
+		Columns: []string{"_uuid", "name"},
+	}
+
+	result, err := o.ovsClient.Exec(selectOp)
+	if err != nil {
+		return nil, err
+	}
+
+	bridges := make(map[string]string)
+	for _, r := range result {
+		for _, row := range r.Rows {
+			u, ok := row["_uuid"].([]interface{})
+			if !ok || len(u) != 2 {
+				continue
+			}
+			uuid, _ := u[1].(string)
+			name, _ := row["name"].(string)
+			bridges[uuid] = name
+		}
+	}
+
+	return bridges, nil
+}
+
+// lookupCapture returns the capture of the bridge, either set for this host
+// or for all the hosts
+func (o *OvsSFlowProbesHandler) lookupCapture(name string) (string, *api.Capture) {
+	bridge := name + "[Type=ovsbridge]"
+	path := o.host + "[Type=host]/" + bridge
+
+	if capture, ok := o.CaptureHandler.Get(path); ok {
+		return path, capture.(*api.Capture)
+	}
+	if capture, ok := o.CaptureHandler.Get("*/" + bridge); ok {
+		return path, capture.(*api.Capture)
+	}
+
+	return "", nil
+}
+
+// Start registers the probes of the OVS bridges having a capture configured,
+// so that a restarted agent captures again without waiting for the bridges
+// to be added to the graph. Registering a probe again later only refreshes
+// its path.
 func (o *OvsSFlowProbesHandler) Start() {
+	o.Graph.AddEventListener(o)
+
+	if o.CaptureHandler == nil {
+		return
+	}
+
+	bridges, err := o.bridges()
+	if err != nil {
+		logging.GetLogger().Errorf("Unable to list OVS bridges: %s", err.Error())
+		return
+	}
+
+	for uuid, name := range bridges {
+		path, capture := o.lookupCapture(name)
+		if capture == nil {
+			continue
+		}
+
+		if err := o.RegisterProbeOnBridge(uuid, o.bridgeAgentUUID(uuid, name), path, capture); err != nil {
+			logging.GetLogger().Errorf("Failed to register flow probe on %s: %s", path, err.Error())
+		}
+	}
 }
 
+// Stop removes the probes of skydive from the OVS bridges, whatever their
+// export protocol, and releases the sFlow agents
 func (o *OvsSFlowProbesHandler) Stop() {
+	o.Graph.RemoveEventListener(o)
+
+	if err := o.cleanupProbeRows(); err != nil {
+		logging.GetLogger().Errorf("Unable to remove the OVS probes: %s", err.Error())
+	}
 	o.allocator.ReleaseAll()
+
+	o.probesLock.Lock()
+	o.probes = make(map[string]*OvsSFlowProbe)
+	o.probesLock.Unlock()
 }
 
 func (o *OvsSFlowProbesHandler) Flush() {
@@ -301,19 +735,60 @@ func (o *OvsSFlowProbesHandler) Flush() {
 	}
 }
 
-func NewOvsSFlowProbesHandler(tb *probes.TopologyProbeBundle, g *graph.Graph, m *mappings.FlowMappingPipeline, a *analyzer.Client) *OvsSFlowProbesHandler {
+// FlowTables returns the flow table of each sFlow agent, by agent UUID
+func (o *OvsSFlowProbesHandler) FlowTables() map[string]*flow.Table {
+	tables := make(map[string]*flow.Table)
+	for _, a := range o.allocator.Agents() {
+		if ft := a.FlowTable(); ft != nil {
+			tables[a.UUID] = ft
+		}
+	}
+	return tables
+}
+
+// FlowMappingPipeline returns the pipeline enhancing the flows of the probes
+func (o *OvsSFlowProbesHandler) FlowMappingPipeline() *mappings.FlowMappingPipeline {
+	return o.allocator.FlowMappingPipeline
+}
+
+func init() {
+	RegisterFlowProbeType("ovssflow", func(tb *probes.TopologyProbeBundle, g *graph.Graph, gfe *mappings.GraphFlowEnhancer, a *analyzer.Client) (FlowProbe, error) {
+		pipeline := mappings.NewFlowMappingPipelineFromConfig(gfe, mappings.NewOvsFlowEnhancer(g))
+		o, err := NewOvsSFlowProbesHandler(tb, g, pipeline, a)
+		if err != nil {
+			// avoid returning a non nil interface holding a nil handler
+			return nil, err
+		}
+		return o, nil
+	})
+}
+
+// ErrOvsdbProbeMissing is returned when the ovssflow probe is started without
+// the ovsdb topology probe it relies on
+var ErrOvsdbProbeMissing = errors.New("agent.ovssflow probe depends on agent.ovsdb topology probe")
+
+func NewOvsSFlowProbesHandler(tb *probes.TopologyProbeBundle, g *graph.Graph, m *mappings.FlowMappingPipeline, a *analyzer.Client) (*OvsSFlowProbesHandler, error) {
 	probe := tb.GetProbe("ovsdb")
 	if probe == nil {
-		logging.GetLogger().Error("Agent.ovssflow probe depends on agent.ovsdb topology probe: agent.ovssflow probe can't start properly")
-		return nil
+		return nil, ErrOvsdbProbeMissing
 	}
 	p := probe.(*probes.OvsdbProbe)
 
+	h, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve hostname: %s", err.Error())
+	}
+
+	allocator := sflow.NewSFlowAgentAllocator(a, m)
+
 	o := &OvsSFlowProbesHandler{
 		Graph:     g,
 		ovsClient: p.OvsMon.OvsClient,
-		allocator: sflow.NewSFlowAgentAllocator(a, m),
+		allocator: allocator,
+		host:      h,
+		probes:    make(map[string]*OvsSFlowProbe),
 	}
+	allocator.OnEvicted = o.onAgentEvicted
 
-	return o
+	return o, nil
 }
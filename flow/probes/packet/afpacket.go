@@ -0,0 +1,321 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+// Package packet captures the packets of the interfaces with AF_PACKET
+// sockets to build their flows
+package packet
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+
+	"github.com/redhat-cip/skydive/analyzer"
+	"github.com/redhat-cip/skydive/api"
+	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/flow"
+	"github.com/redhat-cip/skydive/flow/mappings"
+	fprobes "github.com/redhat-cip/skydive/flow/probes"
+	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/topology"
+	"github.com/redhat-cip/skydive/topology/graph"
+	"github.com/redhat-cip/skydive/topology/probes"
+)
+
+const (
+	maxFrameSize = 65536
+)
+
+// AfpacketProbe captures the packets of an interface with an AF_PACKET
+// socket and aggregates them into its own flow table
+type AfpacketProbe struct {
+	ifName    string
+	probePath string
+	fd        int
+	flowTable *flow.Table
+	running   atomic.Value
+}
+
+type AfpacketProbesHandler struct {
+	graph               *graph.Graph
+	analyzerClient      *analyzer.Client
+	flowMappingPipeline *mappings.FlowMappingPipeline
+	wg                  sync.WaitGroup
+	probes              map[string]*AfpacketProbe
+	probesLock          sync.RWMutex
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+func (p *AfpacketProbe) SetProbePath(flow *flow.Flow) bool {
+	flow.ProbeGraphPath = p.probePath
+	return true
+}
+
+// compileBPFFilter compiles the BPF filter of the ethernet frames with
+// libpcap, without opening the interface
+func compileBPFFilter(expr string) ([]syscall.SockFilter, error) {
+	instructions, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, maxFrameSize, expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid BPF filter \"%s\": %s", expr, err.Error())
+	}
+
+	filter := make([]syscall.SockFilter, len(instructions))
+	for i, ins := range instructions {
+		filter[i] = syscall.SockFilter{Code: ins.Code, Jt: ins.Jt, Jf: ins.Jf, K: ins.K}
+	}
+	return filter, nil
+}
+
+// openAfpacket returns an AF_PACKET socket bound to the interface, reads time
+// out after a second so that the capture loop can be stopped. The filter, if
+// any, is attached before binding so that no other packet is received.
+func openAfpacket(ifName string, filter []syscall.SockFilter) (int, error) {
+	intf, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return -1, err
+	}
+
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(syscall.ETH_P_ALL)))
+	if err != nil {
+		return -1, err
+	}
+
+	if filter != nil {
+		if err := syscall.AttachLsf(fd, filter); err != nil {
+			syscall.Close(fd)
+			return -1, err
+		}
+	}
+
+	addr := &syscall.SockaddrLinklayer{
+		Protocol: htons(syscall.ETH_P_ALL),
+		Ifindex:  intf.Index,
+	}
+	if err := syscall.Bind(fd, addr); err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+
+	tv := &syscall.Timeval{Sec: 1}
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, tv); err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+
+	return fd, nil
+}
+
+func (p *AfpacketProbesHandler) asyncFlowPipeline(flows []*flow.Flow) {
+	p.flowMappingPipeline.Enhance(flows)
+	if p.analyzerClient != nil {
+		p.analyzerClient.SendFlows(flows)
+	}
+}
+
+// forget removes a probe whose capture stopped, unless another probe has
+// been registered on the interface in the meantime
+func (p *AfpacketProbesHandler) forget(probe *AfpacketProbe) {
+	p.probesLock.Lock()
+	defer p.probesLock.Unlock()
+
+	if p.probes[probe.ifName] == probe {
+		delete(p.probes, probe.ifName)
+	}
+}
+
+func (p *AfpacketProbesHandler) run(probe *AfpacketProbe) {
+	defer p.wg.Done()
+	defer syscall.Close(probe.fd)
+	defer probe.flowTable.UnregisterAll()
+	// a capture failing on its own can be registered again
+	defer p.forget(probe)
+
+	var buf [maxFrameSize]byte
+	for probe.running.Load() == true {
+		select {
+		case now := <-probe.flowTable.GetExpireTicker():
+			probe.flowTable.Expire(now)
+		case now := <-probe.flowTable.GetUpdatedTicker():
+			probe.flowTable.Updated(now)
+		default:
+			n, _, err := syscall.Recvfrom(probe.fd, buf[:], 0)
+			if err != nil {
+				if err != syscall.EAGAIN && err != syscall.EINTR {
+					logging.GetLogger().Errorf("Error while reading packets on %s: %s", probe.ifName, err.Error())
+					return
+				}
+				continue
+			}
+
+			packet := gopacket.NewPacket(buf[:n], layers.LayerTypeEthernet, gopacket.Default)
+			flow.FlowFromGoPacket(probe.flowTable, &packet, probe)
+		}
+	}
+}
+
+func (p *AfpacketProbesHandler) RegisterProbe(n *graph.Node, capture *api.Capture) error {
+	name, ok := n.Metadata()["Name"]
+	if !ok || name == "" {
+		return nil
+	}
+	ifName := name.(string)
+
+	logging.GetLogger().Debugf("Starting afpacket capture on %s", ifName)
+
+	p.probesLock.Lock()
+	defer p.probesLock.Unlock()
+
+	if _, ok := p.probes[ifName]; ok {
+		return errors.New(fmt.Sprintf("An afpacket probe already exists for %s", ifName))
+	}
+
+	if capture.FlowTableExpire < 0 || capture.FlowTableUpdate < 0 {
+		return errors.New("flow table expire and update durations must be positive")
+	}
+
+	nodes := p.graph.LookupShortestPath(n, graph.Metadata{"Type": "host"}, topology.IsOwnershipEdge)
+	if len(nodes) == 0 {
+		return errors.New(fmt.Sprintf("Failed to determine probePath for %s", ifName))
+	}
+
+	var filter []syscall.SockFilter
+	if capture.BPFFilter != "" {
+		var err error
+		if filter, err = compileBPFFilter(capture.BPFFilter); err != nil {
+			return err
+		}
+	}
+
+	fd, err := openAfpacket(ifName, filter)
+	if err != nil {
+		return err
+	}
+
+	probe := &AfpacketProbe{
+		ifName:    ifName,
+		probePath: topology.NodePath{Nodes: nodes}.Marshal(),
+		fd:        fd,
+		flowTable: fprobes.NewTableFromConfig(),
+	}
+
+	expire := time.Duration(capture.FlowTableExpire) * time.Second
+	if expire == 0 {
+		expire = time.Duration(config.GetConfig().GetInt("agent.flowtable_expire")) * time.Second
+	}
+	probe.flowTable.RegisterExpire(p.asyncFlowPipeline, expire)
+
+	update := time.Duration(capture.FlowTableUpdate) * time.Second
+	if update == 0 {
+		update = time.Duration(config.GetConfig().GetInt("agent.flowtable_update")) * time.Second
+	}
+	probe.flowTable.RegisterUpdated(p.asyncFlowPipeline, update)
+
+	probe.running.Store(true)
+	p.probes[ifName] = probe
+
+	p.wg.Add(1)
+	go p.run(probe)
+
+	return nil
+}
+
+func (p *AfpacketProbesHandler) unregisterProbe(ifName string) {
+	if probe, ok := p.probes[ifName]; ok {
+		probe.running.Store(false)
+		delete(p.probes, ifName)
+	}
+}
+
+func (p *AfpacketProbesHandler) UnregisterProbe(n *graph.Node) error {
+	p.probesLock.Lock()
+	defer p.probesLock.Unlock()
+
+	if name, ok := n.Metadata()["Name"]; ok && name != "" {
+		p.unregisterProbe(name.(string))
+	}
+	return nil
+}
+
+func (p *AfpacketProbesHandler) Start() {
+}
+
+func (p *AfpacketProbesHandler) Stop() {
+	p.probesLock.Lock()
+	for name := range p.probes {
+		p.unregisterProbe(name)
+	}
+	p.probesLock.Unlock()
+
+	p.wg.Wait()
+}
+
+func (p *AfpacketProbesHandler) Flush() {
+	p.probesLock.RLock()
+	defer p.probesLock.RUnlock()
+
+	for _, probe := range p.probes {
+		probe.flowTable.ExpireNow()
+	}
+}
+
+// FlowTables returns the flow table of each probe, by interface name
+func (p *AfpacketProbesHandler) FlowTables() map[string]*flow.Table {
+	p.probesLock.RLock()
+	defer p.probesLock.RUnlock()
+
+	tables := make(map[string]*flow.Table)
+	for name, probe := range p.probes {
+		tables[name] = probe.flowTable
+	}
+	return tables
+}
+
+// FlowMappingPipeline returns the pipeline enhancing the flows of the probes
+func (p *AfpacketProbesHandler) FlowMappingPipeline() *mappings.FlowMappingPipeline {
+	return p.flowMappingPipeline
+}
+
+func init() {
+	fprobes.RegisterFlowProbeType("afpacket", func(tb *probes.TopologyProbeBundle, g *graph.Graph, gfe *mappings.GraphFlowEnhancer, a *analyzer.Client) (fprobes.FlowProbe, error) {
+		return NewAfpacketProbesHandler(g, mappings.NewFlowMappingPipelineFromConfig(gfe), a), nil
+	})
+}
+
+func NewAfpacketProbesHandler(g *graph.Graph, m *mappings.FlowMappingPipeline, a *analyzer.Client) *AfpacketProbesHandler {
+	return &AfpacketProbesHandler{
+		graph:               g,
+		analyzerClient:      a,
+		flowMappingPipeline: m,
+		probes:              make(map[string]*AfpacketProbe),
+	}
+}
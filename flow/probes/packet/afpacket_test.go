@@ -0,0 +1,81 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package packet
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redhat-cip/skydive/api"
+	"github.com/redhat-cip/skydive/flow/mappings"
+	fprobes "github.com/redhat-cip/skydive/flow/probes"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+func TestAfpacketProbeFailure(t *testing.T) {
+	b, err := graph.NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := graph.NewGraph(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g.Lock()
+	host := g.NewNode(graph.GenID(), graph.Metadata{"Name": "host", "Type": "host"})
+	intf := g.NewNode(graph.GenID(), graph.Metadata{"Name": "lo", "Type": "device"})
+	g.Link(host, intf, graph.Metadata{"RelationType": "ownership"})
+	g.Unlock()
+
+	p := &AfpacketProbesHandler{
+		graph:               g,
+		flowMappingPipeline: mappings.NewFlowMappingPipeline(),
+		probes:              make(map[string]*AfpacketProbe),
+	}
+
+	// reading an invalid socket fails right away
+	probe := &AfpacketProbe{ifName: "lo", fd: -1, flowTable: fprobes.NewTableFromConfig()}
+	probe.flowTable.RegisterExpire(p.asyncFlowPipeline, time.Minute)
+	probe.flowTable.RegisterUpdated(p.asyncFlowPipeline, time.Minute)
+	probe.running.Store(true)
+	p.probes[probe.ifName] = probe
+
+	p.wg.Add(1)
+	p.run(probe)
+
+	if len(p.FlowTables()) != 0 {
+		t.Fatal("A failed probe should be removed")
+	}
+
+	// the interface can be captured again, opening the socket requires
+	// CAP_NET_RAW though
+	g.RLock()
+	err = p.RegisterProbe(intf, &api.Capture{})
+	g.RUnlock()
+	if err != nil && strings.Contains(err.Error(), "already exists") {
+		t.Errorf("A failed probe should not prevent a new registration: %s", err.Error())
+	}
+	p.Stop()
+}
@@ -66,7 +66,12 @@ func (p *PcapProbe) SetProbePath(flow *flow.Flow) bool {
 }
 
 func (p *PcapProbesHandler) handlePacket(pcapProbe *PcapProbe, packet gopacket.Packet) {
-	flows := []*flow.Flow{flow.FlowFromGoPacket(p.flowTable, &packet, pcapProbe)}
+	f := flow.FlowFromGoPacket(p.flowTable, &packet, pcapProbe)
+	if f == nil {
+		return
+	}
+
+	flows := []*flow.Flow{f}
 	p.flowTable.Update(flows)
 	p.flowMappingPipeline.Enhance(flows)
 
@@ -98,7 +103,10 @@ func (p *PcapProbesHandler) RegisterProbe(n *graph.Node, capture *api.Capture) e
 		}
 
 		if capture.BPFFilter != "" {
-			handle.SetBPFFilter(capture.BPFFilter)
+			if err := handle.SetBPFFilter(capture.BPFFilter); err != nil {
+				handle.Close()
+				return fmt.Errorf("invalid BPF filter \"%s\": %s", capture.BPFFilter, err.Error())
+			}
 		}
 
 		probePath := topology.NodePath{Nodes: nodes}.Marshal()
@@ -167,12 +175,28 @@ func (p *PcapProbesHandler) Stop() {
 func (o *PcapProbesHandler) Flush() {
 }
 
+// FlowTables returns the flow table shared by all the probes
+func (p *PcapProbesHandler) FlowTables() map[string]*flow.Table {
+	return map[string]*flow.Table{"": p.flowTable}
+}
+
+// FlowMappingPipeline returns the pipeline enhancing the flows of the probes
+func (p *PcapProbesHandler) FlowMappingPipeline() *mappings.FlowMappingPipeline {
+	return p.flowMappingPipeline
+}
+
+func init() {
+	RegisterFlowProbeType("pcap", func(tb *probes.TopologyProbeBundle, g *graph.Graph, gfe *mappings.GraphFlowEnhancer, a *analyzer.Client) (FlowProbe, error) {
+		return NewPcapProbesHandler(tb, g, mappings.NewFlowMappingPipelineFromConfig(gfe), a), nil
+	})
+}
+
 func NewPcapProbesHandler(tb *probes.TopologyProbeBundle, g *graph.Graph, p *mappings.FlowMappingPipeline, a *analyzer.Client) *PcapProbesHandler {
 	handler := &PcapProbesHandler{
 		graph:               g,
 		analyzerClient:      a,
 		flowMappingPipeline: p,
-		flowTable:           flow.NewTable(),
+		flowTable:           NewTableFromConfig(),
 		probes:              make(map[string]*PcapProbe),
 	}
 	return handler
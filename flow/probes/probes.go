@@ -25,6 +25,7 @@ package probes
 import (
 	"github.com/redhat-cip/skydive/analyzer"
 	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/flow"
 	"github.com/redhat-cip/skydive/flow/mappings"
 	"github.com/redhat-cip/skydive/logging"
 	"github.com/redhat-cip/skydive/probe"
@@ -32,9 +33,47 @@ import (
 	"github.com/redhat-cip/skydive/topology/probes"
 )
 
+// FlowProbeConstructor builds the handler of the captures of a type, an error
+// is returned if the handler can't be started
+type FlowProbeConstructor func(tb *probes.TopologyProbeBundle, g *graph.Graph, gfe *mappings.GraphFlowEnhancer, a *analyzer.Client) (FlowProbe, error)
+
+var flowProbeConstructors = make(map[string]FlowProbeConstructor)
+
+// RegisterFlowProbeType makes a capture type available to the agent.flow.probes
+// configuration and to the captures having this Type
+func RegisterFlowProbeType(t string, c FlowProbeConstructor) {
+	flowProbeConstructors[t] = c
+}
+
+// NewTableFromConfig returns a flow table capped by agent.flowtable_max and
+// keying the flows by flow.key_fields
+func NewTableFromConfig() *flow.Table {
+	ft := flow.NewTable()
+	if err := ft.SetMaxFlows(config.GetConfig().GetInt("agent.flowtable_max"), config.GetConfig().GetString("agent.flowtable_max_policy")); err != nil {
+		logging.GetLogger().Errorf("Unable to cap the flow table: %s", err.Error())
+	}
+	if err := ft.SetKeyFields(config.GetConfig().GetStringSlice("flow.key_fields")); err != nil {
+		logging.GetLogger().Errorf("Unable to set the flow key: %s", err.Error())
+	}
+	return ft
+}
+
+// FlowTableProbe is implemented by the flow probes exposing their flow
+// tables, by name
+type FlowTableProbe interface {
+	FlowTables() map[string]*flow.Table
+}
+
+// FlowMappingPipelineProbe is implemented by the flow probes enhancing their
+// flows with a pipeline of their own
+type FlowMappingPipelineProbe interface {
+	FlowMappingPipeline() *mappings.FlowMappingPipeline
+}
+
 type FlowProbeBundle struct {
 	probe.ProbeBundle
-	Graph *graph.Graph
+	Graph          *graph.Graph
+	AnalyzerClient *analyzer.Client
 }
 
 func (fpb *FlowProbeBundle) Flush() {
@@ -44,6 +83,40 @@ func (fpb *FlowProbeBundle) Flush() {
 	}
 }
 
+// FlowTables returns the flow tables of the probes, named after the probe
+// type followed by the name given by the probe, if any
+func (fpb *FlowProbeBundle) FlowTables() map[string]*flow.Table {
+	tables := make(map[string]*flow.Table)
+	for t, p := range fpb.ProbeBundle.Probes {
+		ftp, ok := p.(FlowTableProbe)
+		if !ok {
+			continue
+		}
+
+		for name, ft := range ftp.FlowTables() {
+			if name != "" {
+				name = t + "/" + name
+			} else {
+				name = t
+			}
+			tables[name] = ft
+		}
+	}
+	return tables
+}
+
+// FlowMappingPipelineStats returns the enhancement stats summed over the
+// pipelines of the probes
+func (fpb *FlowProbeBundle) FlowMappingPipelineStats() mappings.FlowMappingPipelineStats {
+	var stats mappings.FlowMappingPipelineStats
+	for _, p := range fpb.ProbeBundle.Probes {
+		if mp, ok := p.(FlowMappingPipelineProbe); ok && mp.FlowMappingPipeline() != nil {
+			stats = stats.Add(mp.FlowMappingPipeline().Stats())
+		}
+	}
+	return stats
+}
+
 func (fpb *FlowProbeBundle) UnregisterAllProbes() {
 	fpb.Graph.Lock()
 	defer fpb.Graph.Unlock()
@@ -63,53 +136,37 @@ func NewFlowProbeBundleFromConfig(tb *probes.TopologyProbeBundle, g *graph.Graph
 
 	gfe := mappings.NewGraphFlowEnhancer(g)
 
-	var aclient *analyzer.Client
-
-	addr, port, err := config.GetAnalyzerClientAddr()
+	aclient, err := analyzer.NewClientFromConfig()
 	if err != nil {
-		logging.GetLogger().Errorf("Unable to parse analyzer client: %s", err.Error())
+		logging.GetLogger().Errorf("Analyzer client error: %s", err.Error())
 		return nil
 	}
 
-	if addr != "" {
-		aclient, err = analyzer.NewClient(addr, port)
-		if err != nil {
-			logging.GetLogger().Errorf("Analyzer client error %s:%d : %s", addr, port, err.Error())
-			return nil
-		}
-	}
-
 	probes := make(map[string]probe.Probe)
 	for _, t := range list {
 		if _, ok := probes[t]; ok {
 			continue
 		}
 
-		switch t {
-		case "ovssflow":
-			ofe := mappings.NewOvsFlowEnhancer(g)
-			pipeline := mappings.NewFlowMappingPipeline(gfe, ofe)
-
-			o := NewOvsSFlowProbesHandler(tb, g, pipeline, aclient)
-			if o != nil {
-				probes[t] = o
-			}
-		case "pcap":
-			pipeline := mappings.NewFlowMappingPipeline(gfe)
-
-			o := NewPcapProbesHandler(tb, g, pipeline, aclient)
-			if o != nil {
-				probes[t] = o
-			}
-		default:
+		constructor, ok := flowProbeConstructors[t]
+		if !ok {
 			logging.GetLogger().Errorf("unknown probe type %s", t)
+			continue
+		}
+
+		o, err := constructor(tb, g, gfe, aclient)
+		if err != nil {
+			logging.GetLogger().Errorf("Unable to start the %s flow probe: %s", t, err.Error())
+			continue
 		}
+		probes[t] = o
 	}
 
 	p := probe.NewProbeBundle(probes)
 
 	return &FlowProbeBundle{
-		ProbeBundle: *p,
-		Graph:       g,
+		ProbeBundle:    *p,
+		Graph:          g,
+		AnalyzerClient: aclient,
 	}
 }
@@ -26,6 +26,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"net"
 	"strconv"
 
 	"github.com/google/gopacket"
@@ -55,15 +56,21 @@ func NewFlowStatistics(packet *gopacket.Packet) *FlowStatistics {
 }
 
 func (fs *FlowStatistics) Update(packet *gopacket.Packet) {
-	err := fs.updateLinkLayerStatistics(packet)
+	fs.UpdateWeighted(packet, 1)
+}
+
+// UpdateWeighted counts the packet as weight packets of its size, ex: a
+// sampled packet standing for the packets of the sampling period
+func (fs *FlowStatistics) UpdateWeighted(packet *gopacket.Packet, weight uint64) {
+	err := fs.updateLinkLayerStatistics(packet, weight)
 	if err != nil {
 		return
 	}
-	err = fs.updateNetworkLayerStatistics(packet)
+	err = fs.updateNetworkLayerStatistics(packet, weight)
 	if err != nil {
 		return
 	}
-	err = fs.updateTransportLayerStatistics(packet)
+	err = fs.updateTransportLayerStatistics(packet, weight)
 	if err != nil {
 		return
 	}
@@ -112,7 +119,7 @@ func (fs *FlowStatistics) newLinkLayerEndpointStatistics(packet *gopacket.Packet
 	return nil
 }
 
-func (fs *FlowStatistics) updateLinkLayerStatistics(packet *gopacket.Packet) error {
+func (fs *FlowStatistics) updateLinkLayerStatistics(packet *gopacket.Packet, weight uint64) error {
 	ep := fs.Endpoints[FlowEndpointLayer_LINK]
 	ethernetLayer := (*packet).Layer(layers.LayerTypeEthernet)
 	ethernetPacket, ok := ethernetLayer.(*layers.Ethernet)
@@ -126,51 +133,66 @@ func (fs *FlowStatistics) updateLinkLayerStatistics(packet *gopacket.Packet) err
 	} else {
 		e = ep.BA
 	}
-	e.Packets += uint64(1)
+	e.Packets += weight
 	if ethernetPacket.Length > 0 { // LLC
-		e.Bytes += uint64(ethernetPacket.Length)
+		e.Bytes += uint64(ethernetPacket.Length) * weight
 	} else {
-		e.Bytes += uint64(len(ethernetPacket.Contents) + len(ethernetPacket.Payload))
+		e.Bytes += uint64(len(ethernetPacket.Contents)+len(ethernetPacket.Payload)) * weight
 	}
 	return nil
 }
 
+// networkLayer returns the endpoint type, the addresses and the length of
+// the IPv4 or IPv6 layer of the packet
+func networkLayer(packet *gopacket.Packet) (FlowEndpointType, net.IP, net.IP, uint64, error) {
+	switch l := (*packet).NetworkLayer().(type) {
+	case *layers.IPv4:
+		return FlowEndpointType_IPV4, l.SrcIP, l.DstIP, uint64(l.Length), nil
+	case *layers.IPv6:
+		// the payload length doesn't include the fixed header
+		return FlowEndpointType_IPV6, l.SrcIP, l.DstIP, uint64(len(l.Contents)) + uint64(l.Length), nil
+	}
+	return 0, nil, nil, 0, errors.New("Unable to decode the network layer")
+}
+
 func (fs *FlowStatistics) newNetworkLayerEndpointStatistics(packet *gopacket.Packet) error {
 	ep := &FlowEndpointsStatistics{}
 	ep.AB = &FlowEndpointStatistics{}
 	ep.BA = &FlowEndpointStatistics{}
 
-	ipv4Layer := (*packet).Layer(layers.LayerTypeIPv4)
-	ipv4Packet, ok := ipv4Layer.(*layers.IPv4)
-	if !ok {
-		return errors.New("Unable to decode the ipv4 layer")
+	ptype, src, dst, _, err := networkLayer(packet)
+	if err != nil {
+		return err
 	}
 
-	ep.Type = FlowEndpointType_IPV4
-	ep.AB.Value = ipv4Packet.SrcIP.String()
-	ep.BA.Value = ipv4Packet.DstIP.String()
-	ep.hash(ipv4Packet.SrcIP, ipv4Packet.DstIP)
+	ep.Type = ptype
+	ep.AB.Value = src.String()
+	ep.BA.Value = dst.String()
+	ep.hash(src, dst)
 	fs.Endpoints = append(fs.Endpoints, ep)
 	return nil
 }
 
-func (fs *FlowStatistics) updateNetworkLayerStatistics(packet *gopacket.Packet) error {
-	ipv4Layer := (*packet).Layer(layers.LayerTypeIPv4)
-	ipv4Packet, ok := ipv4Layer.(*layers.IPv4)
-	if !ok {
-		return errors.New("Unable to decode the ipv4 layer")
+func (fs *FlowStatistics) updateNetworkLayerStatistics(packet *gopacket.Packet, weight uint64) error {
+	if len(fs.Endpoints) <= int(FlowEndpointLayer_NETWORK) {
+		return errors.New("Unable to decode the network layer")
+	}
+
+	_, src, _, length, err := networkLayer(packet)
+	if err != nil {
+		return err
 	}
 
 	ep := fs.Endpoints[FlowEndpointLayer_NETWORK]
 
 	var e *FlowEndpointStatistics
-	if ep.AB.Value == ipv4Packet.SrcIP.String() {
+	if ep.AB.Value == src.String() {
 		e = ep.AB
 	} else {
 		e = ep.BA
 	}
-	e.Packets += uint64(1)
-	e.Bytes += uint64(ipv4Packet.Length)
+	e.Packets += weight
+	e.Bytes += length * weight
 	return nil
 }
 
@@ -220,7 +242,7 @@ func (fs *FlowStatistics) newTransportLayerEndpointStatistics(packet *gopacket.P
 	return nil
 }
 
-func (fs *FlowStatistics) updateTransportLayerStatistics(packet *gopacket.Packet) error {
+func (fs *FlowStatistics) updateTransportLayerStatistics(packet *gopacket.Packet, weight uint64) error {
 	if len(fs.Endpoints) <= int(FlowEndpointLayer_TRANSPORT) {
 		return errors.New("Unable to decode the transport layer")
 	}
@@ -248,7 +270,7 @@ func (fs *FlowStatistics) updateTransportLayerStatistics(packet *gopacket.Packet
 	} else {
 		e = ep.BA
 	}
-	e.Packets += uint64(1)
-	e.Bytes += uint64(len(transportLayer.LayerContents()) + len(transportLayer.LayerPayload()))
+	e.Packets += weight
+	e.Bytes += uint64(len(transportLayer.LayerContents())+len(transportLayer.LayerPayload())) * weight
 	return nil
 }
@@ -23,21 +23,55 @@
 package flow
 
 import (
+	"container/list"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"sync"
 	"time"
 
+	"github.com/google/gopacket"
+
 	"github.com/redhat-cip/skydive/logging"
 )
 
+/* Policies applied when a flow is created in a full table */
+const (
+	DropNewPolicy     = "drop-new"
+	EvictOldestPolicy = "evict-oldest"
+	ForceExpirePolicy = "force-expire"
+)
+
 type Table struct {
-	lock    sync.RWMutex
-	table   map[string]*Flow
-	manager tableManager
+	lock       sync.RWMutex
+	table      map[string]*Flow
+	manager    tableManager
+	aggregated uint64
+	metrics    MetricFunc
+	max        int
+	policy     string
+	dropped    uint64
+	evicted    uint64
+	keyFields  []string
+	// whether the sFlow samples count for their sampling rate
+	samplingScale bool
+	// counters of the flows at the last metric sent, by table key
+	counters     map[string]*FlowMetric
+	countersLock sync.Mutex
+	// table keys from the least to the most recently updated flow, so
+	// that the oldest flow is evicted without scanning the table
+	lru      *list.List
+	lruElems map[string]*list.Element
 }
 
 func NewTable() *Table {
-	return &Table{table: make(map[string]*Flow)}
+	return &Table{
+		table:    make(map[string]*Flow),
+		counters: make(map[string]*FlowMetric),
+		lru:      list.New(),
+		lruElems: make(map[string]*list.Element),
+	}
 }
 
 func NewTableFromFlows(flows []*Flow) *Table {
@@ -46,6 +80,38 @@ func NewTableFromFlows(flows []*Flow) *Table {
 	return nft
 }
 
+/* LoadTable returns a table holding the flows of a snapshot, see Snapshot */
+func LoadTable(r io.Reader) (*Table, error) {
+	nft := NewTable()
+	if err := json.NewDecoder(r).Decode(&nft.table); err != nil {
+		return nil, err
+	}
+	if nft.table == nil {
+		return nil, errors.New("no flow table in snapshot")
+	}
+	for key, f := range nft.table {
+		if f == nil {
+			return nil, fmt.Errorf("no flow for key %s in snapshot", key)
+		}
+		nft.touch(key)
+	}
+	return nft, nil
+}
+
+/* Snapshot writes the flows of the table not expired yet as a JSON object */
+/* keyed by table key, the flows being encoded under the table lock. */
+func (ft *Table) Snapshot(w io.Writer) error {
+	ft.lock.RLock()
+	data, err := json.Marshal(ft.table)
+	ft.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+	return err
+}
+
 func (ft *Table) String() string {
 	ft.lock.RLock()
 	defer ft.lock.RUnlock()
@@ -60,6 +126,7 @@ func (ft *Table) Update(flows []*Flow) {
 		} else {
 			ft.table[f.UUID].Statistics = f.Statistics
 		}
+		ft.touch(f.UUID)
 	}
 	ft.lock.Unlock()
 }
@@ -98,20 +165,158 @@ func (ft *Table) GetFlow(key string) *Flow {
 	return nil
 }
 
+/* Upsert by key, packets are aggregated into the flow until it expires. */
+/* nil is returned when the table is full and its policy drops new flows */
 func (ft *Table) GetOrCreateFlow(key string) (*Flow, bool) {
 	ft.lock.Lock()
 	defer ft.lock.Unlock()
 	if flow, found := ft.table[key]; found {
+		ft.aggregated++
+		ft.touch(key)
 		return flow, false
 	}
 
+	if ft.max > 0 && len(ft.table) >= ft.max && !ft.makeRoom() {
+		ft.dropped++
+		return nil, false
+	}
+
 	new := &Flow{}
 	ft.table[key] = new
+	ft.touch(key)
 
 	return new, true
 }
 
-/* Return a new flow.Table that contain <last> active flows */
+/* Set the maximum number of flows of the table and the policy applied */
+/* when it is reached, 0 means unbounded */
+func (ft *Table) SetMaxFlows(max int, policy string) error {
+	switch policy {
+	case DropNewPolicy, EvictOldestPolicy, ForceExpirePolicy:
+	default:
+		return fmt.Errorf("unknown flow table policy: %s", policy)
+	}
+
+	ft.lock.Lock()
+	ft.max, ft.policy = max, policy
+	ft.lock.Unlock()
+	return nil
+}
+
+/* Key the flows created from the packets by the given fields, the addresses */
+/* and the ports by default. The layers not part of the key are the ones of */
+/* the first packet of the flow. */
+func (ft *Table) SetKeyFields(fields []string) error {
+	if len(fields) == 0 {
+		return errors.New("no flow key field")
+	}
+	for _, field := range fields {
+		if !isKeyField(field) {
+			return fmt.Errorf("unknown flow key field: %s", field)
+		}
+	}
+
+	ft.lock.Lock()
+	ft.keyFields = fields
+	ft.lock.Unlock()
+	return nil
+}
+
+/* Scale the counters of the flows created from sFlow samples by the */
+/* sampling rate so that they approximate the actual traffic */
+func (ft *Table) SetSamplingScale(enabled bool) {
+	ft.lock.Lock()
+	ft.samplingScale = enabled
+	ft.lock.Unlock()
+}
+
+func (ft *Table) SamplingScale() bool {
+	ft.lock.RLock()
+	defer ft.lock.RUnlock()
+	return ft.samplingScale
+}
+
+/* Return the key of the flow of the packet, outer encapsulating the packet */
+func (ft *Table) key(packet gopacket.Packet, outer gopacket.Packet) string {
+	ft.lock.RLock()
+	fields := ft.keyFields
+	ft.lock.RUnlock()
+
+	if fields == nil {
+		return NewFlowKeyFromGoPacket(&packet).String()
+	}
+	return keyFromFields(packet, outer, fields)
+}
+
+/* Internal call only, Must be called under ft.lock.Lock(). Apply the */
+/* policy of the full table and return whether a flow can be created */
+func (ft *Table) makeRoom() bool {
+	callback := ft.manager.expire.callback
+	if callback == nil {
+		callback = func(f []*Flow) {}
+	}
+
+	switch ft.policy {
+	case EvictOldestPolicy:
+		front := ft.lru.Front()
+		if front == nil {
+			return false
+		}
+		oldestKey := front.Value.(string)
+		oldest := ft.table[oldestKey]
+
+		/* the evicted flow is sent as an expired one */
+		callback([]*Flow{oldest})
+		ft.sendMetrics([]string{oldestKey}, []*Flow{oldest}, time.Now().Unix(), true)
+		ft.remove(oldestKey)
+		ft.evicted++
+		return true
+	case ForceExpirePolicy:
+		size := len(ft.table)
+		ft.expire(callback, int64(^uint64(0)>>1))
+		ft.evicted += uint64(size - len(ft.table))
+		return true
+	}
+
+	return false
+}
+
+/* Internal call only, Must be called under ft.lock.Lock(). Mark the flow */
+/* of the key as the most recently updated one */
+func (ft *Table) touch(key string) {
+	if e, ok := ft.lruElems[key]; ok {
+		ft.lru.MoveToBack(e)
+		return
+	}
+	ft.lruElems[key] = ft.lru.PushBack(key)
+}
+
+/* Internal call only, Must be called under ft.lock.Lock() */
+func (ft *Table) remove(key string) {
+	if e, ok := ft.lruElems[key]; ok {
+		ft.lru.Remove(e)
+		delete(ft.lruElems, key)
+	}
+	delete(ft.table, key)
+}
+
+/* Return the number of flows not created because the table was full */
+func (ft *Table) Dropped() uint64 {
+	ft.lock.RLock()
+	defer ft.lock.RUnlock()
+	return ft.dropped
+}
+
+/* Return the number of flows expired before their time because the table */
+/* was full */
+func (ft *Table) Evicted() uint64 {
+	ft.lock.RLock()
+	defer ft.lock.RUnlock()
+	return ft.evicted
+}
+
+/* Return a copy of the flows updated within the last duration, taken */
+/* under the table lock so that it can be used while the flows are updated */
 func (ft *Table) FilterLast(last time.Duration) []*Flow {
 	var flows []*Flow
 	selected := time.Now().Unix() - int64((last).Seconds())
@@ -119,7 +324,7 @@ func (ft *Table) FilterLast(last time.Duration) []*Flow {
 	for _, f := range ft.table {
 		fs := f.GetStatistics()
 		if fs.Last >= selected {
-			flows = append(flows, f)
+			flows = append(flows, f.Copy())
 		}
 	}
 	ft.lock.RUnlock()
@@ -167,19 +372,23 @@ func (ft *Table) Expire(now time.Time) {
 /* Internal call only, Must be called under ft.lock.Lock() */
 func (ft *Table) expire(fn ExpireUpdateFunc, expireBefore int64) {
 	var expiredFlows []*Flow
+	var expiredKeys []string
 	flowTableSzBefore := len(ft.table)
-	for _, f := range ft.table {
+	for k, f := range ft.table {
 		fs := f.GetStatistics()
 		if fs.Last < expireBefore {
 			duration := time.Duration(fs.Last - fs.Start)
 			logging.GetLogger().Debugf("Expire flow %s Duration %v", f.UUID, duration)
 			expiredFlows = append(expiredFlows, f)
+			expiredKeys = append(expiredKeys, k)
 		}
 	}
 	/* Advise Clients */
 	fn(expiredFlows)
-	for _, f := range expiredFlows {
-		delete(ft.table, f.UUID)
+	ft.sendMetrics(expiredKeys, expiredFlows, time.Now().Unix(), true)
+	/* flows can be indexed either by UUID or by FlowKey */
+	for _, k := range expiredKeys {
+		ft.remove(k)
 	}
 	flowTableSz := len(ft.table)
 	logging.GetLogger().Debugf("Expire Flow : removed %v ; new size %v", flowTableSzBefore-flowTableSz, flowTableSz)
@@ -195,17 +404,54 @@ func (ft *Table) Updated(now time.Time) {
 /* Internal call only, Must be called under ft.lock.RLock() */
 func (ft *Table) updated(fn ExpireUpdateFunc, updateFrom int64) {
 	var updatedFlows []*Flow
-	for _, f := range ft.table {
+	var updatedKeys []string
+	for k, f := range ft.table {
 		fs := f.GetStatistics()
 		if fs.Last > updateFrom {
 			updatedFlows = append(updatedFlows, f)
+			updatedKeys = append(updatedKeys, k)
 		}
 	}
 	/* Advise Clients */
 	fn(updatedFlows)
+	ft.sendMetrics(updatedKeys, updatedFlows, time.Now().Unix(), false)
 	logging.GetLogger().Debugf("Send updated Flow %d", len(updatedFlows))
 }
 
+/* Send the packets and bytes of the flows counted since their last metric, */
+/* the counters of the expired flows are forgotten */
+func (ft *Table) sendMetrics(keys []string, flows []*Flow, now int64, expired bool) {
+	if ft.metrics == nil {
+		return
+	}
+
+	ft.countersLock.Lock()
+	var metrics []*FlowMetric
+	for i, f := range flows {
+		total := totalMetric(f, now)
+
+		m := total
+		if prev, ok := ft.counters[keys[i]]; ok {
+			m = total.sub(prev)
+		}
+
+		if expired {
+			delete(ft.counters, keys[i])
+		} else {
+			ft.counters[keys[i]] = total
+		}
+
+		if !m.isZero() {
+			metrics = append(metrics, m)
+		}
+	}
+	ft.countersLock.Unlock()
+
+	if len(metrics) > 0 {
+		ft.metrics(metrics)
+	}
+}
+
 func (ft *Table) ExpireNow() {
 	const Now = int64(^uint64(0) >> 1)
 	ft.lock.Lock()
@@ -227,6 +473,14 @@ func (ft *Table) RegisterUpdated(fn ExpireUpdateFunc, since time.Duration) {
 	ft.lock.Unlock()
 }
 
+/* Register a callback receiving the packets and bytes of the flows per update */
+/* window, sent on each update and on expiration */
+func (ft *Table) RegisterMetrics(fn MetricFunc) {
+	ft.lock.Lock()
+	ft.metrics = fn
+	ft.lock.Unlock()
+}
+
 func (ft *Table) UnregisterAll() {
 	ft.lock.Lock()
 	if ft.manager.updated.running {
@@ -240,10 +494,52 @@ func (ft *Table) UnregisterAll() {
 	ft.ExpireNow()
 }
 
+/* Change the expire period of a registered table, the flows are kept */
+func (ft *Table) SetExpireDuration(every time.Duration) {
+	ft.lock.Lock()
+	if ft.manager.expire.running {
+		ft.manager.expire.Reset(every, every)
+	}
+	ft.lock.Unlock()
+}
+
+/* Change the updated period of a registered table, the flows are kept */
+func (ft *Table) SetUpdatedDuration(since time.Duration) {
+	ft.lock.Lock()
+	if ft.manager.updated.running {
+		ft.manager.updated.Reset(since, since+2)
+	}
+	ft.lock.Unlock()
+}
+
+func (ft *Table) UpdatedDuration() time.Duration {
+	ft.lock.RLock()
+	defer ft.lock.RUnlock()
+	return ft.manager.updated.every
+}
+
+/* Return the window during which packets are aggregated into a flow */
+func (ft *Table) AggregationWindow() time.Duration {
+	ft.lock.RLock()
+	defer ft.lock.RUnlock()
+	return ft.manager.expire.duration
+}
+
+/* Return the number of packets/samples aggregated into an existing flow */
+func (ft *Table) Aggregated() uint64 {
+	ft.lock.RLock()
+	defer ft.lock.RUnlock()
+	return ft.aggregated
+}
+
 func (ft *Table) GetExpireTicker() <-chan time.Time {
+	ft.lock.RLock()
+	defer ft.lock.RUnlock()
 	return ft.manager.expire.ticker.C
 }
 
 func (ft *Table) GetUpdatedTicker() <-chan time.Time {
+	ft.lock.RLock()
+	defer ft.lock.RUnlock()
 	return ft.manager.updated.ticker.C
 }
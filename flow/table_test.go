@@ -23,12 +23,19 @@
 package flow
 
 import (
+	"bytes"
 	"fmt"
+	"net"
+	"strings"
 	"testing"
 	"time"
 
 	"crypto/sha1"
 	"encoding/hex"
+	"encoding/json"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 )
 
 func TestNewTable(t *testing.T) {
@@ -67,6 +74,46 @@ func TestTable_Update(t *testing.T) {
 	}
 }
 
+func TestTable_Snapshot(t *testing.T) {
+	ft := NewTestFlowTableComplex(t)
+
+	var b bytes.Buffer
+	if err := ft.Snapshot(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadTable(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(loaded.table) != len(ft.table) {
+		t.Fatalf("Expected %d flows, got %d", len(ft.table), len(loaded.table))
+	}
+
+	// same flows under the same keys
+	for key, f := range ft.table {
+		lf, ok := loaded.table[key]
+		if !ok {
+			t.Fatalf("Flow %s not loaded", key)
+		}
+
+		// the endpoint hashes are only used to identify new flows and are
+		// not part of the JSON
+		data, _ := json.Marshal(f)
+		ldata, _ := json.Marshal(lf)
+		if !bytes.Equal(data, ldata) {
+			t.Errorf("Flow %s differs once loaded: %v != %v", key, lf, f)
+		}
+	}
+
+	for _, snapshot := range []string{"[]", "null", `{"key":null}`} {
+		if _, err := LoadTable(strings.NewReader(snapshot)); err == nil {
+			t.Errorf("Invalid snapshot %s should be refused", snapshot)
+		}
+	}
+}
+
 type MyTestFlowCounter struct {
 	NbFlow int
 }
@@ -117,6 +164,181 @@ func TestTable_updated(t *testing.T) {
 	}
 }
 
+func TestTable_Metrics(t *testing.T) {
+	ft := NewTable()
+
+	var metrics []*FlowMetric
+	ft.RegisterMetrics(func(m []*FlowMetric) {
+		metrics = append(metrics, m...)
+	})
+
+	packet := forgeTestPacket(t, 64, false, ETH, IPv4, TCP)
+	f := FlowFromGoPacket(ft, packet, nil)
+	FlowFromGoPacket(ft, packet, nil)
+
+	noop := func(f []*Flow) {}
+	ft.updated(noop, 0)
+	if len(metrics) != 1 || metrics[0].UUID != f.UUID || metrics[0].ABPackets != 2 {
+		t.Fatalf("Expected the 2 packets of the flow, got %+v", metrics)
+	}
+	size := metrics[0].ABBytes
+
+	// no packet since the last update
+	ft.updated(noop, 0)
+	if len(metrics) != 1 {
+		t.Fatalf("No metric expected without packet, got %+v", metrics)
+	}
+
+	FlowFromGoPacket(ft, packet, nil)
+	ft.expire(noop, int64(^uint64(0)>>1))
+	if len(metrics) != 2 || metrics[1].ABPackets != 1 || metrics[1].ABBytes != size/2 {
+		t.Fatalf("Expected the packet received since the update, got %+v", metrics[1:])
+	}
+
+	if metrics[1].Start != metrics[0].Last {
+		t.Errorf("The windows should follow each other: %+v", metrics)
+	}
+
+	if len(ft.counters) != 0 {
+		t.Error("The counters of the expired flows should be forgotten")
+	}
+}
+
+func TestTable_MaxFlows(t *testing.T) {
+	for _, policy := range []string{DropNewPolicy, EvictOldestPolicy, ForceExpirePolicy} {
+		ft := NewTable()
+		if err := ft.SetMaxFlows(3, policy); err != nil {
+			t.Fatal(err)
+		}
+
+		var expired []*Flow
+		ft.RegisterExpire(func(f []*Flow) { expired = append(expired, f...) }, time.Hour)
+
+		var flows []*Flow
+		for i := int64(0); i < 4; i++ {
+			packet := forgeTestPacket(t, i, false, ETH, IPv4, UDP)
+			flows = append(flows, FlowFromGoPacket(ft, packet, nil))
+		}
+
+		switch policy {
+		case DropNewPolicy:
+			if flows[3] != nil || ft.Dropped() != 1 || len(ft.GetFlows()) != 3 || len(expired) != 0 {
+				t.Errorf("%s: the new flow should be dropped, %d dropped", policy, ft.Dropped())
+			}
+		case EvictOldestPolicy:
+			if flows[3] == nil || ft.Evicted() != 1 || len(ft.GetFlows()) != 3 || len(expired) != 1 {
+				t.Errorf("%s: one flow should be evicted, %d evicted, %d expired", policy, ft.Evicted(), len(expired))
+			}
+		case ForceExpirePolicy:
+			if flows[3] == nil || ft.Evicted() != 3 || len(ft.GetFlows()) != 1 || len(expired) != 3 {
+				t.Errorf("%s: all the flows should be expired, %d evicted, %d expired", policy, ft.Evicted(), len(expired))
+			}
+		}
+
+		// the existing flows are still updated
+		FlowFromGoPacket(ft, forgeTestPacket(t, 3, false, ETH, IPv4, UDP), nil)
+		if policy != DropNewPolicy && ft.Aggregated() != 1 {
+			t.Errorf("%s: the packet should be aggregated into the new flow", policy)
+		}
+		ft.UnregisterAll()
+	}
+
+	if err := NewTable().SetMaxFlows(1, "unknown"); err == nil {
+		t.Error("Expected an error for an unknown policy")
+	}
+}
+
+func TestTable_EvictLeastRecent(t *testing.T) {
+	ft := NewTable()
+	if err := ft.SetMaxFlows(3, EvictOldestPolicy); err != nil {
+		t.Fatal(err)
+	}
+
+	var expired []*Flow
+	ft.RegisterExpire(func(f []*Flow) { expired = append(expired, f...) }, time.Hour)
+	defer ft.UnregisterAll()
+
+	var flows []*Flow
+	for i := int64(0); i < 3; i++ {
+		flows = append(flows, FlowFromGoPacket(ft, forgeTestPacket(t, i, false, ETH, IPv4, UDP), nil))
+	}
+
+	// the first flow is updated, the second one becomes the oldest
+	FlowFromGoPacket(ft, forgeTestPacket(t, 0, false, ETH, IPv4, UDP), nil)
+	FlowFromGoPacket(ft, forgeTestPacket(t, 3, false, ETH, IPv4, UDP), nil)
+
+	if len(expired) != 1 || expired[0] != flows[1] {
+		t.Fatalf("Expected the least recently updated flow to be evicted, got %v", expired)
+	}
+
+	if ft.lru.Len() != len(ft.table) || len(ft.lruElems) != len(ft.table) {
+		t.Errorf("The eviction list is out of sync with the table: %d/%d flows", ft.lru.Len(), len(ft.table))
+	}
+}
+
+// udpPacket returns a packet from 10.0.0.1 to 10.0.0.2 tagged by vlan if
+// not 0
+func udpPacket(t *testing.T, srcPort int, vlan uint16) *gopacket.Packet {
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0x00, 0x0F, 0xAA, 0xFA, 0xAA, 0x01},
+		DstMAC:       net.HardwareAddr{0x00, 0x0F, 0xAA, 0xFA, 0xAA, 0x02},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	stack := []gopacket.SerializableLayer{eth}
+	if vlan != 0 {
+		eth.EthernetType = layers.EthernetTypeDot1Q
+		stack = append(stack, &layers.Dot1Q{VLANIdentifier: vlan, Type: layers.EthernetTypeIPv4})
+	}
+	stack = append(stack,
+		&layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.IP{10, 0, 0, 1}, DstIP: net.IP{10, 0, 0, 2}},
+		&layers.UDP{SrcPort: layers.UDPPort(srcPort), DstPort: 53},
+		gopacket.Payload([]byte{1, 2, 3}))
+
+	buffer := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true}, stack...); err != nil {
+		t.Fatal(err)
+	}
+	packet := gopacket.NewPacket(buffer.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+	return &packet
+}
+
+func TestTable_KeyFields(t *testing.T) {
+	packets := []*gopacket.Packet{udpPacket(t, 1000, 10), udpPacket(t, 1001, 10), udpPacket(t, 1000, 20)}
+
+	tests := []struct {
+		fields []string
+		flows  int
+	}{
+		{nil, 2},
+		{DefaultKeyFields, 2},
+		{[]string{KeyNetwork, KeyProtocol}, 1},
+		{[]string{KeyNetwork, KeyTransport, KeyVLAN}, 3},
+		{[]string{KeyNetwork, KeyVLAN}, 2},
+	}
+
+	for _, test := range tests {
+		ft := NewTable()
+		if test.fields != nil {
+			if err := ft.SetKeyFields(test.fields); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, packet := range packets {
+			FlowFromGoPacket(ft, packet, nil)
+		}
+		if flows := ft.GetFlows(); len(flows) != test.flows {
+			t.Errorf("%v: expected %d flows, got %d", test.fields, test.flows, len(flows))
+		}
+	}
+
+	if err := NewTable().SetKeyFields([]string{KeyNetwork, "unknown"}); err == nil {
+		t.Error("Expected an error for an unknown key field")
+	}
+	if err := NewTable().SetKeyFields([]string{}); err == nil {
+		t.Error("Expected an error for an empty key")
+	}
+}
+
 func TestTable_AsyncExpire(t *testing.T) {
 	t.Skip()
 }
@@ -217,6 +439,23 @@ func TestTable_FilterLast(t *testing.T) {
 	}
 }
 
+func TestTable_FilterLastCopy(t *testing.T) {
+	ft := NewTestFlowTableComplex(t)
+
+	flows := ft.FilterLast(10 * time.Minute)
+	if len(flows) == 0 {
+		t.Fatal("FilterLast should return flows")
+	}
+
+	f := flows[0]
+	f.GetStatistics().Last = 0
+	for _, tf := range ft.table {
+		if tf.UUID == f.UUID && (tf == f || tf.GetStatistics().Last == 0) {
+			t.Error("FilterLast should return copies of the flows")
+		}
+	}
+}
+
 func TestTable_SelectLayer(t *testing.T) {
 	ft := NewTestFlowTableComplex(t)
 
@@ -265,3 +504,55 @@ func TestTable_SymmeticsHash(t *testing.T) {
 		}
 	}
 }
+
+func TestTable_AggregateAndExpire(t *testing.T) {
+	const MaxInt64 = int64(^uint64(0) >> 1)
+	ft := NewTable()
+
+	packet := forgeTestPacket(t, 64, false, ETH, IPv4, TCP)
+	f1 := FlowFromGoPacket(ft, packet, &probePathSetter{"probe"})
+	f2 := FlowFromGoPacket(ft, packet, &probePathSetter{"probe"})
+	if f1 != f2 {
+		t.Error("Packets of a same conversation should be aggregated into the same flow")
+	}
+
+	if ft.Aggregated() != 1 {
+		t.Errorf("Expected 1 aggregated packet, got %d", ft.Aggregated())
+	}
+
+	eth := f1.GetStatistics().GetEndpointsType(FlowEndpointType_ETHERNET)
+	if eth.AB.Packets+eth.BA.Packets != 2 {
+		t.Errorf("Expected 2 packets, got %d", eth.AB.Packets+eth.BA.Packets)
+	}
+
+	fc := MyTestFlowCounter{}
+	ft.expire(fc.countFlowsCallback, MaxInt64)
+	if fc.NbFlow != 1 || ft.String() != "0 flows" {
+		t.Errorf("Flow indexed by key should be expired, %d expired, %s left", fc.NbFlow, ft.String())
+	}
+}
+
+func TestTable_SetDurations(t *testing.T) {
+	ft := NewTestFlowTableComplex(t)
+
+	fc := MyTestFlowCounter{}
+	ft.RegisterExpire(fc.countFlowsCallback, time.Minute)
+	ft.RegisterUpdated(fc.countFlowsCallback, time.Minute)
+	defer ft.UnregisterAll()
+
+	ticker := ft.GetExpireTicker()
+	ft.SetExpireDuration(time.Hour)
+	ft.SetUpdatedDuration(time.Hour)
+
+	if ft.AggregationWindow() != time.Hour || ft.UpdatedDuration() != time.Hour {
+		t.Errorf("Durations not changed: %v %v", ft.AggregationWindow(), ft.UpdatedDuration())
+	}
+
+	if ft.GetExpireTicker() == ticker {
+		t.Error("Expire ticker should have been replaced")
+	}
+
+	if "10 flows" != ft.String() {
+		t.Errorf("Flows should have been kept: %s", ft.String())
+	}
+}
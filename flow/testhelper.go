@@ -25,6 +25,7 @@
 package flow
 
 import (
+	"fmt"
 	"math/rand"
 	"net"
 	"testing"
@@ -43,7 +44,7 @@ const (
 	UDP
 )
 
-/* protos must contain a UDP or TCP layer on top of IPv4 */
+/* protos must contain a UDP or TCP layer on top of IPv4 or IPv6 */
 func forgeTestPacket(t *testing.T, seed int64, swap bool, protos ...ProtocolType) *gopacket.Packet {
 	rnd := rand.New(rand.NewSource(seed))
 
@@ -58,6 +59,9 @@ func forgeTestPacket(t *testing.T, seed int64, swap bool, protos ...ProtocolType
 				DstMAC:       net.HardwareAddr{0x00, 0x0D, 0xBD, 0xBD, byte(rnd.Intn(0x100)), 0xBD},
 				EthernetType: layers.EthernetTypeIPv4,
 			}
+			if protos[i+1] == IPv6 {
+				ethernetLayer.EthernetType = layers.EthernetTypeIPv6
+			}
 			if swap {
 				ethernetLayer.SrcMAC, ethernetLayer.DstMAC = ethernetLayer.DstMAC, ethernetLayer.SrcMAC
 			}
@@ -77,6 +81,23 @@ func forgeTestPacket(t *testing.T, seed int64, swap bool, protos ...ProtocolType
 				ipv4Layer.SrcIP, ipv4Layer.DstIP = ipv4Layer.DstIP, ipv4Layer.SrcIP
 			}
 			protoStack = append(protoStack, ipv4Layer)
+		case IPv6:
+			ipv6Layer := &layers.IPv6{
+				Version:  6,
+				HopLimit: 64,
+				SrcIP:    net.ParseIP(fmt.Sprintf("fd00::%x", rnd.Intn(0x10000))),
+				DstIP:    net.ParseIP(fmt.Sprintf("2001:db8::%x", rnd.Intn(0x10000))),
+			}
+			switch protos[i+1] {
+			case TCP:
+				ipv6Layer.NextHeader = layers.IPProtocolTCP
+			case UDP:
+				ipv6Layer.NextHeader = layers.IPProtocolUDP
+			}
+			if swap {
+				ipv6Layer.SrcIP, ipv6Layer.DstIP = ipv6Layer.DstIP, ipv6Layer.SrcIP
+			}
+			protoStack = append(protoStack, ipv6Layer)
 		case TCP:
 			tcpLayer := &layers.TCP{
 				SrcPort: layers.TCPPort(byte(rnd.Intn(0x10000))),
@@ -25,8 +25,10 @@ package http
 import (
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/abbot/go-http-auth"
@@ -51,7 +53,7 @@ type AuthenticationClient struct {
 }
 
 func (c *AuthenticationClient) getPrefix() string {
-	return fmt.Sprintf("http://%s:%d", c.Addr, c.Port)
+	return "http://" + net.JoinHostPort(c.Addr, strconv.Itoa(c.Port))
 }
 
 func (c *AuthenticationClient) Authenticated() bool {
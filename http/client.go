@@ -28,7 +28,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 
 	"github.com/redhat-cip/skydive/config"
 	"github.com/redhat-cip/skydive/logging"
@@ -134,7 +136,22 @@ func (c *CrudClient) Get(resource string, id string, value interface{}) error {
 	return json.NewDecoder(resp.Body).Decode(value)
 }
 
+// responseError returns the error of a failed request, including the message
+// returned by the server if any
+func responseError(action string, resource string, resp *http.Response) error {
+	if data, _ := ioutil.ReadAll(resp.Body); len(data) > 0 {
+		return errors.New(fmt.Sprintf("Failed to %s %s: %s, %s", action, resource, resp.Status, bytes.TrimSpace(data)))
+	}
+	return errors.New(fmt.Sprintf("Failed to %s %s: %s", action, resource, resp.Status))
+}
+
 func (c *CrudClient) Create(resource string, value interface{}) error {
+	return c.CreateWithParams(resource, nil, value)
+}
+
+// CreateWithParams creates the resource passing the given parameters in the
+// query string of the request
+func (c *CrudClient) CreateWithParams(resource string, params url.Values, value interface{}) error {
 	s, err := json.Marshal(value)
 	if err != nil {
 		return err
@@ -143,6 +160,9 @@ func (c *CrudClient) Create(resource string, value interface{}) error {
 	contentReader := bytes.NewReader(s)
 
 	url := fmt.Sprintf("%s/%s/%s", c.authClient.getPrefix(), c.Root, resource)
+	if len(params) > 0 {
+		url += "?" + params.Encode()
+	}
 
 	resp, err := c.Request("POST", url, contentReader)
 	if err != nil {
@@ -150,7 +170,7 @@ func (c *CrudClient) Create(resource string, value interface{}) error {
 	}
 
 	if resp.StatusCode != 200 {
-		return errors.New(fmt.Sprintf("Failed to create %s: %s", resource, resp.Status))
+		return responseError("create", resource, resp)
 	}
 
 	return json.NewDecoder(resp.Body).Decode(value)
@@ -171,7 +191,7 @@ func (c *CrudClient) Update(resource string, id string, value interface{}) error
 	}
 
 	if resp.StatusCode != 200 {
-		return errors.New(fmt.Sprintf("Failed to update %s: %s", resource, resp.Status))
+		return responseError("update", resource, resp)
 	}
 
 	return json.NewDecoder(resp.Body).Decode(value)
@@ -24,12 +24,12 @@ package http
 
 import (
 	"errors"
-	"fmt"
 	"html/template"
 	"mime"
 	"net"
 	"net/http"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 
@@ -81,9 +81,10 @@ func (s *Server) ListenAndServe() {
 	defer s.wg.Done()
 	s.wg.Add(1)
 
-	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", s.Addr, s.Port))
+	addr := net.JoinHostPort(s.Addr, strconv.Itoa(s.Port))
+	listener, err := net.Listen("tcp", addr)
 	if err != nil {
-		logging.GetLogger().Fatalf("Failed to listen on %s:%d: %s", s.Addr, s.Port, err.Error())
+		logging.GetLogger().Fatalf("Failed to listen on %s: %s", addr, err.Error())
 	}
 
 	s.lock.Lock()
@@ -112,7 +112,7 @@ func (c *WSAsyncClient) sendHello() {
 }
 
 func (c *WSAsyncClient) connect() {
-	host := c.Addr + ":" + strconv.FormatInt(int64(c.Port), 10)
+	host := net.JoinHostPort(c.Addr, strconv.Itoa(c.Port))
 
 	conn, err := net.Dial("tcp", host)
 	if err != nil {
@@ -28,6 +28,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 
@@ -128,6 +129,23 @@ func initLogger() (err error) {
 	return
 }
 
+// Fields formats key/value pairs as key=value separated by spaces so that log
+// lines can be parsed, values containing spaces, quotes or = are quoted.
+func Fields(kv ...interface{}) string {
+	fields := make([]string, 0, (len(kv)+1)/2)
+	for i := 0; i < len(kv); i += 2 {
+		value := "<missing>"
+		if i+1 < len(kv) {
+			value = fmt.Sprint(kv[i+1])
+		}
+		if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+			value = strconv.Quote(value)
+		}
+		fields = append(fields, fmt.Sprintf("%v=%s", kv[i], value))
+	}
+	return strings.Join(fields, " ")
+}
+
 func GetLogger() (log *logging.Logger) {
 	skydiveLoggerLock.Lock()
 	defer skydiveLoggerLock.Unlock()
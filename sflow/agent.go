@@ -24,11 +24,15 @@ package sflow
 
 import (
 	"errors"
+	"fmt"
 	"net"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/google/gopacket"
@@ -43,6 +47,14 @@ import (
 
 const (
 	maxDgramSize = 1500
+	// datagrams waiting to be decoded or to feed the flow table when the
+	// agent has several parsers
+	parserQueueSize = 1000
+)
+
+const (
+	UDPTransport  = "udp"
+	UnixTransport = "unix"
 )
 
 var (
@@ -51,16 +63,67 @@ var (
 
 type SFlowAgent struct {
 	UUID                string
+	Transport           string
 	Addr                string
 	Port                int
+	Socket              string
 	AnalyzerClient      *analyzer.Client
 	flowTable           *flow.Table
 	FlowMappingPipeline *mappings.FlowMappingPipeline
 	FlowProbePathSetter flow.FlowProbePathSetter
+	FlowTableExpire     time.Duration
+	FlowTableUpdate     time.Duration
+	Filter              *flow.PacketFilter
+	IdleTimeout         time.Duration
+	ReadBuffer          int
+	MaxFlows            int
+	MaxFlowsPolicy      string
+	KeyFields           []string
+	SamplingScale       bool
+	conn                net.PacketConn
+	onStopped           func(*SFlowAgent)
 	running             atomic.Value
 	wg                  sync.WaitGroup
 	flush               chan bool
 	flushDone           chan bool
+	flowTableLock       sync.RWMutex
+	datagrams           uint64
+	lastDatagram        int64
+	sampling            *samplingTracker
+
+	// number of goroutines decoding the datagrams, the flow table being
+	// only fed by the agent loop. Defaults to 1.
+	Parsers int
+}
+
+type SFlowAgentStats struct {
+	Datagrams  uint64
+	Flows      int
+	Aggregated uint64
+	Dropped    uint64
+	Evicted    uint64
+	Sampling   []SFlowSamplingStats
+}
+
+// AgentOptions holds the settings of an allocated agent, the zero value
+// keeping the ones of the configuration and of the allocator
+type AgentOptions struct {
+	// override the agent flow table configuration when not 0
+	FlowTableExpire time.Duration
+	FlowTableUpdate time.Duration
+	// only the sampled packets matching the filter are kept if not nil
+	Filter *flow.PacketFilter
+	// the flows are sent with the client of the allocator if nil
+	AnalyzerClient *analyzer.Client
+}
+
+// SFlowAgentSnapshot describes a running sflow agent
+type SFlowAgentSnapshot struct {
+	UUID      string
+	Port      int
+	Target    string
+	ProbePath string
+	Stats     SFlowAgentStats
 }
 
 type SFlowAgentAllocator struct {
@@ -71,37 +134,169 @@ type SFlowAgentAllocator struct {
 	Addr                string
 	MinPort             int
 	MaxPort             int
-	allocated           map[int]*SFlowAgent
+	Transport           string
+	allocated           map[string]*SFlowAgent
+
+	// called with the UUID of the agents stopped by themselves, so that
+	// the sFlow exporters stop sending to their freed port
+	OnEvicted func(uuid string)
+}
+
+// AgentUUID returns a stable and human readable identifier for the agent of
+// the given bridge, so that the same bridge keeps its identity across restarts.
+// The identifier only contains characters allowed in ovsdb named-uuids.
+func AgentUUID(host string, bridge string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, host+"_"+bridge)
 }
 
 func (sfa *SFlowAgent) GetTarget() string {
-	target := []string{sfa.Addr, strconv.FormatInt(int64(sfa.Port), 10)}
-	return strings.Join(target, ":")
+	if sfa.Transport == UnixTransport {
+		return "unix:" + sfa.Socket
+	}
+
+	return net.JoinHostPort(sfa.Addr, strconv.Itoa(sfa.Port))
+}
+
+func (sfa *SFlowAgent) listen() (net.PacketConn, error) {
+	if sfa.Transport == UnixTransport {
+		// remove a socket left by a previous run
+		os.Remove(sfa.Socket)
+
+		return net.ListenUnixgram("unixgram", &net.UnixAddr{Name: sfa.Socket, Net: "unixgram"})
+	}
+
+	addr := net.UDPAddr{
+		Port: sfa.Port,
+		IP:   net.ParseIP(sfa.Addr),
+	}
+	return net.ListenUDP("udp", &addr)
 }
 
-func (sfa *SFlowAgent) feedFlowTable(conn *net.UDPConn) {
-	var buf [maxDgramSize]byte
-	_, _, err := conn.ReadFromUDP(buf[:])
+// setReadBuffer sets the socket receive buffer and returns the size granted
+// by the kernel, which may be clamped by net.core.rmem_max
+func setReadBuffer(conn net.PacketConn, size int) (int, error) {
+	c, ok := conn.(interface {
+		SetReadBuffer(int) error
+		SyscallConn() (syscall.RawConn, error)
+	})
+	if !ok {
+		return 0, errors.New("read buffer not supported by the connection")
+	}
+
+	if err := c.SetReadBuffer(size); err != nil {
+		return 0, err
+	}
+
+	raw, err := c.SyscallConn()
 	if err != nil {
-		conn.SetDeadline(time.Now().Add(1 * time.Second))
-		return
+		return 0, err
 	}
 
-	p := gopacket.NewPacket(buf[:], layers.LayerTypeSFlow, gopacket.Default)
+	var granted int
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		granted, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return granted, sockErr
+}
+
+func decodeDatagram(data []byte) *layers.SFlowDatagram {
+	p := gopacket.NewPacket(data, layers.LayerTypeSFlow, gopacket.Default)
 	sflowLayer := p.Layer(layers.LayerTypeSFlow)
 	sflowPacket, ok := sflowLayer.(*layers.SFlowDatagram)
 	if !ok {
-		return
+		return nil
+	}
+	return sflowPacket
+}
+
+func (sfa *SFlowAgent) readDatagram(conn net.PacketConn, buf []byte) (int, error) {
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		conn.SetDeadline(time.Now().Add(1 * time.Second))
+		return 0, err
 	}
 
+	atomic.AddUint64(&sfa.datagrams, 1)
+	atomic.StoreInt64(&sfa.lastDatagram, time.Now().UnixNano())
+
+	return n, nil
+}
+
+// feedSamples creates or updates the flows of the samples of a datagram, it
+// must only be called by the agent loop, the only writer of the flow table
+func (sfa *SFlowAgent) feedSamples(sflowPacket *layers.SFlowDatagram) {
 	if sflowPacket.SampleCount > 0 {
+		count := 0
 		for _, sample := range sflowPacket.FlowSamples {
-			flows := flow.FlowsFromSFlowSample(sfa.flowTable, &sample, sfa.FlowProbePathSetter)
-			logging.GetLogger().Debugf("%d flows captured", len(flows))
+			sfa.sampling.record(sfa.UUID, sflowPacket, &sample)
+			flows := flow.FlowsFromSFlowSample(sfa.flowTable, sflowPacket, &sample, sfa.FlowProbePathSetter, sfa.Filter)
+			count += len(flows)
 		}
+
+		// logged once per datagram, the samples being the hot path
+		logging.GetLogger().Debugf("Flows captured %s", logging.Fields("agent_uuid", sfa.UUID, "port", sfa.Port, "agent_address", sflowPacket.AgentAddress, "sub_agent_id", sflowPacket.SubAgentID, "sample_count", len(sflowPacket.FlowSamples), "flow_count", count))
 	}
 }
 
+// startParsers reads the datagrams and decodes them with a pool of parsers,
+// the decoded datagrams, not kept in the order they were received, are sent
+// to the returned channel which is closed once the agent is stopped
+func (sfa *SFlowAgent) startParsers(conn net.PacketConn) <-chan *layers.SFlowDatagram {
+	raw := make(chan []byte, parserQueueSize)
+	decoded := make(chan *layers.SFlowDatagram, parserQueueSize)
+
+	go func() {
+		defer close(raw)
+
+		var buf [maxDgramSize]byte
+		for sfa.running.Load() == true {
+			n, err := sfa.readDatagram(conn, buf[:])
+			if err != nil {
+				continue
+			}
+
+			data := make([]byte, n)
+			copy(data, buf[:n])
+			raw <- data
+		}
+	}()
+
+	parsers := sfa.Parsers
+	if parsers < 1 {
+		parsers = 1
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < parsers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for data := range raw {
+				if sflowPacket := decodeDatagram(data); sflowPacket != nil {
+					decoded <- sflowPacket
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(decoded)
+	}()
+
+	return decoded
+}
+
 func (sfa *SFlowAgent) asyncFlowPipeline(flows []*flow.Flow) {
 	if sfa.FlowMappingPipeline != nil {
 		sfa.FlowMappingPipeline.Enhance(flows)
@@ -112,34 +307,110 @@ func (sfa *SFlowAgent) asyncFlowPipeline(flows []*flow.Flow) {
 }
 
 func (sfa *SFlowAgent) start() error {
-	addr := net.UDPAddr{
-		Port: sfa.Port,
-		IP:   net.ParseIP(sfa.Addr),
-	}
-	conn, err := net.ListenUDP("udp", &addr)
-	if err != nil {
-		logging.GetLogger().Errorf("Unable to listen on port %d: %s", sfa.Port, err.Error())
-		return err
+	// the allocator binds the port of the agents it allocates
+	conn := sfa.conn
+	sfa.conn = nil
+	if conn == nil {
+		var err error
+		if conn, err = sfa.listen(); err != nil {
+			logging.GetLogger().Errorf("Unable to listen %s", logging.Fields("agent_uuid", sfa.UUID, "target", sfa.GetTarget(), "error", err))
+
+			// an agent which can't receive any datagram is not kept allocated
+			if sfa.onStopped != nil {
+				sfa.onStopped(sfa)
+			}
+			return err
+		}
 	}
 	defer conn.Close()
+
+	if sfa.Transport == UnixTransport {
+		defer os.Remove(sfa.Socket)
+	}
+
+	if sfa.ReadBuffer > 0 {
+		granted, err := setReadBuffer(conn, sfa.ReadBuffer)
+		if err != nil {
+			logging.GetLogger().Errorf("Unable to set the read buffer %s", logging.Fields("agent_uuid", sfa.UUID, "read_buffer", sfa.ReadBuffer, "error", err))
+		} else {
+			// linux doubles the requested size for its bookkeeping
+			logging.GetLogger().Infof("SFlow agent read buffer set %s", logging.Fields("agent_uuid", sfa.UUID, "read_buffer", sfa.ReadBuffer, "granted", granted))
+		}
+	}
 	conn.SetDeadline(time.Now().Add(1 * time.Second))
 
+	// an idle agent is forgotten once done, the allocator waiting for the
+	// agents it stops while holding its lock
+	idle := false
+	defer func() {
+		if idle && sfa.onStopped != nil {
+			sfa.onStopped(sfa)
+		}
+	}()
+
 	sfa.wg.Add(1)
 	defer sfa.wg.Done()
 
 	sfa.running.Store(true)
 
+	sfa.flowTableLock.Lock()
 	sfa.flowTable = flow.NewTable()
+	sfa.flowTableLock.Unlock()
+
+	if sfa.MaxFlows > 0 {
+		if err := sfa.flowTable.SetMaxFlows(sfa.MaxFlows, sfa.MaxFlowsPolicy); err != nil {
+			logging.GetLogger().Errorf("Unable to cap the flow table %s", logging.Fields("agent_uuid", sfa.UUID, "error", err))
+		}
+	}
+	if len(sfa.KeyFields) > 0 {
+		if err := sfa.flowTable.SetKeyFields(sfa.KeyFields); err != nil {
+			logging.GetLogger().Errorf("Unable to set the flow key %s", logging.Fields("agent_uuid", sfa.UUID, "error", err))
+		}
+	}
+	sfa.flowTable.SetSamplingScale(sfa.SamplingScale)
 	defer sfa.flowTable.UnregisterAll()
 
-	cfgFlowtable_expire := config.GetConfig().GetInt("agent.flowtable_expire")
-	sfa.flowTable.RegisterExpire(sfa.asyncFlowPipeline, time.Duration(cfgFlowtable_expire)*time.Second)
+	expire := sfa.FlowTableExpire
+	if expire == 0 {
+		expire = time.Duration(config.GetConfig().GetInt("agent.flowtable_expire")) * time.Second
+	}
+	sfa.flowTable.RegisterExpire(sfa.asyncFlowPipeline, expire)
+
+	update := sfa.FlowTableUpdate
+	if update == 0 {
+		update = time.Duration(config.GetConfig().GetInt("agent.flowtable_update")) * time.Second
+	}
+	sfa.flowTable.RegisterUpdated(sfa.asyncFlowPipeline, update)
+
+	logging.GetLogger().Debugf("SFlow agent started %s", logging.Fields("agent_uuid", sfa.UUID, "port", sfa.Port, "aggregation_window", sfa.flowTable.AggregationWindow()))
+
+	// a nil channel never fires, idle agents are kept when there is no timeout
+	var idleTicker <-chan time.Time
+	if sfa.IdleTimeout > 0 {
+		ticker := time.NewTicker(sfa.IdleTimeout / 2)
+		defer ticker.Stop()
+		idleTicker = ticker.C
+	}
+	atomic.StoreInt64(&sfa.lastDatagram, time.Now().UnixNano())
 
-	cfgFlowtable_update := config.GetConfig().GetInt("agent.flowtable_update")
-	sfa.flowTable.RegisterUpdated(sfa.asyncFlowPipeline, time.Duration(cfgFlowtable_update)*time.Second)
+	decoded := sfa.startParsers(conn)
+
+	// unblocks the parsers until the reader notices the agent is stopped
+	defer func() {
+		for range decoded {
+		}
+	}()
 
 	for sfa.running.Load() == true {
 		select {
+		case now := <-idleTicker:
+			if now.Sub(time.Unix(0, atomic.LoadInt64(&sfa.lastDatagram))) < sfa.IdleTimeout {
+				continue
+			}
+
+			logging.GetLogger().Infof("SFlow agent evicted, no datagram received %s", logging.Fields("agent_uuid", sfa.UUID, "port", sfa.Port, "idle_timeout", sfa.IdleTimeout))
+			sfa.running.Store(false)
+			idle = true
 		case now := <-sfa.flowTable.GetExpireTicker():
 			sfa.flowTable.Expire(now)
 		case now := <-sfa.flowTable.GetUpdatedTicker():
@@ -147,8 +418,10 @@ func (sfa *SFlowAgent) start() error {
 		case <-sfa.flush:
 			sfa.flowTable.ExpireNow()
 			sfa.flushDone <- true
-		default:
-			sfa.feedFlowTable(conn)
+		case sflowPacket, ok := <-decoded:
+			if ok {
+				sfa.feedSamples(sflowPacket)
+			}
 		}
 	}
 
@@ -172,6 +445,46 @@ func (sfa *SFlowAgent) Flush() {
 	<-sfa.flushDone
 }
 
+func (sfa *SFlowAgent) Stats() SFlowAgentStats {
+	stats := SFlowAgentStats{
+		Datagrams: atomic.LoadUint64(&sfa.datagrams),
+		Sampling:  sfa.sampling.stats(),
+	}
+
+	sfa.flowTableLock.RLock()
+	defer sfa.flowTableLock.RUnlock()
+
+	if sfa.flowTable != nil {
+		stats.Flows = len(sfa.flowTable.GetFlows())
+		stats.Aggregated = sfa.flowTable.Aggregated()
+		stats.Dropped = sfa.flowTable.Dropped()
+		stats.Evicted = sfa.flowTable.Evicted()
+	}
+
+	return stats
+}
+
+// FlowTable returns the flow table of the agent, nil until it is started
+func (sfa *SFlowAgent) FlowTable() *flow.Table {
+	sfa.flowTableLock.RLock()
+	defer sfa.flowTableLock.RUnlock()
+	return sfa.flowTable
+}
+
+// allocatedWith returns whether the agent was allocated with the given options
+func (sfa *SFlowAgent) allocatedWith(opts AgentOptions) bool {
+	if sfa.FlowTableExpire != opts.FlowTableExpire || sfa.FlowTableUpdate != opts.FlowTableUpdate {
+		return false
+	}
+
+	filter := opts.Filter
+	if (sfa.Filter == nil) != (filter == nil) || (filter != nil && sfa.Filter.String() != filter.String()) {
+		return false
+	}
+
+	return sfa.AnalyzerClient.SameDestination(opts.AnalyzerClient)
+}
+
 func (sfa *SFlowAgent) SetFlowProbePathSetter(p flow.FlowProbePathSetter) {
 	sfa.FlowProbePathSetter = p
 }
@@ -179,22 +492,42 @@ func (sfa *SFlowAgent) SetFlowProbePathSetter(p flow.FlowProbePathSetter) {
 func NewSFlowAgent(u string, a string, p int, c *analyzer.Client, m *mappings.FlowMappingPipeline) *SFlowAgent {
 	return &SFlowAgent{
 		UUID:                u,
+		Transport:           UDPTransport,
 		Addr:                a,
 		Port:                p,
 		AnalyzerClient:      c,
 		FlowMappingPipeline: m,
 		flush:               make(chan bool),
 		flushDone:           make(chan bool),
+		sampling:            newSamplingTracker(),
 	}
 }
 
+// NewUnixSFlowAgent returns an agent receiving the sFlow datagrams on a unix
+// datagram socket instead of an UDP port
+func NewUnixSFlowAgent(u string, socket string, c *analyzer.Client, m *mappings.FlowMappingPipeline) *SFlowAgent {
+	sfa := NewSFlowAgent(u, "", 0, c, m)
+	sfa.Transport = UnixTransport
+	sfa.Socket = socket
+
+	return sfa
+}
+
 func NewSFlowAgentFromConfig(u string, a *analyzer.Client, m *mappings.FlowMappingPipeline) (*SFlowAgent, error) {
 	addr, port, err := config.GetHostPortAttributes("sflow", "listen")
 	if err != nil {
 		return nil, err
 	}
 
-	return NewSFlowAgent(u, addr, port, a, m), nil
+	sfa := NewSFlowAgent(u, addr, port, a, m)
+	sfa.ReadBuffer = config.GetConfig().GetInt("sflow.read_buffer")
+	sfa.MaxFlows = config.GetConfig().GetInt("agent.flowtable_max")
+	sfa.MaxFlowsPolicy = config.GetConfig().GetString("agent.flowtable_max_policy")
+	sfa.KeyFields = config.GetConfig().GetStringSlice("flow.key_fields")
+	sfa.SamplingScale = config.GetConfig().GetBool("sflow.sampling_scale")
+	sfa.Parsers = config.GetConfig().GetInt("sflow.parsers")
+
+	return sfa, nil
 }
 
 func (a *SFlowAgentAllocator) Agents() []*SFlowAgent {
@@ -210,16 +543,57 @@ func (a *SFlowAgentAllocator) Agents() []*SFlowAgent {
 	return agents
 }
 
+// Snapshot returns the description of all the allocated agents
+func (a *SFlowAgentAllocator) Snapshot() []SFlowAgentSnapshot {
+	a.RLock()
+	defer a.RUnlock()
+
+	snapshots := make([]SFlowAgentSnapshot, 0, len(a.allocated))
+	for _, agent := range a.allocated {
+		snapshot := SFlowAgentSnapshot{
+			UUID:   agent.UUID,
+			Port:   agent.Port,
+			Target: agent.GetTarget(),
+			Stats:  agent.Stats(),
+		}
+
+		// the setter is the only holder of the probe path
+		if agent.FlowProbePathSetter != nil {
+			f := &flow.Flow{}
+			agent.FlowProbePathSetter.SetProbePath(f)
+			snapshot.ProbePath = f.ProbeGraphPath
+		}
+
+		snapshots = append(snapshots, snapshot)
+	}
+
+	return snapshots
+}
+
 func (a *SFlowAgentAllocator) Release(uuid string) {
 	a.Lock()
 	defer a.Unlock()
 
-	for i, agent := range a.allocated {
-		if uuid == agent.UUID {
-			agent.Stop()
+	if agent, ok := a.allocated[uuid]; ok {
+		agent.Stop()
 
-			delete(a.allocated, i)
-		}
+		delete(a.allocated, uuid)
+	}
+}
+
+// evict forgets an agent that stopped by itself, idle or unable to listen,
+// the agent may have been released and allocated again in the meantime
+func (a *SFlowAgentAllocator) evict(agent *SFlowAgent) {
+	a.Lock()
+	evicted := a.allocated[agent.UUID] == agent
+	if evicted {
+		delete(a.allocated, agent.UUID)
+	}
+	onEvicted := a.OnEvicted
+	a.Unlock()
+
+	if evicted && onEvicted != nil {
+		onEvicted(agent.UUID)
 	}
 }
 
@@ -227,59 +601,135 @@ func (a *SFlowAgentAllocator) ReleaseAll() {
 	a.Lock()
 	defer a.Unlock()
 
-	for i, agent := range a.allocated {
+	for uuid, agent := range a.allocated {
 		agent.Stop()
 
-		delete(a.allocated, i)
+		delete(a.allocated, uuid)
 	}
 }
 
-func (a *SFlowAgentAllocator) Alloc(uuid string, p flow.FlowProbePathSetter) (*SFlowAgent, error) {
-	address := config.GetConfig().GetString("sflow.bind_address")
-	if address == "" {
-		address = "127.0.0.1"
+// portRange returns the range of the ports allocated to the agents
+func (a *SFlowAgentAllocator) portRange() (int, int, error) {
+	min, max := a.MinPort, a.MaxPort
+	if min < 1 || max > 65535 || min > max {
+		return 0, 0, fmt.Errorf("invalid sflow port range %d-%d", min, max)
 	}
+	return min, max, nil
+}
 
-	min := config.GetConfig().GetInt("sflow.port_min")
-	if min == 0 {
-		min = 6345
+// isAddrInUse returns whether a listen error is due to an address already
+// bound
+func isAddrInUse(err error) bool {
+	if opErr, ok := err.(*net.OpError); ok {
+		if sysErr, ok := opErr.Err.(*os.SyscallError); ok {
+			return sysErr.Err == syscall.EADDRINUSE
+		}
+	}
+	return false
+}
+
+// Alloc starts an agent for the given uuid with the given options
+func (a *SFlowAgentAllocator) Alloc(uuid string, p flow.FlowProbePathSetter, opts AgentOptions) (*SFlowAgent, error) {
+	if opts.FlowTableExpire < 0 || opts.FlowTableUpdate < 0 {
+		return nil, errors.New("flow table expire and update durations must be positive")
 	}
 
-	max := config.GetConfig().GetInt("sflow.port_max")
-	if max == 0 {
-		max = 6355
+	if opts.AnalyzerClient == nil {
+		opts.AnalyzerClient = a.AnalyzerClient
 	}
+	client := opts.AnalyzerClient
 
 	a.Lock()
 	defer a.Unlock()
 
-	// check if there is an already allocated agent for this uuid
-	for _, agent := range a.allocated {
-		if uuid == agent.UUID {
-			return agent, AgentAlreadyAllocated
+	address := a.Addr
+	if address == "" {
+		address = "127.0.0.1"
+	}
+
+	min, max, err := a.portRange()
+	if err != nil {
+		return nil, err
+	}
+
+	// check if there is an already allocated agent for this uuid, the
+	// settings of a running agent can't be changed
+	if agent, ok := a.allocated[uuid]; ok {
+		if !agent.allocatedWith(opts) {
+			return nil, fmt.Errorf("agent %s already allocated with other flow table, filter or analyzer settings", uuid)
 		}
+		return agent, AgentAlreadyAllocated
 	}
 
-	for i := min; i != max+1; i++ {
-		if _, ok := a.allocated[i]; !ok {
-			s := NewSFlowAgent(uuid, address, i, a.AnalyzerClient, a.FlowMappingPipeline)
-			s.SetFlowProbePathSetter(p)
+	var s *SFlowAgent
+	if a.Transport == UnixTransport {
+		socket := filepath.Join(config.GetConfig().GetString("sflow.socket_dir"), uuid+".sock")
+		s = NewUnixSFlowAgent(uuid, socket, client, a.FlowMappingPipeline)
 
-			a.allocated[i] = s
+		conn, err := s.listen()
+		if err != nil {
+			return nil, err
+		}
+		s.conn = conn
+	} else {
+		used := make(map[int]bool)
+		for _, agent := range a.allocated {
+			used[agent.Port] = true
+		}
 
-			s.Start()
+		for i := min; i <= max; i++ {
+			if used[i] {
+				continue
+			}
+
+			agent := NewSFlowAgent(uuid, address, i, client, a.FlowMappingPipeline)
+			conn, err := agent.listen()
+			if err != nil {
+				// the port may be bound by another process
+				if isAddrInUse(err) {
+					logging.GetLogger().Debugf("SFlow port already in use %s", logging.Fields("agent_uuid", uuid, "port", i))
+					continue
+				}
+				return nil, err
+			}
+
+			agent.conn = conn
+			s = agent
+			break
+		}
 
-			return s, nil
+		if s == nil {
+			return nil, fmt.Errorf("sflow port range %d-%d exhausted (sflow.port_min, sflow.port_max)", min, max)
 		}
 	}
 
-	return nil, errors.New("sflow port exhausted")
+	s.SetFlowProbePathSetter(p)
+	s.FlowTableExpire = opts.FlowTableExpire
+	s.FlowTableUpdate = opts.FlowTableUpdate
+	s.Filter = opts.Filter
+	s.IdleTimeout = time.Duration(config.GetConfig().GetInt("sflow.idle_timeout")) * time.Second
+	s.ReadBuffer = config.GetConfig().GetInt("sflow.read_buffer")
+	s.MaxFlows = config.GetConfig().GetInt("agent.flowtable_max")
+	s.MaxFlowsPolicy = config.GetConfig().GetString("agent.flowtable_max_policy")
+	s.KeyFields = config.GetConfig().GetStringSlice("flow.key_fields")
+	s.SamplingScale = config.GetConfig().GetBool("sflow.sampling_scale")
+	s.Parsers = config.GetConfig().GetInt("sflow.parsers")
+	s.onStopped = a.evict
+	a.allocated[uuid] = s
+
+	s.Start()
+
+	return s, nil
 }
 
 func NewSFlowAgentAllocator(a *analyzer.Client, m *mappings.FlowMappingPipeline) *SFlowAgentAllocator {
 	return &SFlowAgentAllocator{
 		AnalyzerClient:      a,
 		FlowMappingPipeline: m,
-		allocated:           make(map[int]*SFlowAgent),
+		Addr:                config.GetConfig().GetString("sflow.bind_address"),
+		MinPort:             config.GetConfig().GetInt("sflow.port_min"),
+		MaxPort:             config.GetConfig().GetInt("sflow.port_max"),
+		Transport:           config.GetConfig().GetString("sflow.transport"),
+		allocated:           make(map[string]*SFlowAgent),
 	}
 }
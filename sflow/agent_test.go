@@ -0,0 +1,285 @@
+/*
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package sflow
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/flow"
+	"github.com/redhat-cip/skydive/tools"
+)
+
+func TestIdleAgentEviction(t *testing.T) {
+	allocator := NewSFlowAgentAllocator(nil, nil)
+
+	agent := NewSFlowAgent("idle", "127.0.0.1", 0, nil, nil)
+	agent.IdleTimeout = 200 * time.Millisecond
+	agent.onStopped = allocator.evict
+	allocator.allocated[agent.UUID] = agent
+
+	agent.Start()
+	defer agent.Stop()
+
+	for i := 0; i < 30; i++ {
+		if len(allocator.Agents()) == 0 {
+			if agent.running.Load() == true {
+				t.Error("Evicted agent should be stopped")
+			}
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	t.Error("Idle agent should have been evicted")
+}
+
+func TestIdleAgentStoppedBeforeEviction(t *testing.T) {
+	allocator := NewSFlowAgentAllocator(nil, nil)
+
+	agent := NewSFlowAgent("idle", "127.0.0.1", 0, nil, nil)
+	agent.IdleTimeout = 200 * time.Millisecond
+	allocator.allocated[agent.UUID] = agent
+
+	// like a release racing the eviction, waits for the agent under the
+	// allocator lock
+	stopped := make(chan bool)
+	agent.onStopped = func(s *SFlowAgent) {
+		allocator.Lock()
+		s.wg.Wait()
+		allocator.Unlock()
+
+		allocator.evict(s)
+		stopped <- true
+	}
+
+	agent.Start()
+
+	select {
+	case <-stopped:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Idle agent evicted before being stopped")
+	}
+
+	if len(allocator.Agents()) != 0 {
+		t.Error("Idle agent should have been evicted")
+	}
+}
+
+func TestReadBuffer(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	small, err := setReadBuffer(conn, 4096)
+	if err != nil || small <= 0 {
+		t.Fatalf("Unable to set the read buffer: %d, %v", small, err)
+	}
+
+	large, err := setReadBuffer(conn, 65536)
+	if err != nil || large <= small {
+		t.Errorf("Expected a larger read buffer than %d, got %d (%v)", small, large, err)
+	}
+}
+
+func TestAllocPortInUse(t *testing.T) {
+	// a port bound by another process
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+
+	// the range is set on the allocator, the global config being read by
+	// the running agents
+	allocator := NewSFlowAgentAllocator(nil, nil)
+	allocator.Addr = "127.0.0.1"
+	allocator.MinPort, allocator.MaxPort = port, port
+	defer allocator.ReleaseAll()
+
+	_, err = allocator.Alloc("in-use", nil, AgentOptions{})
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("%d-%d exhausted", port, port)) {
+		t.Fatalf("Expected the range to be exhausted, got %v", err)
+	}
+
+	allocator.MaxPort = port + 1
+	agent, err := allocator.Alloc("next", nil, AgentOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agent.Port != port+1 {
+		t.Errorf("Expected the port in use to be skipped, got %d", agent.Port)
+	}
+
+	allocator.MinPort, allocator.MaxPort = port+1, port
+	if _, err := allocator.Alloc("invalid", nil, AgentOptions{}); err == nil {
+		t.Error("Expected an error for an invalid port range")
+	}
+}
+
+func TestAllocSettingsMismatch(t *testing.T) {
+	allocator := NewSFlowAgentAllocator(nil, nil)
+	allocator.MinPort, allocator.MaxPort = 6345, 6355
+	defer allocator.ReleaseAll()
+
+	if _, err := allocator.Alloc("agent", nil, AgentOptions{FlowTableExpire: time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := allocator.Alloc("agent", nil, AgentOptions{FlowTableExpire: time.Minute}); err != AgentAlreadyAllocated {
+		t.Errorf("Expected the agent to be reused, got %v", err)
+	}
+
+	if _, err := allocator.Alloc("agent", nil, AgentOptions{FlowTableExpire: time.Hour}); err == nil || err == AgentAlreadyAllocated {
+		t.Errorf("Expected an error for another flow table expire, got %v", err)
+	}
+
+	filter, err := flow.NewPacketFilter("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := allocator.Alloc("agent", nil, AgentOptions{FlowTableExpire: time.Minute, Filter: filter}); err == nil || err == AgentAlreadyAllocated {
+		t.Errorf("Expected an error for another filter, got %v", err)
+	}
+}
+
+func TestListenFailureEviction(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	allocator := NewSFlowAgentAllocator(nil, nil)
+
+	// an agent started on a port bound in the meantime
+	agent := NewSFlowAgent("dead", "127.0.0.1", conn.LocalAddr().(*net.UDPAddr).Port, nil, nil)
+	agent.onStopped = allocator.evict
+	allocator.allocated[agent.UUID] = agent
+
+	if err := agent.start(); err == nil {
+		t.Fatal("Expected the agent to fail to listen")
+	}
+
+	if len(allocator.Agents()) != 0 {
+		t.Error("An agent unable to listen should be evicted")
+	}
+}
+
+func TestEvictionCallback(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var evicted []string
+	allocator := NewSFlowAgentAllocator(nil, nil)
+	allocator.OnEvicted = func(uuid string) {
+		evicted = append(evicted, uuid)
+	}
+
+	agent := NewSFlowAgent("dead", "127.0.0.1", conn.LocalAddr().(*net.UDPAddr).Port, nil, nil)
+	agent.onStopped = allocator.evict
+	allocator.allocated[agent.UUID] = agent
+	agent.start()
+
+	// an agent released and allocated again is not evicted twice
+	allocator.evict(agent)
+
+	if len(evicted) != 1 || evicted[0] != "dead" {
+		t.Errorf("Expected the evicted agent to be notified once, got %v", evicted)
+	}
+}
+
+func TestAllocUnixListenFailure(t *testing.T) {
+	config.GetConfig().Set("sflow.socket_dir", "/nonexistent")
+
+	allocator := NewSFlowAgentAllocator(nil, nil)
+	allocator.Transport = UnixTransport
+	defer allocator.ReleaseAll()
+
+	if _, err := allocator.Alloc("unix", nil, AgentOptions{}); err == nil {
+		t.Fatal("Expected the allocation to fail")
+	}
+
+	if len(allocator.Agents()) != 0 {
+		t.Error("An agent unable to listen shouldn't be allocated")
+	}
+}
+
+// replayTrace sends the packets of the trace to an agent and returns the
+// number of packets accounted once all the datagrams are processed
+func replayTrace(t *testing.T, parsers int) uint64 {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+
+	agent := NewSFlowAgent("parsers", "127.0.0.1", port, nil, nil)
+	agent.Parsers = parsers
+	agent.ReadBuffer = 1024 * 1024
+	agent.conn = conn
+
+	agent.Start()
+	defer agent.Stop()
+
+	// one datagram per packet of the trace
+	if err := tools.PCAP2SFlowReplay("127.0.0.1", port, "../tests/pcaptraces/eth-ip4-arp-dns-req-http-google.pcap", 1000, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// every packet either creates a flow or is aggregated to one
+	var accounted uint64
+	for i := 0; i < 50; i++ {
+		time.Sleep(100 * time.Millisecond)
+
+		stats := agent.Stats()
+		if stats.Datagrams == 58 && uint64(stats.Flows)+stats.Aggregated == accounted {
+			return accounted
+		}
+		accounted = uint64(stats.Flows) + stats.Aggregated
+	}
+
+	t.Fatalf("Datagrams not processed: %+v", agent.Stats())
+	return 0
+}
+
+func TestParsers(t *testing.T) {
+	expected := replayTrace(t, 1)
+	if expected == 0 {
+		t.Fatal("No packet accounted")
+	}
+
+	if accounted := replayTrace(t, 4); accounted != expected {
+		t.Errorf("Expected %d packets accounted with several parsers, got %d", expected, accounted)
+	}
+}
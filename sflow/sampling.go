@@ -0,0 +1,146 @@
+/*
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package sflow
+
+import (
+	"math"
+	"sync"
+
+	"github.com/google/gopacket/layers"
+
+	"github.com/redhat-cip/skydive/logging"
+)
+
+const (
+	// number of samples required before estimating the effective sampling
+	minEstimateSamples = 100
+	// relative difference between the claimed and the effective sampling
+	// above which a warning is logged
+	maxSamplingDiscrepancy = 0.5
+)
+
+// SFlowSamplingStats compares the sampling rate claimed by a sFlow source,
+// identified by its agent address, sub-agent and source ID, to the sampling
+// observed from the sample pool counter. EffectiveSampling is 0 until enough
+// samples have been received.
+type SFlowSamplingStats struct {
+	AgentAddress      string
+	SubAgentID        uint32
+	SourceID          uint32
+	SamplingRate      uint32
+	Samples           uint64
+	EffectiveSampling float64
+}
+
+type samplingKey struct {
+	agent    string
+	subAgent uint32
+	source   uint32
+}
+
+type samplingSource struct {
+	SFlowSamplingStats
+	lastPool uint32
+	pool     uint64
+	warned   bool
+}
+
+// samplingTracker estimates the effective sampling of each source as the
+// number of packets added to the sample pool per sample received
+type samplingTracker struct {
+	sync.Mutex
+	sources map[samplingKey]*samplingSource
+}
+
+func newSamplingTracker() *samplingTracker {
+	return &samplingTracker{
+		sources: make(map[samplingKey]*samplingSource),
+	}
+}
+
+func (t *samplingTracker) record(uuid string, dgram *layers.SFlowDatagram, sample *layers.SFlowFlowSample) {
+	t.Lock()
+	defer t.Unlock()
+
+	key := samplingKey{
+		agent:    dgram.AgentAddress.String(),
+		subAgent: dgram.SubAgentID,
+		source:   uint32(sample.SourceIDIndex),
+	}
+
+	source, ok := t.sources[key]
+	if !ok {
+		// the first sample only gives the pool origin
+		t.sources[key] = &samplingSource{
+			SFlowSamplingStats: SFlowSamplingStats{
+				AgentAddress: key.agent,
+				SubAgentID:   key.subAgent,
+				SourceID:     key.source,
+				SamplingRate: sample.SamplingRate,
+			},
+			lastPool: sample.SamplePool,
+		}
+		return
+	}
+
+	// the sampling rate has been reconfigured, start a new estimate
+	if source.SamplingRate != sample.SamplingRate {
+		source.SamplingRate = sample.SamplingRate
+		source.Samples, source.pool, source.EffectiveSampling = 0, 0, 0
+		source.warned = false
+	}
+
+	// the pool is a 32 bits counter that wraps
+	source.pool += uint64(sample.SamplePool - source.lastPool)
+	source.lastPool = sample.SamplePool
+	source.Samples++
+
+	if source.Samples < minEstimateSamples {
+		return
+	}
+
+	source.EffectiveSampling = float64(source.pool) / float64(source.Samples)
+
+	if source.SamplingRate == 0 {
+		return
+	}
+
+	discrepancy := math.Abs(source.EffectiveSampling-float64(source.SamplingRate)) / float64(source.SamplingRate)
+	if discrepancy > maxSamplingDiscrepancy && !source.warned {
+		logging.GetLogger().Warningf("sFlow effective sampling doesn't match the sampling rate %s", logging.Fields("agent_uuid", uuid, "agent_address", key.agent, "sub_agent_id", key.subAgent, "source_id", key.source, "sampling_rate", source.SamplingRate, "effective_sampling", source.EffectiveSampling))
+		source.warned = true
+	} else if discrepancy <= maxSamplingDiscrepancy {
+		source.warned = false
+	}
+}
+
+func (t *samplingTracker) stats() []SFlowSamplingStats {
+	t.Lock()
+	defer t.Unlock()
+
+	stats := make([]SFlowSamplingStats, 0, len(t.sources))
+	for _, source := range t.sources {
+		stats = append(stats, source.SFlowSamplingStats)
+	}
+	return stats
+}
@@ -0,0 +1,68 @@
+/*
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package sflow
+
+import (
+	"math"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestSamplingTracker(t *testing.T) {
+	tracker := newSamplingTracker()
+	dgram := &layers.SFlowDatagram{AgentAddress: net.ParseIP("10.0.0.1"), SubAgentID: 2}
+
+	// the switch claims 1 out of 512 but samples 1 out of 2048, the pool
+	// counter wrapping on the way
+	pool := uint32(math.MaxUint32 - 10000)
+	for i := 0; i <= minEstimateSamples; i++ {
+		tracker.record("test", dgram, &layers.SFlowFlowSample{SourceIDIndex: 3, SamplingRate: 512, SamplePool: pool})
+		pool += 2048
+	}
+
+	stats := tracker.stats()
+	if len(stats) != 1 {
+		t.Fatalf("Expected one source, got %v", stats)
+	}
+
+	s := stats[0]
+	if s.AgentAddress != "10.0.0.1" || s.SubAgentID != 2 || s.SourceID != 3 || s.SamplingRate != 512 {
+		t.Errorf("Wrong source: %+v", s)
+	}
+
+	if s.Samples != minEstimateSamples || s.EffectiveSampling != 2048 {
+		t.Errorf("Expected an effective sampling of 2048 over %d samples, got %+v", minEstimateSamples, s)
+	}
+
+	if !tracker.sources[samplingKey{"10.0.0.1", 2, 3}].warned {
+		t.Error("Sampling discrepancy should have been reported")
+	}
+
+	// a new sampling rate restarts the estimate
+	tracker.record("test", dgram, &layers.SFlowFlowSample{SourceIDIndex: 3, SamplingRate: 2048, SamplePool: pool})
+	if s := tracker.stats()[0]; s.SamplingRate != 2048 || s.Samples != 1 || s.EffectiveSampling != 0 {
+		t.Errorf("Estimate not restarted: %+v", s)
+	}
+}
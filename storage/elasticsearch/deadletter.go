@@ -0,0 +1,179 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package elasticseach
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/redhat-cip/skydive/logging"
+)
+
+// bulkError keeps a copy of the documents of a failed bulk request, the
+// buffer given to the indexer being consumed by the request
+type bulkError struct {
+	err  error
+	data []byte
+}
+
+func (e *bulkError) Error() string {
+	return e.err.Error()
+}
+
+// bulkItemsError is returned when Elasticsearch accepted a bulk request but
+// failed to index some of its items, given by their position in the request
+type bulkItemsError struct {
+	failed []int
+	count  int
+}
+
+func (e *bulkItemsError) Error() string {
+	return fmt.Sprintf("Bulk Insertion Error. Failed item count [%d/%d]", len(e.failed), e.count)
+}
+
+// checkBulkResponse returns a bulkItemsError if some items of the bulk
+// request were not indexed, according to the per item statuses
+func checkBulkResponse(body []byte) error {
+	var response struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Status int `json:"status"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil || !response.Errors {
+		return nil
+	}
+
+	e := &bulkItemsError{count: len(response.Items)}
+	for i, item := range response.Items {
+		for _, result := range item {
+			if result.Status < 200 || result.Status > 299 {
+				e.failed = append(e.failed, i)
+			}
+		}
+	}
+	return e
+}
+
+// bulkItems returns the bulk request made of the given items of a request,
+// an item being an action line followed by a document line
+func bulkItems(data []byte, items []int) []byte {
+	lines := bytes.Split(data, []byte("\n"))
+
+	var buf bytes.Buffer
+	for _, i := range items {
+		if 2*i+1 < len(lines) {
+			buf.Write(lines[2*i])
+			buf.WriteByte('\n')
+			buf.Write(lines[2*i+1])
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Bytes()
+}
+
+// bulkDocuments returns the documents of the given type of a bulk request,
+// made of an action line followed by a document line per document
+func bulkDocuments(data []byte, docType string) [][]byte {
+	var docs [][]byte
+
+	lines := bytes.Split(data, []byte("\n"))
+	for i := 0; i+1 < len(lines); i += 2 {
+		var action map[string]struct {
+			Type string `json:"_type"`
+		}
+		if err := json.Unmarshal(lines[i], &action); err != nil {
+			logging.GetLogger().Errorf("Unable to parse bulk action: %s", err.Error())
+			return docs
+		}
+
+		for _, a := range action {
+			if a.Type == docType {
+				docs = append(docs, lines[i+1])
+			}
+		}
+	}
+
+	return docs
+}
+
+// deadLetter appends the flows that couldn't be stored to a file, one JSON
+// document per line, so that they can be replayed. The documents exceeding
+// the maximum size of the file are dropped.
+type deadLetter struct {
+	sync.Mutex
+	path    string
+	file    *os.File
+	size    int64
+	maxSize int64
+	dropped uint64
+}
+
+func (d *deadLetter) write(docs [][]byte) (int, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	w := bufio.NewWriter(d.file)
+	written := 0
+	for _, doc := range docs {
+		if d.size+int64(len(doc))+1 > d.maxSize {
+			d.dropped += uint64(len(docs) - written)
+			logging.GetLogger().Errorf("Deadletter file %s full, %d flows lost", d.path, len(docs)-written)
+			break
+		}
+
+		if _, err := w.Write(doc); err != nil {
+			return written, err
+		}
+		if err := w.WriteByte('\n'); err != nil {
+			return written, err
+		}
+		d.size += int64(len(doc)) + 1
+		written++
+	}
+
+	return written, w.Flush()
+}
+
+func (d *deadLetter) close() error {
+	return d.file.Close()
+}
+
+func newDeadLetter(path string, maxSize int64) (*deadLetter, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &deadLetter{path: path, file: file, size: info.Size(), maxSize: maxSize}, nil
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package elasticseach
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	elastigo "github.com/mattbaird/elastigo/lib"
+)
+
+func bulkRequest(t *testing.T) []byte {
+	var buf bytes.Buffer
+	for _, doc := range []struct {
+		docType string
+		id      string
+	}{{"flow", "flow1"}, {"metric", "flow1-10"}, {"flow", "flow2"}} {
+		data, err := elastigo.WriteBulkBytes("index", "skydive", doc.docType, doc.id, "", "", nil, map[string]string{"UUID": doc.id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf.Write(data)
+	}
+	return buf.Bytes()
+}
+
+func TestBulkDocuments(t *testing.T) {
+	docs := bulkDocuments(bulkRequest(t), "flow")
+	if len(docs) != 2 || string(docs[0]) != `{"UUID":"flow1"}` || string(docs[1]) != `{"UUID":"flow2"}` {
+		t.Errorf("Expected the 2 flow documents, got %q", docs)
+	}
+}
+
+func TestBulkFailedItems(t *testing.T) {
+	response := `{"errors":true,"items":[
+		{"index":{"_id":"flow1","status":201}},
+		{"index":{"_id":"flow1-10","status":429}},
+		{"index":{"_id":"flow2","status":200}}]}`
+
+	err := checkBulkResponse([]byte(response))
+	ie, ok := err.(*bulkItemsError)
+	if !ok || len(ie.failed) != 1 || ie.failed[0] != 1 {
+		t.Fatalf("Expected the second item to fail, got %v", err)
+	}
+
+	// only the failed metric is kept, not the indexed flows
+	data := bulkItems(bulkRequest(t), ie.failed)
+	if docs := bulkDocuments(data, "flow"); len(docs) != 0 {
+		t.Errorf("Expected no flow to be dead-lettered, got %q", docs)
+	}
+	if docs := bulkDocuments(data, "metric"); len(docs) != 1 || string(docs[0]) != `{"UUID":"flow1-10"}` {
+		t.Errorf("Expected the failed metric, got %q", docs)
+	}
+
+	if err := checkBulkResponse([]byte(`{"errors":false,"items":[]}`)); err != nil {
+		t.Errorf("Expected no error, got %s", err.Error())
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skydive-deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "deadletter.json")
+	dl, err := newDeadLetter(path, 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	docs := bulkDocuments(bulkRequest(t), "flow")
+	if n, err := dl.write(docs); err != nil || n != 2 {
+		t.Fatalf("Expected 2 flows written, got %d (%v)", n, err)
+	}
+	dl.close()
+
+	// the size of the existing file is accounted
+	if dl, err = newDeadLetter(path, 40); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := dl.write(docs); n != 0 || dl.dropped != 2 {
+		t.Errorf("Expected the flows to be dropped once the file is full, %d written", n)
+	}
+	dl.close()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "{\"UUID\":\"flow1\"}\n{\"UUID\":\"flow2\"}\n" {
+		t.Errorf("Unexpected deadletter content: %q", data)
+	}
+}
@@ -23,11 +23,15 @@
 package elasticseach
 
 import (
+	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -39,12 +43,27 @@ import (
 	"github.com/redhat-cip/skydive/storage"
 )
 
-const indexVersion = 1
+const indexVersion = 4
+
+const probePathSearchSize = 100
+
+// the maximum window of results of a default elasticsearch index, the
+// searches returning more results are scrolled by pages of that size
+const sinceSearchSize = 10000
+
+// how long elasticsearch keeps the context of a scrolled search between two
+// pages
+const scrollTimeout = "1m"
 
 const mapping = `
 {"mappings":{"flow":{"dynamic_templates":[
 	{"notanalyzed_graph":{"match":"*GraphPath","mapping":{"type":"string","index":"not_analyzed"}}},
 	{"notanalyzed_layers":{"match":"LayersPath","mapping":{"type":"string","index":"not_analyzed"}}},
+	{"notanalyzed_host":{"match":"Host","mapping":{"type":"string","index":"not_analyzed"}}},
+	{"start_epoch":{"match":"Start","mapping":{"type":"date", "format": "epoch_second"}}},
+	{"last_epoch":{"match":"Last","mapping":{"type":"date", "format": "epoch_second"}}}
+]},"metric":{"dynamic_templates":[
+	{"notanalyzed_uuid":{"match":"UUID","mapping":{"type":"string","index":"not_analyzed"}}},
 	{"start_epoch":{"match":"Start","mapping":{"type":"date", "format": "epoch_second"}}},
 	{"last_epoch":{"match":"Last","mapping":{"type":"date", "format": "epoch_second"}}}
 ]}}}
@@ -54,6 +73,14 @@ type ElasticSearchStorage struct {
 	connection *elastigo.Conn
 	indexer    *elastigo.BulkIndexer
 	started    atomic.Value
+	compress   atomic.Value
+	deadLetter *deadLetter
+	retention  int
+	quit       chan bool
+
+	// last document of the flows, by UUID, see moveFlows
+	flowDocs     map[string]flowDocument
+	flowDocsLock sync.Mutex
 }
 
 func (c *ElasticSearchStorage) StoreFlows(flows []*flow.Flow) error {
@@ -62,13 +89,18 @@ func (c *ElasticSearchStorage) StoreFlows(flows []*flow.Flow) error {
 	}
 
 	for _, flow := range flows {
-		err := c.indexer.Index("skydive", "flow", flow.UUID, "", "", nil, flow)
+		err := c.indexer.Index(flowIndex(flow), "flow", flow.UUID, "", "", nil, flow)
 		if err != nil {
 			logging.GetLogger().Errorf("Error while indexing: %s", err.Error())
 			continue
 		}
 	}
 
+	// the flows updated on another day are stored in a new index
+	if moved := c.moveFlows(flows); len(moved) > 0 {
+		go c.deleteMovedFlows(moved)
+	}
+
 	return nil
 }
 
@@ -101,6 +133,340 @@ func (c *ElasticSearchStorage) SearchFlows(filters storage.Filters) ([]*flow.Flo
 		}
 	}
 
+	return c.search(query)
+}
+
+// SearchFlowsByProbePath returns the flows captured at the given probe graph
+// path, or under it when prefix is set
+func (c *ElasticSearchStorage) SearchFlowsByProbePath(path string, prefix bool) ([]*flow.Flow, error) {
+	if c.started.Load() != true {
+		return nil, errors.New("ElasticSearchStorage is not yet started")
+	}
+
+	match := "term"
+	if prefix {
+		match = "prefix"
+	}
+
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			match: map[string]interface{}{
+				"ProbeGraphPath": path,
+			},
+		},
+		"sort": map[string]interface{}{
+			"Statistics.Last": map[string]string{
+				"order": "desc",
+			},
+		},
+		"from": 0,
+		"size": probePathSearchSize,
+	}
+
+	return c.search(query)
+}
+
+// SearchFlowsSince returns all the flows matching all the term filters and
+// updated since the given epoch second
+func (c *ElasticSearchStorage) SearchFlowsSince(filters storage.Filters, since int64) ([]*flow.Flow, error) {
+	if c.started.Load() != true {
+		return nil, errors.New("ElasticSearchStorage is not yet started")
+	}
+
+	must := []interface{}{
+		map[string]interface{}{
+			"range": map[string]interface{}{
+				"Statistics.Last": map[string]int64{
+					"gte": since,
+				},
+			},
+		},
+	}
+	for k, v := range filters {
+		must = append(must, map[string]interface{}{
+			"term": map[string]interface{}{
+				k: v,
+			},
+		})
+	}
+
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"must": must,
+			},
+		},
+		"sort": map[string]interface{}{
+			"Statistics.Last": map[string]string{
+				"order": "desc",
+			},
+		},
+	}
+
+	sources, err := c.scroll("flow", query)
+	if err != nil {
+		return nil, err
+	}
+
+	flows := make([]*flow.Flow, len(sources))
+	for i, source := range sources {
+		flows[i] = new(flow.Flow)
+		if err := json.Unmarshal(*source, flows[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return flows, nil
+}
+
+// GetFlow returns the stored flow with the given UUID, or nil if there is
+// no such flow
+func (c *ElasticSearchStorage) GetFlow(uuid string) (*flow.Flow, error) {
+	if c.started.Load() != true {
+		return nil, errors.New("ElasticSearchStorage is not yet started")
+	}
+
+	// the alias spans several indices, the flow can't be got directly
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"ids": map[string]interface{}{
+				"values": []string{uuid},
+			},
+		},
+		"size": 1,
+	}
+
+	flows, err := c.search(query)
+	if err != nil || len(flows) == 0 {
+		return nil, err
+	}
+
+	return flows[0], nil
+}
+
+// StoreMetrics stores the packets and bytes of the flows per update window,
+// one document per flow and window
+func (c *ElasticSearchStorage) StoreMetrics(metrics []*flow.FlowMetric) error {
+	if c.started.Load() != true {
+		return errors.New("ElasticSearchStorage is not yet started")
+	}
+
+	for _, m := range metrics {
+		id := fmt.Sprintf("%s-%d", m.UUID, m.Last)
+		if err := c.indexer.Index(dailyIndex(m.Last), "metric", id, "", "", nil, m); err != nil {
+			logging.GetLogger().Errorf("Error while indexing: %s", err.Error())
+			continue
+		}
+	}
+
+	return nil
+}
+
+// SearchMetrics returns the metrics of the flow whose window ended between
+// from and to, epoch seconds, sorted by window
+func (c *ElasticSearchStorage) SearchMetrics(uuid string, from int64, to int64) ([]*flow.FlowMetric, error) {
+	if c.started.Load() != true {
+		return nil, errors.New("ElasticSearchStorage is not yet started")
+	}
+
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"must": []interface{}{
+					map[string]interface{}{
+						"term": map[string]interface{}{
+							"UUID": uuid,
+						},
+					},
+					map[string]interface{}{
+						"range": map[string]interface{}{
+							"Last": map[string]int64{
+								"gte": from,
+								"lte": to,
+							},
+						},
+					},
+				},
+			},
+		},
+		"sort": map[string]interface{}{
+			"Last": map[string]string{
+				"order": "asc",
+			},
+		},
+	}
+
+	sources, err := c.scroll("metric", query)
+	if err != nil {
+		return nil, err
+	}
+
+	metrics := make([]*flow.FlowMetric, len(sources))
+	for i, source := range sources {
+		metrics[i] = new(flow.FlowMetric)
+		if err := json.Unmarshal(*source, metrics[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return metrics, nil
+}
+
+// metricBuckets is the date histogram of the metrics as returned by
+// elasticsearch, keyed by the start of the bucket in milliseconds
+type metricBuckets struct {
+	Buckets struct {
+		Buckets []struct {
+			Key       int64
+			ABPackets struct{ Value float64 }
+			ABBytes   struct{ Value float64 }
+			BAPackets struct{ Value float64 }
+			BABytes   struct{ Value float64 }
+		}
+	}
+}
+
+// AggregateMetrics sums the metrics of the flows matching all the term
+// filters, whose window ended between from and to, per bucket of interval
+// seconds. Each bucket is returned as a metric without UUID spanning the
+// bucket, sorted by time.
+func (c *ElasticSearchStorage) AggregateMetrics(filters storage.Filters, from int64, to int64, interval int64) ([]*flow.FlowMetric, error) {
+	if c.started.Load() != true {
+		return nil, errors.New("ElasticSearchStorage is not yet started")
+	}
+
+	must := []interface{}{
+		map[string]interface{}{
+			"range": map[string]interface{}{
+				"Last": map[string]int64{
+					"gte": from,
+					"lte": to,
+				},
+			},
+		},
+	}
+
+	// the metrics only hold the UUID of their flow, the filters are
+	// applied to the flows updated within the range first
+	if len(filters) > 0 {
+		flows, err := c.SearchFlowsSince(filters, from)
+		if err != nil {
+			return nil, err
+		}
+		if len(flows) == 0 {
+			return []*flow.FlowMetric{}, nil
+		}
+
+		uuids := make([]string, len(flows))
+		for i, f := range flows {
+			uuids[i] = f.UUID
+		}
+		must = append(must, map[string]interface{}{
+			"terms": map[string]interface{}{
+				"UUID": uuids,
+			},
+		})
+	}
+
+	sums := make(map[string]interface{})
+	for _, field := range []string{"ABPackets", "ABBytes", "BAPackets", "BABytes"} {
+		sums[field] = map[string]interface{}{
+			"sum": map[string]string{
+				"field": field,
+			},
+		}
+	}
+
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"must": must,
+			},
+		},
+		"aggs": map[string]interface{}{
+			"Buckets": map[string]interface{}{
+				"date_histogram": map[string]interface{}{
+					"field":         "Last",
+					"interval":      fmt.Sprintf("%ds", interval),
+					"min_doc_count": 0,
+				},
+				"aggs": sums,
+			},
+		},
+		"size": 0,
+	}
+
+	q, err := json.Marshal(query)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := c.connection.Search("skydive", "metric", nil, string(q))
+	if err != nil {
+		return nil, err
+	}
+
+	metrics := []*flow.FlowMetric{}
+	if len(out.Aggregations) == 0 {
+		return metrics, nil
+	}
+
+	var aggs metricBuckets
+	if err := json.Unmarshal(out.Aggregations, &aggs); err != nil {
+		return nil, err
+	}
+
+	for _, b := range aggs.Buckets.Buckets {
+		start := b.Key / 1000
+		metrics = append(metrics, &flow.FlowMetric{
+			Start:     start,
+			Last:      start + interval,
+			ABPackets: uint64(b.ABPackets.Value),
+			ABBytes:   uint64(b.ABBytes.Value),
+			BAPackets: uint64(b.BAPackets.Value),
+			BABytes:   uint64(b.BABytes.Value),
+		})
+	}
+
+	return metrics, nil
+}
+
+// scroll returns the sources of all the documents of the given type matching
+// the query, fetched by pages of sinceSearchSize documents
+func (c *ElasticSearchStorage) scroll(docType string, query map[string]interface{}) ([]*json.RawMessage, error) {
+	query["size"] = sinceSearchSize
+	q, err := json.Marshal(query)
+	if err != nil {
+		return nil, err
+	}
+
+	args := map[string]interface{}{"scroll": scrollTimeout}
+	out, err := c.connection.Search("skydive", docType, args, string(q))
+	if err != nil {
+		return nil, err
+	}
+
+	var sources []*json.RawMessage
+	for {
+		for _, d := range out.Hits.Hits {
+			sources = append(sources, d.Source)
+		}
+
+		if len(out.Hits.Hits) == 0 || len(sources) >= out.Hits.Total {
+			return sources, nil
+		}
+
+		if out.ScrollId == "" {
+			return nil, fmt.Errorf("%d %s documents found but only %d could be retrieved", out.Hits.Total, docType, len(sources))
+		}
+
+		if out, err = c.connection.Scroll(args, out.ScrollId); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (c *ElasticSearchStorage) search(query map[string]interface{}) ([]*flow.Flow, error) {
 	q, err := json.Marshal(query)
 	if err != nil {
 		return nil, err
@@ -143,43 +509,51 @@ func (c *ElasticSearchStorage) request(method string, path string, query string,
 }
 
 func (c *ElasticSearchStorage) initialize() error {
-	indexPath := fmt.Sprintf("/skydive_v%d", indexVersion)
-
-	code, _, _ := c.request("GET", indexPath, "", "")
-	if code == 200 {
-		return nil
+	template, err := indexTemplate()
+	if err != nil {
+		return err
 	}
 
-	code, _, _ = c.request("PUT", indexPath, "", mapping)
+	templatePath := fmt.Sprintf("/_template/skydive_v%d", indexVersion)
+	code, _, _ := c.request("PUT", templatePath, "", template)
 	if code != 200 {
-		return errors.New("Unable to create the skydive index: " + strconv.FormatInt(int64(code), 10))
+		return errors.New("Unable to create the skydive index template: " + strconv.FormatInt(int64(code), 10))
 	}
 
-	aliases := `{"actions": [`
+	// the searches fail as long as the alias has no index
+	indexPath := "/" + dailyIndex(time.Now().Unix())
+	if code, _, _ = c.request("GET", indexPath, "", ""); code != 200 {
+		code, _, _ = c.request("PUT", indexPath, "", "")
+		if code != 200 {
+			return errors.New("Unable to create the skydive index: " + strconv.FormatInt(int64(code), 10))
+		}
+	}
 
-	code, data, _ := c.request("GET", "/_aliases", "", "")
-	if code == 200 {
-		var current map[string]interface{}
+	indices, err := c.indices()
+	if err != nil {
+		return err
+	}
 
-		err := json.Unmarshal(data, &current)
-		if err != nil {
-			return errors.New("Unable to parse aliases: " + err.Error())
+	// the indices of the previous versions aren't searched anymore
+	var removes []string
+	for index, aliases := range indices {
+		if strings.HasPrefix(index, indexPrefix()) {
+			continue
 		}
-
-		for k := range current {
-			if strings.HasPrefix(k, "skydive_") {
-				remove := `{"remove":{"alias": "skydive", "index": "%s"}},`
-				aliases += fmt.Sprintf(remove, k)
+		for _, alias := range aliases {
+			if alias == "skydive" {
+				remove := `{"remove":{"alias": "skydive", "index": "%s"}}`
+				removes = append(removes, fmt.Sprintf(remove, index))
 			}
 		}
 	}
 
-	add := `{"add":{"alias": "skydive", "index": "skydive_v%d"}}]}`
-	aliases += fmt.Sprintf(add, indexVersion)
-
-	code, _, _ = c.request("POST", "/_aliases", "", aliases)
-	if code != 200 {
-		return errors.New("Unable to create an alias to the skydive index: " + strconv.FormatInt(int64(code), 10))
+	if len(removes) > 0 {
+		aliases := `{"actions": [` + strings.Join(removes, ",") + `]}`
+		code, _, _ = c.request("POST", "/_aliases", "", aliases)
+		if code != 200 {
+			return errors.New("Unable to remove the previous skydive indices from the alias: " + strconv.FormatInt(int64(code), 10))
+		}
 	}
 
 	logging.GetLogger().Infof("ElasticSearchStorage started")
@@ -187,6 +561,95 @@ func (c *ElasticSearchStorage) initialize() error {
 	return nil
 }
 
+// sendCompressed sends the bulk requests gzip compressed, if Elasticsearch
+// rejects the compressed request the compression is disabled and the request
+// is sent again uncompressed. Other failures, like an overloaded cluster,
+// are returned for the indexer to retry.
+func (c *ElasticSearchStorage) sendCompressed(buf *bytes.Buffer) error {
+	if c.compress.Load() != true {
+		return c.sendBulk(buf)
+	}
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	if buf.Len() > 0 {
+		logging.GetLogger().Debugf("Elasticsearch bulk request compressed from %d to %d bytes (%.1f%%)",
+			buf.Len(), gz.Len(), float64(gz.Len())*100/float64(buf.Len()))
+	}
+
+	req, err := c.connection.NewRequest("POST", "/_bulk", "")
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "gzip")
+	req.SetBodyBytes(gz.Bytes())
+
+	code, data, err := req.Do(nil)
+	if err != nil {
+		return err
+	}
+
+	if rejectsCompression(code) {
+		logging.GetLogger().Warningf("Elasticsearch doesn't accept compressed requests (%d), disabling compression", code)
+		c.compress.Store(false)
+		return c.sendBulk(buf)
+	}
+
+	if code < 200 || code > 299 {
+		return fmt.Errorf("Bulk Insertion Error. Elasticsearch returned %d: %s", code, bytes.TrimSpace(data))
+	}
+
+	return checkBulkResponse(data)
+}
+
+// sendBulk sends the bulk requests uncompressed, like the indexer does but
+// reporting the items that failed, see checkBulkResponse
+func (c *ElasticSearchStorage) sendBulk(buf *bytes.Buffer) error {
+	body, err := c.connection.DoCommand("POST", "/_bulk", nil, buf)
+	if err != nil {
+		return err
+	}
+	return checkBulkResponse(body)
+}
+
+// rejectsCompression returns whether the status code of a compressed request
+// means that Elasticsearch doesn't support the gzip content encoding
+func rejectsCompression(code int) bool {
+	return code == http.StatusBadRequest || code == http.StatusUnsupportedMediaType
+}
+
+// handleErrors logs the bulk requests which failed after the retry of the
+// indexer and writes their flows to the deadletter file if enabled
+func (c *ElasticSearchStorage) handleErrors(ch chan *elastigo.ErrorBuffer) {
+	for {
+		select {
+		case e := <-ch:
+			logging.GetLogger().Errorf("Error while indexing: %s", e.Err.Error())
+
+			be, ok := e.Err.(*bulkError)
+			if !ok || c.deadLetter == nil {
+				continue
+			}
+
+			docs := bulkDocuments(be.data, "flow")
+			if n, err := c.deadLetter.write(docs); err != nil {
+				logging.GetLogger().Errorf("Unable to write %d flows to the deadletter file: %s", len(docs)-n, err.Error())
+			} else {
+				logging.GetLogger().Warningf("%d flows written to the deadletter file %s", n, c.deadLetter.path)
+			}
+		case <-c.quit:
+			return
+		}
+	}
+}
+
 var ErrBadConfig = errors.New("elasticseach : Config file is misconfigured, check elasticsearch key format")
 
 func (c *ElasticSearchStorage) start() {
@@ -201,7 +664,31 @@ func (c *ElasticSearchStorage) start() {
 	}
 
 	c.indexer = c.connection.NewBulkIndexerErrors(10, 60)
+	sender := c.sendBulk
+	if c.compress.Load() == true {
+		sender = c.sendCompressed
+	}
+	c.indexer.Sender = sender
+	if c.deadLetter != nil {
+		c.indexer.Sender = func(buf *bytes.Buffer) error {
+			data := append([]byte(nil), buf.Bytes()...)
+			if err := sender(buf); err != nil {
+				// only the items that failed are kept, the other ones
+				// being indexed
+				if ie, ok := err.(*bulkItemsError); ok {
+					data = bulkItems(data, ie.failed)
+				}
+				return &bulkError{err: err, data: data}
+			}
+			return nil
+		}
+	}
 	c.indexer.Start()
+	go c.handleErrors(c.indexer.ErrorChannel)
+	if c.retention > 0 {
+		go c.retain()
+	}
+	go c.forget()
 
 	c.started.Store(true)
 }
@@ -213,8 +700,12 @@ func (c *ElasticSearchStorage) Start() {
 func (c *ElasticSearchStorage) Stop() {
 	if c.started.Load() == true {
 		c.indexer.Stop()
+		close(c.quit)
 		c.connection.Close()
 	}
+	if c.deadLetter != nil {
+		c.deadLetter.close()
+	}
 }
 
 func New() (*ElasticSearchStorage, error) {
@@ -227,8 +718,22 @@ func New() (*ElasticSearchStorage, error) {
 	c.Domain = elasticonfig[0]
 	c.Port = elasticonfig[1]
 
-	storage := &ElasticSearchStorage{connection: c}
+	storage := &ElasticSearchStorage{
+		connection: c,
+		quit:       make(chan bool),
+		flowDocs:   make(map[string]flowDocument),
+	}
 	storage.started.Store(false)
+	if path := config.GetConfig().GetString("storage.elasticsearch_deadletter"); path != "" {
+		maxSize := int64(config.GetConfig().GetInt("storage.elasticsearch_deadletter_max_size")) * 1024 * 1024
+		dl, err := newDeadLetter(path, maxSize)
+		if err != nil {
+			return nil, err
+		}
+		storage.deadLetter = dl
+	}
+	storage.compress.Store(config.GetConfig().GetBool("storage.elasticsearch_compress"))
+	storage.retention = config.GetConfig().GetInt("storage.elasticsearch_retention")
 
 	return storage, nil
 }
@@ -0,0 +1,133 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package elasticseach
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	elastigo "github.com/mattbaird/elastigo/lib"
+)
+
+// newCompressedStorage returns a storage sending compressed bulk requests to
+// a server answering them with the given status code
+func newCompressedStorage(t *testing.T, code int) (*ElasticSearchStorage, *httptest.Server) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			w.WriteHeader(code)
+		}
+		w.Write([]byte(`{"errors":false,"items":[]}`))
+	}))
+
+	host, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &ElasticSearchStorage{connection: elastigo.NewConn()}
+	c.connection.Domain = host
+	c.connection.Port = port
+	c.indexer = c.connection.NewBulkIndexerErrors(10, 60)
+	c.compress.Store(true)
+
+	return c, server
+}
+
+func TestSendCompressedRejected(t *testing.T) {
+	for _, code := range []int{http.StatusBadRequest, http.StatusUnsupportedMediaType} {
+		c, server := newCompressedStorage(t, code)
+
+		if err := c.sendCompressed(bytes.NewBufferString("{}\n")); err != nil {
+			t.Errorf("Expected the request to be sent uncompressed, got %s", err.Error())
+		}
+		if c.compress.Load() == true {
+			t.Errorf("Expected the compression to be disabled after a %d", code)
+		}
+
+		server.Close()
+	}
+}
+
+func TestSendCompressedUnavailable(t *testing.T) {
+	for _, code := range []int{http.StatusTooManyRequests, http.StatusServiceUnavailable} {
+		c, server := newCompressedStorage(t, code)
+
+		if err := c.sendCompressed(bytes.NewBufferString("{}\n")); err == nil {
+			t.Errorf("Expected an error to retry after a %d", code)
+		}
+		if c.compress.Load() != true {
+			t.Errorf("Expected the compression to be kept after a %d", code)
+		}
+
+		server.Close()
+	}
+}
+
+func TestSearchFlowsSinceScroll(t *testing.T) {
+	// 3 flows returned by pages of 2 then an empty page
+	pages := []string{`"1","2"`, `"3"`, ``}
+	var scrolled []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/_search/scroll") {
+			scrolled = append(scrolled, r.URL.Query().Get("scroll"))
+		}
+
+		var hits []string
+		if len(pages[0]) > 0 {
+			for _, id := range strings.Split(pages[0], ",") {
+				hits = append(hits, fmt.Sprintf(`{"_id":%s,"_source":{"UUID":%s}}`, id, id))
+			}
+		}
+		pages = pages[1:]
+		fmt.Fprintf(w, `{"_scroll_id":"id","hits":{"total":3,"hits":[%s]}}`, strings.Join(hits, ","))
+	}))
+	defer server.Close()
+
+	host, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &ElasticSearchStorage{connection: elastigo.NewConn()}
+	c.connection.Domain = host
+	c.connection.Port = port
+	c.started.Store(true)
+
+	flows, err := c.SearchFlowsSince(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(flows) != 3 || flows[2].UUID != "3" {
+		t.Errorf("Expected the 3 flows of all the pages, got %v", flows)
+	}
+
+	if len(scrolled) != 1 || scrolled[0] != scrollTimeout {
+		t.Errorf("Expected the search to be scrolled once, got %v", scrolled)
+	}
+}
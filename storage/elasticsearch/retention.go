@@ -0,0 +1,236 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package elasticseach
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/redhat-cip/skydive/flow"
+	"github.com/redhat-cip/skydive/logging"
+)
+
+// the documents are stored in daily indices, created from a template adding
+// them to the skydive alias the searches are done on
+const indexDateFormat = "2006.01.02"
+
+// period of the deletion of the indices past the retention
+const retentionPeriod = time.Hour
+
+func indexPrefix() string {
+	return fmt.Sprintf("skydive_v%d-", indexVersion)
+}
+
+// dailyIndex returns the index of the documents of the day of the epoch
+// second, UTC
+func dailyIndex(epoch int64) string {
+	return indexPrefix() + time.Unix(epoch, 0).UTC().Format(indexDateFormat)
+}
+
+// flowIndex returns the index of the day the flow was last updated, like
+// its metrics, so that an update never recreates an expired index
+func flowIndex(f *flow.Flow) string {
+	if fs := f.GetStatistics(); fs != nil && fs.Last != 0 {
+		return dailyIndex(fs.Last)
+	}
+	return dailyIndex(time.Now().Unix())
+}
+
+// flowDocument locates the last document stored for a flow
+type flowDocument struct {
+	index string
+	last  int64
+}
+
+// moveFlows records the indices of the documents of the flows and returns
+// the documents, by flow UUID, left in the index of a previous day
+func (c *ElasticSearchStorage) moveFlows(flows []*flow.Flow) map[string]string {
+	c.flowDocsLock.Lock()
+	defer c.flowDocsLock.Unlock()
+
+	moved := make(map[string]string)
+	for _, f := range flows {
+		doc := flowDocument{index: flowIndex(f), last: time.Now().Unix()}
+		if fs := f.GetStatistics(); fs != nil && fs.Last != 0 {
+			doc.last = fs.Last
+		}
+		if prev, ok := c.flowDocs[f.UUID]; ok && prev.index != doc.index {
+			moved[f.UUID] = prev.index
+		}
+		c.flowDocs[f.UUID] = doc
+	}
+	return moved
+}
+
+// deleteMovedFlows deletes the documents left by the flows in the index of
+// a previous day
+func (c *ElasticSearchStorage) deleteMovedFlows(moved map[string]string) {
+	var body bytes.Buffer
+	for uuid, index := range moved {
+		fmt.Fprintf(&body, `{"delete":{"_index":"%s","_type":"flow","_id":"%s"}}`+"\n", index, uuid)
+	}
+
+	if _, err := c.connection.DoCommand("POST", "/_bulk", nil, &body); err != nil {
+		logging.GetLogger().Errorf("Unable to delete the previous documents of %d flows: %s", len(moved), err.Error())
+	}
+}
+
+// forgetFlows forgets the documents of the flows not updated for a day, long
+// expired, so that their next document can't be in another index
+func (c *ElasticSearchStorage) forgetFlows(now time.Time) {
+	limit := now.AddDate(0, 0, -1).Unix()
+
+	c.flowDocsLock.Lock()
+	for uuid, doc := range c.flowDocs {
+		if doc.last < limit {
+			delete(c.flowDocs, uuid)
+		}
+	}
+	c.flowDocsLock.Unlock()
+}
+
+// indexTemplate returns the template of the daily indices of the current
+// version
+func indexTemplate() (string, error) {
+	var template map[string]interface{}
+	if err := json.Unmarshal([]byte(mapping), &template); err != nil {
+		return "", err
+	}
+	template["template"] = indexPrefix() + "*"
+	template["aliases"] = map[string]interface{}{"skydive": map[string]interface{}{}}
+
+	data, err := json.Marshal(template)
+	return string(data), err
+}
+
+// expiredIndices returns the daily indices, of any version, whose documents
+// are all older than retention days
+func expiredIndices(indices []string, now time.Time, retention int) []string {
+	limit := now.AddDate(0, 0, -retention)
+
+	var expired []string
+	for _, index := range indices {
+		i := strings.LastIndex(index, "-")
+		if !strings.HasPrefix(index, "skydive_v") || i == -1 {
+			continue
+		}
+
+		day, err := time.Parse(indexDateFormat, index[i+1:])
+		if err != nil {
+			continue
+		}
+
+		if !day.AddDate(0, 0, 1).After(limit) {
+			expired = append(expired, index)
+		}
+	}
+
+	return expired
+}
+
+// indices returns the indices of elasticsearch with their aliases
+func (c *ElasticSearchStorage) indices() (map[string][]string, error) {
+	code, data, err := c.request("GET", "/_aliases", "", "")
+	if err != nil {
+		return nil, err
+	}
+	if code != 200 {
+		return nil, fmt.Errorf("Unable to get the indices: %d", code)
+	}
+
+	var current map[string]struct {
+		Aliases map[string]interface{} `json:"aliases"`
+	}
+	if err := json.Unmarshal(data, &current); err != nil {
+		return nil, fmt.Errorf("Unable to parse aliases: %s", err.Error())
+	}
+
+	indices := make(map[string][]string)
+	for index, a := range current {
+		aliases := []string{}
+		for alias := range a.Aliases {
+			aliases = append(aliases, alias)
+		}
+		indices[index] = aliases
+	}
+
+	return indices, nil
+}
+
+func (c *ElasticSearchStorage) deleteExpiredIndices() {
+	indices, err := c.indices()
+	if err != nil {
+		logging.GetLogger().Errorf("Unable to delete the expired indices: %s", err.Error())
+		return
+	}
+
+	names := make([]string, 0, len(indices))
+	for index := range indices {
+		names = append(names, index)
+	}
+
+	for _, index := range expiredIndices(names, time.Now(), c.retention) {
+		code, _, err := c.request("DELETE", "/"+index, "", "")
+		if err != nil || code != 200 {
+			logging.GetLogger().Errorf("Unable to delete the expired index %s: %d %v", index, code, err)
+			continue
+		}
+		logging.GetLogger().Infof("Expired index %s deleted", index)
+	}
+}
+
+// retain deletes the indices past the retention until the storage is stopped
+func (c *ElasticSearchStorage) retain() {
+	ticker := time.NewTicker(retentionPeriod)
+	defer ticker.Stop()
+
+	for {
+		c.deleteExpiredIndices()
+
+		select {
+		case <-ticker.C:
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+// forget forgets the documents of the long expired flows until the storage is
+// stopped, whatever the retention, so that the flows known never grow
+// unbounded
+func (c *ElasticSearchStorage) forget() {
+	ticker := time.NewTicker(retentionPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			c.forgetFlows(now)
+		case <-c.quit:
+			return
+		}
+	}
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package elasticseach
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/redhat-cip/skydive/flow"
+)
+
+func TestDailyIndex(t *testing.T) {
+	start := time.Date(2016, 7, 14, 23, 59, 0, 0, time.UTC)
+	expected := fmt.Sprintf("skydive_v%d-2016.07.15", indexVersion)
+
+	f := &flow.Flow{Statistics: &flow.FlowStatistics{Start: start.Unix(), Last: start.Add(time.Hour).Unix()}}
+	if index := flowIndex(f); index != expected {
+		t.Errorf("Flow should be stored in the index of the day it was last updated %s, got %s", expected, index)
+	}
+
+	template, err := indexTemplate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded map[string]interface{}
+	if err := json.Unmarshal([]byte(template), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded["template"] != fmt.Sprintf("skydive_v%d-*", indexVersion) || decoded["mappings"] == nil {
+		t.Errorf("Wrong index template: %s", template)
+	}
+}
+
+func TestMoveFlows(t *testing.T) {
+	c := &ElasticSearchStorage{flowDocs: make(map[string]flowDocument)}
+
+	start := time.Date(2016, 7, 14, 23, 59, 0, 0, time.UTC)
+	f := &flow.Flow{UUID: "flow1", Statistics: &flow.FlowStatistics{Start: start.Unix(), Last: start.Unix()}}
+	if moved := c.moveFlows([]*flow.Flow{f}); len(moved) != 0 {
+		t.Errorf("A new flow shouldn't be moved, got %v", moved)
+	}
+
+	// updated the next day, the document of the previous day is deleted
+	f.Statistics.Last = start.Add(time.Minute).Unix()
+	moved := c.moveFlows([]*flow.Flow{f})
+	if moved["flow1"] != dailyIndex(start.Unix()) {
+		t.Errorf("Expected the flow to be moved from %s, got %v", dailyIndex(start.Unix()), moved)
+	}
+
+	if moved := c.moveFlows([]*flow.Flow{f}); len(moved) != 0 {
+		t.Errorf("A flow updated the same day shouldn't be moved, got %v", moved)
+	}
+
+	c.forgetFlows(start.AddDate(0, 0, 1))
+	if len(c.flowDocs) != 1 {
+		t.Error("A flow updated within a day shouldn't be forgotten")
+	}
+	c.forgetFlows(start.AddDate(0, 0, 2))
+	if len(c.flowDocs) != 0 {
+		t.Error("A flow not updated for a day should be forgotten")
+	}
+}
+
+func TestExpiredIndices(t *testing.T) {
+	indices := []string{
+		"skydive_v3-2016.07.10",
+		"skydive_v4-2016.07.12",
+		"skydive_v4-2016.07.13",
+		"skydive_v4-2016.07.14",
+		"skydive_v3",
+		"other-2016.07.01",
+	}
+	now := time.Date(2016, 7, 14, 12, 0, 0, 0, time.UTC)
+
+	expired := expiredIndices(indices, now, 1)
+	if !reflect.DeepEqual(expired, []string{"skydive_v3-2016.07.10", "skydive_v4-2016.07.12"}) {
+		t.Errorf("Wrong expired indices: %v", expired)
+	}
+}
@@ -32,5 +32,11 @@ type Storage interface {
 	Start()
 	StoreFlows(flows []*flow.Flow) error
 	SearchFlows(filters Filters) ([]*flow.Flow, error)
+	SearchFlowsByProbePath(path string, prefix bool) ([]*flow.Flow, error)
+	SearchFlowsSince(filters Filters, since int64) ([]*flow.Flow, error)
+	GetFlow(uuid string) (*flow.Flow, error)
+	StoreMetrics(metrics []*flow.FlowMetric) error
+	SearchMetrics(uuid string, from int64, to int64) ([]*flow.FlowMetric, error)
+	AggregateMetrics(filters Filters, from int64, to int64, interval int64) ([]*flow.FlowMetric, error)
 	Stop()
 }
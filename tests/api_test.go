@@ -27,6 +27,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -161,12 +162,15 @@ func TestAlertApi(t *testing.T) {
 	}
 
 	alert := api.NewAlert()
+	alert.Name = "mtu"
+	alert.Select = "MTU"
+	alert.Test = "MTU > 1500"
 	if err := apiClient.create("alert", alert); err != nil {
 		t.Fatalf("Failed to create alert: %s", err.Error())
 	}
 
 	alert2 := api.NewAlert()
-	if err := apiClient.Get("alert", alert.UUID, &alert2); err != nil {
+	if err := apiClient.Get("alert", alert.UUID.String(), &alert2); err != nil {
 		t.Error(err)
 	}
 
@@ -183,11 +187,11 @@ func TestAlertApi(t *testing.T) {
 		}
 	}
 
-	if alerts[alert.UUID] != *alert {
-		t.Errorf("Alert corrupted: %+v != %+v", alerts[alert.UUID], alert)
+	if alerts[alert.UUID.String()] != *alert {
+		t.Errorf("Alert corrupted: %+v != %+v", alerts[alert.UUID.String()], alert)
 	}
 
-	if err := apiClient.Delete("alert", alert.UUID); err != nil {
+	if err := apiClient.Delete("alert", alert.UUID.String()); err != nil {
 		t.Errorf("Failed to delete alert: %s", err.Error())
 	}
 
@@ -201,6 +205,45 @@ func TestAlertApi(t *testing.T) {
 	}
 }
 
+func TestAlertApiValidation(t *testing.T) {
+	apiServer, err := createAPIServer(t, "noauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer apiServer.Stop()
+	apiClient, err := apiServer.GetClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alert := api.NewAlert()
+	alert.Name = "mtu"
+	alert.Select = "MTU"
+	alert.Test = "MTU > 1500"
+	if err := apiClient.create("alert", alert); err != nil {
+		t.Fatalf("Failed to create alert: %s", err.Error())
+	}
+	defer apiClient.Delete("alert", alert.UUID.String())
+
+	for field, update := range map[string]func(a *api.Alert){
+		"Name":   func(a *api.Alert) { a.Name = "" },
+		"Select": func(a *api.Alert) { a.Select = "" },
+		"Test":   func(a *api.Alert) { a.Test = "MTU >" },
+	} {
+		invalid := api.NewAlert()
+		invalid.Name = "invalid"
+		invalid.Select = "MTU"
+		invalid.Test = "MTU > 1500"
+		update(invalid)
+
+		err := apiClient.Create("alert", invalid)
+		if err == nil || !strings.Contains(err.Error(), field) {
+			t.Errorf("Expected an error on field %s, got %v", field, err)
+		}
+	}
+}
+
 func TestCaptureApi(t *testing.T) {
 	apiServer, err := createAPIServer(t, "basic")
 	if err != nil {
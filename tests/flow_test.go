@@ -25,6 +25,7 @@ package tests
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -136,6 +137,43 @@ func (s *TestStorage) SearchFlows(filters storage.Filters) ([]*flow.Flow, error)
 	return nil, nil
 }
 
+func (s *TestStorage) SearchFlowsByProbePath(path string, prefix bool) ([]*flow.Flow, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	flows := []*flow.Flow{}
+	for _, f := range s.flows {
+		if f.ProbeGraphPath == path || (prefix && strings.HasPrefix(f.ProbeGraphPath, path)) {
+			flows = append(flows, f)
+		}
+	}
+
+	return flows, nil
+}
+
+func (s *TestStorage) SearchFlowsSince(filters storage.Filters, since int64) ([]*flow.Flow, error) {
+	return nil, nil
+}
+
+func (s *TestStorage) GetFlow(uuid string) (*flow.Flow, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.flows[uuid], nil
+}
+
+func (s *TestStorage) StoreMetrics(metrics []*flow.FlowMetric) error {
+	return nil
+}
+
+func (s *TestStorage) SearchMetrics(uuid string, from int64, to int64) ([]*flow.FlowMetric, error) {
+	return nil, nil
+}
+
+func (s *TestStorage) AggregateMetrics(filters storage.Filters, from int64, to int64, interval int64) ([]*flow.FlowMetric, error) {
+	return nil, nil
+}
+
 func (s *TestStorage) GetFlows() []*flow.Flow {
 	s.lock.Lock()
 	defer s.lock.Unlock()
@@ -24,12 +24,12 @@ package helper
 
 import (
 	"bytes"
-	"fmt"
 	"html/template"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"os/exec"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -189,7 +189,7 @@ func NewAgent() *agent.Agent {
 func WaitApi(t *testing.T, analyzer *analyzer.Server) {
 	// waiting for the api endpoint
 	for i := 1; i <= 5; i++ {
-		url := fmt.Sprintf("http://%s:%d/api", analyzer.HTTPServer.Addr, analyzer.HTTPServer.Port)
+		url := "http://" + net.JoinHostPort(analyzer.HTTPServer.Addr, strconv.Itoa(analyzer.HTTPServer.Port)) + "/api"
 		_, err := http.Get(url)
 		if err == nil {
 			return
@@ -214,7 +214,7 @@ func sendPackets(conn *net.UDPConn, packets *[][]byte, sflowSampleSeq *uint32, s
 }
 
 func newUDPConnection(addr string, port int) (*net.UDPConn, error) {
-	srv, err := net.ResolveUDPAddr("udp", addr+":"+strconv.FormatInt(int64(port), 10))
+	srv, err := net.ResolveUDPAddr("udp", net.JoinHostPort(addr, strconv.Itoa(port)))
 	if err != nil {
 		return nil, err
 	}
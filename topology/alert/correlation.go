@@ -0,0 +1,88 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package alert
+
+import (
+	"time"
+
+	"github.com/redhat-cip/skydive/api"
+	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/topology"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// correlation is the id shared by the fires of the nodes owned by the same
+// host, from the first fire until the end of the correlation window
+type correlation struct {
+	id       string
+	deadline time.Time
+}
+
+// ownerKey returns the node path of the host owning all the nodes, empty if
+// they are not owned by a single host. Must be called under graph lock.
+func (a *AlertManager) ownerKey(nodes []*graph.Node) string {
+	var key string
+	for _, n := range nodes {
+		path := a.Graph.LookupShortestPath(n, graph.Metadata{"Type": "host"}, topology.IsOwnershipEdge)
+		if len(path) == 0 {
+			return ""
+		}
+
+		owner := topology.NodePath{Nodes: path[len(path)-1:]}.Marshal()
+		if key != "" && owner != key {
+			return ""
+		}
+		key = owner
+	}
+
+	return key
+}
+
+// correlationID returns the id correlating a fire on the nodes with the
+// other fires of their host, empty when the correlation is disabled or the
+// nodes don't share a host. Must be called under graph lock and alertsLock.
+func (a *AlertManager) correlationID(nodes []*graph.Node, now time.Time) string {
+	window := time.Duration(config.GetConfig().GetInt("analyzer.alert_correlation_window")) * time.Second
+	if window <= 0 {
+		return ""
+	}
+
+	key := a.ownerKey(nodes)
+	if key == "" {
+		return ""
+	}
+
+	for k, c := range a.correlations {
+		if !now.Before(c.deadline) {
+			delete(a.correlations, k)
+		}
+	}
+
+	c, ok := a.correlations[key]
+	if !ok {
+		c = &correlation{id: api.NewUUID().String(), deadline: now.Add(window)}
+		a.correlations[key] = c
+	}
+
+	return c.id
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package alert
+
+import (
+	"testing"
+	"time"
+
+	"github.com/redhat-cip/skydive/api"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+func TestCorrelation(t *testing.T) {
+	g := newGraph(t)
+
+	ownership := graph.Metadata{"RelationType": "ownership"}
+	for _, host := range []string{"host1", "host2"} {
+		h := g.NewNode(graph.GenID(), graph.Metadata{"Name": host, "Type": "host"})
+		for _, name := range []string{"eth0", "eth1"} {
+			n := g.NewNode(graph.GenID(), graph.Metadata{"Name": name, "Type": "device", "Host": host, "State": "DOWN"})
+			g.Link(h, n, ownership)
+		}
+	}
+
+	a := newAlertManager(t, g, nil)
+	l := &fakeAlertListener{}
+	a.AddEventListener(l)
+
+	al := api.NewAlert()
+	al.Select = "State"
+	al.Test = `State == "DOWN"`
+	a.SetAlert(al)
+
+	a.ForceEvaluate()
+	if len(l.messages) != 4 {
+		t.Fatalf("Expected 4 messages, got %v", l.messages)
+	}
+
+	ids := make(map[string]string)
+	for _, msg := range l.messages {
+		host := msg.ReasonData.(*graph.Node).Metadata()["Host"].(string)
+		if msg.CorrelationID == "" {
+			t.Fatalf("Correlation id expected: %v", msg)
+		}
+		if id, ok := ids[host]; ok && id != msg.CorrelationID {
+			t.Errorf("The messages of %s should share a correlation id: %s != %s", host, id, msg.CorrelationID)
+		}
+		ids[host] = msg.CorrelationID
+	}
+	if ids["host1"] == ids["host2"] {
+		t.Error("The messages of distinct hosts shouldn't be correlated")
+	}
+
+	// a new incident starts once the window expired
+	g.RLock()
+	nodes := g.LookupNodes(graph.Metadata{"Host": "host1"})
+	a.alertsLock.Lock()
+	later := a.correlationID(nodes[:1], time.Now().Add(61*time.Second))
+	mixed := a.correlationID(g.LookupNodes(graph.Metadata{"Name": "eth0"}), time.Now())
+	a.alertsLock.Unlock()
+	g.RUnlock()
+
+	if later == "" || later == ids["host1"] {
+		t.Errorf("Expected a new correlation id after the window, got %s", later)
+	}
+	if mixed != "" {
+		t.Errorf("Nodes of distinct hosts shouldn't be correlated, got %s", mixed)
+	}
+}
@@ -0,0 +1,171 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package alert
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redhat-cip/skydive/api"
+	"github.com/redhat-cip/skydive/common"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+const defaultDeltaWindow = time.Minute
+
+// deltaSample is the value of a numeric metadata since the given time
+type deltaSample struct {
+	time  time.Time
+	value float64
+}
+
+// deltaHistory keeps the past values of the numeric metadata used by the
+// threshold alerts, per node and per metadata key. A sample is only stored
+// when the value changes.
+type deltaHistory struct {
+	sync.Mutex
+	samples map[graph.Identifier]map[string][]deltaSample
+}
+
+// deltaFields returns the metadata keys whose delta is requested by the alert
+func deltaFields(al *api.Alert) []string {
+	if al.Type != THRESHOLD {
+		return nil
+	}
+
+	var fields []string
+	for _, f := range strings.Split(al.Delta, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+func deltaWindow(al *api.Alert) time.Duration {
+	if al.DeltaWindow > 0 {
+		return time.Duration(al.DeltaWindow) * time.Second
+	}
+	return defaultDeltaWindow
+}
+
+// record stores the current value of the key, the samples older than the
+// retention are removed except the latest one used as baseline
+func (h *deltaHistory) record(id graph.Identifier, key string, value float64, now time.Time, retention time.Duration) {
+	h.Lock()
+	defer h.Unlock()
+
+	node, ok := h.samples[id]
+	if !ok {
+		node = make(map[string][]deltaSample)
+		h.samples[id] = node
+	}
+
+	samples := node[key]
+	if len(samples) == 0 || samples[len(samples)-1].value != value {
+		samples = append(samples, deltaSample{time: now, value: value})
+	}
+
+	limit := now.Add(-retention)
+	i := 0
+	for i+1 < len(samples) && !samples[i+1].time.After(limit) {
+		i++
+	}
+	node[key] = samples[i:]
+}
+
+// delta returns the variation of the key over the window and the rate per
+// second of this variation. The oldest known value is used as baseline when
+// the history doesn't cover the whole window.
+func (h *deltaHistory) delta(id graph.Identifier, key string, now time.Time, window time.Duration) (float64, float64) {
+	h.Lock()
+	defer h.Unlock()
+
+	samples := h.samples[id][key]
+	if len(samples) == 0 {
+		return 0, 0
+	}
+
+	limit := now.Add(-window)
+	baseline := samples[0]
+	for _, s := range samples[1:] {
+		if s.time.After(limit) {
+			break
+		}
+		baseline = s
+	}
+
+	delta := samples[len(samples)-1].value - baseline.value
+
+	elapsed := now.Sub(baseline.time)
+	if elapsed > window {
+		elapsed = window
+	}
+	if elapsed <= 0 {
+		return delta, 0
+	}
+
+	return delta, delta / elapsed.Seconds()
+}
+
+func (h *deltaHistory) evict(id graph.Identifier) {
+	h.Lock()
+	defer h.Unlock()
+
+	delete(h.samples, id)
+}
+
+// deltaValues returns the node values completed with the delta and the rate
+// of the requested metadata, ex: ifInErrors_delta and ifInErrors_rate
+func (h *deltaHistory) deltaValues(al *api.Alert, n *graph.Node, values map[string]interface{}, now time.Time, retention time.Duration) map[string]interface{} {
+	fields := deltaFields(al)
+	if len(fields) == 0 {
+		return values
+	}
+
+	merged := make(map[string]interface{})
+	for k, v := range values {
+		merged[k] = v
+	}
+
+	for _, field := range fields {
+		value, err := common.ToFloat64(n.Metadata()[field])
+		if err != nil {
+			continue
+		}
+
+		h.record(n.ID, field, value, now, retention)
+		delta, rate := h.delta(n.ID, field, now, deltaWindow(al))
+		merged[field+"_delta"] = delta
+		merged[field+"_rate"] = rate
+	}
+
+	return merged
+}
+
+func newDeltaHistory() *deltaHistory {
+	return &deltaHistory{
+		samples: make(map[graph.Identifier]map[string][]deltaSample),
+	}
+}
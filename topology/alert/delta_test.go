@@ -0,0 +1,89 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package alert
+
+import (
+	"testing"
+	"time"
+
+	"github.com/redhat-cip/skydive/api"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+func TestDeltaHistory(t *testing.T) {
+	h := newDeltaHistory()
+	id := graph.Identifier("node")
+	start := time.Now()
+
+	for i, value := range []float64{10, 10, 40, 100} {
+		h.record(id, "ifInErrors", value, start.Add(time.Duration(i)*30*time.Second), time.Minute)
+	}
+
+	// value at start+30s was 10, now 100 at start+90s
+	now := start.Add(90 * time.Second)
+	if delta, rate := h.delta(id, "ifInErrors", now, time.Minute); delta != 90 || rate != 1.5 {
+		t.Errorf("Expected a delta of 90 and a rate of 1.5, got %f and %f", delta, rate)
+	}
+
+	if samples := h.samples[id]["ifInErrors"]; len(samples) != 3 {
+		t.Errorf("Expected the samples older than the retention to be pruned, got %v", samples)
+	}
+
+	h.evict(id)
+	if delta, rate := h.delta(id, "ifInErrors", now, time.Minute); delta != 0 || rate != 0 {
+		t.Errorf("Expected no delta after eviction, got %f and %f", delta, rate)
+	}
+}
+
+func TestDeltaAlert(t *testing.T) {
+	g := newGraph(t)
+	n := g.NewNode(graph.GenID(), graph.Metadata{"Type": "device", "ifInErrors": 10})
+
+	a := newAlertManager(t, g, nil)
+	l := &fakeAlertListener{}
+	a.AddEventListener(l)
+
+	al := api.NewAlert()
+	al.Type = THRESHOLD
+	al.Select = "ifInErrors"
+	al.Test = "ifInErrors_delta > 100"
+	al.Delta = "ifInErrors"
+	a.SetAlert(al)
+
+	if fired := a.ForceEvaluate(); fired != 0 {
+		t.Fatalf("Alert shouldn't fire without variation, got %d", fired)
+	}
+
+	g.Lock()
+	g.AddMetadata(n, "ifInErrors", 200)
+	g.Unlock()
+
+	if fired := a.ForceEvaluate(); fired != 1 {
+		t.Fatalf("Alert should fire on the variation, got %d", fired)
+	}
+
+	a.OnNodeDeleted(n)
+	if _, ok := a.deltas.samples[n.ID]; ok {
+		t.Error("History of deleted node should be evicted")
+	}
+}
@@ -0,0 +1,173 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package alert
+
+import (
+	"net/url"
+	"time"
+
+	"github.com/redhat-cip/skydive/api"
+	"github.com/redhat-cip/skydive/flow"
+	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/storage"
+)
+
+const defaultFlowWindow = 5 * time.Minute
+
+// flowWindow returns the duration during which the flows tested by the alert
+// have to be updated
+func flowWindow(al *api.Alert) time.Duration {
+	if al.FlowWindow > 0 {
+		return time.Duration(al.FlowWindow) * time.Second
+	}
+	return defaultFlowWindow
+}
+
+// flowFilters returns the storage term filters of the URL encoded Select of
+// a flow alert, ex: LayersPath=Ethernet/IPv4/TCP&ProbeGraphPath=host1
+func flowFilters(al *api.Alert) (storage.Filters, error) {
+	query, err := url.ParseQuery(al.Select)
+	if err != nil {
+		return nil, err
+	}
+
+	filters := make(storage.Filters)
+	for k, v := range query {
+		filters[k] = v[0]
+	}
+	return filters, nil
+}
+
+// flowValues returns the constants available to flow alerts: flowCount the
+// number of flows, flowBytes and flowPackets the link layer bytes and packets
+// of the flows in both directions, counted by the metrics of the window only
+// so that the traffic of the long-lived flows prior to it is ignored.
+func flowValues(flows []*flow.Flow, metrics []*flow.FlowMetric) map[string]interface{} {
+	var bytes, packets float64
+	for _, m := range metrics {
+		bytes += float64(m.ABBytes + m.BABytes)
+		packets += float64(m.ABPackets + m.BAPackets)
+	}
+
+	return map[string]interface{}{
+		"flowCount":   len(flows),
+		"flowBytes":   bytes,
+		"flowPackets": packets,
+	}
+}
+
+// evalFlowTest tests a flow alert, recovering from a panic of the evaluation
+func evalFlowTest(al *api.Alert, values map[string]interface{}) (ok bool, panicked interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			panicked = r
+		}
+	}()
+
+	ok, err = evalTest(al.Test, values)
+	return
+}
+
+// evalFlowAlerts tests the enabled flow alerts against the flows stored
+// during their window and returns how many fired. The storage is queried
+// without holding the alerts lock.
+func (a *AlertManager) evalFlowAlerts(now time.Time) int {
+	if a.Storage == nil {
+		return 0
+	}
+
+	a.alertsLock.RLock()
+	var alerts []api.Alert
+	for _, al := range a.alerts {
+		if _, unhealthy := a.unhealthy[al.UUID]; al.Enabled && al.Type == FLOW && !unhealthy {
+			alerts = append(alerts, *al)
+		}
+	}
+	a.alertsLock.RUnlock()
+
+	fired := 0
+	for _, al := range alerts {
+		filters, err := flowFilters(&al)
+		if err != nil {
+			logging.GetLogger().Errorf("Invalid flow alert select %s", logging.Fields("alert_uuid", al.UUID, "error", err))
+			a.recordFlowEval(al.UUID, now, err)
+			continue
+		}
+
+		window := flowWindow(&al)
+		since := now.Add(-window).Unix()
+		flows, err := a.Storage.SearchFlowsSince(filters, since)
+		if err != nil {
+			logging.GetLogger().Errorf("Unable to search the flows of alert %s", logging.Fields("alert_uuid", al.UUID, "error", err))
+			a.recordFlowEval(al.UUID, now, err)
+			continue
+		}
+
+		// a single bucket spanning the window, or two if not aligned
+		metrics, err := a.Storage.AggregateMetrics(filters, since, now.Unix(), int64(window/time.Second))
+		if err != nil {
+			logging.GetLogger().Errorf("Unable to aggregate the flow metrics of alert %s", logging.Fields("alert_uuid", al.UUID, "error", err))
+			a.recordFlowEval(al.UUID, now, err)
+			continue
+		}
+
+		values := flowValues(flows, metrics)
+		ok, panicked, err := evalFlowTest(&al, values)
+		if panicked != nil {
+			a.alertsLock.Lock()
+			if _, found := a.alerts[al.UUID]; found {
+				a.recordEval(al.UUID, now, nil)
+				a.markUnhealthy(&al, panicked)
+			}
+			a.alertsLock.Unlock()
+			continue
+		}
+		if err != nil {
+			logging.GetLogger().Errorf("Unable to evaluate alert test %s", logging.Fields("alert_uuid", al.UUID, "flow_count", len(flows), "error", err))
+		}
+
+		if !ok {
+			a.recordFlowEval(al.UUID, now, err)
+			continue
+		}
+
+		// the alert may have been updated or deleted meanwhile
+		a.alertsLock.Lock()
+		a.recordEval(al.UUID, now, nil)
+		if stored, found := a.alerts[al.UUID]; found && stored.Enabled && stored.Type == FLOW {
+			a.notify(stored, FLOW, "", values, flows)
+			fired++
+		}
+		a.alertsLock.Unlock()
+	}
+
+	return fired
+}
+
+// recordFlowEval records the result of the evaluation of a flow alert
+func (a *AlertManager) recordFlowEval(id api.UUID, now time.Time, err error) {
+	a.alertsLock.Lock()
+	defer a.alertsLock.Unlock()
+
+	a.recordEval(id, now, err)
+}
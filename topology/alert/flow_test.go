@@ -0,0 +1,137 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package alert
+
+import (
+	"testing"
+	"time"
+
+	"github.com/redhat-cip/skydive/api"
+	"github.com/redhat-cip/skydive/flow"
+	"github.com/redhat-cip/skydive/storage"
+)
+
+type fakeFlowStorage struct {
+	filters  storage.Filters
+	since    int64
+	flows    []*flow.Flow
+	interval int64
+	metrics  []*flow.FlowMetric
+}
+
+func (s *fakeFlowStorage) Start() {
+}
+
+func (s *fakeFlowStorage) Stop() {
+}
+
+func (s *fakeFlowStorage) StoreFlows(flows []*flow.Flow) error {
+	return nil
+}
+
+func (s *fakeFlowStorage) SearchFlows(filters storage.Filters) ([]*flow.Flow, error) {
+	return nil, nil
+}
+
+func (s *fakeFlowStorage) SearchFlowsByProbePath(path string, prefix bool) ([]*flow.Flow, error) {
+	return nil, nil
+}
+
+func (s *fakeFlowStorage) SearchFlowsSince(filters storage.Filters, since int64) ([]*flow.Flow, error) {
+	s.filters, s.since = filters, since
+	return s.flows, nil
+}
+
+func (s *fakeFlowStorage) GetFlow(uuid string) (*flow.Flow, error) {
+	return nil, nil
+}
+
+func (s *fakeFlowStorage) StoreMetrics(metrics []*flow.FlowMetric) error {
+	return nil
+}
+
+func (s *fakeFlowStorage) SearchMetrics(uuid string, from int64, to int64) ([]*flow.FlowMetric, error) {
+	return nil, nil
+}
+
+func (s *fakeFlowStorage) AggregateMetrics(filters storage.Filters, from int64, to int64, interval int64) ([]*flow.FlowMetric, error) {
+	s.interval = interval
+	return s.metrics, nil
+}
+
+func newStoredFlow(bytes uint64) *flow.Flow {
+	return &flow.Flow{
+		Statistics: &flow.FlowStatistics{
+			Endpoints: []*flow.FlowEndpointsStatistics{
+				{
+					Type: flow.FlowEndpointType_ETHERNET,
+					AB:   &flow.FlowEndpointStatistics{Bytes: bytes, Packets: 1},
+					BA:   &flow.FlowEndpointStatistics{Bytes: bytes, Packets: 1},
+				},
+			},
+		},
+	}
+}
+
+func TestFlowAlert(t *testing.T) {
+	// the totals of the flows since their start are ignored, only the
+	// metrics of the window are counted
+	st := &fakeFlowStorage{
+		flows: []*flow.Flow{newStoredFlow(1000000), newStoredFlow(500000)},
+		metrics: []*flow.FlowMetric{
+			{ABBytes: 1000, BABytes: 1000, ABPackets: 1, BAPackets: 1},
+			{ABBytes: 500, BABytes: 500, ABPackets: 1, BAPackets: 1},
+		},
+	}
+
+	a := newAlertManager(t, newGraph(t), nil)
+	a.Storage = st
+	l := &fakeAlertListener{}
+	a.AddEventListener(l)
+
+	al := api.NewAlert()
+	al.Type = FLOW
+	al.Select = "LayersPath=Ethernet/IPv4/TCP"
+	al.Test = "flowCount == 2 && flowBytes > 2000 && flowBytes < 4000 && flowPackets == 4"
+	al.FlowWindow = 60
+	a.SetAlert(al)
+
+	// flow alerts are not evaluated against the graph
+	if fired := a.evalNodes(0); fired != 0 {
+		t.Fatalf("Flow alert evaluated against the graph")
+	}
+
+	now := time.Now()
+	if fired := a.evalFlowAlerts(now); fired != 1 || len(l.messages) != 1 || l.messages[0].Type != FLOW {
+		t.Fatalf("Expected the flow alert to fire, got %d, %v", fired, l.messages)
+	}
+
+	if st.filters["LayersPath"] != "Ethernet/IPv4/TCP" || st.since != now.Add(-time.Minute).Unix() || st.interval != 60 {
+		t.Errorf("Wrong storage query: %v since %d by %ds", st.filters, st.since, st.interval)
+	}
+
+	st.flows, st.metrics = st.flows[:1], st.metrics[:1]
+	if fired := a.evalFlowAlerts(now); fired != 0 {
+		t.Errorf("Flow alert shouldn't fire below the threshold")
+	}
+}
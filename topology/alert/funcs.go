@@ -0,0 +1,66 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package alert
+
+import (
+	"net"
+	"strings"
+
+	eval "github.com/sbinet/go-eval"
+)
+
+// evalFuncs are the helpers available to the alert tests in addition to the
+// node values, ex: hasPrefix(Name, "eth") && cidrContains("10.0.0.0/8", IPV4)
+var evalFuncs = map[string]func(a, b string) bool{
+	"contains":  strings.Contains,
+	"hasPrefix": strings.HasPrefix,
+	"hasSuffix": strings.HasSuffix,
+	// false when the network or the address can't be parsed
+	"cidrContains": func(cidr, ip string) bool {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return false
+		}
+		addr := net.ParseIP(ip)
+		if addr == nil {
+			// the addresses of the interfaces are stored with their prefix
+			if addr, _, err = net.ParseCIDR(ip); err != nil {
+				return false
+			}
+		}
+		return network.Contains(addr)
+	},
+}
+
+var evalFuncType = eval.NewFuncType([]eval.Type{eval.StringType, eval.StringType}, false, []eval.Type{eval.BoolType})
+
+func defineFuncs(w *eval.World) {
+	for name, fn := range evalFuncs {
+		fn := fn
+		w.DefineConst(name, evalFuncType, eval.FuncFromNative(func(t *eval.Thread, in []eval.Value, out []eval.Value) {
+			a := in[0].(eval.StringValue).Get(t)
+			b := in[1].(eval.StringValue).Get(t)
+			out[0].(eval.BoolValue).Set(t, fn(a, b))
+		}, evalFuncType))
+	}
+}
@@ -0,0 +1,59 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package alert
+
+import (
+	"testing"
+)
+
+func TestEvalFuncs(t *testing.T) {
+	values := map[string]interface{}{
+		"Name": "eth0",
+		"IPV4": "10.0.1.2/24",
+		"IP":   "192.168.0.1",
+	}
+
+	tests := map[string]bool{
+		`contains(Name, "th")`:                                       true,
+		`contains(Name, "br")`:                                       false,
+		`hasPrefix(Name, "eth")`:                                     true,
+		`hasPrefix(Name, "tap")`:                                     false,
+		`hasSuffix(Name, "0")`:                                       true,
+		`hasSuffix(Name, "1")`:                                       false,
+		`cidrContains("10.0.0.0/8", IPV4)`:                           true,
+		`cidrContains("10.0.0.0/8", IP)`:                             false,
+		`cidrContains("192.168.0.0/16", IP)`:                         true,
+		`cidrContains("bad", IP)`:                                    false,
+		`cidrContains("10.0.0.0/8", Name)`:                           false,
+		`hasPrefix(Name, "eth") && cidrContains("10.0.0.0/8", IPV4)`: true,
+	}
+
+	for test, expected := range tests {
+		ok, err := evalTest(test, values)
+		if err != nil {
+			t.Errorf("%s: %s", test, err.Error())
+		} else if ok != expected {
+			t.Errorf("%s: expected %v, got %v", test, expected, ok)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package alert
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Shopify/sarama"
+
+	"github.com/redhat-cip/skydive/logging"
+)
+
+// number of alert messages waiting to be published before being dropped
+const kafkaQueueSize = 1000
+
+// delay between two connections to unreachable brokers
+const kafkaRetryPeriod = 5 * time.Second
+
+var errKafkaTimeout = errors.New("not acknowledged by the Kafka brokers in time")
+
+// KafkaAlertSink publishes the alert messages as JSON to a Kafka topic, keyed
+// by the alert UUID. The messages are queued so that the alert evaluation is
+// never blocked, they are dropped once the queue is full, ex: while the
+// brokers are unreachable. The messages of the synchronous alerts are
+// queued as well, keeping their order, but waited for until acknowledged.
+type KafkaAlertSink struct {
+	Brokers     []string
+	Topic       string
+	queue       chan *sarama.ProducerMessage
+	dropped     uint64
+	quit        chan struct{}
+	wg          sync.WaitGroup
+	newProducer func(brokers []string) (sarama.AsyncProducer, error)
+}
+
+func newKafkaProducer(brokers []string) (sarama.AsyncProducer, error) {
+	cfg := sarama.NewConfig()
+	cfg.ClientID = "skydive"
+	cfg.Producer.Return.Errors = true
+	cfg.Producer.Return.Successes = true
+	return sarama.NewAsyncProducer(brokers, cfg)
+}
+
+func (k *KafkaAlertSink) message(msg *AlertMessage) *sarama.ProducerMessage {
+	return &sarama.ProducerMessage{
+		Topic: k.Topic,
+		Key:   sarama.StringEncoder(msg.UUID),
+		Value: sarama.ByteEncoder(msg.Marshal()),
+	}
+}
+
+func (k *KafkaAlertSink) OnAlert(msg *AlertMessage) {
+	m := k.message(msg)
+
+	select {
+	case k.queue <- m:
+	default:
+		dropped := atomic.AddUint64(&k.dropped, 1)
+		logging.GetLogger().Warningf("Kafka alert queue full, message dropped %s", logging.Fields("alert_uuid", msg.UUID, "dropped", dropped))
+	}
+}
+
+// OnAlertSync publishes the message and waits for the acknowledgement of the
+// brokers, the message may still be published after the timeout
+func (k *KafkaAlertSink) OnAlertSync(msg *AlertMessage, timeout time.Duration) error {
+	done := make(chan error, 1)
+	m := k.message(msg)
+	m.Metadata = done
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case k.queue <- m:
+	case <-timer.C:
+		return errKafkaTimeout
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		return errKafkaTimeout
+	}
+}
+
+// Dropped returns the number of alert messages dropped
+func (k *KafkaAlertSink) Dropped() uint64 {
+	return atomic.LoadUint64(&k.dropped)
+}
+
+// connect returns a producer, retrying until the brokers are reachable or
+// the sink is stopped
+func (k *KafkaAlertSink) connect() sarama.AsyncProducer {
+	for {
+		producer, err := k.newProducer(k.Brokers)
+		if err == nil {
+			return producer
+		}
+		logging.GetLogger().Errorf("Unable to connect to the Kafka brokers %s", logging.Fields("brokers", k.Brokers, "error", err))
+
+		select {
+		case <-time.After(kafkaRetryPeriod):
+		case <-k.quit:
+			return nil
+		}
+	}
+}
+
+func (k *KafkaAlertSink) run() {
+	defer k.wg.Done()
+
+	producer := k.connect()
+	if producer == nil {
+		return
+	}
+	defer producer.AsyncClose()
+
+	// the synchronous messages carry the channel waiting for their result
+	go func() {
+		for err := range producer.Errors() {
+			logging.GetLogger().Errorf("Unable to publish alert message %s", logging.Fields("topic", k.Topic, "error", err.Err))
+			if done, ok := err.Msg.Metadata.(chan error); ok {
+				done <- err.Err
+			}
+		}
+	}()
+
+	go func() {
+		for m := range producer.Successes() {
+			if done, ok := m.Metadata.(chan error); ok {
+				done <- nil
+			}
+		}
+	}()
+
+	for {
+		select {
+		case m := <-k.queue:
+			select {
+			case producer.Input() <- m:
+			case <-k.quit:
+				return
+			}
+		case <-k.quit:
+			return
+		}
+	}
+}
+
+func (k *KafkaAlertSink) Start() {
+	k.wg.Add(1)
+	go k.run()
+}
+
+// Stop stops publishing, the messages still queued are dropped
+func (k *KafkaAlertSink) Stop() {
+	close(k.quit)
+	k.wg.Wait()
+}
+
+func NewKafkaAlertSink(brokers []string, topic string) *KafkaAlertSink {
+	return &KafkaAlertSink{
+		Brokers:     brokers,
+		Topic:       topic,
+		queue:       make(chan *sarama.ProducerMessage, kafkaQueueSize),
+		quit:        make(chan struct{}),
+		newProducer: newKafkaProducer,
+	}
+}
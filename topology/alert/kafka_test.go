@@ -0,0 +1,141 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package alert
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+type fakeProducer struct {
+	sarama.AsyncProducer
+	input     chan *sarama.ProducerMessage
+	errors    chan *sarama.ProducerError
+	successes chan *sarama.ProducerMessage
+}
+
+func (p *fakeProducer) Input() chan<- *sarama.ProducerMessage {
+	return p.input
+}
+
+func (p *fakeProducer) Errors() <-chan *sarama.ProducerError {
+	return p.errors
+}
+
+func (p *fakeProducer) Successes() <-chan *sarama.ProducerMessage {
+	return p.successes
+}
+
+func (p *fakeProducer) AsyncClose() {
+	close(p.errors)
+	close(p.successes)
+}
+
+func TestKafkaAlertSink(t *testing.T) {
+	producer := &fakeProducer{
+		input:     make(chan *sarama.ProducerMessage),
+		errors:    make(chan *sarama.ProducerError),
+		successes: make(chan *sarama.ProducerMessage),
+	}
+
+	connected := make(chan bool)
+	sink := NewKafkaAlertSink([]string{"127.0.0.1:9092"}, "alerts")
+	sink.newProducer = func(brokers []string) (sarama.AsyncProducer, error) {
+		// the first connection fails as if the brokers were unreachable
+		if connected == nil {
+			return producer, nil
+		}
+		close(connected)
+		connected = nil
+		return nil, errors.New("unreachable")
+	}
+
+	// queued while the sink isn't connected
+	sink.OnAlert(&AlertMessage{UUID: "alert-1", Count: 2})
+
+	sink.Start()
+	defer sink.Stop()
+
+	select {
+	case m := <-producer.input:
+		key, _ := m.Key.Encode()
+		value, _ := m.Value.Encode()
+
+		var msg AlertMessage
+		if err := json.Unmarshal(value, &msg); err != nil {
+			t.Fatal(err)
+		}
+		if m.Topic != "alerts" || string(key) != "alert-1" || msg.UUID != "alert-1" || msg.Count != 2 {
+			t.Errorf("Wrong message published on %s: %s %+v", m.Topic, key, msg)
+		}
+	case <-time.After(2 * kafkaRetryPeriod):
+		t.Fatal("Alert message not published")
+	}
+}
+
+func TestKafkaAlertSinkDrop(t *testing.T) {
+	sink := NewKafkaAlertSink([]string{"127.0.0.1:9092"}, "alerts")
+
+	// never started, OnAlert must not block once the queue is full
+	for i := 0; i != kafkaQueueSize+10; i++ {
+		sink.OnAlert(&AlertMessage{UUID: "alert-1"})
+	}
+
+	if sink.Dropped() != 10 {
+		t.Errorf("Expected 10 messages dropped, got %d", sink.Dropped())
+	}
+}
+
+func TestKafkaAlertSinkSync(t *testing.T) {
+	producer := &fakeProducer{
+		input:     make(chan *sarama.ProducerMessage),
+		errors:    make(chan *sarama.ProducerError),
+		successes: make(chan *sarama.ProducerMessage),
+	}
+
+	sink := NewKafkaAlertSink([]string{"127.0.0.1:9092"}, "alerts")
+	sink.newProducer = func(brokers []string) (sarama.AsyncProducer, error) {
+		return producer, nil
+	}
+	sink.Start()
+	defer sink.Stop()
+
+	// the brokers don't acknowledge the first message
+	if err := sink.OnAlertSync(&AlertMessage{UUID: "alert-1"}, 100*time.Millisecond); err != errKafkaTimeout {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+	<-producer.input
+
+	go func() {
+		m := <-producer.input
+		producer.successes <- m
+	}()
+
+	if err := sink.OnAlertSync(&AlertMessage{UUID: "alert-2"}, 2*time.Second); err != nil {
+		t.Errorf("Expected the message to be acknowledged, got %v", err)
+	}
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+package alert
+
+import (
+	"strconv"
+
+	"github.com/redhat-cip/skydive/api"
+	"github.com/redhat-cip/skydive/common"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// linkedValueName is the name of the linked value in the alert test, ex:
+// linked_Speed for the Speed of the linked node
+func linkedValueName(al *api.Alert) string {
+	return "linked_" + al.LinkedField
+}
+
+// numericValue converts a metadata value to float64, the numbers stored as
+// strings included
+func numericValue(v interface{}) (float64, bool) {
+	if s, ok := v.(string); ok {
+		f, err := strconv.ParseFloat(s, 64)
+		return f, err == nil
+	}
+
+	f, err := common.ToFloat64(v)
+	return f, err == nil
+}
+
+// linkedValue returns the numeric value of the LinkedField metadata of the
+// first node linked to n, whatever the direction, by an edge of the
+// LinkedEdge relation type, any if empty. Must be called under graph lock.
+func (a *AlertManager) linkedValue(al *api.Alert, n *graph.Node) (float64, bool) {
+	for _, e := range a.Graph.GetNodeEdges(n) {
+		if al.LinkedEdge != "" && e.Metadata()["RelationType"] != al.LinkedEdge {
+			continue
+		}
+
+		parent, child := a.Graph.GetEdgeNodes(e)
+		if parent == nil || child == nil {
+			continue
+		}
+
+		linked := parent
+		if parent.ID == n.ID {
+			linked = child
+		}
+
+		if v, ok := linked.Metadata()[al.LinkedField]; ok {
+			if f, ok := numericValue(v); ok {
+				return f, true
+			}
+		}
+	}
+
+	return 0, false
+}
+
+// linkedValues returns the node values completed with the linked value, false
+// when no linked node has a numeric value
+func (a *AlertManager) linkedValues(al *api.Alert, n *graph.Node, values map[string]interface{}) (map[string]interface{}, bool) {
+	value, ok := a.linkedValue(al, n)
+	if !ok {
+		return nil, false
+	}
+
+	merged := make(map[string]interface{})
+	for k, v := range values {
+		merged[k] = v
+	}
+	merged[linkedValueName(al)] = value
+
+	return merged, true
+}
@@ -0,0 +1,149 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package alert
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/redhat-cip/skydive/api"
+	"github.com/redhat-cip/skydive/logging"
+)
+
+// jsonCompatible converts the maps decoded by yaml, indexed by interface{},
+// into maps that can be encoded in JSON
+func jsonCompatible(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			k, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid key %v", key)
+			}
+
+			c, err := jsonCompatible(value)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = c
+		}
+		return m, nil
+	case []interface{}:
+		for i, value := range v {
+			c, err := jsonCompatible(value)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = c
+		}
+	}
+
+	return v, nil
+}
+
+// parseAlerts decodes a YAML, or JSON, list of alerts. The keys are matched
+// case-insensitively against the alert fields and each alert gets a new UUID.
+func parseAlerts(data []byte) ([]*api.Alert, error) {
+	var list []interface{}
+	if err := yaml.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+
+	alerts := make([]*api.Alert, 0, len(list))
+	for _, item := range list {
+		c, err := jsonCompatible(item)
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := json.Marshal(c)
+		if err != nil {
+			return nil, err
+		}
+
+		alert := api.NewAlert()
+		if err := json.Unmarshal(b, alert); err != nil {
+			return nil, err
+		}
+		alert.UUID = api.NewUUID()
+
+		alerts = append(alerts, alert)
+	}
+
+	return alerts, nil
+}
+
+// cappedAlertHandler refuses to create alerts once max alerts are stored, 0
+// meaning unlimited
+type cappedAlertHandler struct {
+	api.ApiHandler
+	count int
+	max   int
+}
+
+func (h *cappedAlertHandler) Create(resource api.ApiResource) error {
+	if h.max > 0 && h.count >= h.max {
+		return &api.LimitError{Resource: "alerts", Max: h.max}
+	}
+
+	if err := h.ApiHandler.Create(resource); err != nil {
+		return err
+	}
+	h.count++
+	return nil
+}
+
+// loadAlertsFile creates the alerts of the given file which are not already
+// stored, the content hash being used so that they are not duplicated on
+// every restart. No alert is created once maxCount alerts are stored, 0
+// meaning unlimited.
+func loadAlertsFile(h api.ApiHandler, path string, maxCount int) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	alerts, err := parseAlerts(data)
+	if err != nil {
+		return fmt.Errorf("unable to parse %s: %s", path, err.Error())
+	}
+
+	capped := &cappedAlertHandler{ApiHandler: h, count: len(h.Index()), max: maxCount}
+	for _, alert := range alerts {
+		r, err := api.CreateDedup(capped, alert, api.DedupMerge)
+		if err != nil {
+			logging.GetLogger().Errorf("Unable to create alert %s from %s: %s", alert.Name, path, err.Error())
+			continue
+		}
+
+		if r.(*api.Alert).UUID.Equal(alert.UUID) {
+			logging.GetLogger().Infof("Alert %s created from %s", alert.Name, path)
+		}
+	}
+
+	return nil
+}
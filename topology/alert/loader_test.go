@@ -0,0 +1,95 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package alert
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/redhat-cip/skydive/api"
+	"github.com/redhat-cip/skydive/api/apitest"
+)
+
+const alertsFile = `
+- name: mtu
+  select: MTU
+  test: MTU > 1500
+  severity: critical
+- {"Name": "down", "Select": "State", "Test": "State == \"DOWN\"", "Enabled": false}
+`
+
+func TestLoadAlertsFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "skydive-alerts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	f.WriteString(alertsFile)
+	f.Close()
+
+	h := apitest.NewMemoryApiHandler(&api.AlertHandler{})
+	if err := loadAlertsFile(h, f.Name(), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(h.Index()) != 2 {
+		t.Fatalf("Wrong number of alerts: got %d, expected 2", len(h.Index()))
+	}
+
+	for _, r := range h.Index() {
+		al := r.(*api.Alert)
+		switch al.Name {
+		case "mtu":
+			if al.Test != "MTU > 1500" || al.Severity != api.CRITICAL || !al.Enabled {
+				t.Errorf("Alert corrupted: %+v", al)
+			}
+		case "down":
+			if al.Select != "State" || al.Severity != api.WARNING || al.Enabled {
+				t.Errorf("Alert corrupted: %+v", al)
+			}
+		default:
+			t.Errorf("Unexpected alert: %+v", al)
+		}
+	}
+
+	// a restart must not duplicate the alerts
+	if err := loadAlertsFile(h, f.Name(), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(h.Index()) != 2 {
+		t.Errorf("Alerts duplicated: got %d, expected 2", len(h.Index()))
+	}
+
+	// only the alerts below the maximum count are created
+	h = apitest.NewMemoryApiHandler(&api.AlertHandler{})
+	if err := loadAlertsFile(h, f.Name(), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(h.Index()) != 1 {
+		t.Errorf("Wrong number of alerts: got %d, expected 1", len(h.Index()))
+	}
+}
@@ -23,41 +23,159 @@
 package alert
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"go/token"
+	"go/ast"
+	"go/parser"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
 	"sync"
+	"text/template"
 	"time"
 
 	eval "github.com/sbinet/go-eval"
 
 	"github.com/redhat-cip/skydive/api"
+	"github.com/redhat-cip/skydive/common"
+	"github.com/redhat-cip/skydive/config"
 	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/storage"
+	"github.com/redhat-cip/skydive/topology"
 	"github.com/redhat-cip/skydive/topology/graph"
 )
 
 const (
 	FIXED = 1 + iota
 	THRESHOLD
+	AGGREGATE
+	FLOW
 )
 
 type AlertManager struct {
 	graph.DefaultGraphListener
 	Graph          *graph.Graph
 	AlertHandler   api.ApiHandler
+	Storage        storage.Storage
 	watcher        api.StoppableWatcher
-	alerts         map[string]*api.Alert
+	alerts         map[api.UUID]*api.Alert
 	alertsLock     sync.RWMutex
+	reconcileLock  sync.Mutex
 	eventListeners map[AlertEventListener]AlertEventListener
+	groups         map[string]*alertGroup
+	groupsLock     sync.Mutex
+	limiters       map[string]*actionLimiter
+	limitersLock   sync.Mutex
+	deltas         *deltaHistory
+	throttled      map[api.UUID]bool
+	throttledLock  sync.Mutex
+	flagged        map[api.UUID]*alertFlags
+	unhealthy      map[api.UUID]string
+	correlations   map[string]*correlation
+	quit           chan struct{}
+	// maximum number of alerts stored by ReconcileAlerts, 0 for unlimited
+	maxCount int
+
+	// set while the manager updates the graph, under graph lock
+	updatingMetadata bool
+	// nodes selected by the alerts, under alertsLock
+	selects *selectCache
+	// serializes the writes and the pruning of the snapshot files
+	snapshotsLock sync.Mutex
 }
 
 type AlertMessage struct {
-	UUID       string
-	Type       int
-	Timestamp  time.Time
-	Count      int
-	Reason     string
-	ReasonData interface{}
+	UUID        string
+	Type        int
+	Severity    string
+	Timestamp   time.Time
+	Count       int
+	Reason      string
+	ReasonData  interface{}
+	Message     string
+	FirstSeen   time.Time
+	LastSeen    time.Time
+	Occurrences int
+	RateLimited bool
+	Snapshot    string
+	// shared by the messages of the nodes of a same host
+	CorrelationID string
+
+	// graph snapshot taken when the alert fired, written once the message
+	// is actually sent
+	snapshot []byte
+}
+
+// GraphSnapshot holds the nodes matched by an alert, their neighbors and the
+// edges between them at the time the alert fired
+type GraphSnapshot struct {
+	Nodes []*graph.Node
+	Edges []*graph.Edge
+}
+
+// alertGroup coalesces the fires of an alert for the same node until the
+// group window of the alert expires
+type alertGroup struct {
+	msg        *AlertMessage
+	node       graph.Identifier
+	maxActions int
+	deadline   time.Time
+	sync       bool
+}
+
+// actionLimiter counts the messages sent for an alert during a minute
+type actionLimiter struct {
+	start   time.Time
+	count   int
+	limited bool
+}
+
+const (
+	// TimestampRFC3339 marshals the timestamps of the alert messages as
+	// RFC3339 strings with nanoseconds
+	TimestampRFC3339 = "rfc3339"
+	// TimestampEpochMillis marshals the timestamps of the alert messages as
+	// milliseconds since the epoch, 0 for unset ones
+	TimestampEpochMillis = "epoch-millis"
+)
+
+// TimestampFormat is the format of the timestamps of the marshalled alert
+// messages, set from analyzer.alert_timestamp_format by NewAlertManager
+var TimestampFormat = TimestampRFC3339
+
+func epochMillis(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// MarshalJSON encodes the timestamps according to TimestampFormat
+func (am AlertMessage) MarshalJSON() ([]byte, error) {
+	// without the MarshalJSON method
+	type alertMessage AlertMessage
+
+	if TimestampFormat != TimestampEpochMillis {
+		return json.Marshal(alertMessage(am))
+	}
+
+	return json.Marshal(&struct {
+		alertMessage
+		Timestamp int64
+		FirstSeen int64
+		LastSeen  int64
+	}{
+		alertMessage: alertMessage(am),
+		Timestamp:    epochMillis(am.Timestamp),
+		FirstSeen:    epochMillis(am.FirstSeen),
+		LastSeen:     epochMillis(am.LastSeen),
+	})
 }
 
 func (am *AlertMessage) Marshal() []byte {
@@ -73,6 +191,13 @@ type AlertEventListener interface {
 	OnAlert(n *AlertMessage)
 }
 
+// SyncAlertEventListener is implemented by the listeners able to deliver the
+// messages of the synchronous alerts, returning once the message is
+// delivered or the timeout expired
+type SyncAlertEventListener interface {
+	OnAlertSync(n *AlertMessage, timeout time.Duration) error
+}
+
 func (a *AlertManager) AddEventListener(l AlertEventListener) {
 	a.alertsLock.Lock()
 	defer a.alertsLock.Unlock()
@@ -87,56 +212,825 @@ func (a *AlertManager) DelEventListener(l AlertEventListener) {
 	delete(a.eventListeners, l)
 }
 
-func (a *AlertManager) EvalNodes() {
+// actionPlaceholder matches the ${VAR} placeholders of the alert actions and
+// the "$$" escaping a literal "$"
+var actionPlaceholder = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandAction replaces ${VAR} placeholders of an action with the value of
+// the corresponding environment variable, so that secrets don't have to be
+// stored within the alert definition. Only the variables prefixed by
+// analyzer.alert_env_prefix are expanded, the action being sent to the
+// clients, the other placeholders and the bare $VAR are kept as is. "$$" can
+// be used to get a literal "$".
+func expandAction(action string) string {
+	prefix := config.GetConfig().GetString("analyzer.alert_env_prefix")
+
+	return actionPlaceholder.ReplaceAllStringFunc(action, func(placeholder string) string {
+		if placeholder == "$$" {
+			return "$"
+		}
+
+		name := placeholder[2 : len(placeholder)-1]
+		if prefix == "" || !strings.HasPrefix(name, prefix) {
+			logging.GetLogger().Warningf("Environment variable %s used in alert action is not prefixed by %s", name, prefix)
+			return placeholder
+		}
+
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			logging.GetLogger().Warningf("Environment variable %s used in alert action is not defined", name)
+		}
+		return value
+	})
+}
+
+// renderTemplate renders the text/template placeholders of s against the
+// given values, the raw string is returned if the rendering fails
+func renderTemplate(s string, values map[string]interface{}) string {
+	t, err := template.New("alert").Parse(s)
+	if err != nil {
+		logging.GetLogger().Errorf("Unable to parse alert template %s: %s", s, err.Error())
+		return s
+	}
+
+	var b bytes.Buffer
+	if err := t.Execute(&b, values); err != nil {
+		logging.GetLogger().Errorf("Unable to render alert template %s: %s", s, err.Error())
+		return s
+	}
+
+	return b.String()
+}
+
+// testIdents returns the identifiers referenced by the test, nil if the test
+// can't be parsed
+func testIdents(test string) map[string]bool {
+	expr, err := parser.ParseExpr(test)
+	if err != nil {
+		return nil
+	}
+
+	idents := make(map[string]bool)
+	ast.Inspect(expr, func(node ast.Node) bool {
+		if ident, ok := node.(*ast.Ident); ok {
+			idents[ident.Name] = true
+		}
+		return true
+	})
+	return idents
+}
+
+// evalTest evaluates the test with the values it references defined as
+// constants, the other values are skipped
+func evalTest(test string, values map[string]interface{}) (bool, error) {
+	toEval := "(" + test + ") == true"
+
+	parsed := parsedTests.get(test)
+	if parsed.err != nil {
+		return false, fmt.Errorf("Can't compile expression : %s", toEval)
+	}
+
+	w := eval.NewWorld()
+	defineFuncs(w)
+	for k, v := range values {
+		if !parsed.idents[k] {
+			continue
+		}
+		t, v := toTypeValue(v)
+		w.DefineConst(k, t, v)
+	}
+
+	expr, err := w.CompileExpr(parsed.fset, parsed.expr)
+	if err != nil {
+		return false, fmt.Errorf("Can't compile expression : %s", toEval)
+	}
+
+	ret, err := expr.Run()
+	if err != nil {
+		return false, fmt.Errorf("Can't evaluate expression : %s", toEval)
+	}
+
+	return ret.String() == "true", nil
+}
+
+// snapshot returns the subgraph made of the given nodes and their neighbors,
+// must be called under graph lock
+func (a *AlertManager) snapshot(nodes []*graph.Node) *GraphSnapshot {
+	snapshot := &GraphSnapshot{}
+
+	seen := make(map[graph.Identifier]bool)
+	addNode := func(n *graph.Node) {
+		if n != nil && !seen[n.ID] {
+			seen[n.ID] = true
+			snapshot.Nodes = append(snapshot.Nodes, n)
+		}
+	}
+
+	for _, n := range nodes {
+		addNode(n)
+
+		for _, e := range a.Graph.GetNodeEdges(n) {
+			if seen[e.ID] {
+				continue
+			}
+			seen[e.ID] = true
+			snapshot.Edges = append(snapshot.Edges, e)
+
+			parent, child := a.Graph.GetEdgeNodes(e)
+			addNode(parent)
+			addNode(child)
+		}
+	}
+
+	return snapshot
+}
+
+// marshalSnapshot returns the snapshot of the nodes to be written when the
+// message is sent, must be called under graph lock
+func (a *AlertManager) marshalSnapshot(msg *AlertMessage, nodes []*graph.Node) []byte {
+	data, err := json.Marshal(a.snapshot(nodes))
+	if err != nil {
+		logging.GetLogger().Errorf("Unable to marshal the graph snapshot %s", logging.Fields("alert_uuid", msg.UUID, "error", err))
+		return nil
+	}
+	return data
+}
+
+// storeSnapshot writes the snapshot of the message in the alert snapshot
+// directory and returns the path of the file, named after the alert UUID.
+// The oldest files are removed above analyzer.alert_snapshot_max_files.
+func (a *AlertManager) storeSnapshot(msg *AlertMessage) string {
+	dir := config.GetConfig().GetString("analyzer.alert_snapshot_dir")
+	max := config.GetConfig().GetInt("analyzer.alert_snapshot_max_files")
+	path := filepath.Join(dir, fmt.Sprintf("%s-%d.json", msg.UUID, msg.Timestamp.UnixNano()))
+	uuid, data := msg.UUID, msg.snapshot
+
+	go func() {
+		a.snapshotsLock.Lock()
+		defer a.snapshotsLock.Unlock()
+
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			logging.GetLogger().Errorf("Unable to create the alert snapshot directory %s", logging.Fields("alert_uuid", uuid, "path", dir, "error", err))
+			return
+		}
+
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			logging.GetLogger().Errorf("Unable to write the graph snapshot %s", logging.Fields("alert_uuid", uuid, "path", path, "error", err))
+			return
+		}
+
+		if max > 0 {
+			pruneSnapshots(dir, max)
+		}
+	}()
+
+	return path
+}
+
+type snapshotFiles []os.FileInfo
+
+func (s snapshotFiles) Len() int {
+	return len(s)
+}
+
+func (s snapshotFiles) Less(i, j int) bool {
+	return s[i].ModTime().Before(s[j].ModTime())
+}
+
+func (s snapshotFiles) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+// pruneSnapshots removes the oldest snapshot files of the directory so that
+// at most max are kept
+func pruneSnapshots(dir string, max int) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		logging.GetLogger().Errorf("Unable to list the graph snapshots %s", logging.Fields("path", dir, "error", err))
+		return
+	}
+
+	var files snapshotFiles
+	for _, info := range infos {
+		if info.Mode().IsRegular() && filepath.Ext(info.Name()) == ".json" {
+			files = append(files, info)
+		}
+	}
+
+	if len(files) <= max {
+		return
+	}
+	sort.Sort(files)
+
+	for _, info := range files[:len(files)-max] {
+		path := filepath.Join(dir, info.Name())
+		if err := os.Remove(path); err != nil {
+			logging.GetLogger().Errorf("Unable to remove the graph snapshot %s", logging.Fields("path", path, "error", err))
+		}
+	}
+}
+
+// allowAction returns whether a message of the alert can be sent, limited
+// is true only for the first message suppressed during the current minute
+func (a *AlertManager) allowAction(id string, max int, now time.Time) (allowed bool, limited bool) {
+	if max <= 0 {
+		return true, false
+	}
+
+	a.limitersLock.Lock()
+	defer a.limitersLock.Unlock()
+
+	l, ok := a.limiters[id]
+	if !ok || now.Sub(l.start) >= time.Minute {
+		l = &actionLimiter{start: now}
+		a.limiters[id] = l
+	}
+
+	if l.count < max {
+		l.count++
+		return true, false
+	}
+
+	if !l.limited {
+		l.limited = true
+		return false, true
+	}
+
+	return false, false
+}
+
+// emit sends the message to the listeners unless the alert exceeded its
+// action rate limit, in which case a single rate limited message is sent
+// for the current minute. The messages of the synchronous alerts are
+// delivered inline by the listeners supporting it. Must be called under
+// alertsLock.
+func (a *AlertManager) emit(msg *AlertMessage, maxActions int, sync bool) {
+	allowed, limited := a.allowAction(msg.UUID, maxActions, time.Now())
+	if !allowed {
+		if !limited {
+			return
+		}
+
+		logging.GetLogger().Warningf("Alert actions suppressed %s", logging.Fields("alert_uuid", msg.UUID, "max_actions_per_minute", maxActions))
+
+		marker := *msg
+		marker.RateLimited = true
+		marker.Reason = fmt.Sprintf("rate limited to %d actions per minute", maxActions)
+		marker.ReasonData = nil
+		marker.snapshot = nil
+		msg = &marker
+	}
+
+	// only the messages sent have their snapshot written
+	if msg.snapshot != nil {
+		msg.Snapshot = a.storeSnapshot(msg)
+	}
+
+	logging.GetLogger().Debugf("Alert message sent %s", logging.Fields(
+		"alert_uuid", msg.UUID,
+		"node_id", messageNodeID(msg),
+		"node_count", messageNodeCount(msg),
+		"severity", msg.Severity,
+		"occurrences", msg.Occurrences,
+		"rate_limited", msg.RateLimited,
+		"reason", msg.Reason,
+	))
+	timeout := time.Duration(config.GetConfig().GetInt("analyzer.alert_sync_timeout")) * time.Second
+	for _, l := range a.eventListeners {
+		if s, ok := l.(SyncAlertEventListener); ok && sync {
+			if err := s.OnAlertSync(msg, timeout); err != nil {
+				logging.GetLogger().Errorf("Alert message not delivered %s", logging.Fields("alert_uuid", msg.UUID, "timeout", timeout, "error", err))
+			}
+			continue
+		}
+		l.OnAlert(msg)
+	}
+}
+
+// messageNodeID returns the ID of the node that fired the alert, empty for
+// aggregate alerts
+func messageNodeID(msg *AlertMessage) string {
+	if n, ok := msg.ReasonData.(*graph.Node); ok {
+		return string(n.ID)
+	}
+	return ""
+}
+
+// messageNodeCount returns the number of nodes involved in the message
+func messageNodeCount(msg *AlertMessage) int {
+	switch d := msg.ReasonData.(type) {
+	case *graph.Node:
+		return 1
+	case []*graph.Node:
+		return len(d)
+	}
+	return 0
+}
+
+// notify sends an alert message for the fire identified by key, the action
+// and the message are rendered against values. When the alert has a group
+// window the fires are accumulated and sent once the window expires.
+// Must be called under alertsLock.
+func (a *AlertManager) notify(al *api.Alert, t int, key string, values map[string]interface{}, data interface{}) {
+	al.Count++
+
+	if al.FireOnce {
+		a.latch(al)
+	}
+
+	now := time.Now()
+	msg := &AlertMessage{
+		UUID:        al.UUID.String(),
+		Type:        t,
+		Severity:    al.Severity,
+		Timestamp:   now,
+		Count:       al.Count,
+		Reason:      renderTemplate(expandAction(al.Action), values),
+		ReasonData:  data,
+		Message:     renderTemplate(al.Message, values),
+		FirstSeen:   now,
+		LastSeen:    now,
+		Occurrences: 1,
+	}
+
+	var nodes []*graph.Node
+	switch d := data.(type) {
+	case *graph.Node:
+		nodes = []*graph.Node{d}
+	case []*graph.Node:
+		nodes = d
+	}
+
+	if len(nodes) > 0 {
+		msg.CorrelationID = a.correlationID(nodes, now)
+
+		if al.Snapshot {
+			msg.snapshot = a.marshalSnapshot(msg, nodes)
+		}
+	}
+
+	if al.GroupWindow <= 0 {
+		a.emit(msg, al.MaxActionsPerMinute, al.Synchronous)
+		return
+	}
+
+	a.groupsLock.Lock()
+	defer a.groupsLock.Unlock()
+
+	id := msg.UUID + "/" + key
+	if group, ok := a.groups[id]; ok {
+		group.msg.Timestamp = now
+		group.msg.Count = al.Count
+		group.msg.Reason = msg.Reason
+		group.msg.ReasonData = data
+		group.msg.Message = msg.Message
+		group.msg.snapshot = msg.snapshot
+		group.msg.LastSeen = now
+		group.msg.Occurrences++
+		return
+	}
+
+	group := &alertGroup{
+		msg:        msg,
+		maxActions: al.MaxActionsPerMinute,
+		deadline:   now.Add(time.Duration(al.GroupWindow) * time.Second),
+		sync:       al.Synchronous,
+	}
+	if n, ok := data.(*graph.Node); ok {
+		group.node = n.ID
+	}
+	a.groups[id] = group
+}
+
+// maxLatchBackoff bounds the delay between two attempts to persist a latch
+const maxLatchBackoff = time.Minute
+
+// errAlertChanged aborts the persistence of a latch when the stored alert was
+// modified after the alert fired, a re-enable or an edit being kept
+var errAlertChanged = errors.New("alert modified since it fired")
+
+// latch disables a FireOnce alert which fired, the alert is disabled right
+// away and the change persisted asynchronously so that the graph is not
+// blocked by etcd. Must be called under alertsLock.
+func (a *AlertManager) latch(al *api.Alert) {
+	logging.GetLogger().Infof("Alert fired once, disabled %s", logging.Fields("alert_uuid", al.UUID))
+	al.Enabled = false
+
+	updater, ok := a.AlertHandler.(api.ApiUpdater)
+	if !ok {
+		return
+	}
+
+	go a.persistLatch(updater, al.UUID.String(), a.WatcherIndex())
+}
+
+// persistLatch disables the stored alert unless it was modified after the
+// alert fired, fired being the index of the last alert event known then. Only
+// Enabled is changed and the write is retried until it succeeds or the
+// manager is stopped, so that the latch survives a restart.
+func (a *AlertManager) persistLatch(updater api.ApiUpdater, id string, fired uint64) {
+	backoff := time.Second
+	for {
+		err := updater.Update(id, func(r api.ApiResource, version uint64) error {
+			if version > fired {
+				return errAlertChanged
+			}
+			r.(*api.Alert).Enabled = false
+			return nil
+		})
+
+		switch err.(type) {
+		case nil:
+			return
+		case *api.NotFoundError:
+			logging.GetLogger().Debugf("Latched alert deleted %s", logging.Fields("alert_uuid", id))
+			return
+		}
+		if err == errAlertChanged {
+			logging.GetLogger().Infof("Alert modified since it fired, latch dropped %s", logging.Fields("alert_uuid", id))
+			return
+		}
+
+		logging.GetLogger().Errorf("Unable to persist the disabled alert %s", logging.Fields("alert_uuid", id, "error", err, "retry_in", backoff))
+		select {
+		case <-time.After(backoff):
+		case <-a.quit:
+			return
+		}
+
+		if backoff *= 2; backoff > maxLatchBackoff {
+			backoff = maxLatchBackoff
+		}
+	}
+}
+
+// clearNode drops the pending fires of the given node so that they are not
+// sent once the node has been removed from the graph
+func (a *AlertManager) clearNode(id graph.Identifier) {
+	a.groupsLock.Lock()
+	defer a.groupsLock.Unlock()
+
+	for key, group := range a.groups {
+		if group.node == id {
+			logging.GetLogger().Debugf("Alert fires dropped %s", logging.Fields("alert_uuid", group.msg.UUID, "node_id", id, "occurrences", group.msg.Occurrences))
+			delete(a.groups, key)
+		}
+	}
+}
+
+// flushGroups sends the groups whose window expired before now
+func (a *AlertManager) flushGroups(now time.Time) {
 	a.alertsLock.RLock()
 	defer a.alertsLock.RUnlock()
 
-	for _, al := range a.alerts {
-		nodes := a.Graph.LookupNodesFromKey(al.Select)
+	a.groupsLock.Lock()
+	defer a.groupsLock.Unlock()
+
+	for id, group := range a.groups {
+		if !now.Before(group.deadline) {
+			a.emit(group.msg, group.maxActions, group.sync)
+			delete(a.groups, id)
+		}
+	}
+}
+
+func (a *AlertManager) asyncTick() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	flowTicker := time.NewTicker(time.Duration(config.GetConfig().GetInt("analyzer.alert_flow_interval")) * time.Second)
+	defer flowTicker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			a.flushGroups(now)
+			a.resumeThrottled()
+		case now := <-flowTicker.C:
+			a.evalFlowAlerts(now)
+		case <-a.quit:
+			return
+		}
+	}
+}
+
+// aggregateValues returns the constants available to aggregate alerts:
+// matchCount the number of selected nodes, matchSum and matchAvg the sum and
+// the average of the numeric metadata named by the Aggregate field.
+func aggregateValues(al *api.Alert, nodes []*graph.Node) map[string]interface{} {
+	values := map[string]interface{}{
+		"matchCount": len(nodes),
+	}
+
+	if al.Aggregate != "" {
+		var sum float64
+		var count int
 		for _, n := range nodes {
-			w := eval.NewWorld()
-			defConst := func(name string, val interface{}) {
-				t, v := toTypeValue(val)
-				w.DefineConst(name, t, v)
+			if f, err := common.ToFloat64(n.Metadata()[al.Aggregate]); err == nil {
+				sum += f
+				count++
 			}
-			for k, v := range n.Metadata() {
-				defConst(k, v)
+		}
+
+		avg := float64(0)
+		if count > 0 {
+			avg = sum / float64(count)
+		}
+		values["matchSum"] = sum
+		values["matchAvg"] = avg
+	}
+
+	return values
+}
+
+// hostNodes keeps only the nodes owned by a host whose name matches the
+// given pattern, shell wildcards are accepted
+func (a *AlertManager) hostNodes(pattern string, nodes []*graph.Node) []*graph.Node {
+	var owned []*graph.Node
+	for _, n := range nodes {
+		path := a.Graph.LookupShortestPath(n, graph.Metadata{"Type": "host"}, topology.IsOwnershipEdge)
+		if len(path) == 0 {
+			continue
+		}
+
+		name, _ := path[len(path)-1].Metadata()["Name"].(string)
+		if ok, err := filepath.Match(pattern, name); err != nil {
+			logging.GetLogger().Errorf("Invalid alert host pattern %s: %s", pattern, err.Error())
+			return nil
+		} else if ok {
+			owned = append(owned, n)
+		}
+	}
+
+	return owned
+}
+
+// neighbor returns the parent of the node linked by an edge of the given
+// relation type, any relation type if empty
+func (a *AlertManager) neighbor(n *graph.Node, relation string) *graph.Node {
+	for _, e := range a.Graph.GetNodeEdges(n) {
+		if relation != "" && e.Metadata()["RelationType"] != relation {
+			continue
+		}
+
+		if parent, child := a.Graph.GetEdgeNodes(e); child != nil && child.ID == n.ID && parent != nil {
+			return parent
+		}
+	}
+
+	return nil
+}
+
+// neighborValues returns the node values completed with the metadata of the
+// neighbor prefixed by alias, ex: parent_State
+func neighborValues(values map[string]interface{}, alias string, neighbor *graph.Node) map[string]interface{} {
+	merged := make(map[string]interface{})
+	for k, v := range values {
+		merged[k] = v
+	}
+	for k, v := range neighbor.Metadata() {
+		merged[alias+"_"+k] = v
+	}
+
+	return merged
+}
+
+// evalAlert evaluates the alert on the selected nodes and returns whether
+// it fired, must be called under graph lock and alertsLock
+func (a *AlertManager) evalAlert(al *api.Alert, now time.Time, retention time.Duration) bool {
+	nodes := a.selects.lookup(a.Graph, al.Select)
+	if al.Host != "" {
+		nodes = a.hostNodes(al.Host, nodes)
+	}
+
+	// aggregate alerts are evaluated once over the whole selection
+	if al.Type == AGGREGATE {
+		values := aggregateValues(al, nodes)
+		ok, err := evalTest(al.Test, values)
+		if err != nil {
+			logging.GetLogger().Errorf("Unable to evaluate alert test %s", logging.Fields("alert_uuid", al.UUID, "node_count", len(nodes), "error", err))
+			al.LastError = err.Error()
+			return false
+		}
+
+		if ok {
+			a.notify(al, AGGREGATE, "", values, nodes)
+		}
+
+		if key := metadataKey(al); key != "" {
+			var firing []*graph.Node
+			if ok {
+				firing = nodes
 			}
-			fs := token.NewFileSet()
-			toEval := "(" + al.Test + ") == true"
-			expr, err := w.Compile(fs, toEval)
-			if err != nil {
-				logging.GetLogger().Error("Can't compile expression : " + toEval)
+			a.updateFlags(al, key, firing)
+		}
+		return ok
+	}
+
+	var firing []*graph.Node
+	for _, n := range nodes {
+		values := map[string]interface{}(n.Metadata())
+		if al.NeighborAlias != "" {
+			neighbor := a.neighbor(n, al.NeighborEdge)
+			if neighbor == nil {
 				continue
 			}
-			ret, err := expr.Run()
-			if err != nil {
-				logging.GetLogger().Error("Can't evaluate expression : " + toEval)
+			values = neighborValues(values, al.NeighborAlias, neighbor)
+		}
+		// the nodes without linked value, ex: interface speed, are skipped
+		if al.LinkedField != "" {
+			var ok bool
+			if values, ok = a.linkedValues(al, n, values); !ok {
 				continue
 			}
+		}
+		values = a.deltas.deltaValues(al, n, values, now, retention)
+
+		ok, err := evalTest(al.Test, values)
+		if err != nil {
+			logging.GetLogger().Errorf("Unable to evaluate alert test %s", logging.Fields("alert_uuid", al.UUID, "node_id", n.ID, "error", err))
+			al.LastError = fmt.Sprintf("node %s: %s", n.ID, err.Error())
+			continue
+		}
+
+		if ok {
+			a.notify(al, FIXED, string(n.ID), values, n)
+			firing = append(firing, n)
+
+			// a latching alert fires for the first matching node only
+			if al.FireOnce {
+				break
+			}
+		}
+	}
+
+	if key := metadataKey(al); key != "" {
+		a.updateFlags(al, key, firing)
+	}
+
+	return len(firing) > 0
+}
+
+// evalOrder returns the enabled alerts, the ones left by a throttled
+// evaluation first. Must be called under alertsLock and throttledLock.
+func (a *AlertManager) evalOrder() []*api.Alert {
+	var throttled, others []*api.Alert
+	for _, al := range a.alerts {
+		// flow alerts are evaluated against the flow storage on their own
+		if !al.Enabled || al.Type == FLOW {
+			continue
+		}
+
+		if _, ok := a.unhealthy[al.UUID]; ok {
+			continue
+		}
+
+		if a.throttled[al.UUID] {
+			throttled = append(throttled, al)
+		} else {
+			others = append(others, al)
+		}
+	}
 
-			if ret.String() == "true" {
-				al.Count++
-
-				msg := AlertMessage{
-					UUID:       al.UUID,
-					Type:       FIXED,
-					Timestamp:  time.Now(),
-					Count:      al.Count,
-					Reason:     al.Action,
-					ReasonData: n,
-				}
-
-				logging.GetLogger().Debugf("AlertMessage to WS : " + al.UUID + " " + msg.String())
-				for _, l := range a.eventListeners {
-					l.OnAlert(&msg)
-				}
+	return append(throttled, others...)
+}
+
+// evalNodes evaluates the enabled alerts until the budget is exceeded, the
+// alerts not evaluated are kept to be evaluated first on the next tick. At
+// least one alert is evaluated per call, 0 means no budget.
+func (a *AlertManager) evalNodes(budget time.Duration) int {
+	// the write lock is needed as the alert counts are updated
+	a.alertsLock.Lock()
+	defer a.alertsLock.Unlock()
+
+	a.throttledLock.Lock()
+	defer a.throttledLock.Unlock()
+
+	// the metadata history has to cover the largest delta window
+	now := time.Now()
+	var retention time.Duration
+	for _, al := range a.alerts {
+		if w := deltaWindow(al); al.Enabled && len(deltaFields(al)) > 0 && w > retention {
+			retention = w
+		}
+	}
+
+	a.clearStaleFlags()
+
+	alerts := a.evalOrder()
+	a.throttled = make(map[api.UUID]bool)
+
+	fired := 0
+	for i, al := range alerts {
+		if budget > 0 && i > 0 && time.Since(now) > budget {
+			for _, al := range alerts[i:] {
+				a.throttled[al.UUID] = true
 			}
+
+			logging.GetLogger().Warningf("Alert evaluation throttled %s", logging.Fields("evaluated", i, "remaining", len(alerts)-i, "budget", budget))
+			break
+		}
+
+		if a.evalIsolated(al, now, retention) {
+			fired++
 		}
 	}
+
+	return fired
+}
+
+// evalIsolated evaluates an alert, recovering from a panic of the evaluation
+// so that the other alerts are still evaluated. The error of the evaluation,
+// if any, is kept on the alert. Must be called under graph lock and
+// alertsLock.
+func (a *AlertManager) evalIsolated(al *api.Alert, now time.Time, retention time.Duration) (fired bool) {
+	a.recordEval(al.UUID, now, nil)
+
+	defer func() {
+		if r := recover(); r != nil {
+			a.markUnhealthy(al, r)
+			fired = false
+		}
+	}()
+
+	return a.evalAlert(al, now, retention)
+}
+
+// markUnhealthy records the panic of an alert evaluation, the alert is then
+// skipped until it is updated. Must be called under alertsLock.
+func (a *AlertManager) markUnhealthy(al *api.Alert, r interface{}) {
+	logging.GetLogger().Errorf("Alert evaluation panicked, alert skipped until updated %s", logging.Fields("alert_uuid", al.UUID, "panic", r))
+	a.unhealthy[al.UUID] = fmt.Sprint(r)
+
+	if stored, ok := a.alerts[al.UUID]; ok {
+		stored.LastError = fmt.Sprintf("evaluation panicked: %v", r)
+	}
+}
+
+// recordEval sets the time and the error of the last evaluation of the
+// alert, returned by Get and Index. Must be called under alertsLock.
+func (a *AlertManager) recordEval(id api.UUID, now time.Time, err error) {
+	al, ok := a.alerts[id]
+	if !ok {
+		return
+	}
+
+	al.LastEvalTime = now
+	al.LastError = ""
+	if err != nil {
+		al.LastError = err.Error()
+	}
+}
+
+// Unhealthy returns the reason why the evaluation of an alert panicked, if
+// it did
+func (a *AlertManager) Unhealthy(id api.UUID) (string, bool) {
+	a.alertsLock.RLock()
+	defer a.alertsLock.RUnlock()
+
+	reason, ok := a.unhealthy[id]
+	return reason, ok
+}
+
+// resumeThrottled evaluates the alerts left by a throttled evaluation
+func (a *AlertManager) resumeThrottled() {
+	a.throttledLock.Lock()
+	throttled := len(a.throttled)
+	a.throttledLock.Unlock()
+
+	if throttled == 0 {
+		return
+	}
+
+	a.Graph.Lock()
+	defer a.Graph.Unlock()
+
+	a.EvalNodes()
+}
+
+// EvalNodes evaluates the enabled alerts and returns how many fired, must
+// be called under graph lock. The evaluation stops once it lasted more than
+// analyzer.alert_eval_budget milliseconds so that the graph events are not
+// blocked, the remaining alerts are then evaluated on the next tick.
+func (a *AlertManager) EvalNodes() int {
+	budget := time.Duration(config.GetConfig().GetInt("analyzer.alert_eval_budget")) * time.Millisecond
+	return a.evalNodes(budget)
+}
+
+// ForceEvaluate evaluates all the alerts right away, regardless of the
+// evaluation budget, and returns how many alerts fired
+func (a *AlertManager) ForceEvaluate() int {
+	a.Graph.Lock()
+	defer a.Graph.Unlock()
+
+	return a.evalNodes(0)
 }
 
 func (a *AlertManager) OnNodeUpdated(n *graph.Node) {
+	// the flags set by the alerts don't trigger an evaluation
+	if a.updatingMetadata {
+		return
+	}
 	a.EvalNodes()
 }
 
@@ -144,22 +1038,134 @@ func (a *AlertManager) OnNodeAdded(n *graph.Node) {
 	a.EvalNodes()
 }
 
+func (a *AlertManager) OnNodeDeleted(n *graph.Node) {
+	a.clearNode(n.ID)
+	a.deltas.evict(n.ID)
+}
+
 func (a *AlertManager) SetAlert(at *api.Alert) {
 	logging.GetLogger().Debugf("New alert added: %v", at)
 
+	// the manager keeps its own copy so that the caller can't alter it
+	// while it is evaluated
+	al := *at
+
 	a.alertsLock.Lock()
 	defer a.alertsLock.Unlock()
 
-	a.alerts[at.UUID] = at
+	// keep the count of an updated alert, ex: when enabled/disabled
+	if old, ok := a.alerts[al.UUID]; ok && old.Count > al.Count {
+		al.Count = old.Count
+	}
+
+	a.alerts[al.UUID] = &al
+
+	// an updated alert gets evaluated again
+	delete(a.unhealthy, al.UUID)
 }
 
-func (a *AlertManager) DeleteAlert(id string) {
-	logging.GetLogger().Debugf("Alert deleted: %s", id)
+// Get returns a copy of the alert with the given UUID
+func (a *AlertManager) Get(id api.UUID) (*api.Alert, bool) {
+	a.alertsLock.RLock()
+	defer a.alertsLock.RUnlock()
+
+	al, ok := a.alerts[id]
+	if !ok {
+		return nil, false
+	}
+
+	c := *al
+	return &c, true
+}
+
+// Index returns a copy of all the alerts known by the manager
+func (a *AlertManager) Index() map[api.UUID]*api.Alert {
+	a.alertsLock.RLock()
+	defer a.alertsLock.RUnlock()
+
+	alerts := make(map[api.UUID]*api.Alert, len(a.alerts))
+	for id, al := range a.alerts {
+		c := *al
+		alerts[id] = &c
+	}
+
+	return alerts
+}
+
+// LimitedAlertHandler is the alert API handler refusing to create an alert
+// once the manager knows MaxCount alerts, the updates of the existing alerts
+// being still allowed. 0 means unlimited.
+type LimitedAlertHandler struct {
+	api.ApiHandler
+	Manager  *AlertManager
+	MaxCount int
+}
+
+// Create stores the alert, waiting for a running reconciliation to complete
+func (h *LimitedAlertHandler) Create(resource api.ApiResource) error {
+	h.Manager.reconcileLock.Lock()
+	defer h.Manager.reconcileLock.Unlock()
+
+	if h.MaxCount > 0 {
+		h.Manager.alertsLock.RLock()
+		_, exists := h.Manager.alerts[resource.(*api.Alert).UUID]
+		count := len(h.Manager.alerts)
+		h.Manager.alertsLock.RUnlock()
+
+		if !exists && count >= h.MaxCount {
+			return &api.LimitError{Resource: "alerts", Max: h.MaxCount}
+		}
+	}
+
+	return h.ApiHandler.Create(resource)
+}
+
+// Delete removes the alert, waiting for a running reconciliation to complete
+func (h *LimitedAlertHandler) Delete(id string) error {
+	h.Manager.reconcileLock.Lock()
+	defer h.Manager.reconcileLock.Unlock()
+
+	return h.ApiHandler.Delete(id)
+}
+
+// NewLimitedAlertHandler returns the alert API handler of the manager
+// limited to maxCount alerts
+func NewLimitedAlertHandler(a *AlertManager, maxCount int) *LimitedAlertHandler {
+	return &LimitedAlertHandler{
+		ApiHandler: a.AlertHandler,
+		Manager:    a,
+		MaxCount:   maxCount,
+	}
+}
+
+func (a *AlertManager) DeleteAlert(id api.UUID) {
+	logging.GetLogger().Debugf("Alert deleted: %s", id.String())
 
 	a.alertsLock.Lock()
 	defer a.alertsLock.Unlock()
 
 	delete(a.alerts, id)
+	delete(a.unhealthy, id)
+
+	a.limitersLock.Lock()
+	delete(a.limiters, id.String())
+	a.limitersLock.Unlock()
+}
+
+// ExportAlerts streams the alerts known by the manager as a JSON object
+// indexed by UUID. The alerts are copied first so that a slow writer doesn't
+// block the alert updates.
+func (a *AlertManager) ExportAlerts(w io.Writer) error {
+	alerts := a.Index()
+
+	enc := api.NewAlertEncoder(w)
+	for _, al := range alerts {
+		if err := enc.Encode(al.UUID.String(), al); err != nil {
+			return err
+		}
+	}
+
+	return enc.Close()
 }
 
 func (a *AlertManager) onApiWatcherEvent(action string, id string, resource api.ApiResource) {
@@ -167,27 +1173,80 @@ func (a *AlertManager) onApiWatcherEvent(action string, id string, resource api.
 	case "init", "create", "set", "update":
 		a.SetAlert(resource.(*api.Alert))
 	case "expire", "delete":
-		a.DeleteAlert(id)
+		u, err := api.ParseUUID(id)
+		if err != nil {
+			logging.GetLogger().Errorf("Invalid alert UUID %s: %s", id, err.Error())
+			return
+		}
+		a.DeleteAlert(u)
 	}
 }
 
+// WatcherIndex returns the etcd index of the last alert event handled, 0 if
+// the alert handler doesn't report it
+func (a *AlertManager) WatcherIndex() uint64 {
+	if w, ok := a.watcher.(api.IndexedWatcher); ok {
+		return w.LastIndex()
+	}
+	return 0
+}
+
 func (a *AlertManager) Start() {
 	a.watcher = a.AlertHandler.AsyncWatch(a.onApiWatcherEvent)
 
 	a.Graph.AddEventListener(a)
+
+	go a.asyncTick()
 }
 
 func (a *AlertManager) Stop() {
+	a.Graph.RemoveEventListener(a)
 
+	// closed rather than sent to, the ticker may not run if the manager
+	// wasn't started
+	close(a.quit)
+
+	if a.watcher != nil {
+		a.watcher.Stop()
+	}
 }
 
-func NewAlertManager(g *graph.Graph, ah api.ApiHandler) *AlertManager {
+// NewAlertManager returns an alert manager, failing if the alerts backend
+// can't be used to store and watch the alerts
+func NewAlertManager(g *graph.Graph, ah api.ApiHandler) (*AlertManager, error) {
+	if tester, ok := ah.(api.ApiSelfTester); ok {
+		if err := tester.SelfTest(); err != nil {
+			endpoints := strings.Join(config.GetConfig().GetStringSlice("etcd.servers"), ",")
+			return nil, fmt.Errorf("etcd %s not usable for the alerts: %s", endpoints, err.Error())
+		}
+	}
+
+	TimestampFormat = config.GetConfig().GetString("analyzer.alert_timestamp_format")
+	parsedTests.setSize(config.GetConfig().GetInt("analyzer.alert_test_cache_size"))
+
+	maxCount := config.GetConfig().GetInt("alert.max_count")
+	if path := config.GetConfig().GetString("analyzer.alerts_file"); path != "" {
+		if err := loadAlertsFile(ah, path, maxCount); err != nil {
+			logging.GetLogger().Errorf("Unable to load alerts file: %s", err.Error())
+		}
+	}
+
 	return &AlertManager{
 		Graph:          g,
 		AlertHandler:   ah,
-		alerts:         make(map[string]*api.Alert),
+		alerts:         make(map[api.UUID]*api.Alert),
 		eventListeners: make(map[AlertEventListener]AlertEventListener),
-	}
+		groups:         make(map[string]*alertGroup),
+		limiters:       make(map[string]*actionLimiter),
+		deltas:         newDeltaHistory(),
+		selects:        newSelectCache(),
+		throttled:      make(map[api.UUID]bool),
+		flagged:        make(map[api.UUID]*alertFlags),
+		unhealthy:      make(map[api.UUID]string),
+		correlations:   make(map[string]*correlation),
+		quit:           make(chan struct{}),
+		maxCount:       maxCount,
+	}, nil
 }
 
 /*
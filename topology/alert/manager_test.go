@@ -0,0 +1,885 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package alert
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redhat-cip/skydive/api"
+	"github.com/redhat-cip/skydive/api/apitest"
+	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+func newGraph(t *testing.T) *graph.Graph {
+	b, err := graph.NewMemoryBackend()
+	if err != nil {
+		t.Error(err.Error())
+	}
+
+	g, err := graph.NewGraph(b)
+	if err != nil {
+		t.Error(err.Error())
+	}
+
+	return g
+}
+
+func newAlertManager(t *testing.T, g *graph.Graph, ah api.ApiHandler) *AlertManager {
+	a, err := NewAlertManager(g, ah)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestExpandAction(t *testing.T) {
+	os.Setenv("SKYDIVE_ALERT_TOKEN", "s3cr3t")
+	defer os.Unsetenv("SKYDIVE_ALERT_TOKEN")
+	os.Unsetenv("SKYDIVE_ALERT_UNDEFINED")
+
+	tests := map[string]string{
+		"http://hook/?token=${SKYDIVE_ALERT_TOKEN}":     "http://hook/?token=s3cr3t",
+		"http://hook/?token=${SKYDIVE_ALERT_UNDEFINED}": "http://hook/?token=",
+		"echo $$HOME":    "echo $HOME",
+		"no placeholder": "no placeholder",
+		"echo ${HOME}":   "echo ${HOME}",
+		"echo $HOME":     "echo $HOME",
+	}
+
+	for action, expected := range tests {
+		if expanded := expandAction(action); expanded != expected {
+			t.Errorf("Expected %s, got %s", expected, expanded)
+		}
+	}
+}
+
+func TestAggregateValues(t *testing.T) {
+	g := newGraph(t)
+	g.NewNode(graph.GenID(), graph.Metadata{"Type": "netns", "MTU": 1500})
+	g.NewNode(graph.GenID(), graph.Metadata{"Type": "netns", "MTU": 9000})
+
+	al := &api.Alert{Aggregate: "MTU"}
+	values := aggregateValues(al, g.LookupNodes(graph.Metadata{"Type": "netns"}))
+
+	if values["matchCount"] != 2 || values["matchSum"] != float64(10500) || values["matchAvg"] != float64(5250) {
+		t.Fatalf("Wrong aggregate values: %v", values)
+	}
+
+	if ok, err := evalTest("matchCount > 1 && matchAvg > 5000", values); err != nil || !ok {
+		t.Errorf("Aggregate test should match: %v", err)
+	}
+}
+
+func TestHostNodes(t *testing.T) {
+	g := newGraph(t)
+	for _, host := range []string{"compute-1", "compute-2", "network-1"} {
+		root := g.NewNode(graph.GenID(), graph.Metadata{"Name": host, "Type": "host"})
+		intf := g.NewNode(graph.GenID(), graph.Metadata{"Name": "eth0", "Type": "device"})
+		g.Link(root, intf, graph.Metadata{"RelationType": "ownership"})
+	}
+
+	a := newAlertManager(t, g, nil)
+	nodes := g.LookupNodes(graph.Metadata{"Type": "device"})
+
+	if owned := a.hostNodes("compute-2", nodes); len(owned) != 1 {
+		t.Errorf("Expected 1 node owned by compute-2, got %d", len(owned))
+	}
+
+	if owned := a.hostNodes("compute-*", nodes); len(owned) != 2 {
+		t.Errorf("Expected 2 nodes owned by compute-*, got %d", len(owned))
+	}
+}
+
+type fakeAlertListener struct {
+	messages []*AlertMessage
+}
+
+func (l *fakeAlertListener) OnAlert(msg *AlertMessage) {
+	l.messages = append(l.messages, msg)
+}
+
+func TestGroupWindow(t *testing.T) {
+	g := newGraph(t)
+	g.NewNode(graph.GenID(), graph.Metadata{"Type": "netns", "MTU": 1500})
+
+	a := newAlertManager(t, g, nil)
+	l := &fakeAlertListener{}
+	a.AddEventListener(l)
+
+	al := api.NewAlert()
+	al.Select = "MTU"
+	al.Test = "MTU > 1000"
+	al.GroupWindow = 10
+	a.SetAlert(al)
+
+	a.EvalNodes()
+	a.EvalNodes()
+	if fired := a.ForceEvaluate(); fired != 1 {
+		t.Errorf("Expected 1 alert fired, got %d", fired)
+	}
+
+	a.flushGroups(time.Now())
+	if len(l.messages) != 0 {
+		t.Fatalf("Fires shouldn't be sent before the end of the window: %v", l.messages)
+	}
+
+	a.flushGroups(time.Now().Add(11 * time.Second))
+	if len(l.messages) != 1 || l.messages[0].Occurrences != 3 || l.messages[0].Count != 3 {
+		t.Fatalf("Expected one message with 3 occurrences, got %v", l.messages)
+	}
+
+	if l.messages[0].LastSeen.Before(l.messages[0].FirstSeen) {
+		t.Errorf("Wrong first/last seen: %v", l.messages[0])
+	}
+}
+
+func TestNodeDeleted(t *testing.T) {
+	g := newGraph(t)
+	n1 := g.NewNode(graph.GenID(), graph.Metadata{"Type": "netns", "MTU": 1500})
+	g.NewNode(graph.GenID(), graph.Metadata{"Type": "netns", "MTU": 9000})
+
+	a := newAlertManager(t, g, nil)
+	l := &fakeAlertListener{}
+	a.AddEventListener(l)
+
+	al := api.NewAlert()
+	al.Select = "MTU"
+	al.Test = "MTU > 1000"
+	al.GroupWindow = 10
+	a.SetAlert(al)
+
+	a.EvalNodes()
+	a.OnNodeDeleted(n1)
+
+	a.flushGroups(time.Now().Add(11 * time.Second))
+	if len(l.messages) != 1 || messageNodeID(l.messages[0]) == string(n1.ID) {
+		t.Fatalf("Only the fires of the remaining node should be sent, got %v", l.messages)
+	}
+}
+
+func TestExportAlerts(t *testing.T) {
+	a := newAlertManager(t, newGraph(t), nil)
+
+	var b bytes.Buffer
+	if err := a.ExportAlerts(&b); err != nil || b.String() != "{}\n" {
+		t.Fatalf("Expected an empty object, got %s: %v", b.String(), err)
+	}
+
+	for _, test := range []string{"MTU > 1000", "MTU < 1000"} {
+		al := api.NewAlert()
+		al.Select = "MTU"
+		al.Test = test
+		a.SetAlert(al)
+	}
+
+	b.Reset()
+	if err := a.ExportAlerts(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	var alerts map[string]*api.Alert
+	if err := json.Unmarshal(b.Bytes(), &alerts); err != nil {
+		t.Fatalf("Invalid export %s: %s", b.String(), err.Error())
+	}
+
+	if len(alerts) != 2 {
+		t.Fatalf("Expected 2 alerts, got %v", alerts)
+	}
+	for id, al := range alerts {
+		if al.UUID.String() != id || al.Select != "MTU" {
+			t.Errorf("Wrong exported alert %s: %v", id, al)
+		}
+	}
+}
+
+func TestGetCopy(t *testing.T) {
+	g := newGraph(t)
+	g.NewNode(graph.GenID(), graph.Metadata{"Type": "netns", "MTU": 1500})
+
+	a := newAlertManager(t, g, nil)
+
+	al := api.NewAlert()
+	al.Select = "MTU"
+	al.Test = "MTU > 1000"
+	a.SetAlert(al)
+
+	// neither the stored alert nor the returned ones alias the caller's
+	al.Test = "MTU < 1000"
+	got, ok := a.Get(al.UUID)
+	if !ok || got.Test != "MTU > 1000" {
+		t.Fatalf("Stored alert altered by the caller: %v", got)
+	}
+
+	got.UUID = api.NewUUID()
+	a.Index()[al.UUID].Select = "Name"
+	if got, _ := a.Get(al.UUID); got.UUID != al.UUID || got.Select != "MTU" {
+		t.Fatalf("Stored alert altered through a returned copy: %v", got)
+	}
+
+	// to be run with -race
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				al := api.NewAlert()
+				al.Select = "MTU"
+				al.Test = "MTU > 1000"
+				a.SetAlert(al)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if got, ok := a.Get(al.UUID); ok {
+					got.Count++
+				}
+				var b bytes.Buffer
+				a.ExportAlerts(&b)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				a.ForceEvaluate()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := len(a.Index()); n != 201 {
+		t.Errorf("Expected 201 alerts, got %d", n)
+	}
+}
+
+func TestEvalBudget(t *testing.T) {
+	g := newGraph(t)
+	g.NewNode(graph.GenID(), graph.Metadata{"Type": "netns", "MTU": 1500})
+
+	a := newAlertManager(t, g, nil)
+	for i := 0; i < 3; i++ {
+		al := api.NewAlert()
+		al.Select = "MTU"
+		al.Test = "MTU > 1000"
+		a.SetAlert(al)
+	}
+
+	if fired := a.evalNodes(time.Nanosecond); fired != 1 || len(a.throttled) != 2 {
+		t.Fatalf("Expected 1 alert evaluated and 2 throttled, got %d fired and %d throttled", fired, len(a.throttled))
+	}
+
+	throttled := a.throttled
+	a.throttledLock.Lock()
+	order := a.evalOrder()
+	a.throttledLock.Unlock()
+	if !throttled[order[0].UUID] || !throttled[order[1].UUID] {
+		t.Error("Throttled alerts should be evaluated first")
+	}
+
+	if fired := a.evalNodes(0); fired != 3 || len(a.throttled) != 0 {
+		t.Errorf("Expected all the alerts evaluated without budget, got %d fired and %d throttled", fired, len(a.throttled))
+	}
+}
+
+func TestRenderTemplate(t *testing.T) {
+	values := map[string]interface{}{"Name": "eth0", "Host": "web1"}
+
+	tests := map[string]string{
+		"Interface {{.Name}} on host {{.Host}} is down": "Interface eth0 on host web1 is down",
+		"static message":     "static message",
+		"unknown {{.Other}}": "unknown <no value>",
+		"broken {{.Name":     "broken {{.Name",
+	}
+
+	for tmpl, expected := range tests {
+		if rendered := renderTemplate(tmpl, values); rendered != expected {
+			t.Errorf("Expected %s, got %s", expected, rendered)
+		}
+	}
+}
+
+func TestActionRateLimit(t *testing.T) {
+	g := newGraph(t)
+	a := newAlertManager(t, g, nil)
+
+	now := time.Now()
+	for i := 0; i != 2; i++ {
+		if allowed, _ := a.allowAction("alert", 2, now); !allowed {
+			t.Fatalf("Action %d should be allowed", i)
+		}
+	}
+
+	if allowed, limited := a.allowAction("alert", 2, now); allowed || !limited {
+		t.Errorf("First action above the limit should be marked as limited")
+	}
+
+	if allowed, limited := a.allowAction("alert", 2, now); allowed || limited {
+		t.Errorf("Further actions should be silently suppressed")
+	}
+
+	if allowed, _ := a.allowAction("alert", 2, now.Add(time.Minute)); !allowed {
+		t.Errorf("Actions should be allowed again in the next window")
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	g := newGraph(t)
+	host := g.NewNode(graph.GenID(), graph.Metadata{"Name": "host1", "Type": "host"})
+	intf := g.NewNode(graph.GenID(), graph.Metadata{"Name": "eth0", "Type": "device"})
+	g.NewNode(graph.GenID(), graph.Metadata{"Name": "eth1", "Type": "device"})
+	g.Link(host, intf)
+
+	a := newAlertManager(t, g, nil)
+	snapshot := a.snapshot([]*graph.Node{intf})
+
+	if len(snapshot.Nodes) != 2 || len(snapshot.Edges) != 1 {
+		t.Errorf("Expected the interface, its host and the link between them, got %v", snapshot)
+	}
+}
+
+func TestSnapshotSuppressed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skydive-alerts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config.GetConfig().Set("analyzer.alert_snapshot_dir", dir)
+
+	a := newAlertManager(t, newGraph(t), nil)
+	for i := 0; i < 3; i++ {
+		a.emit(&AlertMessage{UUID: "alert", Timestamp: time.Now(), snapshot: []byte("{}")}, 1, false)
+	}
+
+	// the writes are asynchronous, wait for them
+	time.Sleep(200 * time.Millisecond)
+
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("Expected a single snapshot for the message sent, got %d", len(files))
+	}
+}
+
+func TestPruneSnapshots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skydive-alerts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("alert-%d.json", i))
+		if err := ioutil.WriteFile(path, []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		mtime := now.Add(time.Duration(i) * time.Minute)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pruneSnapshots(dir, 2)
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 2 || files[0].Name() != "alert-3.json" || files[1].Name() != "alert-4.json" {
+		t.Errorf("Expected only the 2 most recent snapshots to be kept, got %v", files)
+	}
+}
+
+func TestNeighborAlert(t *testing.T) {
+	g := newGraph(t)
+	bridge := g.NewNode(graph.GenID(), graph.Metadata{"Name": "br0", "Type": "ovsbridge", "State": "UP"})
+	intf := g.NewNode(graph.GenID(), graph.Metadata{"Name": "eth0", "Type": "device", "State": "DOWN"})
+	g.NewNode(graph.GenID(), graph.Metadata{"Name": "eth1", "Type": "device", "State": "DOWN"})
+	g.Link(bridge, intf, graph.Metadata{"RelationType": "layer2"})
+
+	a := newAlertManager(t, g, nil)
+	l := &fakeAlertListener{}
+	a.AddEventListener(l)
+
+	al := api.NewAlert()
+	al.Select = "State"
+	al.Test = `State == "DOWN" && parent_State == "UP"`
+	al.NeighborEdge = "layer2"
+	al.NeighborAlias = "parent"
+	a.SetAlert(al)
+
+	a.EvalNodes()
+	if len(l.messages) != 1 || l.messages[0].ReasonData.(*graph.Node) != intf {
+		t.Errorf("Expected only eth0 to fire, got %v", l.messages)
+	}
+}
+
+func TestPanickingAlert(t *testing.T) {
+	g := newGraph(t)
+	// int64 values are not handled by the go-eval wrappers
+	g.NewNode(graph.GenID(), graph.Metadata{"Type": "netns", "MTU": 1500, "Bad": int64(1)})
+
+	a := newAlertManager(t, g, nil)
+
+	bad := api.NewAlert()
+	bad.Select = "Bad"
+	bad.Test = "Bad > 0"
+	a.SetAlert(bad)
+
+	good := api.NewAlert()
+	good.Select = "MTU"
+	good.Test = "MTU > 1000"
+	a.SetAlert(good)
+
+	if fired := a.ForceEvaluate(); fired != 1 {
+		t.Fatalf("Expected the healthy alert to fire, got %d fired", fired)
+	}
+
+	if _, ok := a.Unhealthy(bad.UUID); !ok {
+		t.Error("The panicking alert should be marked unhealthy")
+	}
+	if _, ok := a.Unhealthy(good.UUID); ok {
+		t.Error("The healthy alert shouldn't be marked unhealthy")
+	}
+
+	// the graph event handler keeps evaluating the healthy alerts
+	g.AddEventListener(a)
+	g.Lock()
+	g.NewNode(graph.GenID(), graph.Metadata{"Type": "netns", "MTU": 9000, "Bad": int64(2)})
+	g.Unlock()
+	if got, _ := a.Get(good.UUID); got.Count < 2 {
+		t.Errorf("Expected the healthy alert to fire on the new node, got count %d", got.Count)
+	}
+
+	// updating the alert makes it evaluated again
+	bad.Select = "MTU"
+	bad.Test = "MTU > 1000"
+	a.SetAlert(bad)
+	if _, ok := a.Unhealthy(bad.UUID); ok {
+		t.Error("An updated alert shouldn't be unhealthy anymore")
+	}
+	if fired := a.ForceEvaluate(); fired != 2 {
+		t.Errorf("Expected both alerts to fire, got %d fired", fired)
+	}
+}
+
+func TestEvalTestIdents(t *testing.T) {
+	idents := testIdents(`MTU > 1500 && contains(Name, "eth")`)
+	for _, ident := range []string{"MTU", "Name", "contains"} {
+		if !idents[ident] {
+			t.Errorf("%s should be referenced: %v", ident, idents)
+		}
+	}
+	if len(idents) != 3 {
+		t.Errorf("Wrong referenced identifiers: %v", idents)
+	}
+
+	// the values not referenced, even of unsupported types, are skipped
+	values := map[string]interface{}{
+		"MTU":   1800,
+		"Name":  "eth0",
+		"Peers": []string{"eth1", "eth2"},
+	}
+	if ok, err := evalTest(`MTU > 1500 && contains(Name, "eth")`, values); err != nil || !ok {
+		t.Errorf("Test should be true: %v", err)
+	}
+
+	if _, err := evalTest("Speed > 1000", values); err == nil {
+		t.Error("Test referencing an undefined value should fail")
+	}
+}
+
+func TestAlertLastError(t *testing.T) {
+	g := newGraph(t)
+	g.Lock()
+	g.NewNode(graph.GenID(), graph.Metadata{"Type": "netns", "MTU": 1500})
+	g.Unlock()
+
+	a := newAlertManager(t, g, nil)
+
+	al := api.NewAlert()
+	al.Select = "MTU"
+	al.Test = "MTU > Speed"
+	a.SetAlert(al)
+
+	a.ForceEvaluate()
+	got, _ := a.Get(al.UUID)
+	if got.LastError == "" || got.LastEvalTime.IsZero() {
+		t.Fatalf("The evaluation error should be kept: %+v", got)
+	}
+
+	al.Test = "MTU > 1000"
+	a.SetAlert(al)
+	a.ForceEvaluate()
+	if got := a.Index()[al.UUID]; got.LastError != "" || got.LastEvalTime.IsZero() {
+		t.Errorf("The evaluation error should be cleared: %+v", got)
+	}
+}
+
+func TestLimitedAlertHandler(t *testing.T) {
+	a := newAlertManager(t, newGraph(t), apitest.NewMemoryApiHandler(&api.AlertHandler{}))
+	h := NewLimitedAlertHandler(a, 2)
+
+	var alerts []*api.Alert
+	for _, test := range []string{"MTU > 1000", "MTU < 1000", "MTU == 1000"} {
+		al := api.NewAlert()
+		al.Select = "MTU"
+		al.Test = test
+		alerts = append(alerts, al)
+	}
+
+	for _, al := range alerts[:2] {
+		if err := h.Create(al); err != nil {
+			t.Fatal(err)
+		}
+		// known by the manager once watched from etcd
+		a.SetAlert(al)
+	}
+
+	err := h.Create(alerts[2])
+	if _, ok := err.(*api.LimitError); !ok {
+		t.Fatalf("Expected a limit error, got %v", err)
+	}
+
+	// updating an existing alert is allowed
+	alerts[0].Severity = api.CRITICAL
+	if err := h.Create(alerts[0]); err != nil {
+		t.Errorf("Update of an existing alert refused: %s", err.Error())
+	}
+
+	a.DeleteAlert(alerts[1].UUID)
+	if err := h.Create(alerts[2]); err != nil {
+		t.Errorf("Creation refused below the limit: %s", err.Error())
+	}
+
+	// 0 means unlimited
+	h.MaxCount = 0
+	if err := h.Create(api.NewAlert()); err != nil {
+		t.Errorf("Creation refused without limit: %s", err.Error())
+	}
+}
+
+func TestAlertMessageTimestampFormat(t *testing.T) {
+	defer func(format string) { TimestampFormat = format }(TimestampFormat)
+
+	now := time.Date(2016, 5, 4, 10, 20, 30, 123456789, time.UTC)
+	msg := &AlertMessage{UUID: "alert", Timestamp: now, FirstSeen: now, Count: 1}
+
+	var m map[string]interface{}
+	if err := json.Unmarshal(msg.Marshal(), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m["Timestamp"] != "2016-05-04T10:20:30.123456789Z" || m["UUID"] != "alert" {
+		t.Errorf("Expected an RFC3339 timestamp by default, got %v", m)
+	}
+
+	TimestampFormat = TimestampEpochMillis
+
+	m = nil
+	if err := json.Unmarshal(msg.Marshal(), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m["Timestamp"] != float64(1462357230123) || m["FirstSeen"] != float64(1462357230123) {
+		t.Errorf("Expected epoch millis timestamps, got %v", m)
+	}
+	if m["LastSeen"] != float64(0) || m["UUID"] != "alert" || m["Count"] != float64(1) {
+		t.Errorf("Wrong epoch millis message %v", m)
+	}
+}
+
+func TestLinkedAlert(t *testing.T) {
+	g := newGraph(t)
+	port := g.NewNode(graph.GenID(), graph.Metadata{"Name": "port0", "Type": "ovsport", "Rate": float64(900)})
+	intf := g.NewNode(graph.GenID(), graph.Metadata{"Name": "eth0", "Type": "device", "Speed": 1000})
+	slow := g.NewNode(graph.GenID(), graph.Metadata{"Name": "port1", "Type": "ovsport", "Rate": float64(900)})
+	g.Link(port, intf, graph.Metadata{"RelationType": "layer2"})
+	g.Link(slow, g.NewNode(graph.GenID(), graph.Metadata{"Name": "eth1", "Speed": "10000"}), graph.Metadata{"RelationType": "layer2"})
+	// no speed, skipped
+	g.NewNode(graph.GenID(), graph.Metadata{"Name": "port2", "Type": "ovsport", "Rate": float64(900)})
+
+	a := newAlertManager(t, g, nil)
+	l := &fakeAlertListener{}
+	a.AddEventListener(l)
+
+	al := api.NewAlert()
+	al.Select = "Rate"
+	al.Test = `Rate > 0.8 * linked_Speed`
+	al.LinkedEdge = "layer2"
+	al.LinkedField = "Speed"
+	a.SetAlert(al)
+
+	a.EvalNodes()
+	if len(l.messages) != 1 || l.messages[0].ReasonData.(*graph.Node) != port {
+		t.Errorf("Expected only port0 to fire, got %v", l.messages)
+	}
+	if stored, _ := a.Get(al.UUID); stored.LastError != "" {
+		t.Errorf("Nodes without linked speed should be skipped, got %s", stored.LastError)
+	}
+}
+
+func TestSelectCache(t *testing.T) {
+	g := newGraph(t)
+	g.NewNode(graph.GenID(), graph.Metadata{"Name": "eth0", "MTU": 1500})
+	lo := g.NewNode(graph.GenID(), graph.Metadata{"Name": "lo"})
+
+	a := newAlertManager(t, g, nil)
+	l := &fakeAlertListener{}
+	a.AddEventListener(l)
+
+	for _, test := range []string{"MTU > 1400", "MTU > 9000"} {
+		al := api.NewAlert()
+		al.Select = "MTU"
+		al.Test = test
+		a.SetAlert(al)
+	}
+
+	a.EvalNodes()
+	if a.selects.lookups != 1 {
+		t.Errorf("Expected the alerts sharing a select to scan the graph once, got %d", a.selects.lookups)
+	}
+	if len(l.messages) != 1 {
+		t.Fatalf("Expected eth0 to fire, got %v", l.messages)
+	}
+
+	// the nodes selected before the change are not kept
+	version := g.Version()
+	g.AddMetadata(lo, "MTU", 65536)
+	if g.Version() == version {
+		t.Error("Expected the graph version to change")
+	}
+
+	l.messages = nil
+	a.EvalNodes()
+	if len(l.messages) != 3 {
+		t.Errorf("Expected the new selected node to be evaluated, got %v", l.messages)
+	}
+}
+
+type fakeSyncListener struct {
+	fakeAlertListener
+	synchronous []*AlertMessage
+}
+
+func (l *fakeSyncListener) OnAlertSync(msg *AlertMessage, timeout time.Duration) error {
+	l.synchronous = append(l.synchronous, msg)
+	return nil
+}
+
+func TestSynchronousAlert(t *testing.T) {
+	g := newGraph(t)
+	g.NewNode(graph.GenID(), graph.Metadata{"Name": "eth0", "MTU": 1500})
+
+	a := newAlertManager(t, g, nil)
+	l := &fakeSyncListener{}
+	a.AddEventListener(l)
+
+	al := api.NewAlert()
+	al.Select = "MTU"
+	al.Test = "MTU > 1400"
+	a.SetAlert(al)
+
+	critical := api.NewAlert()
+	critical.Select = "MTU"
+	critical.Test = "MTU > 1400"
+	critical.Synchronous = true
+	a.SetAlert(critical)
+
+	a.EvalNodes()
+	if len(l.messages) != 1 || l.messages[0].UUID != al.UUID.String() {
+		t.Errorf("Expected the asynchronous alert to be delivered by OnAlert, got %v", l.messages)
+	}
+	if len(l.synchronous) != 1 || l.synchronous[0].UUID != critical.UUID.String() {
+		t.Errorf("Expected the synchronous alert to be delivered by OnAlertSync, got %v", l.synchronous)
+	}
+}
+
+// latchingAlertHandler stores the alerts in memory, failing the first
+// updates and reporting the given version of the stored alerts
+type latchingAlertHandler struct {
+	*apitest.MemoryApiHandler
+	version  uint64
+	failures int
+	results  chan error
+}
+
+func (h *latchingAlertHandler) Update(id string, update func(api.ApiResource, uint64) error) error {
+	if h.failures > 0 {
+		h.failures--
+		err := fmt.Errorf("etcd unavailable")
+		h.results <- err
+		return err
+	}
+
+	err := h.MemoryApiHandler.Update(id, func(r api.ApiResource, _ uint64) error {
+		return update(r, h.version)
+	})
+	h.results <- err
+	return err
+}
+
+func TestFireOnceAlert(t *testing.T) {
+	g := newGraph(t)
+	g.NewNode(graph.GenID(), graph.Metadata{"Name": "eth0", "MTU": 1500})
+	g.NewNode(graph.GenID(), graph.Metadata{"Name": "eth1", "MTU": 1500})
+
+	h := &latchingAlertHandler{
+		MemoryApiHandler: apitest.NewMemoryApiHandler(&api.AlertHandler{}),
+		failures:         1,
+		results:          make(chan error, 10),
+	}
+	a := newAlertManager(t, g, h)
+	defer a.Stop()
+	l := &fakeAlertListener{}
+	a.AddEventListener(l)
+
+	al := api.NewAlert()
+	al.Name = "mtu"
+	al.Select = "MTU"
+	al.Test = "MTU > 1400"
+	al.FireOnce = true
+	a.SetAlert(al)
+
+	// edited through the API after being loaded by the manager
+	stored := *al
+	stored.Action = "http://hook/"
+	h.Create(&stored)
+
+	a.EvalNodes()
+	a.EvalNodes()
+	if len(l.messages) != 1 {
+		t.Errorf("Expected the alert to fire once, got %v", l.messages)
+	}
+
+	// the failed write is retried
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-h.results:
+			if (i == 0) != (err != nil) {
+				t.Errorf("Unexpected result of update %d: %v", i, err)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("Disabled alert not persisted")
+		}
+	}
+
+	r, _ := h.Get(al.ID())
+	if persisted := r.(*api.Alert); persisted.Enabled || persisted.Action != "http://hook/" {
+		t.Errorf("Expected only Enabled to be changed, got %+v", persisted)
+	}
+
+	// enabled again through the API
+	al.Enabled = true
+	a.SetAlert(al)
+	a.EvalNodes()
+	if len(l.messages) != 2 {
+		t.Errorf("Expected the re-enabled alert to fire again, got %v", l.messages)
+	}
+}
+
+func TestFireOnceAlertModified(t *testing.T) {
+	g := newGraph(t)
+	g.NewNode(graph.GenID(), graph.Metadata{"Name": "eth0", "MTU": 1500})
+
+	// the stored alert is more recent than the alerts known by the manager
+	h := &latchingAlertHandler{
+		MemoryApiHandler: apitest.NewMemoryApiHandler(&api.AlertHandler{}),
+		version:          1,
+		results:          make(chan error, 10),
+	}
+	a := newAlertManager(t, g, h)
+	defer a.Stop()
+
+	al := api.NewAlert()
+	al.Name = "mtu"
+	al.Select = "MTU"
+	al.Test = "MTU > 1400"
+	al.FireOnce = true
+	a.SetAlert(al)
+
+	stored := *al
+	h.Create(&stored)
+
+	a.EvalNodes()
+
+	select {
+	case err := <-h.results:
+		if err != errAlertChanged {
+			t.Errorf("Expected the latch to be dropped, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Latch not persisted")
+	}
+
+	if r, _ := h.Get(al.ID()); !r.(*api.Alert).Enabled {
+		t.Error("Expected the modified alert to stay enabled")
+	}
+}
+
+func TestTestCache(t *testing.T) {
+	c := newTestCache(2)
+
+	c.get("MTU > 1500")
+	c.get("Speed > 1000")
+	if p := c.get("MTU > 1500"); p.err != nil || !p.idents["MTU"] || c.parses != 2 {
+		t.Errorf("Expected the cached test, got %+v after %d parses", p, c.parses)
+	}
+
+	// the least recently used test is evicted
+	c.get("State == \"UP\"")
+	if _, ok := c.entries["Speed > 1000"]; ok || c.lru.Len() != 2 {
+		t.Errorf("Expected Speed > 1000 to be evicted: %v", c.entries)
+	}
+	if c.get("MTU > 1500"); c.parses != 3 {
+		t.Errorf("Expected MTU > 1500 to stay cached, got %d parses", c.parses)
+	}
+
+	if p := c.get("MTU >"); p.err == nil {
+		t.Error("Expected a parse error")
+	}
+
+	c.setSize(1)
+	if c.lru.Len() != 1 {
+		t.Errorf("Expected the cache to be shrunk, got %d tests", c.lru.Len())
+	}
+}
+
+func TestStopNotStarted(t *testing.T) {
+	a := newAlertManager(t, newGraph(t), apitest.NewMemoryApiHandler(&api.AlertHandler{}))
+
+	stopped := make(chan struct{})
+	go func() {
+		a.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Stopping a manager not started should not block")
+	}
+}
@@ -0,0 +1,135 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package alert
+
+import (
+	"strings"
+
+	"github.com/redhat-cip/skydive/api"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+const metadataActionPrefix = "metadata:"
+
+// metadataKey returns the metadata flag set on the nodes matched by an alert
+// whose action is metadata:<key>, empty for the other actions
+func metadataKey(al *api.Alert) string {
+	if !strings.HasPrefix(al.Action, metadataActionPrefix) {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(al.Action, metadataActionPrefix))
+}
+
+// setNodeFlag writes the flag of an alert on a node. The graph listeners are
+// notified synchronously, the manager ignores the updates it is doing so that
+// the flag doesn't trigger a new evaluation. Must be called under graph lock.
+func (a *AlertManager) setNodeFlag(n *graph.Node, key string, firing bool) {
+	a.updatingMetadata = true
+	defer func() { a.updatingMetadata = false }()
+
+	if firing {
+		a.Graph.AddMetadata(n, key, true)
+		return
+	}
+
+	if _, ok := n.Metadata()[key]; !ok {
+		return
+	}
+
+	m := make(graph.Metadata)
+	for k, v := range n.Metadata() {
+		if k != key {
+			m[k] = v
+		}
+	}
+	a.Graph.SetMetadata(n, m)
+}
+
+// alertFlags are the nodes on which an alert set its flag
+type alertFlags struct {
+	key   string
+	nodes map[graph.Identifier]bool
+}
+
+// flaggedByOthers returns whether another alert keeps the flag set on the node
+func (a *AlertManager) flaggedByOthers(id api.UUID, key string, node graph.Identifier) bool {
+	for other, flags := range a.flagged {
+		if other != id && flags.key == key && flags.nodes[node] {
+			return true
+		}
+	}
+	return false
+}
+
+// clearFlags clears the flags set by the alert, except on the given nodes.
+// Must be called under graph lock and alertsLock.
+func (a *AlertManager) clearFlags(id api.UUID, keep map[graph.Identifier]bool) {
+	flags, ok := a.flagged[id]
+	if !ok {
+		return
+	}
+	delete(a.flagged, id)
+
+	for node := range flags.nodes {
+		if keep[node] || a.flaggedByOthers(id, flags.key, node) {
+			continue
+		}
+		if n := a.Graph.GetNode(node); n != nil {
+			a.setNodeFlag(n, flags.key, false)
+		}
+	}
+}
+
+// updateFlags sets the flag of the alert on the firing nodes and clears it
+// from the nodes flagged by a previous evaluation that don't fire anymore.
+// Must be called under graph lock and alertsLock.
+func (a *AlertManager) updateFlags(al *api.Alert, key string, firing []*graph.Node) {
+	if flags, ok := a.flagged[al.UUID]; ok && flags.key != key {
+		a.clearFlags(al.UUID, nil)
+	}
+
+	flags := &alertFlags{key: key, nodes: make(map[graph.Identifier]bool)}
+	for _, n := range firing {
+		if previous, ok := a.flagged[al.UUID]; !ok || !previous.nodes[n.ID] {
+			a.setNodeFlag(n, key, true)
+		}
+		flags.nodes[n.ID] = true
+	}
+
+	a.clearFlags(al.UUID, flags.nodes)
+
+	if len(flags.nodes) > 0 {
+		a.flagged[al.UUID] = flags
+	}
+}
+
+// clearStaleFlags clears the flags of the alerts deleted, disabled or whose
+// action doesn't set a flag anymore. Must be called under graph lock and
+// alertsLock.
+func (a *AlertManager) clearStaleFlags() {
+	for id := range a.flagged {
+		if al, ok := a.alerts[id]; !ok || !al.Enabled || metadataKey(al) == "" {
+			a.clearFlags(id, nil)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package alert
+
+import (
+	"testing"
+
+	"github.com/redhat-cip/skydive/api"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+func TestMetadataAction(t *testing.T) {
+	g := newGraph(t)
+	n := g.NewNode(graph.GenID(), graph.Metadata{"Type": "netns", "MTU": 1500})
+
+	a := newAlertManager(t, g, nil)
+	g.AddEventListener(a)
+
+	al := api.NewAlert()
+	al.Select = "MTU"
+	al.Test = "MTU > 1000"
+	al.Action = "metadata:AlertFiring"
+	a.SetAlert(al)
+
+	// the flag write notifies the manager, which must not evaluate again
+	// under its own locks
+	if fired := a.ForceEvaluate(); fired != 1 {
+		t.Fatalf("Expected the alert to fire, got %d", fired)
+	}
+
+	g.Lock()
+	if n.Metadata()["AlertFiring"] != true {
+		t.Errorf("Firing node not flagged: %v", n.Metadata())
+	}
+
+	// resolved by the node update
+	g.AddMetadata(n, "MTU", 500)
+	if _, ok := n.Metadata()["AlertFiring"]; ok {
+		t.Errorf("Flag not cleared once the alert resolved: %v", n.Metadata())
+	}
+
+	g.AddMetadata(n, "MTU", 9000)
+	if n.Metadata()["AlertFiring"] != true {
+		t.Errorf("Node not flagged again: %v", n.Metadata())
+	}
+	g.Unlock()
+
+	a.DeleteAlert(al.UUID)
+	a.ForceEvaluate()
+
+	g.Lock()
+	if _, ok := n.Metadata()["AlertFiring"]; ok {
+		t.Errorf("Flag not cleared once the alert deleted: %v", n.Metadata())
+	}
+	g.Unlock()
+}
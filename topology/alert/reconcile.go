@@ -0,0 +1,179 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package alert
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/redhat-cip/skydive/api"
+	"github.com/redhat-cip/skydive/logging"
+)
+
+// ReconcileSummary counts the changes applied by ReconcileAlerts
+type ReconcileSummary struct {
+	Created int
+	Updated int
+	Deleted int
+}
+
+// reconcileChange is a change staged by ReconcileAlerts, alert is the alert
+// to store, nil to delete previous, and previous the stored alert, nil for a
+// creation
+type reconcileChange struct {
+	alert    *api.Alert
+	previous *api.Alert
+}
+
+func (a *AlertManager) applyChange(c reconcileChange) error {
+	if c.alert == nil {
+		return a.AlertHandler.Delete(c.previous.ID())
+	}
+	return a.AlertHandler.Create(c.alert)
+}
+
+// revertChange restores the state preceding an applied change
+func (a *AlertManager) revertChange(c reconcileChange) error {
+	if c.previous == nil {
+		return a.AlertHandler.Delete(c.alert.ID())
+	}
+	return a.AlertHandler.Create(c.previous)
+}
+
+// sameDefinition compares two alerts ignoring the fields maintained by the
+// analyzer
+func sameDefinition(current *api.Alert, desired *api.Alert) bool {
+	c, d := *current, *desired
+	d.UUID, d.CreateTime, d.Count, d.Hash = c.UUID, c.CreateTime, c.Count, c.Hash
+	d.LastError, d.LastEvalTime = c.LastError, c.LastEvalTime
+	return c == d
+}
+
+// ReconcileAlerts makes the stored alerts match the desired ones. A desired
+// alert matches a stored alert having the same UUID or, without UUID, the
+// same content hash. Matching alerts are updated if their definition
+// changed, the others are created and the stored alerts left unmatched are
+// deleted. All the desired alerts are validated before any change is applied
+// and the applied changes are reverted if one of them fails. The alert API
+// handler is locked out meanwhile. The desired alerts can't exceed
+// alert.max_count.
+func (a *AlertManager) ReconcileAlerts(desired []*api.Alert) (*ReconcileSummary, error) {
+	a.reconcileLock.Lock()
+	defer a.reconcileLock.Unlock()
+
+	// all the stored alerts are either desired or deleted
+	if a.maxCount > 0 && len(desired) > a.maxCount {
+		return nil, &api.LimitError{Resource: "alerts", Max: a.maxCount}
+	}
+
+	uuids := make(map[api.UUID]bool)
+	for _, al := range desired {
+		if err := al.Validate(); err != nil {
+			return nil, fmt.Errorf("alert %s: %s", al.Name, err.Error())
+		}
+
+		if !al.UUID.IsZero() {
+			if uuids[al.UUID] {
+				return nil, fmt.Errorf("alert %s: duplicated UUID %s", al.Name, al.UUID)
+			}
+			uuids[al.UUID] = true
+		}
+	}
+
+	current := make(map[api.UUID]*api.Alert)
+	for _, r := range a.AlertHandler.Index() {
+		c := r.(*api.Alert)
+		current[c.UUID] = c
+	}
+
+	// resolve the matches first so that a desired alert without UUID can't
+	// take the stored alert explicitly referenced by another one
+	matches := make([]*api.Alert, len(desired))
+	for i, al := range desired {
+		if !al.UUID.IsZero() {
+			if c, ok := current[al.UUID]; ok {
+				matches[i] = c
+				delete(current, al.UUID)
+			}
+		}
+	}
+
+	for i, al := range desired {
+		if matches[i] != nil || !al.UUID.IsZero() {
+			continue
+		}
+
+		hash := al.ContentHash()
+		for id, c := range current {
+			if c.ContentHash() == hash {
+				matches[i] = c
+				delete(current, id)
+				break
+			}
+		}
+	}
+
+	summary := &ReconcileSummary{}
+	var changes []reconcileChange
+	for i, al := range desired {
+		alert := *al
+
+		if c := matches[i]; c != nil {
+			if sameDefinition(c, al) {
+				continue
+			}
+
+			alert.UUID, alert.CreateTime, alert.Count = c.UUID, c.CreateTime, c.Count
+			changes = append(changes, reconcileChange{alert: &alert, previous: c})
+			summary.Updated++
+			continue
+		}
+
+		if alert.UUID.IsZero() {
+			alert.UUID = api.NewUUID()
+		}
+		alert.CreateTime = time.Now()
+		changes = append(changes, reconcileChange{alert: &alert})
+		summary.Created++
+	}
+
+	for _, c := range current {
+		changes = append(changes, reconcileChange{previous: c})
+		summary.Deleted++
+	}
+
+	for i, c := range changes {
+		if err := a.applyChange(c); err != nil {
+			for j := i - 1; j >= 0; j-- {
+				if err := a.revertChange(changes[j]); err != nil {
+					logging.GetLogger().Errorf("Unable to revert an alert reconciliation change %s", logging.Fields("error", err))
+				}
+			}
+			return nil, err
+		}
+	}
+
+	logging.GetLogger().Infof("Alerts reconciled %s", logging.Fields("created", summary.Created, "updated", summary.Updated, "deleted", summary.Deleted))
+
+	return summary, nil
+}
@@ -0,0 +1,175 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package alert
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/redhat-cip/skydive/api"
+	"github.com/redhat-cip/skydive/api/apitest"
+)
+
+func newReconcileAlert(name string, test string) *api.Alert {
+	al := api.NewAlert()
+	al.Name = name
+	al.Select = "MTU"
+	al.Test = test
+	return al
+}
+
+func TestReconcileAlerts(t *testing.T) {
+	h := apitest.NewMemoryApiHandler(&api.AlertHandler{})
+
+	kept := newReconcileAlert("kept", "MTU > 1500")
+	changed := newReconcileAlert("changed", "MTU > 9000")
+	removed := newReconcileAlert("removed", "MTU < 1500")
+	for _, al := range []*api.Alert{kept, changed, removed} {
+		h.Create(al)
+	}
+
+	g := newGraph(t)
+	a := newAlertManager(t, g, h)
+
+	// same content without UUID matches by hash, the changed one by UUID
+	sameKept := newReconcileAlert("kept", "MTU > 1500")
+	sameKept.UUID = api.UUID{}
+
+	update := *changed
+	update.Severity = api.CRITICAL
+
+	created := newReconcileAlert("created", "MTU == 1280")
+	created.UUID = api.UUID{}
+
+	summary, err := a.ReconcileAlerts([]*api.Alert{sameKept, &update, created})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *summary != (ReconcileSummary{Created: 1, Updated: 1, Deleted: 1}) {
+		t.Errorf("Wrong summary: %+v", summary)
+	}
+
+	if len(h.Index()) != 3 {
+		t.Fatalf("Wrong number of alerts: got %d, expected 3", len(h.Index()))
+	}
+
+	if _, ok := h.Get(removed.ID()); ok {
+		t.Error("Removed alert should have been deleted")
+	}
+
+	if r, ok := h.Get(kept.ID()); !ok || r.(*api.Alert).CreateTime != kept.CreateTime {
+		t.Error("Unchanged alert should have been kept")
+	}
+
+	if r, ok := h.Get(changed.ID()); !ok || r.(*api.Alert).Severity != api.CRITICAL {
+		t.Error("Changed alert should have been updated")
+	}
+
+	// a second run is a no-op
+	summary, err = a.ReconcileAlerts([]*api.Alert{sameKept, &update, created})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *summary != (ReconcileSummary{}) {
+		t.Errorf("Wrong summary: %+v", summary)
+	}
+
+	invalid := newReconcileAlert("invalid", "MTU >")
+	if _, err := a.ReconcileAlerts([]*api.Alert{invalid}); err == nil {
+		t.Error("Invalid alert should have been rejected")
+	}
+
+	if len(h.Index()) != 3 {
+		t.Errorf("Nothing should be applied when an alert is invalid, got %d alerts", len(h.Index()))
+	}
+
+	a.maxCount = 2
+	if _, err := a.ReconcileAlerts([]*api.Alert{sameKept, &update, created}); err == nil {
+		t.Error("Alerts above the maximum count should have been rejected")
+	} else if _, ok := err.(*api.LimitError); !ok {
+		t.Errorf("Expected a limit error, got %v", err)
+	}
+}
+
+// failingDeleteHandler is an alert handler unable to delete any alert
+type failingDeleteHandler struct {
+	*apitest.MemoryApiHandler
+}
+
+func (h *failingDeleteHandler) Delete(id string) error {
+	return errors.New("delete failed")
+}
+
+func TestReconcileAlertsRollback(t *testing.T) {
+	h := &failingDeleteHandler{apitest.NewMemoryApiHandler(&api.AlertHandler{})}
+
+	changed := newReconcileAlert("changed", "MTU > 9000")
+	removed := newReconcileAlert("removed", "MTU < 1500")
+	for _, al := range []*api.Alert{changed, removed} {
+		h.Create(al)
+	}
+
+	a := newAlertManager(t, newGraph(t), h)
+
+	update := *changed
+	update.Severity = api.CRITICAL
+
+	if _, err := a.ReconcileAlerts([]*api.Alert{&update}); err == nil {
+		t.Fatal("Expected the failed deletion to be returned")
+	}
+
+	if r, ok := h.Get(changed.ID()); !ok || r.(*api.Alert).Severity != changed.Severity {
+		t.Error("Updated alert should have been reverted")
+	}
+
+	if _, ok := h.Get(removed.ID()); !ok || len(h.Index()) != 2 {
+		t.Errorf("Expected the stored alerts to be kept, got %d alerts", len(h.Index()))
+	}
+}
+
+func TestReconcileExcludesApi(t *testing.T) {
+	a := newAlertManager(t, newGraph(t), apitest.NewMemoryApiHandler(&api.AlertHandler{}))
+	h := NewLimitedAlertHandler(a, 0)
+
+	// a reconciliation in progress
+	a.reconcileLock.Lock()
+
+	created := make(chan error)
+	go func() {
+		created <- h.Create(newReconcileAlert("api", "MTU > 1500"))
+	}()
+
+	select {
+	case <-created:
+		t.Fatal("Alert created during a reconciliation")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	a.reconcileLock.Unlock()
+	if err := <-created; err != nil {
+		t.Error(err)
+	}
+}
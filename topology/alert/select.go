@@ -0,0 +1,58 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package alert
+
+import (
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// selectCache keeps the nodes selected by the alerts so that the alerts
+// sharing a select don't scan the graph again. The cache is dropped as soon
+// as the graph version changes.
+type selectCache struct {
+	version uint64
+	nodes   map[string][]*graph.Node
+	lookups uint64
+}
+
+// lookup returns the nodes having the select key, must be called under
+// graph lock. The returned slice is shared and must not be modified.
+func (c *selectCache) lookup(g *graph.Graph, key string) []*graph.Node {
+	if version := g.Version(); version != c.version || c.nodes == nil {
+		c.version = version
+		c.nodes = make(map[string][]*graph.Node)
+	}
+
+	nodes, ok := c.nodes[key]
+	if !ok {
+		nodes = g.LookupNodesFromKey(key)
+		c.nodes[key] = nodes
+		c.lookups++
+	}
+
+	return nodes
+}
+
+func newSelectCache() *selectCache {
+	return &selectCache{}
+}
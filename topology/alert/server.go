@@ -23,7 +23,14 @@
 package alert
 
 import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/abbot/go-http-auth"
+
+	"github.com/redhat-cip/skydive/api"
 	shttp "github.com/redhat-cip/skydive/http"
+	"github.com/redhat-cip/skydive/logging"
 )
 
 const (
@@ -71,6 +78,87 @@ func (a *AlertServer) OnUnregisterClient(c *shttp.WSClient) {
 	delete(a.clients, c)
 }
 
+type EvaluateResult struct {
+	Fired int
+}
+
+func (a *AlertServer) evaluate(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	result := EvaluateResult{Fired: a.AlertManager.ForceEvaluate()}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		logging.GetLogger().Criticalf("Failed to display alert evaluation: %s", err.Error())
+	}
+}
+
+func (a *AlertServer) reconcile(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	var list []json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&list); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	desired := make([]*api.Alert, len(list))
+	for i, data := range list {
+		desired[i] = a.AlertManager.AlertHandler.New().(*api.Alert)
+		if err := json.Unmarshal(data, desired[i]); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	summary, err := a.AlertManager.ReconcileAlerts(desired)
+	if err != nil {
+		logging.GetLogger().Errorf("Failed to reconcile alerts: %s", err.Error())
+		if _, ok := err.(*api.LimitError); ok {
+			http.Error(w, err.Error(), http.StatusForbidden)
+		} else {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(summary); err != nil {
+		logging.GetLogger().Criticalf("Failed to display alert reconciliation: %s", err.Error())
+	}
+}
+
+func (a *AlertServer) export(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := a.AlertManager.ExportAlerts(w); err != nil {
+		logging.GetLogger().Criticalf("Failed to export alerts: %s", err.Error())
+	}
+}
+
+// RegisterEvaluateApi adds an endpoint forcing the evaluation of the alerts,
+// one replacing the whole alert set and one exporting it
+func (a *AlertServer) RegisterEvaluateApi(r *shttp.Server) {
+	r.RegisterRoutes([]shttp.Route{
+		{
+			"AlertEvaluate",
+			"POST",
+			"/api/alert/evaluate",
+			a.evaluate,
+		},
+		{
+			"AlertReconcile",
+			"POST",
+			"/api/alert/reconcile",
+			a.reconcile,
+		},
+		{
+			"AlertExport",
+			"GET",
+			"/api/alert/export",
+			a.export,
+		},
+	})
+}
+
 func NewServer(a *AlertManager, server *shttp.WSServer) *AlertServer {
 	s := &AlertServer{
 		AlertManager: a,
@@ -0,0 +1,110 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package alert
+
+import (
+	"container/list"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"sync"
+)
+
+// defaultTestCacheSize is the number of parsed tests kept until the alert
+// manager sets the configured size
+const defaultTestCacheSize = 1000
+
+// parsedTest is an alert test parsed once for all its evaluations. The
+// values being compiled in as constants, only the parsing can be kept.
+type parsedTest struct {
+	test   string
+	fset   *token.FileSet
+	expr   ast.Expr
+	idents map[string]bool
+	err    error
+}
+
+// testCache keeps the most recently used tests parsed, so that the test of
+// an alert is not parsed again for every node while the tests of the deleted
+// or updated alerts are evicted.
+type testCache struct {
+	lock    sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List
+	parses  uint64
+}
+
+var parsedTests = newTestCache(defaultTestCacheSize)
+
+func parseTest(test string) *parsedTest {
+	p := &parsedTest{test: test, fset: token.NewFileSet()}
+	if p.expr, p.err = parser.ParseExprFrom(p.fset, "", "("+test+") == true", 0); p.err == nil {
+		p.idents = testIdents(test)
+	}
+	return p
+}
+
+// get returns the parsed test, parsing it if not cached
+func (c *testCache) get(test string) *parsedTest {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if e, ok := c.entries[test]; ok {
+		c.lru.MoveToFront(e)
+		return e.Value.(*parsedTest)
+	}
+
+	p := parseTest(test)
+	c.parses++
+	c.entries[test] = c.lru.PushFront(p)
+	c.evict()
+
+	return p
+}
+
+func (c *testCache) evict() {
+	for c.lru.Len() > c.size {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.entries, e.Value.(*parsedTest).test)
+	}
+}
+
+// setSize changes the maximum number of tests kept, evicting the least
+// recently used ones if needed
+func (c *testCache) setSize(size int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.size = size
+	c.evict()
+}
+
+func newTestCache(size int) *testCache {
+	return &testCache{
+		size:    size,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
@@ -27,6 +27,7 @@ import (
 	"errors"
 	"os"
 	"sync"
+	"sync/atomic"
 
 	"github.com/nu7hatch/gouuid"
 
@@ -92,6 +93,7 @@ type Graph struct {
 	backend        GraphBackend
 	host           string
 	eventListeners []GraphEventListener
+	version        uint64
 }
 
 type EdgeValidator func(e *Edge) bool
@@ -272,12 +274,12 @@ func (g *Graph) StartMetadataTransaction(i interface{}) *MetadataTransaction {
 	return &t
 }
 
-func (g *Graph) lookupShortestPath(n *Node, m Metadata, path []*Node, v map[Identifier]bool, ev ...EdgeValidator) []*Node {
+func (g *Graph) lookupShortestPath(n *Node, match func(*Node) bool, path []*Node, v map[Identifier]bool, ev ...EdgeValidator) []*Node {
 	v[n.ID] = true
 
 	path = append(path, n)
 
-	if n.matchMetadata(m) {
+	if match(n) {
 		return path
 	}
 
@@ -307,7 +309,7 @@ func (g *Graph) lookupShortestPath(n *Node, m Metadata, path []*Node, v map[Iden
 				nv[k] = v
 			}
 
-			sub := g.lookupShortestPath(neighbor, m, path, nv)
+			sub := g.lookupShortestPath(neighbor, match, path, nv, ev...)
 			if len(sub) > 0 && (len(shortest) == 0 || len(sub) < len(shortest)) {
 				shortest = sub
 			}
@@ -318,7 +320,18 @@ func (g *Graph) lookupShortestPath(n *Node, m Metadata, path []*Node, v map[Iden
 }
 
 func (g *Graph) LookupShortestPath(n *Node, m Metadata, ev ...EdgeValidator) []*Node {
-	return g.lookupShortestPath(n, m, []*Node{}, make(map[Identifier]bool), ev...)
+	match := func(n *Node) bool {
+		return n.matchMetadata(m)
+	}
+	return g.lookupShortestPath(n, match, []*Node{}, make(map[Identifier]bool), ev...)
+}
+
+// LookupShortestPathToNode returns the shortest path from n to the target node
+func (g *Graph) LookupShortestPathToNode(n *Node, target *Node, ev ...EdgeValidator) []*Node {
+	match := func(n *Node) bool {
+		return n.ID == target.ID
+	}
+	return g.lookupShortestPath(n, match, []*Node{}, make(map[Identifier]bool), ev...)
 }
 
 func (g *Graph) LookupParentNodes(n *Node, f Metadata) []*Node {
@@ -437,6 +450,31 @@ func (g *Graph) LookupNodes(m Metadata) []*Node {
 	return nodes
 }
 
+// CountNodes returns the number of nodes matching the metadata without
+// building the list of the nodes
+func (g *Graph) CountNodes(m Metadata) int {
+	count := 0
+	for _, n := range g.backend.GetNodes() {
+		if n.matchMetadata(m) {
+			count++
+		}
+	}
+
+	return count
+}
+
+// CountEdges returns the number of edges matching the metadata
+func (g *Graph) CountEdges(m Metadata) int {
+	count := 0
+	for _, e := range g.backend.GetEdges() {
+		if e.matchMetadata(m) {
+			count++
+		}
+	}
+
+	return count
+}
+
 func (g *Graph) LookupNodesFromKey(key string) []*Node {
 	nodes := []*Node{}
 
@@ -566,6 +604,10 @@ func (g *Graph) GetEdges() []*Edge {
 	return g.backend.GetEdges()
 }
 
+func (g *Graph) GetNodeEdges(n *Node) []*Edge {
+	return g.backend.GetNodeEdges(n)
+}
+
 func (g *Graph) GetEdgeNodes(e *Edge) (*Node, *Node) {
 	return g.backend.GetEdgeNodes(e)
 }
@@ -585,37 +627,55 @@ func (g *Graph) MarshalJSON() ([]byte, error) {
 	})
 }
 
+// Version returns a counter incremented on every change of the graph, the
+// results computed from the graph can be kept while it stays the same
+func (g *Graph) Version() uint64 {
+	return atomic.LoadUint64(&g.version)
+}
+
 func (g *Graph) NotifyNodeUpdated(n *Node) {
+	atomic.AddUint64(&g.version, 1)
+
 	for _, l := range g.eventListeners {
 		l.OnNodeUpdated(n)
 	}
 }
 
 func (g *Graph) NotifyNodeDeleted(n *Node) {
+	atomic.AddUint64(&g.version, 1)
+
 	for _, l := range g.eventListeners {
 		l.OnNodeDeleted(n)
 	}
 }
 
 func (g *Graph) NotifyNodeAdded(n *Node) {
+	atomic.AddUint64(&g.version, 1)
+
 	for _, l := range g.eventListeners {
 		l.OnNodeAdded(n)
 	}
 }
 
 func (g *Graph) NotifyEdgeUpdated(e *Edge) {
+	atomic.AddUint64(&g.version, 1)
+
 	for _, l := range g.eventListeners {
 		l.OnEdgeUpdated(e)
 	}
 }
 
 func (g *Graph) NotifyEdgeDeleted(e *Edge) {
+	atomic.AddUint64(&g.version, 1)
+
 	for _, l := range g.eventListeners {
 		l.OnEdgeDeleted(e)
 	}
 }
 
 func (g *Graph) NotifyEdgeAdded(e *Edge) {
+	atomic.AddUint64(&g.version, 1)
+
 	for _, l := range g.eventListeners {
 		l.OnEdgeAdded(e)
 	}
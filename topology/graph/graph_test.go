@@ -112,6 +112,35 @@ func TestBasicLookup(t *testing.T) {
 	}
 }
 
+func TestCount(t *testing.T) {
+	g := newGraph(t)
+
+	n1 := g.NewNode(GenID(), Metadata{"MTU": 1500, "State": "UP", "Type": "intf"})
+	n2 := g.NewNode(GenID(), Metadata{"MTU": 9000, "State": "DOWN", "Type": "intf"})
+	n3 := g.NewNode(GenID(), Metadata{"State": "DOWN"})
+
+	g.Link(n1, n2, Metadata{"RelationType": "layer2"})
+	g.Link(n2, n3)
+
+	if c := g.CountNodes(Metadata{"Type": "intf", "State": "DOWN"}); c != 1 {
+		t.Errorf("Expected 1 node, got %d", c)
+	}
+	// numbers of the JSON filters are float64
+	if c := g.CountNodes(Metadata{"MTU": float64(1500)}); c != 1 {
+		t.Errorf("Expected 1 node, got %d", c)
+	}
+	if c := g.CountNodes(Metadata{}); c != 3 {
+		t.Errorf("Expected all the nodes, got %d", c)
+	}
+
+	if c := g.CountEdges(Metadata{"RelationType": "layer2"}); c != 1 {
+		t.Errorf("Expected 1 edge, got %d", c)
+	}
+	if c := g.CountEdges(nil); c != 2 {
+		t.Errorf("Expected all the edges, got %d", c)
+	}
+}
+
 func TestBasicLookupMultipleTypes(t *testing.T) {
 	g := newGraph(t)
 
@@ -249,6 +278,20 @@ func TestPath(t *testing.T) {
 	if len(r) == 0 || !validatePath(r, "4/1") {
 		t.Errorf("Wrong nodes returned: %v", r)
 	}
+
+	// the validator applies to all the edges of the path
+	r = g.LookupShortestPathToNode(n3, n1, v)
+	if len(r) > 0 {
+		t.Errorf("Shouldn't have returned a path: %v", r)
+	}
+
+	// 3/4/1 is as short using the Layer3 edge
+	r = g.LookupShortestPathToNode(n3, n1, func(e *Edge) bool {
+		return e.Metadata()["Type"].(string) == "Layer2"
+	})
+	if len(r) == 0 || !validatePath(r, "3/2/1") {
+		t.Errorf("Wrong nodes returned: %v", r)
+	}
 }
 
 func TestMetadata(t *testing.T) {